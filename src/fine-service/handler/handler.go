@@ -0,0 +1,309 @@
+package handler
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"library-system/src/fine-service/storage"
+	"library-system/src/pkg/apierror"
+	"library-system/src/pkg/audit"
+
+	"github.com/gin-gonic/gin"
+)
+
+type MessageResponse struct {
+	Message string `json:"message"`
+}
+
+type Handler struct {
+	storage storage.Storage
+	policy  Policy
+}
+
+type RequestAssessFines struct {
+	ReservationUid  string `json:"reservationUid"`
+	LibraryUid      string `json:"libraryUid"`
+	TillDate        string `json:"tillDate"`
+	Date            string `json:"date"`
+	ConditionBefore string `json:"conditionBefore"`
+	ConditionAfter  string `json:"conditionAfter"`
+}
+
+type RequestCreatePayment struct {
+	Kind    string `json:"kind"`
+	Amount  int    `json:"amount"`
+	Comment string `json:"comment"`
+}
+
+type FineResponse struct {
+	Fine_uid        string `json:"fineUid"`
+	Username        string `json:"username"`
+	Reservation_uid string `json:"reservationUid"`
+	Library_uid     string `json:"libraryUid"`
+	Reason          string `json:"reason"`
+	Amount          int    `json:"amount"`
+	Paid            int    `json:"paid"`
+	Waived          int    `json:"waived"`
+	Outstanding     int    `json:"outstanding"`
+	Created_at      string `json:"createdAt"`
+}
+
+type PaymentResponse struct {
+	Payment_uid string `json:"paymentUid"`
+	Fine_uid    string `json:"fineUid"`
+	Kind        string `json:"kind"`
+	Amount      int    `json:"amount"`
+	Recorded_by string `json:"recordedBy"`
+	Comment     string `json:"comment"`
+	Created_at  string `json:"createdAt"`
+}
+
+type BalanceResponse struct {
+	Username    string `json:"username"`
+	Outstanding int    `json:"outstanding"`
+	Threshold   int    `json:"threshold"`
+	Blocked     bool   `json:"blocked"`
+}
+
+type ReaderBalanceResponse struct {
+	Username    string `json:"username"`
+	Fines       int    `json:"fines"`
+	Outstanding int    `json:"outstanding"`
+}
+
+type LibraryBalanceResponse struct {
+	Library_uid string `json:"libraryUid"`
+	Fines       int    `json:"fines"`
+	Outstanding int    `json:"outstanding"`
+}
+
+func NewHandler(storage storage.Storage, policy Policy) *Handler {
+	return &Handler{storage: storage, policy: policy}
+}
+
+func (h *Handler) AssessFines(c *gin.Context) {
+
+	username := c.GetHeader("X-User-Name")
+
+	if username == "" {
+		apierror.Respond(c, apierror.BadRequest("username must be given as X-User-Name Header"))
+		return
+	}
+
+	var reqAssess RequestAssessFines
+
+	err := json.NewDecoder(c.Request.Body).Decode(&reqAssess)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to decode body", "error", err)
+		apierror.Respond(c, apierror.BadRequest("invalid request body: %s", err.Error()))
+		return
+	}
+
+	tillDate, err := time.Parse("2006-01-02", reqAssess.TillDate)
+	if err != nil {
+		apierror.Respond(c, apierror.Validation("tillDate must be a date in YYYY-MM-DD format"))
+		return
+	}
+
+	date, err := time.Parse("2006-01-02", reqAssess.Date)
+	if err != nil {
+		apierror.Respond(c, apierror.Validation("date must be a date in YYYY-MM-DD format"))
+		return
+	}
+
+	charges := map[string]int{
+		ReasonOverdue:   h.policy.OverdueFine(tillDate, date),
+		ReasonCondition: h.policy.ConditionFine(reqAssess.ConditionBefore, reqAssess.ConditionAfter),
+	}
+
+	fines := make([]storage.Fine, 0)
+
+	for _, reason := range []string{ReasonOverdue, ReasonCondition} {
+		if charges[reason] == 0 {
+			continue
+		}
+
+		fine, err := h.storage.CreateFine(c.Request.Context(), username, reqAssess.ReservationUid, reqAssess.LibraryUid, reason, charges[reason])
+
+		if err != nil {
+			slog.ErrorContext(c.Request.Context(), "failed to create fine", "error", err)
+			apierror.Respond(c, err)
+			return
+		}
+
+		fines = append(fines, fine)
+	}
+
+	c.JSON(http.StatusOK, FinesToResponse(fines))
+}
+
+func (h *Handler) GetFines(c *gin.Context) {
+
+	username := c.GetHeader("X-User-Name")
+
+	if username == "" {
+		apierror.Respond(c, apierror.BadRequest("username must be given as X-User-Name Header"))
+		return
+	}
+
+	fines, err := h.storage.GetFines(c.Request.Context(), username)
+
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to get fines", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, FinesToResponse(fines))
+}
+
+func (h *Handler) GetBalance(c *gin.Context) {
+
+	username := c.GetHeader("X-User-Name")
+
+	if username == "" {
+		apierror.Respond(c, apierror.BadRequest("username must be given as X-User-Name Header"))
+		return
+	}
+
+	outstanding, err := h.storage.GetOutstanding(c.Request.Context(), username)
+
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to get balance", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, BalanceResponse{
+		Username:    username,
+		Outstanding: outstanding,
+		Threshold:   h.policy.BlockThreshold,
+		Blocked:     h.policy.Blocked(outstanding),
+	})
+}
+
+// CreatePayment records a payment or waiver in the name of the librarian the
+// gateway passes on as the actor of the request.
+func (h *Handler) CreatePayment(c *gin.Context) {
+
+	recordedBy := audit.Actor(c.Request.Context())
+
+	if recordedBy == audit.System {
+		apierror.Respond(c, apierror.BadRequest("librarian must be given as %s Header", audit.ActorHeader))
+		return
+	}
+
+	var reqPayment RequestCreatePayment
+
+	err := json.NewDecoder(c.Request.Body).Decode(&reqPayment)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to decode body", "error", err)
+		apierror.Respond(c, apierror.BadRequest("invalid request body: %s", err.Error()))
+		return
+	}
+
+	if reqPayment.Kind != "PAYMENT" && reqPayment.Kind != "WAIVER" {
+		apierror.Respond(c, apierror.Validation("kind must be PAYMENT or WAIVER"))
+		return
+	}
+
+	if reqPayment.Amount <= 0 {
+		apierror.Respond(c, apierror.Validation("amount must be positive"))
+		return
+	}
+
+	payment, err := h.storage.CreatePayment(c.Request.Context(), c.Param("uid"), reqPayment.Kind, reqPayment.Amount, recordedBy, reqPayment.Comment)
+
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to create payment", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, PaymentResponse{
+		Payment_uid: payment.Payment_uid,
+		Fine_uid:    c.Param("uid"),
+		Kind:        payment.Kind,
+		Amount:      payment.Amount,
+		Recorded_by: payment.Recorded_by,
+		Comment:     payment.Comment,
+		Created_at:  payment.Created_at.Format(time.RFC3339),
+	})
+}
+
+func (h *Handler) GetReaderReport(c *gin.Context) {
+
+	balances, err := h.storage.GetOutstandingByReader(c.Request.Context())
+
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to get report", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	res := make([]ReaderBalanceResponse, len(balances))
+
+	for index, value := range balances {
+		res[index] = ReaderBalanceResponse{
+			Username:    value.Key,
+			Fines:       value.Fines,
+			Outstanding: value.Outstanding,
+		}
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) GetLibraryReport(c *gin.Context) {
+
+	balances, err := h.storage.GetOutstandingByLibrary(c.Request.Context())
+
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to get report", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	res := make([]LibraryBalanceResponse, len(balances))
+
+	for index, value := range balances {
+		res[index] = LibraryBalanceResponse{
+			Library_uid: value.Key,
+			Fines:       value.Fines,
+			Outstanding: value.Outstanding,
+		}
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func FineToResponse(fine storage.Fine) FineResponse {
+	return FineResponse{
+		Fine_uid:        fine.Fine_uid,
+		Username:        fine.Username,
+		Reservation_uid: fine.Reservation_uid,
+		Library_uid:     fine.Library_uid,
+		Reason:          fine.Reason,
+		Amount:          fine.Amount,
+		Paid:            fine.Paid,
+		Waived:          fine.Waived,
+		Outstanding:     fine.Outstanding(),
+		Created_at:      fine.Created_at.Format(time.RFC3339),
+	}
+}
+
+func FinesToResponse(fines []storage.Fine) []FineResponse {
+	res := make([]FineResponse, len(fines))
+
+	for index, value := range fines {
+		res[index] = FineToResponse(value)
+	}
+
+	return res
+}
+
+func (h *Handler) GetHealth(c *gin.Context) {
+	c.Status(http.StatusOK)
+}
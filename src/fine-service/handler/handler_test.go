@@ -0,0 +1,243 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"library-system/src/fine-service/storage"
+	"library-system/src/pkg/audit"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	libraryUid     = "83575e12-7ce0-48ee-9931-51919ff3c9ee"
+	reservationUid = "3c4d5e6f-0000-4000-8000-000000000001"
+	overdueUid     = "5e6f7a8b-0000-4000-8000-000000000001"
+	unknownUid     = "00000000-0000-4000-8000-000000000000"
+)
+
+type testCase struct {
+	name   string
+	method string
+	path   string
+	header http.Header
+	body   string
+	status int
+	// response is the expected body, or a part of it
+	response string
+}
+
+var (
+	reader    = http.Header{"X-User-Name": {"Test Max"}}
+	librarian = http.Header{audit.ActorHeader: {"admin"}}
+)
+
+func newTestRouter() (*gin.Engine, storage.Storage) {
+	gin.SetMode(gin.TestMode)
+
+	memory := storage.NewMemory()
+	memory.AddFine(storage.Fine{
+		Fine_uid: overdueUid, Username: "Test Max", Reservation_uid: reservationUid, Library_uid: libraryUid,
+		Reason: ReasonOverdue, Amount: 5000, Created_at: time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC),
+	})
+
+	handler := NewHandler(memory, Policy{DailyRate: 1000, GraceDays: 2, OverdueCap: 50000, ConditionRate: 20000, ConditionCap: 40000, BlockThreshold: 10000})
+
+	router := gin.New()
+	router.Use(audit.Middleware())
+	handler.Register(router)
+
+	return router, memory
+}
+
+func serve(router *gin.Engine, method, path string, header http.Header, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func run(t *testing.T, tests []testCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, _ := newTestRouter()
+
+			recorder := serve(router, tt.method, tt.path, tt.header, tt.body)
+
+			if recorder.Code != tt.status || !strings.Contains(recorder.Body.String(), tt.response) {
+				t.Errorf("expected %d %s, got %d %s", tt.status, tt.response, recorder.Code, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestAssessFines(t *testing.T) {
+	late := `{"reservationUid":"3c4d5e6f-0000-4000-8000-000000000002","libraryUid":"` + libraryUid + `","tillDate":"2021-10-11","date":"2021-10-16","conditionBefore":"EXCELLENT","conditionAfter":"GOOD"}`
+
+	run(t, []testCase{
+		{"late and damaged", http.MethodPost, "/api/v1/fines/assess", reader, late, http.StatusOK,
+			`"reason":"OVERDUE","amount":3000,"paid":0,"waived":0,"outstanding":3000`},
+		{"condition charge", http.MethodPost, "/api/v1/fines/assess", reader, late, http.StatusOK, `"reason":"CONDITION","amount":20000`},
+		{"on time and intact", http.MethodPost, "/api/v1/fines/assess", reader,
+			`{"reservationUid":"3c4d5e6f-0000-4000-8000-000000000002","libraryUid":"` + libraryUid + `","tillDate":"2021-10-11","date":"2021-10-11","conditionBefore":"GOOD","conditionAfter":"GOOD"}`,
+			http.StatusOK, `[]`},
+		{"invalid date", http.MethodPost, "/api/v1/fines/assess", reader, `{"tillDate":"2021-10-11","date":"today"}`, http.StatusUnprocessableEntity, "date must be a date"},
+		{"malformed body", http.MethodPost, "/api/v1/fines/assess", reader, `{"tillDate":`, http.StatusBadRequest, `"code":"BAD_REQUEST"`},
+		{"missing username", http.MethodPost, "/api/v1/fines/assess", nil, late, http.StatusBadRequest, "X-User-Name"},
+	})
+}
+
+func TestAssessFinesOnce(t *testing.T) {
+	router, memory := newTestRouter()
+
+	body := `{"reservationUid":"` + reservationUid + `","libraryUid":"` + libraryUid + `","tillDate":"2021-10-01","date":"2021-10-20","conditionBefore":"GOOD","conditionAfter":"GOOD"}`
+	recorder := serve(router, http.MethodPost, "/api/v1/fines/assess", reader, body)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"fineUid":"`+overdueUid+`"`) {
+		t.Errorf("expected the existing overdue fine, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	if fines, _ := memory.GetFines(context.Background(), "Test Max"); len(fines) != 1 || fines[0].Amount != 5000 {
+		t.Errorf("a reassessment must not fine the reservation again, got %+v", fines)
+	}
+}
+
+func TestGetFines(t *testing.T) {
+	run(t, []testCase{
+		{"reader with fines", http.MethodGet, "/api/v1/fines", reader, "", http.StatusOK,
+			`[{"fineUid":"` + overdueUid + `","username":"Test Max","reservationUid":"` + reservationUid + `","libraryUid":"` + libraryUid +
+				`","reason":"OVERDUE","amount":5000,"paid":0,"waived":0,"outstanding":5000,"createdAt":"2021-10-01T00:00:00Z"}]`},
+		{"reader without fines", http.MethodGet, "/api/v1/fines", http.Header{"X-User-Name": {"Test Min"}}, "", http.StatusOK, `[]`},
+		{"missing username", http.MethodGet, "/api/v1/fines", nil, "", http.StatusBadRequest, `"code":"BAD_REQUEST"`},
+	})
+}
+
+func TestGetBalance(t *testing.T) {
+	router, _ := newTestRouter()
+
+	recorder := serve(router, http.MethodGet, "/api/v1/fines/balance", reader, "")
+	if recorder.Code != http.StatusOK || recorder.Body.String() != `{"username":"Test Max","outstanding":5000,"threshold":10000,"blocked":false}` {
+		t.Errorf("unexpected balance %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	body := `{"reservationUid":"3c4d5e6f-0000-4000-8000-000000000002","libraryUid":"` + libraryUid + `","tillDate":"2021-10-11","date":"2021-10-11","conditionBefore":"EXCELLENT","conditionAfter":"BAD"}`
+	serve(router, http.MethodPost, "/api/v1/fines/assess", reader, body)
+
+	recorder = serve(router, http.MethodGet, "/api/v1/fines/balance", reader, "")
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"outstanding":45000,"threshold":10000,"blocked":true`) {
+		t.Errorf("expected the reader to be blocked, got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestCreatePayment(t *testing.T) {
+	path := "/api/v1/fines/" + overdueUid + "/payments"
+
+	run(t, []testCase{
+		{"payment", http.MethodPost, path, librarian, `{"kind":"PAYMENT","amount":2000,"comment":"cash"}`, http.StatusCreated,
+			`"fineUid":"` + overdueUid + `","kind":"PAYMENT","amount":2000,"recordedBy":"admin","comment":"cash"`},
+		{"waiver of the whole fine", http.MethodPost, path, librarian, `{"kind":"WAIVER","amount":5000}`, http.StatusCreated, `"kind":"WAIVER","amount":5000`},
+		{"overpayment", http.MethodPost, path, librarian, `{"kind":"PAYMENT","amount":5001}`, http.StatusUnprocessableEntity, "exceeds outstanding balance"},
+		{"unknown fine", http.MethodPost, "/api/v1/fines/" + unknownUid + "/payments", librarian, `{"kind":"PAYMENT","amount":100}`, http.StatusNotFound, "fine not found"},
+		{"invalid kind", http.MethodPost, path, librarian, `{"kind":"REFUND","amount":100}`, http.StatusUnprocessableEntity, "kind must be PAYMENT or WAIVER"},
+		{"invalid amount", http.MethodPost, path, librarian, `{"kind":"PAYMENT","amount":0}`, http.StatusUnprocessableEntity, "amount must be positive"},
+		{"malformed body", http.MethodPost, path, librarian, `{"kind":`, http.StatusBadRequest, `"code":"BAD_REQUEST"`},
+		{"missing librarian", http.MethodPost, path, nil, `{"kind":"PAYMENT","amount":100}`, http.StatusBadRequest, "librarian must be given"},
+	})
+}
+
+func TestCreatePaymentIgnoresRecorderInBody(t *testing.T) {
+	router, memory := newTestRouter()
+
+	recorder := serve(router, http.MethodPost, "/api/v1/fines/"+overdueUid+"/payments", librarian, `{"kind":"PAYMENT","amount":5000,"recordedBy":"someone else"}`)
+	if recorder.Code != http.StatusCreated || !strings.Contains(recorder.Body.String(), `"recordedBy":"admin"`) {
+		t.Errorf("expected the payment to be recorded by admin, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	if fine, _ := memory.GetFineByUid(context.Background(), overdueUid); fine.Paid != 5000 || fine.Outstanding() != 0 {
+		t.Errorf("expected the fine to be paid, got %+v", fine)
+	}
+}
+
+func TestReports(t *testing.T) {
+	run(t, []testCase{
+		{"readers", http.MethodGet, "/api/v1/fines/reports/readers", librarian, "", http.StatusOK, `[{"username":"Test Max","fines":1,"outstanding":5000}]`},
+		{"libraries", http.MethodGet, "/api/v1/fines/reports/libraries", librarian, "", http.StatusOK, `[{"libraryUid":"` + libraryUid + `","fines":1,"outstanding":5000}]`},
+	})
+
+	router, _ := newTestRouter()
+	serve(router, http.MethodPost, "/api/v1/fines/"+overdueUid+"/payments", librarian, `{"kind":"WAIVER","amount":5000}`)
+	if recorder := serve(router, http.MethodGet, "/api/v1/fines/reports/readers", librarian, ""); recorder.Body.String() != `[]` {
+		t.Errorf("settled fines must be left out, got %s", recorder.Body.String())
+	}
+}
+
+func TestOverdueFine(t *testing.T) {
+
+	policy := Policy{DailyRate: 100, GraceDays: 2, OverdueCap: 1000}
+	tillDate := time.Date(2021, 10, 11, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		days int
+		want int
+	}{
+		{-3, 0},
+		{0, 0},
+		{2, 0},
+		{3, 100},
+		{7, 500},
+		{40, 1000},
+	}
+
+	for _, tt := range tests {
+		got := policy.OverdueFine(tillDate, tillDate.AddDate(0, 0, tt.days))
+		if got != tt.want {
+			t.Errorf("OverdueFine(%d days) = %d, want %d", tt.days, got, tt.want)
+		}
+	}
+}
+
+func TestConditionFine(t *testing.T) {
+
+	policy := Policy{ConditionRate: 300, ConditionCap: 500}
+
+	tests := []struct {
+		before string
+		after  string
+		want   int
+	}{
+		{"EXCELLENT", "EXCELLENT", 0},
+		{"EXCELLENT", "GOOD", 300},
+		{"GOOD", "BAD", 300},
+		{"EXCELLENT", "BAD", 500},
+		{"BAD", "EXCELLENT", 0},
+		{"", "BAD", 0},
+	}
+
+	for _, tt := range tests {
+		got := policy.ConditionFine(tt.before, tt.after)
+		if got != tt.want {
+			t.Errorf("ConditionFine(%s, %s) = %d, want %d", tt.before, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestBlocked(t *testing.T) {
+
+	policy := Policy{BlockThreshold: 500}
+
+	if policy.Blocked(500) {
+		t.Errorf("balance equal to the threshold must not block")
+	}
+	if !policy.Blocked(501) {
+		t.Errorf("balance above the threshold must block")
+	}
+}
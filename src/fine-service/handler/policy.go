@@ -0,0 +1,81 @@
+package handler
+
+import "time"
+
+const (
+	ReasonOverdue   string = "OVERDUE"
+	ReasonCondition string = "CONDITION"
+)
+
+// Policy describes how fines are charged. All amounts are in minor currency
+// units (kopecks), a zero cap means the charge is not capped.
+type Policy struct {
+	DailyRate      int
+	GraceDays      int
+	OverdueCap     int
+	ConditionRate  int
+	ConditionCap   int
+	BlockThreshold int
+}
+
+func DefaultPolicy() Policy {
+	return Policy{
+		DailyRate:      1000,
+		GraceDays:      3,
+		OverdueCap:     50000,
+		ConditionRate:  20000,
+		ConditionCap:   40000,
+		BlockThreshold: 50000,
+	}
+}
+
+var conditionRank = map[string]int{
+	"EXCELLENT": 0,
+	"GOOD":      1,
+	"BAD":       2,
+}
+
+// OverdueFine returns the charge for a book returned on returnDate that was due
+// on tillDate. Days within the grace period are not charged.
+func (p Policy) OverdueFine(tillDate time.Time, returnDate time.Time) int {
+	days := int(returnDate.Truncate(24*time.Hour).Sub(tillDate.Truncate(24*time.Hour)).Hours() / 24)
+	days = days - p.GraceDays
+	if days <= 0 {
+		return 0
+	}
+
+	return capAmount(days*p.DailyRate, p.OverdueCap)
+}
+
+// ConditionFine returns the charge for every step the condition dropped by,
+// e.g. EXCELLENT to BAD is two steps. Unknown conditions are not charged.
+func (p Policy) ConditionFine(before string, after string) int {
+	rankBefore, ok := conditionRank[before]
+	if !ok {
+		return 0
+	}
+	rankAfter, ok := conditionRank[after]
+	if !ok {
+		return 0
+	}
+
+	steps := rankAfter - rankBefore
+	if steps <= 0 {
+		return 0
+	}
+
+	return capAmount(steps*p.ConditionRate, p.ConditionCap)
+}
+
+// Blocked reports whether a reader with the given unpaid balance may not
+// take new books.
+func (p Policy) Blocked(outstanding int) bool {
+	return outstanding > p.BlockThreshold
+}
+
+func capAmount(amount int, limit int) int {
+	if limit > 0 && amount > limit {
+		return limit
+	}
+	return amount
+}
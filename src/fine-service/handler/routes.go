@@ -0,0 +1,21 @@
+package handler
+
+import (
+	"library-system/src/pkg/audit"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Register adds the routes of fine-service to router. Probes and metrics are
+// registered by the caller.
+func (h *Handler) Register(router gin.IRoutes) {
+	router.GET("/api/v1/fines", h.GetFines)
+	router.GET("/api/v1/fines/balance", h.GetBalance)
+	router.POST("/api/v1/fines/assess", h.AssessFines)
+	router.POST("/api/v1/fines/:uid/payments", h.CreatePayment)
+	router.GET("/api/v1/fines/reports/readers", h.GetReaderReport)
+	router.GET("/api/v1/fines/reports/libraries", h.GetLibraryReport)
+	router.GET("/api/v1/audit", audit.Handler(h.storage.Audit(), "fine-service"))
+
+	router.GET("/manage/health", h.GetHealth)
+}
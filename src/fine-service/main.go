@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"library-system/src/fine-service/handler"
+	"library-system/src/fine-service/migrations"
+	"library-system/src/fine-service/storage"
+	"library-system/src/pkg/audit"
+	"library-system/src/pkg/health"
+	"library-system/src/pkg/logging"
+	"library-system/src/pkg/metrics"
+	"library-system/src/pkg/migrate"
+	"library-system/src/pkg/outbox"
+	"library-system/src/pkg/server"
+	"library-system/src/pkg/tracing"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+)
+
+func main() {
+	logging.Setup("fine-service")
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "fine-service")
+	if err != nil {
+		slog.Error("tracing init failed", "error", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
+	postgresURL := fmt.Sprintf("host=%s port=%d user=%s dbname=%s password=%s",
+		"postgres", 5432, "program", "fines", "test")
+	psqlDB, err := storage.NewPgStorage(context.Background(), postgresURL)
+	if err != nil {
+		slog.Error("postgresql init failed", "error", err)
+		os.Exit(1)
+	}
+	defer psqlDB.Close()
+
+	if err = health.WaitFor(context.Background(), "postgres", psqlDB.Ping); err != nil {
+		slog.Error("postgresql init failed", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("connected to PostgreSQL")
+
+	migrator, err := migrate.New(psqlDB.Pool(), migrations.Schema, nil)
+	if err != nil {
+		slog.Error("migrations init failed", "error", err)
+		os.Exit(1)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err = migrator.Command(context.Background(), os.Args[2:], os.Stdout); err != nil {
+			slog.Error("migrate failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err = migrator.OnStart(context.Background()); err != nil {
+		slog.Error("migrations failed", "error", err)
+		os.Exit(1)
+	}
+
+	metrics.RegisterPool(psqlDB)
+
+	checker := health.New(2 * time.Second)
+	checker.Add("postgres", psqlDB.Ping)
+	checker.Add("migrations", migrator.Check)
+
+	policy := handler.DefaultPolicy()
+	policy.DailyRate = envInt("FINE_DAILY_RATE", policy.DailyRate)
+	policy.GraceDays = envInt("FINE_GRACE_DAYS", policy.GraceDays)
+	policy.OverdueCap = envInt("FINE_OVERDUE_CAP", policy.OverdueCap)
+	policy.ConditionRate = envInt("FINE_CONDITION_RATE", policy.ConditionRate)
+	policy.ConditionCap = envInt("FINE_CONDITION_CAP", policy.ConditionCap)
+	policy.BlockThreshold = envInt("FINE_BLOCK_THRESHOLD", policy.BlockThreshold)
+
+	handler := handler.NewHandler(psqlDB, policy)
+
+	router := gin.New()
+	router.Use(gin.Recovery(), tracing.Middleware("fine-service"), logging.Middleware(), audit.Middleware(), metrics.Middleware())
+
+	router.Use(cors.Default())
+
+	handler.Register(router)
+
+	router.GET("/manage/live", checker.Live)
+	router.GET("/manage/ready", checker.Ready)
+	router.GET("/manage/metrics", metrics.Handler())
+
+	// publish the events of the outbox to the services listening on the
+	// fine_events channel
+	outboxInterval, err := time.ParseDuration(os.Getenv("OUTBOX_INTERVAL"))
+	if err != nil {
+		outboxInterval = time.Second
+	}
+	relay := outbox.NewRelay(psqlDB.Outbox(), outbox.NewPgBroker(psqlDB.Pool(), "fine_events"))
+
+	srv := server.New(server.ConfigFromEnv(":8040"), router, checker)
+	srv.Go(func(ctx context.Context) { relay.Run(ctx, outboxInterval) })
+
+	if err = srv.Run(); err != nil {
+		slog.Error("server stopped with error", "error", err)
+	}
+}
+
+func envInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
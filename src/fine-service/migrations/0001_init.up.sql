@@ -0,0 +1,28 @@
+CREATE TABLE fine
+(
+    id              SERIAL PRIMARY KEY,
+    fine_uid        uuid UNIQUE NOT NULL,
+    username        VARCHAR(80) NOT NULL,
+    reservation_uid uuid        NOT NULL,
+    library_uid     uuid        NOT NULL,
+    reason          VARCHAR(20) NOT NULL
+        CHECK (reason IN ('OVERDUE', 'CONDITION')),
+    amount          INT         NOT NULL
+        CHECK (amount > 0),
+    created_at      TIMESTAMP   NOT NULL,
+    UNIQUE (reservation_uid, reason)
+);
+
+CREATE TABLE payment
+(
+    id          SERIAL PRIMARY KEY,
+    payment_uid uuid UNIQUE  NOT NULL,
+    fine_id     INT REFERENCES fine (id),
+    kind        VARCHAR(20)  NOT NULL
+        CHECK (kind IN ('PAYMENT', 'WAIVER')),
+    amount      INT          NOT NULL
+        CHECK (amount > 0),
+    recorded_by VARCHAR(80)  NOT NULL,
+    comment     VARCHAR(255) NOT NULL,
+    created_at  TIMESTAMP    NOT NULL
+);
@@ -0,0 +1,14 @@
+-- domain events written in the transaction of the change they describe,
+-- until the relay has published them
+CREATE TABLE outbox
+(
+    id           BIGSERIAL PRIMARY KEY,
+    event_uid    uuid UNIQUE  NOT NULL,
+    type         VARCHAR(80)  NOT NULL,
+    entity_uid   VARCHAR(255) NOT NULL,
+    payload      jsonb        NOT NULL,
+    created_at   TIMESTAMP    NOT NULL,
+    published_at TIMESTAMP
+);
+
+CREATE INDEX outbox_pending_idx ON outbox (id) WHERE published_at IS NULL;
@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"library-system/src/pkg/apierror"
+	"library-system/src/pkg/audit"
+	"library-system/src/pkg/outbox"
+
+	"github.com/google/uuid"
+)
+
+var (
+	reasons = map[string]bool{"OVERDUE": true, "CONDITION": true}
+	kinds   = map[string]bool{"PAYMENT": true, "WAIVER": true}
+)
+
+// memory is a Storage kept in memory with the semantics of postgres, for
+// tests and local development.
+type memory struct {
+	mu       sync.Mutex
+	fines    []Fine
+	payments []Payment
+	outbox   outbox.MemoryStore
+	audit    audit.MemoryLog
+}
+
+func NewMemory() *memory {
+	return &memory{outbox: outbox.NewMemoryStore(), audit: audit.NewMemoryLog()}
+}
+
+func (m *memory) Outbox() outbox.Store {
+	return m.outbox
+}
+
+func (m *memory) Audit() audit.Log {
+	return m.audit
+}
+
+// AddFine inserts fine as is, without payments, and returns it with its id.
+func (m *memory) AddFine(fine Fine) Fine {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fine.ID = len(m.fines) + 1
+	fine.Paid, fine.Waived = 0, 0
+	fine.Created_at = fine.Created_at.UTC()
+	m.fines = append(m.fines, fine)
+
+	return fine
+}
+
+// validUids reports a validation error like postgres does for malformed uuids.
+func validUids(uids ...string) error {
+	for _, uid := range uids {
+		if _, err := uuid.Parse(uid); err != nil {
+			return apierror.Validation("invalid input syntax for type uuid: %q", uid)
+		}
+	}
+	return nil
+}
+
+// settled returns fine with the sums of its payments and waivers.
+func (m *memory) settled(fine Fine) Fine {
+	for _, payment := range m.payments {
+		if payment.Fine_id != fine.ID {
+			continue
+		}
+		if payment.Kind == "PAYMENT" {
+			fine.Paid += payment.Amount
+		} else {
+			fine.Waived += payment.Amount
+		}
+	}
+	return fine
+}
+
+func (m *memory) CreateFine(ctx context.Context, username string, reservationUid string, libraryUid string, reason string, amount int) (Fine, error) {
+	if err := validUids(reservationUid, libraryUid); err != nil {
+		return Fine{}, err
+	}
+	if !reasons[reason] {
+		return Fine{}, apierror.Validation("invalid reason %q", reason)
+	}
+	if amount <= 0 {
+		return Fine{}, apierror.Validation("amount must be positive")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, fine := range m.fines {
+		if fine.Reservation_uid == reservationUid && fine.Reason == reason {
+			return m.settled(fine), nil
+		}
+	}
+
+	fine := Fine{
+		ID:              len(m.fines) + 1,
+		Fine_uid:        uuid.New().String(),
+		Username:        username,
+		Reservation_uid: reservationUid,
+		Library_uid:     libraryUid,
+		Reason:          reason,
+		Amount:          amount,
+		Created_at:      time.Now().UTC(),
+	}
+
+	event, err := fineCreatedEvent(fine)
+	if err != nil {
+		return Fine{}, err
+	}
+	entry, err := createdEntry(ctx, fine)
+	if err != nil {
+		return Fine{}, err
+	}
+
+	m.fines = append(m.fines, fine)
+	m.outbox.Add(event)
+	m.audit.Add(entry)
+
+	return fine, nil
+}
+
+func (m *memory) GetFines(ctx context.Context, username string) ([]Fine, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fines := []Fine{}
+	for _, fine := range m.fines {
+		if fine.Username == username {
+			fines = append(fines, m.settled(fine))
+		}
+	}
+
+	sort.SliceStable(fines, func(i, j int) bool {
+		return fines[i].Created_at.Before(fines[j].Created_at)
+	})
+
+	return fines, nil
+}
+
+func (m *memory) GetFineByUid(ctx context.Context, fineUid string) (Fine, error) {
+	if err := validUids(fineUid); err != nil {
+		return Fine{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, fine := range m.fines {
+		if fine.Fine_uid == fineUid {
+			return m.settled(fine), nil
+		}
+	}
+
+	return Fine{}, ErrFineNotFound
+}
+
+func (m *memory) GetOutstanding(ctx context.Context, username string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	outstanding := 0
+	for _, fine := range m.fines {
+		if fine.Username == username {
+			outstanding += m.settled(fine).Outstanding()
+		}
+	}
+
+	return outstanding, nil
+}
+
+func (m *memory) CreatePayment(ctx context.Context, fineUid string, kind string, amount int, recordedBy string, comment string) (Payment, error) {
+	if err := validUids(fineUid); err != nil {
+		return Payment{}, err
+	}
+	if !kinds[kind] {
+		return Payment{}, apierror.Validation("invalid kind %q", kind)
+	}
+	if amount <= 0 {
+		return Payment{}, apierror.Validation("amount must be positive")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, fine := range m.fines {
+		if fine.Fine_uid != fineUid {
+			continue
+		}
+
+		outstanding := m.settled(fine).Outstanding()
+		if amount > outstanding {
+			return Payment{}, ErrOverpayment
+		}
+
+		payment := Payment{
+			ID:          len(m.payments) + 1,
+			Payment_uid: uuid.New().String(),
+			Fine_id:     fine.ID,
+			Kind:        kind,
+			Amount:      amount,
+			Recorded_by: recordedBy,
+			Comment:     comment,
+			Created_at:  time.Now().UTC(),
+		}
+
+		event, err := paymentRecordedEvent(fineUid, fine.Username, outstanding, payment)
+		if err != nil {
+			return Payment{}, err
+		}
+		entry, err := paymentEntry(ctx, fineUid, outstanding, payment)
+		if err != nil {
+			return Payment{}, err
+		}
+
+		m.payments = append(m.payments, payment)
+		m.outbox.Add(event)
+		m.audit.Add(entry)
+
+		return payment, nil
+	}
+
+	return Payment{}, ErrFineNotFound
+}
+
+func (m *memory) GetOutstandingByReader(ctx context.Context) ([]Balance, error) {
+	return m.balances(func(fine Fine) string { return fine.Username }), nil
+}
+
+func (m *memory) GetOutstandingByLibrary(ctx context.Context) ([]Balance, error) {
+	return m.balances(func(fine Fine) string { return fine.Library_uid }), nil
+}
+
+// balances groups the outstanding part of every unsettled fine by key,
+// largest balance first.
+func (m *memory) balances(key func(Fine) string) []Balance {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	byKey := make(map[string]*Balance)
+	balances := []Balance{}
+	var keys []string
+
+	for _, fine := range m.fines {
+		outstanding := m.settled(fine).Outstanding()
+		if outstanding <= 0 {
+			continue
+		}
+
+		balance, ok := byKey[key(fine)]
+		if !ok {
+			balance = &Balance{Key: key(fine)}
+			byKey[key(fine)] = balance
+			keys = append(keys, key(fine))
+		}
+		balance.Fines++
+		balance.Outstanding += outstanding
+	}
+
+	for _, key := range keys {
+		balances = append(balances, *byKey[key])
+	}
+
+	sort.SliceStable(balances, func(i, j int) bool {
+		return balances[i].Outstanding > balances[j].Outstanding
+	})
+
+	return balances
+}
@@ -0,0 +1,424 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"library-system/src/pkg/apierror"
+	"library-system/src/pkg/audit"
+	"library-system/src/pkg/outbox"
+	"library-system/src/pkg/tracing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var ErrFineNotFound = apierror.NotFound("fine not found")
+var ErrOverpayment = apierror.Validation("amount exceeds outstanding balance of the fine")
+
+type Fine struct {
+	ID              int       `json:"id"`
+	Fine_uid        string    `json:"fine_uid"`
+	Username        string    `json:"username"`
+	Reservation_uid string    `json:"reservation_uid"`
+	Library_uid     string    `json:"library_uid"`
+	Reason          string    `json:"reason"`
+	Amount          int       `json:"amount"`
+	Paid            int       `json:"paid"`
+	Waived          int       `json:"waived"`
+	Created_at      time.Time `json:"created_at"`
+}
+
+func (f Fine) Outstanding() int {
+	return f.Amount - f.Paid - f.Waived
+}
+
+type Payment struct {
+	ID          int       `json:"id"`
+	Payment_uid string    `json:"payment_uid"`
+	Fine_id     int       `json:"fine_id"`
+	Kind        string    `json:"kind"`
+	Amount      int       `json:"amount"`
+	Recorded_by string    `json:"recorded_by"`
+	Comment     string    `json:"comment"`
+	Created_at  time.Time `json:"created_at"`
+}
+
+type Balance struct {
+	Key         string `json:"key"`
+	Fines       int    `json:"fines"`
+	Outstanding int    `json:"outstanding"`
+}
+
+// Events written to the outbox. FineCreated has the Fine as payload,
+// PaymentRecorded a PaymentEvent.
+const (
+	FineCreated     = "fine.created"
+	PaymentRecorded = "fine.payment_recorded"
+)
+
+type PaymentEvent struct {
+	FineUid     string `json:"fineUid"`
+	Username    string `json:"username"`
+	PaymentUid  string `json:"paymentUid"`
+	Kind        string `json:"kind"`
+	Amount      int    `json:"amount"`
+	Outstanding int    `json:"outstanding"`
+}
+
+func fineCreatedEvent(fine Fine) (outbox.Event, error) {
+	return outbox.New(FineCreated, fine.Fine_uid, fine)
+}
+
+func paymentRecordedEvent(fineUid string, username string, outstanding int, payment Payment) (outbox.Event, error) {
+	return outbox.New(PaymentRecorded, fineUid, PaymentEvent{
+		FineUid:     fineUid,
+		Username:    username,
+		PaymentUid:  payment.Payment_uid,
+		Kind:        payment.Kind,
+		Amount:      payment.Amount,
+		Outstanding: outstanding - payment.Amount,
+	})
+}
+
+// Actions recorded in the audit log.
+const (
+	AuditFineCreated     = "fine.created"
+	AuditPaymentRecorded = "fine.payment_recorded"
+)
+
+// settlementAudit is the outstanding part of a fine before and after a
+// payment or a waiver, with the payment that settled it.
+type settlementAudit struct {
+	PaymentUid  string `json:"paymentUid,omitempty"`
+	Kind        string `json:"kind,omitempty"`
+	Amount      int    `json:"amount,omitempty"`
+	Outstanding int    `json:"outstanding"`
+}
+
+func createdEntry(ctx context.Context, fine Fine) (audit.Entry, error) {
+	return audit.New(ctx, AuditFineCreated, "fine", fine.Fine_uid, nil, fine)
+}
+
+func paymentEntry(ctx context.Context, fineUid string, outstanding int, payment Payment) (audit.Entry, error) {
+	return audit.New(ctx, AuditPaymentRecorded, "fine", fineUid, settlementAudit{Outstanding: outstanding}, settlementAudit{
+		PaymentUid:  payment.Payment_uid,
+		Kind:        payment.Kind,
+		Amount:      payment.Amount,
+		Outstanding: outstanding - payment.Amount,
+	})
+}
+
+type Storage interface {
+	CreateFine(ctx context.Context, username string, reservationUid string, libraryUid string, reason string, amount int) (Fine, error)
+	GetFines(ctx context.Context, username string) ([]Fine, error)
+	GetFineByUid(ctx context.Context, fineUid string) (Fine, error)
+	GetOutstanding(ctx context.Context, username string) (int, error)
+	CreatePayment(ctx context.Context, fineUid string, kind string, amount int, recordedBy string, comment string) (Payment, error)
+	GetOutstandingByReader(ctx context.Context) ([]Balance, error)
+	GetOutstandingByLibrary(ctx context.Context) ([]Balance, error)
+	// Outbox holds the events of the changes above.
+	Outbox() outbox.Store
+	// Audit holds the audit trail of the changes above.
+	Audit() audit.Log
+}
+
+type postgres struct {
+	db *pgxpool.Pool
+}
+
+func NewPgStorage(ctx context.Context, connString string) (*postgres, error) {
+	db, err := tracing.NewPool(ctx, connString)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create connection pool: %w", err)
+	}
+
+	return &postgres{db}, nil
+}
+
+func (pg *postgres) Ping(ctx context.Context) error {
+	return pg.db.Ping(ctx)
+}
+
+func (pg *postgres) Stat() *pgxpool.Stat {
+	return pg.db.Stat()
+}
+
+func (pg *postgres) Pool() *pgxpool.Pool {
+	return pg.db
+}
+
+func (pg *postgres) Close() {
+	pg.db.Close()
+}
+
+func (pg *postgres) Outbox() outbox.Store {
+	return outbox.NewPgStore(pg.db)
+}
+
+func (pg *postgres) Audit() audit.Log {
+	return audit.NewPgLog(pg.db)
+}
+
+const fineColumns = `fine.id, fine.fine_uid, fine.username, fine.reservation_uid, fine.library_uid,
+	fine.reason, fine.amount, fine.created_at,
+	COALESCE(SUM(payment.amount) FILTER (WHERE payment.kind = 'PAYMENT'), 0) AS paid,
+	COALESCE(SUM(payment.amount) FILTER (WHERE payment.kind = 'WAIVER'), 0) AS waived`
+
+// CreateFine records a fine for the reservation. A reservation can be fined
+// only once per reason, so repeated assessments return the existing fine.
+func (pg *postgres) CreateFine(ctx context.Context, username string, reservationUid string, libraryUid string, reason string, amount int) (Fine, error) {
+
+	fine := Fine{
+		Fine_uid:        uuid.New().String(),
+		Username:        username,
+		Reservation_uid: reservationUid,
+		Library_uid:     libraryUid,
+		Reason:          reason,
+		Amount:          amount,
+		Created_at:      time.Now().UTC(),
+	}
+
+	query := `INSERT INTO fine (fine_uid, username, reservation_uid, library_uid, reason, amount, created_at)
+	VALUES (@fine_uid, @username, @reservation_uid, @library_uid, @reason, @amount, @created_at)
+	ON CONFLICT (reservation_uid, reason) DO NOTHING RETURNING id`
+	args := pgx.NamedArgs{
+		"fine_uid":        fine.Fine_uid,
+		"username":        fine.Username,
+		"reservation_uid": fine.Reservation_uid,
+		"library_uid":     fine.Library_uid,
+		"reason":          fine.Reason,
+		"amount":          fine.Amount,
+		"created_at":      fine.Created_at,
+	}
+
+	err := pgx.BeginFunc(ctx, pg.db, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, query, args).Scan(&fine.ID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			// fined before, the existing fine is returned below
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to insert row: %w", err)
+		}
+
+		event, err := fineCreatedEvent(fine)
+		if err != nil {
+			return err
+		}
+		if err = outbox.Write(ctx, tx, event); err != nil {
+			return err
+		}
+
+		entry, err := createdEntry(ctx, fine)
+		if err != nil {
+			return err
+		}
+		return audit.Write(ctx, tx, entry)
+	})
+	if err != nil {
+		return Fine{}, err
+	}
+
+	query = `SELECT ` + fineColumns + ` FROM fine LEFT JOIN payment ON payment.fine_id = fine.id
+	WHERE fine.reservation_uid = @reservation_uid AND fine.reason = @reason GROUP BY fine.id`
+
+	return pg.collectFine(ctx, query, pgx.NamedArgs{
+		"reservation_uid": reservationUid,
+		"reason":          reason,
+	})
+}
+
+func (pg *postgres) GetFines(ctx context.Context, username string) ([]Fine, error) {
+
+	query := `SELECT ` + fineColumns + ` FROM fine LEFT JOIN payment ON payment.fine_id = fine.id
+	WHERE fine.username = @username GROUP BY fine.id ORDER BY fine.created_at`
+
+	rows, err := pg.db.Query(ctx, query, pgx.NamedArgs{"username": username})
+
+	var fines []Fine
+
+	if err != nil {
+		return fines, fmt.Errorf("unable to query: %w", err)
+	}
+	defer rows.Close()
+
+	fines, err = pgx.CollectRows(rows, pgx.RowToStructByName[Fine])
+	if err != nil {
+		slog.ErrorContext(ctx, "CollectRows error", "error", err)
+		return fines, err
+	}
+
+	return fines, nil
+}
+
+func (pg *postgres) GetFineByUid(ctx context.Context, fineUid string) (Fine, error) {
+
+	query := `SELECT ` + fineColumns + ` FROM fine LEFT JOIN payment ON payment.fine_id = fine.id
+	WHERE fine.fine_uid = @fine_uid GROUP BY fine.id`
+
+	return pg.collectFine(ctx, query, pgx.NamedArgs{"fine_uid": fineUid})
+}
+
+func (pg *postgres) collectFine(ctx context.Context, query string, args pgx.NamedArgs) (Fine, error) {
+
+	rows, err := pg.db.Query(ctx, query, args)
+
+	var fine Fine
+
+	if err != nil {
+		return fine, fmt.Errorf("unable to query: %w", err)
+	}
+	defer rows.Close()
+
+	fine, err = pgx.CollectOneRow(rows, pgx.RowToStructByName[Fine])
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fine, ErrFineNotFound
+	}
+
+	if err != nil {
+		slog.ErrorContext(ctx, "CollectRows error", "error", err)
+		return fine, err
+	}
+
+	return fine, nil
+}
+
+func (pg *postgres) GetOutstanding(ctx context.Context, username string) (int, error) {
+
+	query := `SELECT COALESCE(SUM(fine.amount), 0) - COALESCE((SELECT SUM(payment.amount) FROM payment
+	JOIN fine ON fine.id = payment.fine_id WHERE fine.username = @username), 0)
+	FROM fine WHERE fine.username = @username`
+
+	var outstanding int
+
+	err := pg.db.QueryRow(ctx, query, pgx.NamedArgs{"username": username}).Scan(&outstanding)
+	if err != nil {
+		return outstanding, fmt.Errorf("unable to query: %w", err)
+	}
+
+	return outstanding, nil
+}
+
+// CreatePayment records a payment or a waiver against a single fine. The fine
+// row is locked so that concurrent payments can not exceed its amount.
+func (pg *postgres) CreatePayment(ctx context.Context, fineUid string, kind string, amount int, recordedBy string, comment string) (Payment, error) {
+
+	var payment Payment
+
+	tx, err := pg.db.Begin(ctx)
+	if err != nil {
+		return payment, fmt.Errorf("unable to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var fineId, fineAmount int
+	var username string
+	err = tx.QueryRow(ctx, `SELECT id, username, amount FROM fine WHERE fine_uid = @fine_uid FOR UPDATE`,
+		pgx.NamedArgs{"fine_uid": fineUid}).Scan(&fineId, &username, &fineAmount)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return payment, ErrFineNotFound
+	}
+	if err != nil {
+		return payment, fmt.Errorf("unable to query: %w", err)
+	}
+
+	var settled int
+	err = tx.QueryRow(ctx, `SELECT COALESCE(SUM(amount), 0) FROM payment WHERE fine_id = @fine_id`,
+		pgx.NamedArgs{"fine_id": fineId}).Scan(&settled)
+	if err != nil {
+		return payment, fmt.Errorf("unable to query: %w", err)
+	}
+
+	if amount > fineAmount-settled {
+		return payment, ErrOverpayment
+	}
+
+	payment = Payment{
+		Payment_uid: uuid.New().String(),
+		Fine_id:     fineId,
+		Kind:        kind,
+		Amount:      amount,
+		Recorded_by: recordedBy,
+		Comment:     comment,
+		Created_at:  time.Now().UTC(),
+	}
+
+	query := `INSERT INTO payment (payment_uid, fine_id, kind, amount, recorded_by, comment, created_at)
+	VALUES (@payment_uid, @fine_id, @kind, @amount, @recorded_by, @comment, @created_at) RETURNING id`
+	args := pgx.NamedArgs{
+		"payment_uid": payment.Payment_uid,
+		"fine_id":     payment.Fine_id,
+		"kind":        payment.Kind,
+		"amount":      payment.Amount,
+		"recorded_by": payment.Recorded_by,
+		"comment":     payment.Comment,
+		"created_at":  payment.Created_at,
+	}
+	err = tx.QueryRow(ctx, query, args).Scan(&payment.ID)
+	if err != nil {
+		return payment, fmt.Errorf("unable to insert row: %w", err)
+	}
+
+	event, err := paymentRecordedEvent(fineUid, username, fineAmount-settled, payment)
+	if err != nil {
+		return payment, err
+	}
+	if err = outbox.Write(ctx, tx, event); err != nil {
+		return payment, err
+	}
+
+	entry, err := paymentEntry(ctx, fineUid, fineAmount-settled, payment)
+	if err != nil {
+		return payment, err
+	}
+	if err = audit.Write(ctx, tx, entry); err != nil {
+		return payment, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return payment, fmt.Errorf("unable to commit transaction: %w", err)
+	}
+
+	return payment, nil
+}
+
+func (pg *postgres) GetOutstandingByReader(ctx context.Context) ([]Balance, error) {
+	return pg.collectBalances(ctx, "username")
+}
+
+func (pg *postgres) GetOutstandingByLibrary(ctx context.Context) ([]Balance, error) {
+	return pg.collectBalances(ctx, "library_uid")
+}
+
+// collectBalances groups the outstanding part of every unsettled fine by the
+// given fine column. The column is always one of the constants above.
+func (pg *postgres) collectBalances(ctx context.Context, column string) ([]Balance, error) {
+
+	query := fmt.Sprintf(`SELECT f.%[1]s::text AS key, COUNT(*)::int AS fines, SUM(f.outstanding)::int AS outstanding
+	FROM (SELECT fine.%[1]s, fine.amount - COALESCE(SUM(payment.amount), 0) AS outstanding
+		FROM fine LEFT JOIN payment ON payment.fine_id = fine.id GROUP BY fine.id) f
+	WHERE f.outstanding > 0 GROUP BY f.%[1]s ORDER BY outstanding DESC`, column)
+
+	rows, err := pg.db.Query(ctx, query)
+
+	var balances []Balance
+
+	if err != nil {
+		return balances, fmt.Errorf("unable to query: %w", err)
+	}
+	defer rows.Close()
+
+	balances, err = pgx.CollectRows(rows, pgx.RowToStructByName[Balance])
+	if err != nil {
+		slog.ErrorContext(ctx, "CollectRows error", "error", err)
+		return balances, err
+	}
+
+	return balances, nil
+}
@@ -0,0 +1,41 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"library-system/src/fine-service/migrations"
+	"library-system/src/fine-service/storage"
+	"library-system/src/fine-service/storage/storagetest"
+	"library-system/src/pkg/pgtest"
+)
+
+func TestMemory(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T, fixture storagetest.Fixture) storage.Storage {
+		memory := storage.NewMemory()
+		for _, fine := range fixture.Fines {
+			memory.AddFine(fine)
+		}
+		return memory
+	})
+}
+
+func TestPostgres(t *testing.T) {
+	connString := pgtest.Open(t, "TEST_POSTGRES_FINES", migrations.Schema)
+
+	pg, err := storage.NewPgStorage(context.Background(), connString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Close()
+
+	storagetest.Run(t, func(t *testing.T, fixture storagetest.Fixture) storage.Storage {
+		pgtest.Exec(t, pg.Pool(), `TRUNCATE fine, payment, outbox, audit_log RESTART IDENTITY`)
+		for _, f := range fixture.Fines {
+			pgtest.Exec(t, pg.Pool(), `INSERT INTO fine (fine_uid, username, reservation_uid, library_uid, reason, amount, created_at)
+				VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+				f.Fine_uid, f.Username, f.Reservation_uid, f.Library_uid, f.Reason, f.Amount, f.Created_at)
+		}
+		return pg
+	})
+}
@@ -0,0 +1,298 @@
+// Package storagetest is the conformance suite that every implementation of
+// the fine-service Storage must pass.
+package storagetest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"library-system/src/fine-service/storage"
+	"library-system/src/pkg/apierror"
+	"library-system/src/pkg/audit"
+)
+
+const (
+	libraryUid = "83575e12-7ce0-48ee-9931-51919ff3c9ee"
+	otherUid   = "1b2c3d4e-0000-4000-8000-000000000002"
+	unknownUid = "00000000-0000-4000-8000-000000000000"
+)
+
+type Fixture struct {
+	// Fines are inserted in order, so their ids are 1, 2, ...
+	Fines []storage.Fine
+}
+
+// Factory returns a storage holding exactly the fixture.
+type Factory func(t *testing.T, fixture Fixture) storage.Storage
+
+func date(day int) time.Time {
+	return time.Date(2021, 10, day, 0, 0, 0, 0, time.UTC)
+}
+
+func fineUid(n int) string {
+	return fmt.Sprintf("5e6f7a8b-0000-4000-8000-%012d", n)
+}
+
+func reservationUid(n int) string {
+	return fmt.Sprintf("3c4d5e6f-0000-4000-8000-%012d", n)
+}
+
+var fixture = Fixture{
+	Fines: []storage.Fine{
+		{Fine_uid: fineUid(1), Username: "Test Max", Reservation_uid: reservationUid(1), Library_uid: libraryUid, Reason: "OVERDUE", Amount: 5000, Created_at: date(1)},
+		{Fine_uid: fineUid(2), Username: "Test Max", Reservation_uid: reservationUid(1), Library_uid: libraryUid, Reason: "CONDITION", Amount: 20000, Created_at: date(2)},
+		{Fine_uid: fineUid(3), Username: "Test Min", Reservation_uid: reservationUid(2), Library_uid: otherUid, Reason: "OVERDUE", Amount: 3000, Created_at: date(3)},
+	},
+}
+
+func fineUids(fines []storage.Fine) []string {
+	uids := make([]string, len(fines))
+	for i, fine := range fines {
+		uids[i] = fine.Fine_uid
+	}
+	return uids
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func expectCode(t *testing.T, err error, code apierror.Code) {
+	t.Helper()
+
+	if err == nil || apierror.From(err).Code != code {
+		t.Errorf("expected %s, got %v", code, err)
+	}
+}
+
+func Run(t *testing.T, newStorage Factory) {
+	ctx := context.Background()
+
+	t.Run("CreateFine", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		fine, err := s.CreateFine(ctx, "Test Min", reservationUid(3), otherUid, "CONDITION", 40000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fine.Fine_uid == "" || fine.ID == 0 || fine.Username != "Test Min" || fine.Amount != 40000 || fine.Outstanding() != 40000 {
+			t.Errorf("unexpected fine %+v", fine)
+		}
+
+		// a reservation is fined once per reason
+		again, err := s.CreateFine(ctx, "Test Min", reservationUid(3), otherUid, "CONDITION", 20000)
+		if err != nil || again.Fine_uid != fine.Fine_uid || again.Amount != 40000 {
+			t.Errorf("expected the existing fine, got %+v (%v)", again, err)
+		}
+		if fines, _ := s.GetFines(ctx, "Test Min"); len(fines) != 2 {
+			t.Errorf("expected 2 fines, got %+v", fines)
+		}
+
+		_, err = s.CreateFine(ctx, "Test Min", reservationUid(3), otherUid, "LATE", 1000)
+		expectCode(t, err, apierror.CodeValidation)
+
+		_, err = s.CreateFine(ctx, "Test Min", "not-a-uid", otherUid, "OVERDUE", 1000)
+		expectCode(t, err, apierror.CodeValidation)
+	})
+
+	t.Run("GetFines", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		fines, err := s.GetFines(ctx, "Test Max")
+		if err != nil || !equal(fineUids(fines), []string{fineUid(1), fineUid(2)}) {
+			t.Errorf("expected the fines of Test Max oldest first, got %v (%v)", fineUids(fines), err)
+		}
+
+		fines, err = s.GetFines(ctx, "Unknown")
+		if err != nil || len(fines) != 0 {
+			t.Errorf("expected no fines, got %+v (%v)", fines, err)
+		}
+	})
+
+	t.Run("GetFineByUid", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		fine, err := s.GetFineByUid(ctx, fineUid(3))
+		if err != nil || fine.ID != 3 || fine.Library_uid != otherUid || fine.Reason != "OVERDUE" || !fine.Created_at.Equal(date(3)) {
+			t.Errorf("unexpected fine %+v (%v)", fine, err)
+		}
+
+		_, err = s.GetFineByUid(ctx, unknownUid)
+		expectCode(t, err, apierror.CodeNotFound)
+
+		_, err = s.GetFineByUid(ctx, "not-a-uid")
+		expectCode(t, err, apierror.CodeValidation)
+	})
+
+	t.Run("CreatePayment", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		payment, err := s.CreatePayment(ctx, fineUid(2), "PAYMENT", 15000, "admin", "cash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if payment.Payment_uid == "" || payment.Fine_id != 2 || payment.Amount != 15000 || payment.Recorded_by != "admin" || payment.Comment != "cash" {
+			t.Errorf("unexpected payment %+v", payment)
+		}
+
+		if _, err = s.CreatePayment(ctx, fineUid(2), "WAIVER", 5000, "admin", "first offence"); err != nil {
+			t.Fatal(err)
+		}
+
+		fine, _ := s.GetFineByUid(ctx, fineUid(2))
+		if fine.Paid != 15000 || fine.Waived != 5000 || fine.Outstanding() != 0 {
+			t.Errorf("expected the fine to be settled, got %+v", fine)
+		}
+
+		_, err = s.CreatePayment(ctx, fineUid(2), "PAYMENT", 1, "admin", "")
+		expectCode(t, err, apierror.CodeValidation)
+
+		_, err = s.CreatePayment(ctx, unknownUid, "PAYMENT", 100, "admin", "")
+		expectCode(t, err, apierror.CodeNotFound)
+
+		_, err = s.CreatePayment(ctx, fineUid(1), "REFUND", 100, "admin", "")
+		expectCode(t, err, apierror.CodeValidation)
+	})
+
+	t.Run("Overpayment", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		_, err := s.CreatePayment(ctx, fineUid(1), "PAYMENT", 5001, "admin", "")
+		expectCode(t, err, apierror.CodeValidation)
+
+		if fine, _ := s.GetFineByUid(ctx, fineUid(1)); fine.Paid != 0 || fine.Outstanding() != 5000 {
+			t.Errorf("a refused payment must change nothing, got %+v", fine)
+		}
+
+		if _, err = s.CreatePayment(ctx, fineUid(1), "PAYMENT", 5000, "admin", ""); err != nil {
+			t.Errorf("paying the whole fine is not an overpayment, got %v", err)
+		}
+	})
+
+	t.Run("GetOutstanding", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		if outstanding, err := s.GetOutstanding(ctx, "Test Max"); err != nil || outstanding != 25000 {
+			t.Errorf("expected 25000, got %d (%v)", outstanding, err)
+		}
+
+		s.CreatePayment(ctx, fineUid(1), "PAYMENT", 2000, "admin", "")
+		s.CreatePayment(ctx, fineUid(2), "WAIVER", 20000, "admin", "")
+
+		if outstanding, err := s.GetOutstanding(ctx, "Test Max"); err != nil || outstanding != 3000 {
+			t.Errorf("expected 3000 after payments, got %d (%v)", outstanding, err)
+		}
+		if outstanding, err := s.GetOutstanding(ctx, "Unknown"); err != nil || outstanding != 0 {
+			t.Errorf("expected nothing outstanding, got %d (%v)", outstanding, err)
+		}
+	})
+
+	t.Run("Reports", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		s.CreatePayment(ctx, fineUid(1), "PAYMENT", 5000, "admin", "")
+
+		readers, err := s.GetOutstandingByReader(ctx)
+		expected := []storage.Balance{{Key: "Test Max", Fines: 1, Outstanding: 20000}, {Key: "Test Min", Fines: 1, Outstanding: 3000}}
+		if err != nil || len(readers) != 2 || readers[0] != expected[0] || readers[1] != expected[1] {
+			t.Errorf("expected %+v, got %+v (%v)", expected, readers, err)
+		}
+
+		libraries, err := s.GetOutstandingByLibrary(ctx)
+		expected = []storage.Balance{{Key: libraryUid, Fines: 1, Outstanding: 20000}, {Key: otherUid, Fines: 1, Outstanding: 3000}}
+		if err != nil || len(libraries) != 2 || libraries[0] != expected[0] || libraries[1] != expected[1] {
+			t.Errorf("expected %+v, got %+v (%v)", expected, libraries, err)
+		}
+
+		s.CreatePayment(ctx, fineUid(3), "WAIVER", 3000, "admin", "")
+		if readers, _ = s.GetOutstandingByReader(ctx); len(readers) != 1 || readers[0].Key != "Test Max" {
+			t.Errorf("settled readers must be left out, got %+v", readers)
+		}
+	})
+
+	t.Run("Outbox", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		fine, err := s.CreateFine(ctx, "Test Min", reservationUid(3), otherUid, "OVERDUE", 4000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = s.CreatePayment(ctx, fine.Fine_uid, "PAYMENT", 1500, "admin", ""); err != nil {
+			t.Fatal(err)
+		}
+
+		// repeated assessments and failed payments are not published
+		s.CreateFine(ctx, "Test Min", reservationUid(3), otherUid, "OVERDUE", 4000)
+		s.CreatePayment(ctx, fine.Fine_uid, "PAYMENT", 5000, "admin", "")
+
+		events, err := s.Outbox().Pending(ctx, 10)
+		if err != nil || len(events) != 2 {
+			t.Fatalf("expected 2 events, got %+v (%v)", events, err)
+		}
+
+		var created storage.Fine
+		if err = events[0].Decode(&created); err != nil || events[0].Type != storage.FineCreated ||
+			events[0].EntityUid != fine.Fine_uid || created.Amount != 4000 {
+			t.Errorf("unexpected event %+v (%v)", events[0], err)
+		}
+
+		var paid storage.PaymentEvent
+		if err = events[1].Decode(&paid); err != nil || events[1].Type != storage.PaymentRecorded ||
+			paid.Username != "Test Min" || paid.Kind != "PAYMENT" || paid.Amount != 1500 || paid.Outstanding != 2500 {
+			t.Errorf("unexpected event %+v %+v (%v)", events[1], paid, err)
+		}
+	})
+
+	t.Run("Audit", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		fine, err := s.CreateFine(ctx, "Test Min", reservationUid(3), otherUid, "OVERDUE", 4000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = s.CreatePayment(audit.WithActor(ctx, "admin"), fine.Fine_uid, "WAIVER", 1000, "admin", ""); err != nil {
+			t.Fatal(err)
+		}
+
+		// repeated assessments and failed changes are not recorded
+		s.CreateFine(ctx, "Test Min", reservationUid(3), otherUid, "OVERDUE", 4000)
+		s.CreatePayment(ctx, fine.Fine_uid, "PAYMENT", 5000, "admin", "")
+
+		entries, err := s.Audit().Query(ctx, audit.Filter{Limit: 10})
+		if err != nil || len(entries) != 2 {
+			t.Fatalf("expected 2 entries, got %+v (%v)", entries, err)
+		}
+
+		waived, created := entries[0], entries[1]
+
+		var before, after struct {
+			Kind        string
+			Amount      int
+			Outstanding int
+		}
+		json.Unmarshal(waived.Before, &before)
+		json.Unmarshal(waived.After, &after)
+		if waived.Action != storage.AuditPaymentRecorded || waived.EntityUid != fine.Fine_uid || waived.Actor != "admin" ||
+			before.Outstanding != 4000 || after.Kind != "WAIVER" || after.Amount != 1000 || after.Outstanding != 3000 {
+			t.Errorf("unexpected entry %+v", waived)
+		}
+
+		var payload storage.Fine
+		json.Unmarshal(created.After, &payload)
+		if created.Action != storage.AuditFineCreated || created.EntityType != "fine" || created.Actor != audit.System ||
+			len(created.Before) != 0 || payload.Fine_uid != fine.Fine_uid || payload.Amount != 4000 {
+			t.Errorf("unexpected entry %+v", created)
+		}
+	})
+}
@@ -0,0 +1,208 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Backend stores cached values. Implementations must be safe for concurrent
+// use.
+type Backend interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+}
+
+// Cache is a read-through cache in front of a Backend. Concurrent loads of
+// the same key are collapsed into one. Backend failures are treated as
+// misses so that an unavailable cache never fails a request.
+//
+// Every invalidation raises the generation of its keys, so that a value
+// loaded before an invalidation is not stored after it.
+type Cache struct {
+	backend Backend
+	ttl     time.Duration
+	group   singleflight.Group
+
+	mu          sync.Mutex
+	generations map[string]uint64
+}
+
+func New(backend Backend, ttl time.Duration) *Cache {
+	return &Cache{backend: backend, ttl: ttl, generations: make(map[string]uint64)}
+}
+
+// Get returns the cached value for key, calling load and storing its result
+// on a miss.
+func (c *Cache) Get(ctx context.Context, key string, load func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	if value, ok := c.lookup(ctx, key); ok {
+		return value, nil
+	}
+
+	value, err, _ := c.group.Do(key, func() (any, error) {
+		generation := c.Generation(key)
+
+		value, err := load(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		c.SetAt(ctx, key, value, generation)
+		return value, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return value.([]byte), nil
+}
+
+// GetMany returns the cached values of the keys that are present.
+func (c *Cache) GetMany(ctx context.Context, keys []string) map[string][]byte {
+	values := make(map[string][]byte, len(keys))
+
+	for _, key := range keys {
+		if value, ok := c.lookup(ctx, key); ok {
+			values[key] = value
+		}
+	}
+
+	return values
+}
+
+func (c *Cache) Set(ctx context.Context, key string, value []byte) {
+	if err := c.backend.Set(ctx, key, value, c.ttl); err != nil {
+		slog.WarnContext(ctx, "cache set failed", "key", key, "error", err)
+	}
+}
+
+// Generation returns the generation of key, to be taken before its value is
+// loaded and passed to SetAt.
+func (c *Cache) Generation(key string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.generations[key]
+}
+
+// SetAt stores the value of key loaded at generation, unless key has been
+// invalidated since.
+func (c *Cache) SetAt(ctx context.Context, key string, value []byte, generation uint64) {
+	if c.Generation(key) != generation {
+		return
+	}
+
+	c.Set(ctx, key, value)
+
+	// an invalidation between the check and the write may have deleted the
+	// key before the value was written
+	if c.Generation(key) != generation {
+		if err := c.backend.Delete(ctx, key); err != nil {
+			slog.WarnContext(ctx, "cache delete failed", "key", key, "error", err)
+		}
+	}
+}
+
+func (c *Cache) Invalidate(ctx context.Context, keys ...string) error {
+	c.mu.Lock()
+	for _, key := range keys {
+		c.generations[key]++
+	}
+	c.mu.Unlock()
+
+	return c.backend.Delete(ctx, keys...)
+}
+
+func (c *Cache) lookup(ctx context.Context, key string) ([]byte, bool) {
+	value, ok, err := c.backend.Get(ctx, key)
+	if err != nil {
+		slog.WarnContext(ctx, "cache get failed", "key", key, "error", err)
+		return nil, false
+	}
+	return value, ok
+}
+
+type entry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+// memoryBackend is an LRU cache holding at most maxEntries values.
+type memoryBackend struct {
+	mu         sync.Mutex
+	maxEntries int
+	order      *list.List
+	items      map[string]*list.Element
+}
+
+func NewMemory(maxEntries int) Backend {
+	return &memoryBackend{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (m *memoryBackend) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	element, ok := m.items[key]
+	if !ok {
+		return nil, false, nil
+	}
+
+	item := element.Value.(*entry)
+	if time.Now().After(item.expiresAt) {
+		m.remove(element)
+		return nil, false, nil
+	}
+
+	m.order.MoveToFront(element)
+	return item.value, true, nil
+}
+
+func (m *memoryBackend) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if element, ok := m.items[key]; ok {
+		item := element.Value.(*entry)
+		item.value = value
+		item.expiresAt = time.Now().Add(ttl)
+		m.order.MoveToFront(element)
+		return nil
+	}
+
+	m.items[key] = m.order.PushFront(&entry{key: key, value: value, expiresAt: time.Now().Add(ttl)})
+
+	for m.maxEntries > 0 && m.order.Len() > m.maxEntries {
+		m.remove(m.order.Back())
+	}
+
+	return nil
+}
+
+func (m *memoryBackend) Delete(ctx context.Context, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range keys {
+		if element, ok := m.items[key]; ok {
+			m.remove(element)
+		}
+	}
+
+	return nil
+}
+
+func (m *memoryBackend) remove(element *list.Element) {
+	m.order.Remove(element)
+	delete(m.items, element.Value.(*entry).key)
+}
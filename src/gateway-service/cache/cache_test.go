@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"library-system/src/gateway-service/cache/fakeredis"
+)
+
+func testBackend(t *testing.T, backend Backend) {
+	ctx := context.Background()
+
+	if _, ok, err := backend.Get(ctx, "book:1"); ok || err != nil {
+		t.Fatalf("empty backend: ok=%v err=%v", ok, err)
+	}
+
+	if err := backend.Set(ctx, "book:1", []byte(`{"name":"Совершенный код"}`), time.Minute); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	value, ok, err := backend.Get(ctx, "book:1")
+	if !ok || err != nil || string(value) != `{"name":"Совершенный код"}` {
+		t.Errorf("get after set: %q ok=%v err=%v", value, ok, err)
+	}
+
+	backend.Set(ctx, "book:2", []byte("short"), 10*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	if _, ok, _ := backend.Get(ctx, "book:2"); ok {
+		t.Errorf("expired value must not be returned")
+	}
+
+	if err = backend.Delete(ctx, "book:1", "missing"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if _, ok, _ := backend.Get(ctx, "book:1"); ok {
+		t.Errorf("deleted value must not be returned")
+	}
+}
+
+func TestMemoryBackend(t *testing.T) {
+	testBackend(t, NewMemory(10))
+}
+
+func TestMemoryBackendEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemory(2)
+
+	backend.Set(ctx, "a", []byte("a"), time.Minute)
+	backend.Set(ctx, "b", []byte("b"), time.Minute)
+	backend.Get(ctx, "a")
+	backend.Set(ctx, "c", []byte("c"), time.Minute)
+
+	if _, ok, _ := backend.Get(ctx, "b"); ok {
+		t.Errorf("least recently used entry must be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok, _ := backend.Get(ctx, key); !ok {
+			t.Errorf("entry %s must be kept", key)
+		}
+	}
+}
+
+func TestRedisBackend(t *testing.T) {
+	server, err := fakeredis.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start fake redis: %v", err)
+	}
+	defer server.Close()
+
+	testBackend(t, NewRedis(server.Addr(), 2))
+}
+
+func TestCacheLoadsOnce(t *testing.T) {
+	cache := New(NewMemory(10), time.Minute)
+
+	var loads int32
+	load := func(ctx context.Context) ([]byte, error) {
+		atomic.AddInt32(&loads, 1)
+		time.Sleep(20 * time.Millisecond)
+		return []byte("library"), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := cache.Get(context.Background(), "library:1", load)
+			if err != nil || string(value) != "library" {
+				t.Errorf("unexpected result %q %v", value, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	cache.Get(context.Background(), "library:1", load)
+
+	if loads != 1 {
+		t.Errorf("expected a single load, got %d", loads)
+	}
+}
+
+func TestCacheDropsValuesLoadedBeforeInvalidation(t *testing.T) {
+	ctx := context.Background()
+	cache := New(NewMemory(10), time.Minute)
+
+	// the book changes while its old version is being loaded
+	value, err := cache.Get(ctx, "book:1", func(ctx context.Context) ([]byte, error) {
+		cache.Invalidate(ctx, "book:1")
+		return []byte("old"), nil
+	})
+	if err != nil || string(value) != "old" {
+		t.Fatalf("unexpected result %q %v", value, err)
+	}
+
+	value, _ = cache.Get(ctx, "book:1", func(ctx context.Context) ([]byte, error) {
+		return []byte("new"), nil
+	})
+	if string(value) != "new" {
+		t.Errorf("a value loaded before an invalidation must not be cached, got %q", value)
+	}
+
+	generation := cache.Generation("book:2")
+	cache.Invalidate(ctx, "book:2")
+	cache.SetAt(ctx, "book:2", []byte("old"), generation)
+	if values := cache.GetMany(ctx, []string{"book:2"}); len(values) != 0 {
+		t.Errorf("expected nothing cached, got %q", values)
+	}
+}
+
+func TestCacheSurvivesBackendFailure(t *testing.T) {
+	cache := New(NewRedis("127.0.0.1:1", 1), time.Minute)
+
+	value, err := cache.Get(context.Background(), "library:1", func(ctx context.Context) ([]byte, error) {
+		return []byte("library"), nil
+	})
+	if err != nil || string(value) != "library" {
+		t.Errorf("unavailable backend must fall back to load, got %q %v", value, err)
+	}
+}
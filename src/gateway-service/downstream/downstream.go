@@ -0,0 +1,251 @@
+// Package downstream wraps the HTTP calls the gateway makes to other
+// services with timeouts, retries and a circuit breaker per service.
+package downstream
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"library-system/src/gateway-service/idempotency"
+	"library-system/src/pkg/apierror"
+	"library-system/src/pkg/audit"
+	"library-system/src/pkg/logging"
+	"library-system/src/pkg/tracing"
+)
+
+type Config struct {
+	ConnectTimeout   time.Duration
+	ReadTimeout      time.Duration
+	Retries          int
+	BackoffBase      time.Duration
+	BackoffMax       time.Duration
+	FailureThreshold int
+	OpenTimeout      time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ConnectTimeout:   time.Second,
+		ReadTimeout:      5 * time.Second,
+		Retries:          2,
+		BackoffBase:      50 * time.Millisecond,
+		BackoffMax:       time.Second,
+		FailureThreshold: 5,
+		OpenTimeout:      30 * time.Second,
+	}
+}
+
+// ConfigFromEnv overrides fields of config from <PREFIX>_CONNECT_TIMEOUT,
+// <PREFIX>_READ_TIMEOUT, <PREFIX>_RETRIES, <PREFIX>_FAILURE_THRESHOLD and
+// <PREFIX>_OPEN_TIMEOUT when they are set and valid.
+func ConfigFromEnv(prefix string, config Config) Config {
+	durations := map[string]*time.Duration{
+		"CONNECT_TIMEOUT": &config.ConnectTimeout,
+		"READ_TIMEOUT":    &config.ReadTimeout,
+		"OPEN_TIMEOUT":    &config.OpenTimeout,
+	}
+	for name, field := range durations {
+		if value, err := time.ParseDuration(os.Getenv(prefix + "_" + name)); err == nil {
+			*field = value
+		}
+	}
+
+	ints := map[string]*int{
+		"RETRIES":           &config.Retries,
+		"FAILURE_THRESHOLD": &config.FailureThreshold,
+	}
+	for name, field := range ints {
+		if value, err := strconv.Atoi(os.Getenv(prefix + "_" + name)); err == nil {
+			*field = value
+		}
+	}
+
+	return config
+}
+
+// Client sends requests to one downstream service.
+type Client struct {
+	name    string
+	config  Config
+	http    *http.Client
+	breaker *Breaker
+}
+
+func NewClient(name string, config Config) *Client {
+	dialer := &net.Dialer{Timeout: config.ConnectTimeout}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.ResponseHeaderTimeout = config.ReadTimeout
+
+	return &Client{
+		name:    name,
+		config:  config,
+		http:    &http.Client{Transport: tracing.Transport(transport), Timeout: config.ConnectTimeout + config.ReadTimeout},
+		breaker: NewBreaker(config.FailureThreshold, config.OpenTimeout),
+	}
+}
+
+func (cl *Client) Name() string {
+	return cl.name
+}
+
+func (cl *Client) Breaker() *Breaker {
+	return cl.breaker
+}
+
+// Do sends the request, failing fast while the breaker is open. GET and HEAD
+// requests are retried with jittered exponential backoff on network errors
+// and 502, 503 and 504 responses, unless the context of the request is done.
+// Failures to get a response are returned as apierror.CodeUnavailable errors.
+// Other requests may change the service, so they are marked as
+// idempotency.Changing the request of the gateway.
+func (cl *Client) Do(req *http.Request) (*http.Response, error) {
+	safe := req.Method == http.MethodGet || req.Method == http.MethodHead
+
+	attempts := 1
+	if safe {
+		attempts += cl.config.Retries
+	}
+
+	var res *http.Response
+	var err error
+
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if err := sleep(req.Context(), cl.backoff(attempt)); err != nil {
+				return nil, apierror.Unavailable(err, "%s is unavailable", cl.name)
+			}
+		}
+
+		if err = cl.breaker.Allow(); err != nil {
+			callErrors.WithLabelValues(cl.name, failureReason(nil, err)).Inc()
+			return nil, apierror.Unavailable(err, "%s is unavailable", cl.name)
+		}
+
+		if !safe {
+			idempotency.Changing(req.Context())
+		}
+
+		start := time.Now()
+		res, err = cl.http.Do(req)
+		cl.observe(req, res, err, start)
+
+		// a request the caller cancelled or let time out says nothing about
+		// the service and is not worth retrying
+		if req.Context().Err() != nil {
+			cl.breaker.Release()
+			break
+		}
+		cl.breaker.Record(err == nil && res.StatusCode < http.StatusInternalServerError)
+
+		if !retryable(res, err) || attempt == attempts-1 {
+			break
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+	}
+
+	if err != nil {
+		return nil, apierror.Unavailable(err, "%s is unavailable", cl.name)
+	}
+
+	return res, nil
+}
+
+func (cl *Client) backoff(attempt int) time.Duration {
+	backoff := cl.config.BackoffBase << (attempt - 1)
+	if backoff > cl.config.BackoffMax || backoff <= 0 {
+		backoff = cl.config.BackoffMax
+	}
+	if backoff <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(backoff)) + 1)
+}
+
+func retryable(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func sleep(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Clients routes requests to the Client registered for their host. Requests
+// to unknown hosts go through a client with the fallback configuration.
+type Clients struct {
+	byHost   map[string]*Client
+	fallback *Client
+}
+
+func NewClients(fallback Config) *Clients {
+	return &Clients{
+		byHost:   make(map[string]*Client),
+		fallback: NewClient("default", fallback),
+	}
+}
+
+// Register adds a client for the host of serviceURL.
+func (cs *Clients) Register(name string, serviceURL string, config Config) error {
+	parsed, err := url.Parse(serviceURL)
+	if err != nil {
+		return err
+	}
+
+	cs.byHost[parsed.Host] = NewClient(name, config)
+	return nil
+}
+
+func (cs *Clients) Do(req *http.Request) (*http.Response, error) {
+	logging.Propagate(req)
+	audit.Propagate(req)
+
+	if client, ok := cs.byHost[req.URL.Host]; ok {
+		return client.Do(req)
+	}
+	return cs.fallback.Do(req)
+}
+
+type ClientStatus struct {
+	Name string `json:"name"`
+	BreakerStatus
+}
+
+func (cs *Clients) Status() []ClientStatus {
+	status := make([]ClientStatus, 0, len(cs.byHost))
+	for _, client := range cs.byHost {
+		status = append(status, ClientStatus{Name: client.name, BreakerStatus: client.breaker.Status()})
+	}
+
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Name < status[j].Name
+	})
+
+	return status
+}
@@ -0,0 +1,241 @@
+package downstream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"library-system/src/pkg/apierror"
+)
+
+// faultyServer fails the first failures requests with status, or hangs for
+// delay before answering when delay is set.
+func faultyServer(failures int32, status int, delay time.Duration) (*httptest.Server, *int32) {
+	var calls int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := atomic.AddInt32(&calls, 1)
+
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if call <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	return server, &calls
+}
+
+func testConfig() Config {
+	return Config{
+		ConnectTimeout:   time.Second,
+		ReadTimeout:      time.Second,
+		Retries:          2,
+		BackoffBase:      time.Millisecond,
+		BackoffMax:       5 * time.Millisecond,
+		FailureThreshold: 3,
+		OpenTimeout:      time.Minute,
+	}
+}
+
+func TestRetriesGetUntilSuccess(t *testing.T) {
+	server, calls := faultyServer(2, http.StatusServiceUnavailable, 0)
+	defer server.Close()
+
+	client := NewClient("rating", testConfig())
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || *calls != 3 {
+		t.Errorf("expected success on the third call, got status %d after %d calls", res.StatusCode, *calls)
+	}
+}
+
+func TestDoesNotRetryPost(t *testing.T) {
+	server, calls := faultyServer(1, http.StatusServiceUnavailable, 0)
+	defer server.Close()
+
+	client := NewClient("reservation", testConfig())
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL, nil)
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusServiceUnavailable || *calls != 1 {
+		t.Errorf("POST must not be retried, got status %d after %d calls", res.StatusCode, *calls)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	server, _ := faultyServer(0, 0, time.Second)
+	defer server.Close()
+
+	config := testConfig()
+	config.ReadTimeout = 50 * time.Millisecond
+	config.Retries = 0
+	client := NewClient("rating", config)
+
+	started := time.Now()
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	if _, err := client.Do(req); err == nil {
+		t.Fatalf("hung server must time out")
+	}
+
+	if elapsed := time.Since(started); elapsed > 500*time.Millisecond {
+		t.Errorf("timeout took %s", elapsed)
+	}
+}
+
+func TestCancelledRequestsAreNotFailures(t *testing.T) {
+	server, calls := faultyServer(0, 0, time.Second)
+	defer server.Close()
+
+	client := NewClient("rating", testConfig())
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		_, err := client.Do(req)
+		cancel()
+
+		if apierror.From(err).Code != apierror.CodeUnavailable {
+			t.Errorf("expected an unavailable error, got %v", err)
+		}
+	}
+
+	if *calls != 3 {
+		t.Errorf("requests whose context is done must not be retried, got %d calls", *calls)
+	}
+	if status := client.Breaker().Status(); status.State != StateClosed || status.Failures != 0 {
+		t.Errorf("requests whose context is done must not count as failures, got %+v", status)
+	}
+}
+
+func TestCancelledBackoff(t *testing.T) {
+	server, calls := faultyServer(100, http.StatusServiceUnavailable, 0)
+	defer server.Close()
+
+	config := testConfig()
+	config.BackoffBase = time.Minute
+	config.BackoffMax = time.Minute
+	client := NewClient("rating", config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if _, err := client.Do(req); apierror.From(err).Code != apierror.CodeUnavailable || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected an unavailable error wrapping the deadline, got %v", err)
+	}
+	if *calls != 1 {
+		t.Errorf("expected the backoff to be cut short, got %d calls", *calls)
+	}
+}
+
+func TestBreakerOpensAndFailsFast(t *testing.T) {
+	server, calls := faultyServer(100, http.StatusInternalServerError, 0)
+	defer server.Close()
+
+	config := testConfig()
+	config.Retries = 0
+	client := NewClient("library", config)
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		res.Body.Close()
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	if _, err := client.Do(req); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected open circuit, got %v", err)
+	}
+	if *calls != 3 {
+		t.Errorf("open circuit must not reach the server, got %d calls", *calls)
+	}
+	if client.Breaker().Status().State != StateOpen {
+		t.Errorf("expected OPEN state, got %s", client.Breaker().Status().State)
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	now := time.Now()
+	breaker := NewBreaker(1, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	breaker.Allow()
+	breaker.Record(false)
+	if err := breaker.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected open circuit, got %v", err)
+	}
+
+	now = now.Add(time.Minute)
+	if err := breaker.Allow(); err != nil {
+		t.Fatalf("probe must be allowed after the open timeout, got %v", err)
+	}
+	if err := breaker.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("only one probe may run at a time, got %v", err)
+	}
+
+	breaker.Record(false)
+	if breaker.Status().State != StateOpen {
+		t.Errorf("failed probe must re-open the breaker, got %s", breaker.Status().State)
+	}
+
+	// a released probe lets the next call probe
+	now = now.Add(time.Minute)
+	breaker.Allow()
+	breaker.Release()
+	if err := breaker.Allow(); err != nil {
+		t.Fatalf("a released probe must allow another, got %v", err)
+	}
+	breaker.Record(true)
+	if breaker.Status().State != StateClosed {
+		t.Errorf("successful probe must close the breaker, got %s", breaker.Status().State)
+	}
+}
+
+func TestClientsRouteByHost(t *testing.T) {
+	server, calls := faultyServer(0, 0, 0)
+	defer server.Close()
+
+	clients := NewClients(testConfig())
+	if err := clients.Register("rating", server.URL, testConfig()); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/v1/rating/", nil)
+	res, err := clients.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	res.Body.Close()
+
+	status := clients.Status()
+	if *calls != 1 || len(status) != 1 || status[0].Name != "rating" || status[0].State != StateClosed {
+		t.Errorf("unexpected status %+v after %d calls", status, *calls)
+	}
+}
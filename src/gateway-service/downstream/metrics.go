@@ -0,0 +1,59 @@
+package downstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"library-system/src/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	callDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "downstream_request_duration_seconds",
+		Help:    "Latency of single attempts of calls to downstream services by service, method and status.",
+		Buckets: metrics.LatencyBuckets,
+	}, []string{"service", "method", "status"})
+
+	callErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "downstream_errors_total",
+		Help: "Failed attempts of calls to downstream services by service and reason.",
+	}, []string{"service", "reason"})
+)
+
+// observe records one attempt. Attempts without a response are recorded with
+// the status "error".
+func (cl *Client) observe(req *http.Request, res *http.Response, err error, start time.Time) {
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(res.StatusCode)
+	}
+	callDuration.WithLabelValues(cl.name, req.Method, status).Observe(time.Since(start).Seconds())
+
+	if reason := failureReason(res, err); reason != "" {
+		callErrors.WithLabelValues(cl.name, reason).Inc()
+	}
+}
+
+func failureReason(res *http.Response, err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrCircuitOpen):
+		return "circuit_open"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case err != nil:
+		return "connection"
+	case res.StatusCode >= http.StatusInternalServerError:
+		return "server_error"
+	}
+	return ""
+}
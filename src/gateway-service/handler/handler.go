@@ -2,23 +2,85 @@ package handler
 
 import (
 	"bytes"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+
+	"library-system/src/gateway-service/cache"
+	"library-system/src/gateway-service/downstream"
+	"library-system/src/gateway-service/limits"
+	"library-system/src/gateway-service/rating"
+	"library-system/src/pkg/apierror"
+	"library-system/src/pkg/audit"
+	"library-system/src/pkg/etag"
+	"library-system/src/pkg/outbox"
 
 	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 )
 
-const (
-	ratingService      string = "http://rating-service:8050"
-	libraryService     string = "http://library-service:8060"
-	reservationService string = "http://reservation-service:8070"
-)
+// Services holds the base URLs of the services the gateway calls.
+type Services struct {
+	Rating       string
+	Library      string
+	Reservation  string
+	Fine         string
+	Notification string
+}
 
-type ErrorResponse struct {
-	Message string `json:"message"`
+// DefaultServices returns the addresses of the services in docker-compose.
+func DefaultServices() Services {
+	return Services{
+		Rating:       "http://rating-service:8050",
+		Library:      "http://library-service:8060",
+		Reservation:  "http://reservation-service:8070",
+		Fine:         "http://fine-service:8040",
+		Notification: "http://notification-service:8030",
+	}
+}
+
+// ServicesFromEnv overrides the default addresses with RATING_SERVICE_URL,
+// LIBRARY_SERVICE_URL, RESERVATION_SERVICE_URL, FINE_SERVICE_URL and
+// NOTIFICATION_SERVICE_URL when they are set.
+func ServicesFromEnv() Services {
+	services := DefaultServices()
+
+	urls := map[string]*string{
+		"RATING_SERVICE_URL":       &services.Rating,
+		"LIBRARY_SERVICE_URL":      &services.Library,
+		"RESERVATION_SERVICE_URL":  &services.Reservation,
+		"FINE_SERVICE_URL":         &services.Fine,
+		"NOTIFICATION_SERVICE_URL": &services.Notification,
+	}
+	for name, field := range urls {
+		if value := os.Getenv(name); value != "" {
+			*field = strings.TrimSuffix(value, "/")
+		}
+	}
+
+	return services
+}
+
+// ByName lists the services keyed by name.
+func (s Services) ByName() map[string]string {
+	return map[string]string{
+		"rating-service":       s.Rating,
+		"library-service":      s.Library,
+		"reservation-service":  s.Reservation,
+		"fine-service":         s.Fine,
+		"notification-service": s.Notification,
+	}
 }
 
 type MessageResponse struct {
@@ -74,17 +136,37 @@ type ReservationResponse struct {
 	Status          string `json:"status"`
 	Start_date      string `json:"startDate"`
 	Till_date       string `json:"tillDate"`
+	Version         int    `json:"version"`
 }
 
+// ReservationToUserResponse carries the version of the reservation, which
+// the librarian returns the book with as If-Match.
 type ReservationToUserResponse struct {
 	Reservation_uid string             `json:"reservationUid"`
 	Status          string             `json:"status"`
 	Start_date      string             `json:"startDate"`
 	Till_date       string             `json:"tillDate"`
+	Version         int                `json:"version"`
 	Book            BookToUserResponse `json:"book"`
 	Library         LibraryResponse    `json:"library"`
 }
 
+type ReservationHistoryResponse struct {
+	Page          int                   `json:"page"`
+	PageSize      int                   `json:"pageSize"`
+	TotalElements int                   `json:"totalElements"`
+	Items         []ReservationResponse `json:"items"`
+	NextCursor    string                `json:"nextCursor,omitempty"`
+}
+
+type ReservationsLimited struct {
+	Page          int                         `json:"page"`
+	PageSize      int                         `json:"pageSize"`
+	TotalElements int                         `json:"totalElements"`
+	Items         []ReservationToUserResponse `json:"items"`
+	NextCursor    string                      `json:"nextCursor,omitempty"`
+}
+
 type TakeBookResponse struct {
 	Reservation_uid string             `json:"reservationUid"`
 	Status          string             `json:"status"`
@@ -102,29 +184,126 @@ type CreateReservationRequest struct {
 }
 
 type UpdateReservationRequest struct {
+	Condition string   `json:"condition"`
+	Date      string   `json:"date"`
+	Notes     string   `json:"notes,omitempty"`
+	Photos    []string `json:"photos,omitempty"`
+}
+
+// AssessConditionRequest records the condition a book is returned in, with
+// the librarian passed on as the assessor.
+type AssessConditionRequest struct {
+	Condition      string   `json:"condition"`
+	Date           string   `json:"date"`
+	ReservationUid string   `json:"reservationUid"`
+	Notes          string   `json:"notes,omitempty"`
+	Photos         []string `json:"photos,omitempty"`
+}
+
+type BookInfoResponse struct {
+	Book_uid      string `json:"bookUid"`
+	Name          string `json:"name"`
+	Author        string `json:"author"`
+	Genre         string `json:"genre"`
+	Material_type string `json:"materialType"`
+}
+
+func (book BookInfoResponse) ToUser() BookToUserResponse {
+	return BookToUserResponse{
+		Book_uid: book.Book_uid,
+		Name:     book.Name,
+		Author:   book.Author,
+		Genre:    book.Genre,
+	}
+}
+
+type BookConditionResponse struct {
 	Condition string `json:"condition"`
-	Date      string `json:"date"`
 }
 
-type ReservationAmount struct {
-	Amount int `json:"amount"`
+type FineResponse struct {
+	Fine_uid        string `json:"fineUid"`
+	Reservation_uid string `json:"reservationUid"`
+	Library_uid     string `json:"libraryUid"`
+	Reason          string `json:"reason"`
+	Amount          int    `json:"amount"`
+	Paid            int    `json:"paid"`
+	Waived          int    `json:"waived"`
+	Outstanding     int    `json:"outstanding"`
+	Created_at      string `json:"createdAt"`
+}
+
+type FineBalanceResponse struct {
+	Username    string `json:"username"`
+	Outstanding int    `json:"outstanding"`
+	Threshold   int    `json:"threshold"`
+	Blocked     bool   `json:"blocked"`
+}
+
+type AssessFinesRequest struct {
+	ReservationUid  string `json:"reservationUid"`
+	LibraryUid      string `json:"libraryUid"`
+	TillDate        string `json:"tillDate"`
+	Date            string `json:"date"`
+	ConditionBefore string `json:"conditionBefore"`
+	ConditionAfter  string `json:"conditionAfter"`
 }
 
-type Handler struct{}
+type BookAvailableRequest struct {
+	BookUid    string `json:"bookUid"`
+	LibraryUid string `json:"libraryUid"`
+}
+
+type CreatePaymentRequest struct {
+	Kind    string `json:"kind"`
+	Amount  int    `json:"amount"`
+	Comment string `json:"comment"`
+}
+
+// ratingSourceHeader is set when the rating in a response did not come from
+// rating-service, e.g. "CACHED" or "DEFAULT".
+const ratingSourceHeader = "X-Rating-Source"
+
+const (
+	batchSize        = 50
+	batchConcurrency = 8
+)
+
+// CacheEventRequest is the part of an outbox event of library-service the
+// cache is invalidated by.
+type CacheEventRequest struct {
+	Type      string `json:"type"`
+	EntityUid string `json:"entityUid"`
+}
+
+// doer sends HTTP requests, e.g. *http.Client or *downstream.Clients.
+type doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+type Handler struct {
+	services    Services
+	limits      *limits.Service
+	cache       *cache.Cache
+	clients     *downstream.Clients
+	ratings     *rating.Service
+	eventsToken string
+	group       singleflight.Group
+}
 
-func NewHandler() *Handler {
-	return &Handler{}
+// NewHandler returns the handler of the gateway. Change events are only
+// accepted with eventsToken, none at all if it is empty.
+func NewHandler(services Services, limits *limits.Service, cache *cache.Cache, clients *downstream.Clients, ratings *rating.Service, eventsToken string) *Handler {
+	return &Handler{services: services, limits: limits, cache: cache, clients: clients, ratings: ratings, eventsToken: eventsToken}
 }
 
 func (h *Handler) GetLibrariesByCity(c *gin.Context) {
 	params := c.Request.URL.Query()
-	requestURL := fmt.Sprintf("%s/api/v1/libraries/", libraryService)
+	requestURL := fmt.Sprintf("%s/api/v1/libraries/", h.services.Library)
 
-	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, requestURL, nil)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 
@@ -132,31 +311,19 @@ func (h *Handler) GetLibrariesByCity(c *gin.Context) {
 	q.Add("city", c.Query("city"))
 	req.URL.RawQuery = q.Encode()
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := h.clients.Do(req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
-		return
-	}
-
-	resBody, err := io.ReadAll(res.Body)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 
 	var libraries []LibraryResponse
-	if json.Unmarshal(resBody, &libraries) != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+	if err = readJSON(res, &libraries); err != nil {
+		apierror.Respond(c, err)
 		return
 	}
 
-	fmt.Println(libraries)
+	slog.DebugContext(c.Request.Context(), "libraries received", "count", len(libraries))
 
 	pageParam := params.Get("page")
 	if pageParam == "" {
@@ -164,9 +331,7 @@ func (h *Handler) GetLibrariesByCity(c *gin.Context) {
 	}
 	page, err := strconv.Atoi(pageParam)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, apierror.Validation("page must be a number"))
 		return
 	}
 
@@ -176,9 +341,7 @@ func (h *Handler) GetLibrariesByCity(c *gin.Context) {
 	}
 	size, err := strconv.Atoi(sizeParam)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, apierror.Validation("size must be a number"))
 		return
 	}
 
@@ -205,13 +368,11 @@ func (h *Handler) GetLibrariesByCity(c *gin.Context) {
 
 func (h *Handler) GetBooksByLibraryUid(c *gin.Context) {
 	params := c.Request.URL.Query()
-	requestURL := fmt.Sprintf("%s/api/v1/libraries/%s/books/", libraryService, c.Param("uid"))
+	requestURL := fmt.Sprintf("%s/api/v1/libraries/%s/books/", h.services.Library, c.Param("uid"))
 
-	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, requestURL, nil)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 
@@ -219,31 +380,19 @@ func (h *Handler) GetBooksByLibraryUid(c *gin.Context) {
 	q.Add("showAll", c.Query("showAll"))
 	req.URL.RawQuery = q.Encode()
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
-		return
-	}
-
-	resBody, err := io.ReadAll(res.Body)
+	res, err := h.clients.Do(req)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 
 	var books []BookResponse
-	if json.Unmarshal(resBody, &books) != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+	if err = readJSON(res, &books); err != nil {
+		apierror.Respond(c, err)
 		return
 	}
 
-	fmt.Println(books)
+	slog.DebugContext(c.Request.Context(), "books received", "count", len(books))
 
 	pageParam := params.Get("page")
 	if pageParam == "" {
@@ -251,9 +400,7 @@ func (h *Handler) GetBooksByLibraryUid(c *gin.Context) {
 	}
 	page, err := strconv.Atoi(pageParam)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, apierror.Validation("page must be a number"))
 		return
 	}
 
@@ -263,9 +410,7 @@ func (h *Handler) GetBooksByLibraryUid(c *gin.Context) {
 	}
 	size, err := strconv.Atoi(sizeParam)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, apierror.Validation("size must be a number"))
 		return
 	}
 
@@ -296,196 +441,229 @@ func (h *Handler) GetRating(c *gin.Context) {
 	token := c.GetHeader("X-Authorization")
 
 	if token != "admin" {
-		c.JSON(http.StatusUnauthorized, ErrorResponse{
-			Message: "only admin can use this",
-		})
+		apierror.Respond(c, apierror.Unauthorized("only admin can use this"))
 		return
 	}
 
 	if username == "" {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: "username must be given as X-User-Name Header",
-		})
+		apierror.Respond(c, apierror.BadRequest("username must be given as X-User-Name Header"))
+		return
+	}
+
+	stars, source, err := h.ratings.Get(c.Request.Context(), username)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
+	if source != rating.SourceService {
+		c.Header(ratingSourceHeader, string(source))
+	}
+
+	c.JSON(http.StatusOK, RatingResponse{
+		Stars: stars,
+	})
+}
+
+// GetReservations pages through the reservations of the reader, oldest
+// first.
+func (h *Handler) GetReservations(c *gin.Context) {
+
+	username := c.GetHeader("X-User-Name")
+	token := c.GetHeader("X-Authorization")
+
+	if token != "admin" {
+		apierror.Respond(c, apierror.Unauthorized("only admin can use this"))
+		return
+	}
+
+	if username == "" {
+		apierror.Respond(c, apierror.BadRequest("username must be given as X-User-Name Header"))
 		return
 	}
 
-	requestURL := fmt.Sprintf("%s/api/v1/rating/", ratingService)
+	requestURL := fmt.Sprintf("%s/api/v1/reservations/history", h.services.Reservation)
 
-	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, requestURL, nil)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 	req.Header.Set("X-User-Name", username)
 
-	res, err := http.DefaultClient.Do(req)
+	// oldest first unless asked otherwise; a cursor continues where the
+	// nextCursor of the previous page left off
+	q := req.URL.Query()
+	q.Add("order", c.DefaultQuery("order", "asc"))
+	q.Add("size", c.DefaultQuery("size", "100"))
+	for _, param := range []string{"page", "cursor"} {
+		if value := c.Query(param); value != "" {
+			q.Add(param, value)
+		}
+	}
+	req.URL.RawQuery = q.Encode()
+
+	res, err := h.clients.Do(req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 
-	resBody, err := io.ReadAll(res.Body)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+	var history ReservationHistoryResponse
+	if err = readJSON(res, &history); err != nil {
+		apierror.Respond(c, err)
 		return
 	}
 
-	var rating RatingResponse
-	if json.Unmarshal(resBody, &rating) != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+	items, err := h.reservationsToUser(c.Request.Context(), history.Items)
+	if err != nil {
+		apierror.Respond(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, RatingResponse{
-		Stars: rating.Stars,
+	c.JSON(http.StatusOK, ReservationsLimited{
+		Page:          history.Page,
+		PageSize:      history.PageSize,
+		TotalElements: history.TotalElements,
+		Items:         items,
+		NextCursor:    history.NextCursor,
 	})
 }
 
-func (h *Handler) GetReservations(c *gin.Context) {
+// GetReservation returns a reservation of the reader with its ETag, which the
+// librarian returns the book with.
+func (h *Handler) GetReservation(c *gin.Context) {
 
 	username := c.GetHeader("X-User-Name")
 	token := c.GetHeader("X-Authorization")
 
 	if token != "admin" {
-		c.JSON(http.StatusUnauthorized, ErrorResponse{
-			Message: "only admin can use this",
-		})
+		apierror.Respond(c, apierror.Unauthorized("only admin can use this"))
 		return
 	}
 
 	if username == "" {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: "username must be given as X-User-Name Header",
-		})
+		apierror.Respond(c, apierror.BadRequest("username must be given as X-User-Name Header"))
 		return
 	}
 
-	requestURL := fmt.Sprintf("%s/api/v1/reservations/", reservationService)
+	requestURL := fmt.Sprintf("%s/api/v1/reservations/info/%s", h.services.Reservation, c.Param("uid"))
 
-	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, requestURL, nil)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 	req.Header.Set("X-User-Name", username)
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := h.clients.Do(req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 
-	resBody, err := io.ReadAll(res.Body)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+	var reservation ReservationResponse
+	if err = readJSON(res, &reservation); err != nil {
+		apierror.Respond(c, err)
 		return
 	}
 
-	var reservations []ReservationResponse
-	if json.Unmarshal(resBody, &reservations) != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+	if reservation.Username != username {
+		apierror.Respond(c, apierror.NotFound("reservation not found"))
 		return
 	}
 
-	response := make([]ReservationToUserResponse, len(reservations))
+	items, err := h.reservationsToUser(c.Request.Context(), []ReservationResponse{reservation})
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
 
-	for i, reservation := range reservations {
-		requestBookURL := fmt.Sprintf("%s/api/v1/books/%s/", libraryService, reservation.Book_uid)
+	etag.Set(c, reservation.Version)
+	c.JSON(http.StatusOK, items[0])
+}
 
-		req, err := http.NewRequest(http.MethodGet, requestBookURL, nil)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, ErrorResponse{
-				Message: err.Error(),
-			})
-			return
-		}
+func (h *Handler) GetReservationHistory(c *gin.Context) {
+	h.reservationHistory(c, "/api/v1/reservations/history")
+}
 
-		res, err := http.DefaultClient.Do(req)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, ErrorResponse{
-				Message: err.Error(),
-			})
-			return
-		}
+// GetArchivedReservations pages through the reservations the reservation
+// service has archived like GetReservationHistory does through the others.
+func (h *Handler) GetArchivedReservations(c *gin.Context) {
+	h.reservationHistory(c, "/api/v1/reservations/archive")
+}
 
-		resBody, err := io.ReadAll(res.Body)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, ErrorResponse{
-				Message: err.Error(),
-			})
-			return
-		}
+// reservationHistory serves a page of reservations from path of the
+// reservation service, with their books and libraries.
+func (h *Handler) reservationHistory(c *gin.Context, path string) {
 
-		var book BookToUserResponse
-		if json.Unmarshal(resBody, &book) != nil {
-			c.JSON(http.StatusBadRequest, ErrorResponse{
-				Message: err.Error(),
-			})
-			return
-		}
+	username := c.GetHeader("X-User-Name")
+	token := c.GetHeader("X-Authorization")
 
-		requestLibraryURL := fmt.Sprintf("%s/api/v1/libraries/%s/", libraryService, reservation.Library_uid)
+	if token != "admin" {
+		apierror.Respond(c, apierror.Unauthorized("only admin can use this"))
+		return
+	}
 
-		reqLib, err := http.NewRequest(http.MethodGet, requestLibraryURL, nil)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, ErrorResponse{
-				Message: err.Error(),
-			})
-			return
-		}
+	if username == "" {
+		apierror.Respond(c, apierror.BadRequest("username must be given as X-User-Name Header"))
+		return
+	}
 
-		resLib, err := http.DefaultClient.Do(reqLib)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, ErrorResponse{
-				Message: err.Error(),
-			})
-			return
-		}
+	requestURL := h.services.Reservation + path
 
-		resLibBody, err := io.ReadAll(resLib.Body)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, ErrorResponse{
-				Message: err.Error(),
-			})
-			return
-		}
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, requestURL, nil)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+	req.Header.Set("X-User-Name", username)
 
-		var library LibraryResponse
-		if json.Unmarshal(resLibBody, &library) != nil {
-			c.JSON(http.StatusBadRequest, ErrorResponse{
-				Message: err.Error(),
-			})
-			return
+	q := req.URL.Query()
+	for _, param := range []string{"status", "libraryUid", "bookUid", "from", "to", "order", "size", "cursor"} {
+		if value := c.Query(param); value != "" {
+			q.Add(param, value)
 		}
+	}
+	req.URL.RawQuery = q.Encode()
 
-		response[i] = ReservationToUserResponse{
-			Reservation_uid: reservation.Reservation_uid,
-			Status:          reservation.Status,
-			Start_date:      reservation.Start_date,
-			Till_date:       reservation.Till_date,
-			Book:            book,
-			Library:         library,
-		}
+	res, err := h.clients.Do(req)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
 
+	if res.StatusCode != http.StatusOK {
+		c.Data(res.StatusCode, "application/json; charset=utf-8", resBody)
+		return
 	}
 
-	c.JSON(http.StatusOK, response)
+	var history ReservationHistoryResponse
+	if err = json.Unmarshal(resBody, &history); err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
+	items, err := h.reservationsToUser(c.Request.Context(), history.Items)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, ReservationsLimited{
+		Page:          history.Page,
+		PageSize:      history.PageSize,
+		TotalElements: history.TotalElements,
+		Items:         items,
+		NextCursor:    history.NextCursor,
+	})
 }
 
 func (h *Handler) CreateReservation(c *gin.Context) {
@@ -493,9 +671,7 @@ func (h *Handler) CreateReservation(c *gin.Context) {
 	username := c.GetHeader("X-User-Name")
 
 	if username == "" {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: "username must be given as X-User-Name Header",
-		})
+		apierror.Respond(c, apierror.BadRequest("username must be given as X-User-Name Header"))
 		return
 	}
 
@@ -503,201 +679,158 @@ func (h *Handler) CreateReservation(c *gin.Context) {
 
 	err := json.NewDecoder(c.Request.Body).Decode(&inputCreateBody)
 	if err != nil {
-		fmt.Printf("failed to decode body %s\n", err.Error())
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		slog.ErrorContext(c.Request.Context(), "failed to decode body", "error", err)
+		apierror.Respond(c, apierror.BadRequest("invalid request body: %s", err.Error()))
 		return
 	}
 
-	//getting amount
-	requestAmountURL := fmt.Sprintf("%s/api/v1/reservations/amount", reservationService)
+	//getting current loans
+	requestLoansURL := fmt.Sprintf("%s/api/v1/reservations", h.services.Reservation)
 
-	reqAmount, err := http.NewRequest(http.MethodGet, requestAmountURL, nil)
+	reqLoans, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, requestLoansURL, nil)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
-	reqAmount.Header.Set("X-User-Name", username)
+	reqLoans.Header.Set("X-User-Name", username)
 
-	resAmount, err := http.DefaultClient.Do(reqAmount)
+	resLoans, err := h.clients.Do(reqLoans)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 
-	resBodyAmount, err := io.ReadAll(resAmount.Body)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+	var reservations []ReservationResponse
+	if err = readJSON(resLoans, &reservations); err != nil {
+		apierror.Respond(c, err)
 		return
 	}
 
-	var reservationAmount ReservationAmount
-	if json.Unmarshal(resBodyAmount, &reservationAmount) != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
-		return
+	rented := make([]ReservationResponse, 0)
+	loanBookUids := make([]string, 0)
+	for _, reservation := range reservations {
+		if reservation.Status == "RENTED" {
+			rented = append(rented, reservation)
+			loanBookUids = append(loanBookUids, reservation.Book_uid)
+		}
 	}
 
-	//getting a rating
-	requestRatingURL := fmt.Sprintf("%s/api/v1/rating/", ratingService)
-
-	reqRating, err := http.NewRequest(http.MethodGet, requestRatingURL, nil)
+	loanBooks, err := h.lookupBooks(c.Request.Context(), loanBookUids)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
-	reqRating.Header.Set("X-User-Name", username)
 
-	resRating, err := http.DefaultClient.Do(reqRating)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
-		return
+	loans := make([]limits.Item, len(rented))
+	for i, reservation := range rented {
+		loans[i] = limits.Item{
+			LibraryUid:   reservation.Library_uid,
+			Genre:        loanBooks[reservation.Book_uid].Genre,
+			MaterialType: loanBooks[reservation.Book_uid].Material_type,
+		}
 	}
 
-	resBodyRating, err := io.ReadAll(resRating.Body)
+	requestedBook, err := h.getBookInfo(c.Request.Context(), inputCreateBody.BookUid)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 
-	var rating RatingResponse
-	if json.Unmarshal(resBodyRating, &rating) != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+	//getting a rating
+	stars, source, err := h.ratings.Get(c.Request.Context(), username)
+	if err != nil {
+		apierror.Respond(c, err)
 		return
 	}
 
-	if reservationAmount.Amount >= rating.Stars {
-		c.JSON(http.StatusBadRequest, MessageResponse{
-			Message: "user cannot take new book",
-		})
-		return
+	if source != rating.SourceService {
+		c.Header(ratingSourceHeader, string(source))
 	}
 
-	//create reservation
-	requestCreateURL := fmt.Sprintf("%s/api/v1/reservations", reservationService)
+	ratingResponse := RatingResponse{Stars: stars}
 
-	marshalled, err := json.Marshal(inputCreateBody)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
-	}
+	//checking borrowing limits
+	decision := h.limits.Check(limits.Request{
+		Stars: ratingResponse.Stars,
+		Loans: loans,
+		Item: limits.Item{
+			LibraryUid:   inputCreateBody.LibraryUid,
+			Genre:        requestedBook.Genre,
+			MaterialType: requestedBook.Material_type,
+		},
+	})
 
-	reqCreate, err := http.NewRequest(http.MethodPost, requestCreateURL, bytes.NewReader(marshalled))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+	if !decision.Allowed {
+		apierror.Respond(c, apierror.Conflict(decision.Reason))
 		return
 	}
-	reqCreate.Header.Set("X-User-Name", username)
 
-	resCreate, err := http.DefaultClient.Do(reqCreate)
+	//checking unpaid fines
+	requestBalanceURL := fmt.Sprintf("%s/api/v1/fines/balance", h.services.Fine)
+
+	reqBalance, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, requestBalanceURL, nil)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
+	reqBalance.Header.Set("X-User-Name", username)
 
-	resBodyCreate, err := io.ReadAll(resCreate.Body)
+	resBalance, err := h.clients.Do(reqBalance)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 
-	var createReserv ReservationResponse
-	if json.Unmarshal(resBodyCreate, &createReserv) != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+	var balance FineBalanceResponse
+	if err = readJSON(resBalance, &balance); err != nil {
+		apierror.Respond(c, err)
 		return
 	}
 
-	//create response
-	requestBookURL := fmt.Sprintf("%s/api/v1/books/%s/", libraryService, createReserv.Book_uid)
-
-	reqBook, err := http.NewRequest(http.MethodGet, requestBookURL, nil)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+	if balance.Blocked {
+		apierror.Respond(c, apierror.Conflict("user has unpaid fines"))
 		return
 	}
 
-	resBook, err := http.DefaultClient.Do(reqBook)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
-		return
-	}
+	//create reservation
+	requestCreateURL := fmt.Sprintf("%s/api/v1/reservations", h.services.Reservation)
 
-	resBodyBook, err := io.ReadAll(resBook.Body)
+	marshalled, err := json.Marshal(inputCreateBody)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 
-	var book BookToUserResponse
-	if json.Unmarshal(resBodyBook, &book) != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+	reqCreate, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, requestCreateURL, bytes.NewReader(marshalled))
+	if err != nil {
+		apierror.Respond(c, err)
 		return
 	}
+	reqCreate.Header.Set("X-User-Name", username)
 
-	requestLibraryURL := fmt.Sprintf("%s/api/v1/libraries/%s/", libraryService, createReserv.Library_uid)
-
-	reqLib, err := http.NewRequest(http.MethodGet, requestLibraryURL, nil)
+	resCreate, err := h.clients.Do(reqCreate)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 
-	resLib, err := http.DefaultClient.Do(reqLib)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+	var createReserv ReservationResponse
+	if err = readJSON(resCreate, &createReserv); err != nil {
+		apierror.Respond(c, err)
 		return
 	}
+	etag.Copy(c, resCreate)
 
-	resLibBody, err := io.ReadAll(resLib.Body)
+	//create response
+	book, err := h.getBookInfo(c.Request.Context(), createReserv.Book_uid)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 
-	var library LibraryResponse
-	if json.Unmarshal(resLibBody, &library) != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+	libraries, err := h.lookupLibraries(c.Request.Context(), []string{createReserv.Library_uid})
+	if err != nil {
+		apierror.Respond(c, err)
 		return
 	}
 
@@ -706,34 +839,28 @@ func (h *Handler) CreateReservation(c *gin.Context) {
 		Status:          createReserv.Status,
 		Start_date:      createReserv.Start_date,
 		Till_date:       createReserv.Till_date,
-		Book:            book,
-		Library:         library,
-		Rating:          rating,
+		Book:            book.ToUser(),
+		Library:         libraries[createReserv.Library_uid],
+		Rating:          ratingResponse,
 	}
 
 	//update count
-	requestUpdateCountURL := fmt.Sprintf("%s/api/v1/books/%s/count/0", libraryService, book.Book_uid)
+	requestUpdateCountURL := fmt.Sprintf("%s/api/v1/books/%s/count/0", h.services.Library, book.Book_uid)
 
-	reqCount, err := http.NewRequest(http.MethodPut, requestUpdateCountURL, nil)
+	reqCount, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPut, requestUpdateCountURL, nil)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 
-	resCount, err := http.DefaultClient.Do(reqCount)
+	resCount, err := h.clients.Do(reqCount)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 
-	if resCount.StatusCode != 200 {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: "error while updating count",
-		})
+	if err = apierror.FromResponse(resCount); err != nil {
+		apierror.Respond(c, err)
 		return
 	}
 
@@ -748,112 +875,141 @@ func (h *Handler) ReturnBook(c *gin.Context) {
 	token := c.GetHeader("X-Authorization")
 
 	if token != "admin" {
-		c.JSON(http.StatusUnauthorized, ErrorResponse{
-			Message: "only admin can use this",
-		})
+		apierror.Respond(c, apierror.Unauthorized("only admin can use this"))
 		return
 	}
 
 	if username == "" {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: "username must be given as X-User-Name Header",
-		})
+		apierror.Respond(c, apierror.BadRequest("username must be given as X-User-Name Header"))
+		return
+	}
+
+	// the version the librarian has seen, so that a reservation is not
+	// returned twice; * would return it whatever happened since
+	version, err := etag.IfMatch(c)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+	if version == etag.Any {
+		apierror.Respond(c, apierror.PreconditionRequired("%s must be given with the ETag of the reservation, * is not accepted", etag.IfMatchHeader))
 		return
 	}
 
 	var inputUpdateBody UpdateReservationRequest
 
-	err := json.NewDecoder(c.Request.Body).Decode(&inputUpdateBody)
+	err = json.NewDecoder(c.Request.Body).Decode(&inputUpdateBody)
 	if err != nil {
-		fmt.Printf("failed to decode body %s\n", err.Error())
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		slog.ErrorContext(c.Request.Context(), "failed to decode body", "error", err)
+		apierror.Respond(c, apierror.BadRequest("invalid request body: %s", err.Error()))
 		return
 	}
 
 	//getting reservation info
-	requestReservURL := fmt.Sprintf("%s/api/v1/reservations/info/%s", reservationService, c.Param("uid"))
+	requestReservURL := fmt.Sprintf("%s/api/v1/reservations/info/%s", h.services.Reservation, c.Param("uid"))
 
-	reqReserv, err := http.NewRequest(http.MethodGet, requestReservURL, nil)
+	reqReserv, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, requestReservURL, nil)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 	reqReserv.Header.Set("X-User-Name", username)
 
-	resReserv, err := http.DefaultClient.Do(reqReserv)
+	resReserv, err := h.clients.Do(reqReserv)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
-		return
-	}
-
-	resBodyReserv, err := io.ReadAll(resReserv.Body)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 
 	var reservation ReservationResponse
-	if json.Unmarshal(resBodyReserv, &reservation) != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+	if err = readJSON(resReserv, &reservation); err != nil {
+		apierror.Respond(c, err)
 		return
 	}
 
 	//updating status
-	requestStatusURL := fmt.Sprintf("%s/api/v1/reservations/%s", reservationService, c.Param("uid"))
+	requestStatusURL := fmt.Sprintf("%s/api/v1/reservations/%s", h.services.Reservation, c.Param("uid"))
 
 	marshalled, err := json.Marshal(inputUpdateBody)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
+		return
 	}
 
-	reqStatus, err := http.NewRequest(http.MethodPut, requestStatusURL, bytes.NewReader(marshalled))
+	reqStatus, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPut, requestStatusURL, bytes.NewReader(marshalled))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 
-	resStatus, err := http.DefaultClient.Do(reqStatus)
+	etag.Forward(c, reqStatus)
+
+	resStatus, err := h.clients.Do(reqStatus)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 
+	if err = apierror.FromResponse(resStatus); err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+	etag.Copy(c, resStatus)
+
 	if resStatus.StatusCode == 204 {
 		resFee = resFee + 1
 	}
 
+	//getting condition before return
+	requestBookConditionURL := fmt.Sprintf("%s/api/v1/books/%s/condition", h.services.Library, reservation.Book_uid)
+
+	reqBookCondition, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, requestBookConditionURL, nil)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
+	resBookCondition, err := h.clients.Do(reqBookCondition)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
+	var bookCondition BookConditionResponse
+	if err = readJSON(resBookCondition, &bookCondition); err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
 	//updating condition
-	requestConditionURL := fmt.Sprintf("%s/api/v1/books/%s/condition", libraryService, reservation.Book_uid)
+	requestConditionURL := fmt.Sprintf("%s/api/v1/books/%s/condition", h.services.Library, reservation.Book_uid)
+
+	marshalledCondition, err := json.Marshal(AssessConditionRequest{
+		Condition:      inputUpdateBody.Condition,
+		Date:           inputUpdateBody.Date,
+		ReservationUid: reservation.Reservation_uid,
+		Notes:          inputUpdateBody.Notes,
+		Photos:         inputUpdateBody.Photos,
+	})
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
 
-	reqCondition, err := http.NewRequest(http.MethodPut, requestConditionURL, bytes.NewReader(marshalled))
+	reqCondition, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPut, requestConditionURL, bytes.NewReader(marshalledCondition))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 
-	resCondition, err := http.DefaultClient.Do(reqCondition)
+	resCondition, err := h.clients.Do(reqCondition)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
+		return
+	}
+
+	if err = apierror.FromResponse(resCondition); err != nil {
+		apierror.Respond(c, err)
 		return
 	}
 
@@ -862,59 +1018,84 @@ func (h *Handler) ReturnBook(c *gin.Context) {
 	}
 
 	//updating count
-	requestCountURL := fmt.Sprintf("%s/api/v1/books/%s/count/1/", libraryService, reservation.Book_uid)
+	requestCountURL := fmt.Sprintf("%s/api/v1/books/%s/count/1/", h.services.Library, reservation.Book_uid)
 
-	reqCount, err := http.NewRequest(http.MethodPut, requestCountURL, nil)
+	reqCount, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPut, requestCountURL, nil)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 
-	_, err = http.DefaultClient.Do(reqCount)
+	resCount, err := h.clients.Do(reqCount)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
+		return
+	}
+
+	if err = apierror.FromResponse(resCount); err != nil {
+		apierror.Respond(c, err)
 		return
 	}
 
-	//getting rating
-	requestRatingURL := fmt.Sprintf("%s/api/v1/rating/", ratingService)
+	//assessing fines
+	requestAssessURL := fmt.Sprintf("%s/api/v1/fines/assess", h.services.Fine)
 
-	reqRating, err := http.NewRequest(http.MethodGet, requestRatingURL, nil)
+	marshalledAssess, err := json.Marshal(AssessFinesRequest{
+		ReservationUid:  reservation.Reservation_uid,
+		LibraryUid:      reservation.Library_uid,
+		TillDate:        reservation.Till_date,
+		Date:            inputUpdateBody.Date,
+		ConditionBefore: bookCondition.Condition,
+		ConditionAfter:  inputUpdateBody.Condition,
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
-	reqRating.Header.Set("X-User-Name", username)
 
-	resRating, err := http.DefaultClient.Do(reqRating)
+	reqAssess, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, requestAssessURL, bytes.NewReader(marshalledAssess))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
+	reqAssess.Header.Set("X-User-Name", username)
 
-	resBodyRating, err := io.ReadAll(resRating.Body)
+	resAssess, err := h.clients.Do(reqAssess)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 
-	var rating RatingResponse
-	if json.Unmarshal(resBodyRating, &rating) != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+	if err = apierror.FromResponse(resAssess); err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
+	//notifying readers waiting for the book
+	marshalledAvailable, err := json.Marshal(BookAvailableRequest{
+		BookUid:    reservation.Book_uid,
+		LibraryUid: reservation.Library_uid,
+	})
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
+	requestAvailableURL := fmt.Sprintf("%s/api/v1/notifications/events/book-available", h.services.Notification)
+
+	reqAvailable, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, requestAvailableURL, bytes.NewReader(marshalledAvailable))
+	if err != nil {
+		apierror.Respond(c, err)
 		return
 	}
+	reqAvailable.Header.Set("Content-Type", "application/json")
+
+	resAvailable, err := h.clients.Do(reqAvailable)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to notify about available book", "error", err)
+	} else {
+		resAvailable.Body.Close()
+	}
 
 	//update rating
 	if resFee != 0 {
@@ -923,45 +1104,597 @@ func (h *Handler) ReturnBook(c *gin.Context) {
 		resFee = 1
 	}
 
-	rating.Stars = rating.Stars + resFee
+	h.ratings.Apply(c.Request.Context(), username, c.Param("uid"), resFee)
+
+	c.JSON(http.StatusNoContent, MessageResponse{
+		Message: "Book was successfully returned",
+	})
+}
+
+func (h *Handler) GetFines(c *gin.Context) {
+
+	username := c.GetHeader("X-User-Name")
+
+	if username == "" {
+		apierror.Respond(c, apierror.BadRequest("username must be given as X-User-Name Header"))
+		return
+	}
+
+	requestURL := fmt.Sprintf("%s/api/v1/fines", h.services.Fine)
 
-	if rating.Stars < 0 {
-		rating.Stars = 0
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, requestURL, nil)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
 	}
-	if rating.Stars > 100 {
-		rating.Stars = 100
+	req.Header.Set("X-User-Name", username)
+
+	res, err := h.clients.Do(req)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
+	var fines []FineResponse
+	if err = readJSON(res, &fines); err != nil {
+		apierror.Respond(c, err)
+		return
 	}
 
-	requestUpdRatingURL := fmt.Sprintf("%s/api/v1/rating/", ratingService)
+	c.JSON(http.StatusOK, fines)
+}
+
+func (h *Handler) CreateFinePayment(c *gin.Context) {
 
-	marshalled, err = json.Marshal(rating)
+	token := c.GetHeader("X-Authorization")
+
+	if token != "admin" {
+		apierror.Respond(c, apierror.Unauthorized("only admin can use this"))
+		return
+	}
+
+	var inputPaymentBody CreatePaymentRequest
+
+	err := json.NewDecoder(c.Request.Body).Decode(&inputPaymentBody)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		slog.ErrorContext(c.Request.Context(), "failed to decode body", "error", err)
+		apierror.Respond(c, apierror.BadRequest("invalid request body: %s", err.Error()))
+		return
 	}
 
-	reqUpdRating, err := http.NewRequest(http.MethodPut, requestUpdRatingURL, bytes.NewReader(marshalled))
+	requestURL := fmt.Sprintf("%s/api/v1/fines/%s/payments", h.services.Fine, c.Param("uid"))
+
+	marshalled, err := json.Marshal(inputPaymentBody)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodPost, requestURL, bytes.NewReader(marshalled))
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
+	res, err := h.clients.Do(req)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		apierror.Respond(c, err)
 		return
 	}
 
-	reqUpdRating.Header.Set("X-User-Name", username)
+	c.Data(res.StatusCode, "application/json; charset=utf-8", resBody)
+}
+
+func (h *Handler) GetFinesReport(c *gin.Context) {
+
+	token := c.GetHeader("X-Authorization")
+
+	if token != "admin" {
+		apierror.Respond(c, apierror.Unauthorized("only admin can use this"))
+		return
+	}
+
+	report := c.Param("report")
+	if report != "readers" && report != "libraries" {
+		apierror.Respond(c, apierror.NotFound("report must be readers or libraries"))
+		return
+	}
 
-	_, err = http.DefaultClient.Do(reqUpdRating)
+	requestURL := fmt.Sprintf("%s/api/v1/fines/reports/%s", h.services.Fine, report)
+
+	req, err := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, requestURL, nil)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
+	res, err := h.clients.Do(req)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Message: err.Error(),
+		apierror.Respond(c, err)
+		return
+	}
+
+	c.Data(res.StatusCode, "application/json; charset=utf-8", resBody)
+}
+
+// GetAudit merges the audit trails of library, reservation, rating and fine
+// services, newest first. The filter is passed on to each of them and the
+// result is cut to its limit.
+func (h *Handler) GetAudit(c *gin.Context) {
+
+	token := c.GetHeader("X-Authorization")
+
+	if token != "admin" {
+		apierror.Respond(c, apierror.Unauthorized("only admin can use this"))
+		return
+	}
+
+	filter, err := audit.ParseFilter(c)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
+	services := []string{h.services.Library, h.services.Reservation, h.services.Rating, h.services.Fine}
+	trails := make([][]audit.Entry, len(services))
+
+	g, ctx := errgroup.WithContext(c.Request.Context())
+	for i, service := range services {
+		requestURL := fmt.Sprintf("%s/api/v1/audit?%s", service, c.Request.URL.RawQuery)
+		trail := &trails[i]
+
+		g.Go(func() error {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+			if err != nil {
+				return err
+			}
+
+			res, err := h.clients.Do(req)
+			if err != nil {
+				return err
+			}
+
+			return readJSON(res, trail)
 		})
+	}
+	if err = g.Wait(); err != nil {
+		apierror.Respond(c, err)
 		return
 	}
 
-	c.JSON(http.StatusNoContent, MessageResponse{
-		Message: "Book was successfully returned",
+	entries := []audit.Entry{}
+	for _, trail := range trails {
+		entries = append(entries, trail...)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.After(entries[j].CreatedAt)
+	})
+	if len(entries) > filter.Limit {
+		entries = entries[:filter.Limit]
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+func (h *Handler) GetBook(c *gin.Context) {
+	h.forwardForAdmin(c, http.MethodGet, fmt.Sprintf("%s/api/v1/books/%s/", h.services.Library, c.Param("uid")))
+}
+
+func (h *Handler) UpdateBook(c *gin.Context) {
+	h.forwardForAdmin(c, http.MethodPut, fmt.Sprintf("%s/api/v1/books/%s/", h.services.Library, c.Param("uid")))
+}
+
+func (h *Handler) GetLibrary(c *gin.Context) {
+	h.forwardForAdmin(c, http.MethodGet, fmt.Sprintf("%s/api/v1/libraries/%s/", h.services.Library, c.Param("uid")))
+}
+
+func (h *Handler) UpdateLibrary(c *gin.Context) {
+	h.forwardForAdmin(c, http.MethodPut, fmt.Sprintf("%s/api/v1/libraries/%s/", h.services.Library, c.Param("uid")))
+}
+
+func (h *Handler) GetConditionHistory(c *gin.Context) {
+	h.forwardForAdmin(c, http.MethodGet, fmt.Sprintf("%s/api/v1/books/%s/condition/history", h.services.Library, c.Param("uid")))
+}
+
+func (h *Handler) CreateDamageReport(c *gin.Context) {
+	h.forwardForAdmin(c, http.MethodPost, fmt.Sprintf("%s/api/v1/books/%s/damage-reports", h.services.Library, c.Param("uid")))
+}
+
+func (h *Handler) GetDamageReports(c *gin.Context) {
+	h.forwardForAdmin(c, http.MethodGet, fmt.Sprintf("%s/api/v1/damage-reports?%s", h.services.Library, c.Request.URL.RawQuery))
+}
+
+func (h *Handler) ResolveDamageReport(c *gin.Context) {
+	h.forwardForAdmin(c, http.MethodPost, fmt.Sprintf("%s/api/v1/damage-reports/%s/resolve", h.services.Library, c.Param("uid")))
+}
+
+// forwardForAdmin passes the request body of a librarian on and copies the
+// downstream response back. The librarian is passed on as the actor, and
+// If-Match and ETag are passed through for updates of versioned records.
+func (h *Handler) forwardForAdmin(c *gin.Context, method string, requestURL string) {
+
+	token := c.GetHeader("X-Authorization")
+
+	if token != "admin" {
+		apierror.Respond(c, apierror.Unauthorized("only admin can use this"))
+		return
+	}
+
+	req, err := http.NewRequestWithContext(c.Request.Context(), method, requestURL, c.Request.Body)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	etag.Forward(c, req)
+
+	res, err := h.clients.Do(req)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
+	etag.Copy(c, res)
+	c.Data(res.StatusCode, "application/json; charset=utf-8", resBody)
+}
+
+func (h *Handler) GetNotifications(c *gin.Context) {
+	h.forwardForUser(c, http.MethodGet, fmt.Sprintf("%s/api/v1/notifications", h.services.Notification))
+}
+
+func (h *Handler) GetNotificationPreferences(c *gin.Context) {
+	h.forwardForUser(c, http.MethodGet, fmt.Sprintf("%s/api/v1/notifications/preferences", h.services.Notification))
+}
+
+func (h *Handler) UpdateNotificationPreferences(c *gin.Context) {
+	h.forwardForUser(c, http.MethodPut, fmt.Sprintf("%s/api/v1/notifications/preferences", h.services.Notification))
+}
+
+func (h *Handler) CreateNotificationSubscription(c *gin.Context) {
+	h.forwardForUser(c, http.MethodPost, fmt.Sprintf("%s/api/v1/notifications/subscriptions", h.services.Notification))
+}
+
+// forwardForUser passes the request body on behalf of the user given in the
+// X-User-Name header and copies the downstream response back.
+func (h *Handler) forwardForUser(c *gin.Context, method string, requestURL string) {
+
+	username := c.GetHeader("X-User-Name")
+
+	if username == "" {
+		apierror.Respond(c, apierror.BadRequest("username must be given as X-User-Name Header"))
+		return
+	}
+
+	req, err := http.NewRequestWithContext(c.Request.Context(), method, requestURL, c.Request.Body)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+	req.Header.Set("X-User-Name", username)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := h.clients.Do(req)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
+	c.Data(res.StatusCode, "application/json; charset=utf-8", resBody)
+}
+
+// reservationsToUser adds book and library details to every reservation.
+// Each distinct book and library is taken from the cache or fetched once,
+// using batch lookups that run concurrently.
+func (h *Handler) reservationsToUser(ctx context.Context, reservations []ReservationResponse) ([]ReservationToUserResponse, error) {
+	bookUids := make([]string, len(reservations))
+	libraryUids := make([]string, len(reservations))
+	for i, reservation := range reservations {
+		bookUids[i] = reservation.Book_uid
+		libraryUids[i] = reservation.Library_uid
+	}
+
+	var books map[string]BookInfoResponse
+	var libraries map[string]LibraryResponse
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.Go(func() (err error) {
+		books, err = h.lookupBooks(ctx, bookUids)
+		return err
+	})
+	g.Go(func() (err error) {
+		libraries, err = h.lookupLibraries(ctx, libraryUids)
+		return err
 	})
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	response := make([]ReservationToUserResponse, len(reservations))
+
+	for i, reservation := range reservations {
+		response[i] = ReservationToUserResponse{
+			Reservation_uid: reservation.Reservation_uid,
+			Status:          reservation.Status,
+			Start_date:      reservation.Start_date,
+			Till_date:       reservation.Till_date,
+			Version:         reservation.Version,
+			Book:            books[reservation.Book_uid].ToUser(),
+			Library:         libraries[reservation.Library_uid],
+		}
+	}
+
+	return response, nil
+}
+
+// readJSON decodes a downstream response into v. Error responses are
+// returned as they are, so that their status and code reach the client.
+func readJSON(res *http.Response, v any) error {
+	defer res.Body.Close()
+
+	if err := apierror.FromResponse(res); err != nil {
+		return err
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return apierror.Unavailable(err, "invalid response from %s", res.Request.URL.Host)
+	}
+
+	return nil
+}
+
+// fetchBatch looks up distinct uids through a batch endpoint, at most
+// batchSize per request and batchConcurrency requests at a time. Identical
+// requests running at the same time share a single downstream call, unless
+// generation, if given, tells their uids apart.
+func fetchBatch[T any](ctx context.Context, client doer, group *singleflight.Group, requestURL string, uids []string, key func(T) string, generation func(uid string) uint64) (map[string]T, error) {
+	distinct := make([]string, 0, len(uids))
+	seen := make(map[string]bool, len(uids))
+	for _, uid := range uids {
+		if !seen[uid] {
+			seen[uid] = true
+			distinct = append(distinct, uid)
+		}
+	}
+	sort.Strings(distinct)
+
+	result := make(map[string]T, len(distinct))
+	var mu sync.Mutex
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(batchConcurrency)
+
+	for start := 0; start < len(distinct); start += batchSize {
+		end := start + batchSize
+		if end > len(distinct) {
+			end = len(distinct)
+		}
+		batchURL := requestURL + "?uids=" + url.QueryEscape(strings.Join(distinct[start:end], ","))
+
+		flight := batchURL
+		if generation != nil {
+			for _, uid := range distinct[start:end] {
+				flight += fmt.Sprintf(";%d", generation(uid))
+			}
+		}
+
+		g.Go(func() error {
+			items, err, _ := group.Do(flight, func() (any, error) {
+				req, err := http.NewRequestWithContext(ctx, http.MethodGet, batchURL, nil)
+				if err != nil {
+					return nil, err
+				}
+
+				res, err := client.Do(req)
+				if err != nil {
+					return nil, err
+				}
+				defer res.Body.Close()
+
+				if err = apierror.FromResponse(res); err != nil {
+					return nil, err
+				}
+
+				var items []T
+				if err = json.NewDecoder(res.Body).Decode(&items); err != nil {
+					return nil, err
+				}
+				return items, nil
+			})
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, item := range items.([]T) {
+				result[key(item)] = item
+			}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// getBookInfo returns the attributes of a book that borrowing limits are
+// evaluated on.
+func (h *Handler) getBookInfo(ctx context.Context, bookUid string) (BookInfoResponse, error) {
+	books, err := h.lookupBooks(ctx, []string{bookUid})
+	if err != nil {
+		return BookInfoResponse{}, err
+	}
+
+	book, ok := books[bookUid]
+	if !ok {
+		return book, apierror.NotFound("book %s not found", bookUid)
+	}
+
+	return book, nil
+}
+
+func (h *Handler) lookupBooks(ctx context.Context, bookUids []string) (map[string]BookInfoResponse, error) {
+	return cachedBatch(ctx, h.cache, h.clients, &h.group, "book:", fmt.Sprintf("%s/api/v1/books", h.services.Library), bookUids,
+		func(book BookInfoResponse) string { return book.Book_uid })
+}
+
+func (h *Handler) lookupLibraries(ctx context.Context, libraryUids []string) (map[string]LibraryResponse, error) {
+	return cachedBatch(ctx, h.cache, h.clients, &h.group, "library:", fmt.Sprintf("%s/api/v1/libraries", h.services.Library), libraryUids,
+		func(library LibraryResponse) string { return library.Library_uid })
+}
+
+// cachedBatch serves uids from the cache, stored under prefix+uid, and looks
+// up only the missing ones with fetchBatch. Items invalidated while they are
+// fetched are returned but not cached.
+func cachedBatch[T any](ctx context.Context, cache *cache.Cache, client doer, group *singleflight.Group, prefix string, requestURL string, uids []string, key func(T) string) (map[string]T, error) {
+	keys := make([]string, len(uids))
+	for i, uid := range uids {
+		keys[i] = prefix + uid
+	}
+
+	result := make(map[string]T, len(uids))
+	cached := cache.GetMany(ctx, keys)
+
+	missing := make([]string, 0)
+	for _, uid := range uids {
+		var item T
+		if value, ok := cached[prefix+uid]; ok && json.Unmarshal(value, &item) == nil {
+			result[uid] = item
+		} else {
+			missing = append(missing, uid)
+		}
+	}
+
+	if len(missing) == 0 {
+		return result, nil
+	}
+
+	generations := make(map[string]uint64, len(missing))
+	for _, uid := range missing {
+		generations[uid] = cache.Generation(prefix + uid)
+	}
+
+	// a call started before an invalidation is not shared with the callers
+	// that have seen it
+	fetched, err := fetchBatch(ctx, client, group, requestURL, missing, key,
+		func(uid string) uint64 { return generations[uid] })
+	if err != nil {
+		return nil, err
+	}
+
+	for uid, item := range fetched {
+		if marshalled, err := json.Marshal(item); err == nil {
+			cache.SetAt(ctx, prefix+uid, marshalled, generations[uid])
+		}
+		result[uid] = item
+	}
+
+	return result, nil
+}
+
+// InvalidateCache receives the events the outbox relay of library-service
+// publishes and drops the affected entry. Events the cache does not depend on
+// are acknowledged as well, so they do not hold up the relay.
+func (h *Handler) InvalidateCache(c *gin.Context) {
+
+	token := c.GetHeader(outbox.TokenHeader)
+
+	if h.eventsToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.eventsToken)) != 1 {
+		apierror.Respond(c, apierror.Unauthorized("only library-service can send change events"))
+		return
+	}
+
+	var event CacheEventRequest
+
+	err := json.NewDecoder(c.Request.Body).Decode(&event)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to decode body", "error", err)
+		apierror.Respond(c, apierror.BadRequest("invalid request body: %s", err.Error()))
+		return
+	}
+
+	var key string
+	switch event.Type {
+	case "book.updated":
+		key = "book:" + event.EntityUid
+	case "library.updated":
+		key = "library:" + event.EntityUid
+	default:
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	if err = h.cache.Invalidate(c.Request.Context(), key); err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to invalidate cache", "key", key, "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetBreakers reports the circuit breaker state of every downstream service.
+func (h *Handler) GetBreakers(c *gin.Context) {
+
+	token := c.GetHeader("X-Authorization")
+
+	if token != "admin" {
+		apierror.Respond(c, apierror.Unauthorized("only admin can use this"))
+		return
+	}
+
+	c.JSON(http.StatusOK, h.clients.Status())
+}
+
+// GetPendingRatings lists rating updates waiting for rating-service.
+func (h *Handler) GetPendingRatings(c *gin.Context) {
+
+	token := c.GetHeader("X-Authorization")
+
+	if token != "admin" {
+		apierror.Respond(c, apierror.Unauthorized("only admin can use this"))
+		return
+	}
+
+	pending, err := h.ratings.Pending(c.Request.Context())
+	if err != nil {
+		apierror.Respond(c, apierror.Unavailable(err, "rating updates are unavailable"))
+		return
+	}
+
+	c.JSON(http.StatusOK, pending)
 }
 
 func (h *Handler) GetHealth(c *gin.Context) {
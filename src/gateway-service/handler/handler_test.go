@@ -0,0 +1,202 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"library-system/src/gateway-service/cache"
+	"library-system/src/pkg/outbox"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/singleflight"
+)
+
+func TestFetchBatch(t *testing.T) {
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+
+		uids := strings.Split(r.URL.Query().Get("uids"), ",")
+		if len(uids) > batchSize {
+			t.Errorf("batch of %d uids exceeds %d", len(uids), batchSize)
+		}
+
+		libraries := make([]LibraryResponse, len(uids))
+		for i, uid := range uids {
+			libraries[i] = LibraryResponse{Library_uid: uid, Name: "library " + uid}
+		}
+		json.NewEncoder(w).Encode(libraries)
+	}))
+	defer server.Close()
+
+	uids := make([]string, 0)
+	for i := 0; i < 3*batchSize; i++ {
+		uids = append(uids, fmt.Sprintf("uid-%d", i%(batchSize+1)))
+	}
+
+	var group singleflight.Group
+	libraries, err := fetchBatch(context.Background(), http.DefaultClient, &group, server.URL, uids,
+		func(library LibraryResponse) string { return library.Library_uid }, nil)
+	if err != nil {
+		t.Fatalf("fetchBatch failed: %v", err)
+	}
+
+	if len(libraries) != batchSize+1 {
+		t.Errorf("expected %d distinct libraries, got %d", batchSize+1, len(libraries))
+	}
+	if libraries["uid-7"].Name != "library uid-7" {
+		t.Errorf("unexpected library %+v", libraries["uid-7"])
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 batch requests for %d distinct uids, got %d", batchSize+1, calls)
+	}
+}
+
+func TestCachedBatch(t *testing.T) {
+
+	var requested int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uids := strings.Split(r.URL.Query().Get("uids"), ",")
+		atomic.AddInt32(&requested, int32(len(uids)))
+
+		books := make([]BookInfoResponse, len(uids))
+		for i, uid := range uids {
+			books[i] = BookInfoResponse{Book_uid: uid, Name: "book " + uid}
+		}
+		json.NewEncoder(w).Encode(books)
+	}))
+	defer server.Close()
+
+	booksCache := cache.New(cache.NewMemory(100), time.Minute)
+	key := func(book BookInfoResponse) string { return book.Book_uid }
+
+	var group singleflight.Group
+	lookup := func(uids ...string) map[string]BookInfoResponse {
+		books, err := cachedBatch(context.Background(), booksCache, http.DefaultClient, &group, "book:", server.URL, uids, key)
+		if err != nil {
+			t.Fatalf("cachedBatch failed: %v", err)
+		}
+		return books
+	}
+
+	lookup("a", "b")
+	books := lookup("a", "b", "c")
+
+	if len(books) != 3 || books["a"].Name != "book a" {
+		t.Errorf("unexpected books %+v", books)
+	}
+	if requested != 3 {
+		t.Errorf("expected 3 uids to be requested, got %d", requested)
+	}
+
+	booksCache.Invalidate(context.Background(), "book:a")
+	lookup("a", "b", "c")
+
+	if requested != 4 {
+		t.Errorf("expected only the invalidated uid to be requested again, got %d", requested)
+	}
+}
+
+func TestCachedBatchAfterInvalidation(t *testing.T) {
+
+	var requests int32
+	fetched := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := "new"
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// the first request reads the book before it changes
+			name = "old"
+			close(fetched)
+			<-release
+		}
+		json.NewEncoder(w).Encode([]BookInfoResponse{{Book_uid: "a", Name: name}})
+	}))
+	defer server.Close()
+
+	booksCache := cache.New(cache.NewMemory(100), time.Minute)
+	key := func(book BookInfoResponse) string { return book.Book_uid }
+
+	var group singleflight.Group
+	lookup := func() BookInfoResponse {
+		books, err := cachedBatch(context.Background(), booksCache, http.DefaultClient, &group, "book:", server.URL, []string{"a"}, key)
+		if err != nil {
+			t.Errorf("cachedBatch failed: %v", err)
+		}
+		return books["a"]
+	}
+
+	done := make(chan BookInfoResponse)
+	go func() { done <- lookup() }()
+
+	<-fetched
+	booksCache.Invalidate(context.Background(), "book:a")
+
+	// a lookup after the invalidation does not wait for the old request
+	second := make(chan BookInfoResponse)
+	go func() { second <- lookup() }()
+
+	select {
+	case book := <-second:
+		if book.Name != "new" {
+			t.Errorf("expected the changed book, got %+v", book)
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("a lookup after the invalidation waited for the request before it")
+	}
+
+	close(release)
+	if book := <-done; book.Name != "old" {
+		t.Errorf("expected the first lookup to get the book it read, got %+v", book)
+	}
+
+	if book := lookup(); book.Name != "new" || requests != 2 {
+		t.Errorf("expected the changed book to stay cached, got %+v after %d requests", book, requests)
+	}
+}
+
+func TestInvalidateCache(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	booksCache := cache.New(cache.NewMemory(100), time.Minute)
+	handler := NewHandler(Services{}, nil, booksCache, nil, nil, "secret")
+
+	router := gin.New()
+	router.POST("/manage/cache/invalidate", handler.InvalidateCache)
+
+	tests := []struct {
+		token     string
+		eventType string
+		status    int
+		cached    bool
+	}{
+		{"", "book.updated", http.StatusUnauthorized, true},
+		{"guess", "book.updated", http.StatusUnauthorized, true},
+		{"secret", "book.updated", http.StatusNoContent, false},
+		{"secret", "book.count_changed", http.StatusNoContent, true},
+	}
+
+	for _, tt := range tests {
+		booksCache.Set(context.Background(), "book:a", []byte(`{}`))
+
+		body := fmt.Sprintf(`{"id":1,"type":%q,"entityUid":"a","payload":{}}`, tt.eventType)
+		req := httptest.NewRequest(http.MethodPost, "/manage/cache/invalidate", strings.NewReader(body))
+		req.Header.Set(outbox.TokenHeader, tt.token)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+
+		cached := len(booksCache.GetMany(context.Background(), []string{"book:a"})) == 1
+		if recorder.Code != tt.status || cached != tt.cached {
+			t.Errorf("token %q, %s: expected %d, got %d with the book cached %v", tt.token, tt.eventType, tt.status, recorder.Code, cached)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"time"
+
+	"library-system/src/gateway-service/idempotency"
+	"library-system/src/gateway-service/openapi"
+	"library-system/src/pkg/audit"
+	"library-system/src/pkg/logging"
+	"library-system/src/pkg/metrics"
+	"library-system/src/pkg/tracing"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+)
+
+// Router returns a router with the middleware every request to the gateway
+// goes through and the routes of h, so that tests run the same stack as
+// production. Probes and metrics are registered by the caller.
+func (h *Handler) Router(spec *openapi.Spec, idempotencyStore idempotency.Store, idempotencyTTL time.Duration) *gin.Engine {
+	router := gin.New()
+	router.Use(gin.Recovery(), tracing.Middleware("gateway-service"), logging.Middleware(), audit.GatewayMiddleware(), metrics.Middleware())
+
+	router.Use(cors.Default())
+
+	// отклоняем запросы, не соответствующие спецификации API
+	router.Use(spec.Middleware())
+
+	router.Use(idempotency.Middleware(idempotencyStore, idempotencyTTL))
+
+	h.Register(router)
+
+	return router
+}
+
+// Register adds the routes of the gateway to router. Probes and metrics are
+// registered by the caller.
+func (h *Handler) Register(router gin.IRoutes) {
+	// общие методы, для пользователя
+	router.GET("/api/v1/libraries", h.GetLibrariesByCity)              // получить список библиотек
+	router.GET("/api/v1/libraries/:uid/books", h.GetBooksByLibraryUid) // получить список книг выбранной библиотеки
+	router.POST("/api/v1/reservations", h.CreateReservation)           // забронировать книгу в библиотеке
+
+	// приватные методы, для библиотекаря
+	router.GET("/api/v1/reservations", h.GetReservations)                 // получить список забронированных книг пользователя
+	router.GET("/api/v1/reservations/history", h.GetReservationHistory)   // история бронирований с фильтрами и постраничным выводом
+	router.GET("/api/v1/reservations/archive", h.GetArchivedReservations) // архив закрытых бронирований, с теми же фильтрами
+	router.GET("/api/v1/reservations/info/:uid", h.GetReservation)        // получить бронирование с его ETag для возврата книги
+	router.POST("/api/v1/reservations/:uid/return", h.ReturnBook)         // получить книгу от пользователя, оценив ее состояние
+	router.GET("/api/v1/rating", h.GetRating)                             // получить рейтинг пользователя
+
+	// каталог, для библиотекаря; изменения требуют If-Match с ETag записи
+	router.GET("/api/v1/books/:uid", h.GetBook)           // получить книгу с ее ETag
+	router.PUT("/api/v1/books/:uid", h.UpdateBook)        // изменить книгу
+	router.GET("/api/v1/libraries/:uid", h.GetLibrary)    // получить библиотеку с ее ETag
+	router.PUT("/api/v1/libraries/:uid", h.UpdateLibrary) // изменить библиотеку
+
+	// состояние книг и ремонт, для библиотекаря
+	router.GET("/api/v1/books/:uid/condition/history", h.GetConditionHistory) // история оценок состояния книги
+	router.POST("/api/v1/books/:uid/damage-reports", h.CreateDamageReport)    // снять экземпляр с полки в ремонт
+	router.GET("/api/v1/damage-reports", h.GetDamageReports)                  // экземпляры в ремонте и после него
+	router.POST("/api/v1/damage-reports/:uid/resolve", h.ResolveDamageReport) // вернуть экземпляр на полку или списать
+
+	// штрафы
+	router.GET("/api/v1/fines", h.GetFines)                         // получить штрафы пользователя
+	router.POST("/api/v1/fines/:uid/payments", h.CreateFinePayment) // записать оплату или списание штрафа
+	router.GET("/api/v1/fines/reports/:report", h.GetFinesReport)   // задолженность по читателям или библиотекам
+
+	// журнал изменений, для библиотекаря
+	router.GET("/api/v1/audit", h.GetAudit) // кто, когда и что изменил во всех сервисах
+
+	// уведомления
+	router.GET("/api/v1/notifications", h.GetNotifications)                              // журнал отправленных уведомлений
+	router.GET("/api/v1/notifications/preferences", h.GetNotificationPreferences)        // настройки уведомлений пользователя
+	router.PUT("/api/v1/notifications/preferences", h.UpdateNotificationPreferences)     // изменить настройки уведомлений
+	router.POST("/api/v1/notifications/subscriptions", h.CreateNotificationSubscription) // сообщить, когда книга станет доступна
+
+	// сервисные методы
+	router.GET("/manage/health", h.GetHealth)
+	router.POST("/manage/cache/invalidate", h.InvalidateCache) // сброс кэша по событию library-service, с его токеном
+	router.GET("/manage/breakers", h.GetBreakers)              // состояние предохранителей сервисов, для библиотекаря
+	router.GET("/manage/rating/pending", h.GetPendingRatings)  // изменения рейтинга, ожидающие rating-service, для библиотекаря
+}
@@ -0,0 +1,253 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"library-system/src/pkg/apierror"
+
+	"github.com/gin-gonic/gin"
+)
+
+const Header string = "Idempotency-Key"
+
+// ReplayedHeaders are stored with a response and replayed with it, besides
+// its Content-Type.
+var ReplayedHeaders = []string{"ETag", "Location", "X-Rating-Source"}
+
+// Record is the first response given to a request with an idempotency key.
+// A record without a status is still being processed.
+type Record struct {
+	Fingerprint string
+	Status      int
+	ContentType string
+	// Header holds the ReplayedHeaders of the response.
+	Header    http.Header
+	Body      []byte
+	ExpiresAt time.Time
+}
+
+type changingKey struct{}
+
+// Changing records that the request is about to change state in another
+// service. A request that fails after that keeps its key and its failure is
+// replayed, since running it again could repeat the change.
+func Changing(ctx context.Context) {
+	if changing, ok := ctx.Value(changingKey{}).(*atomic.Bool); ok {
+		changing.Store(true)
+	}
+}
+
+type Store interface {
+	// Reserve stores an empty record for the key unless an unexpired one
+	// already exists, in which case the existing record is returned with false.
+	Reserve(ctx context.Context, key string, record Record) (Record, bool, error)
+	Save(ctx context.Context, key string, record Record) error
+	Delete(ctx context.Context, key string) error
+}
+
+type memoryStore struct {
+	mu        sync.Mutex
+	records   map[string]Record
+	lastSweep time.Time
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{records: make(map[string]Record)}
+}
+
+func (s *memoryStore) Reserve(ctx context.Context, key string, record Record) (Record, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep()
+
+	existing, ok := s.records[key]
+	if ok && time.Now().Before(existing.ExpiresAt) {
+		return existing, false, nil
+	}
+
+	s.records[key] = record
+	return record, true, nil
+}
+
+// sweep drops expired records at most once a minute.
+func (s *memoryStore) sweep() {
+	now := time.Now()
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+
+	for key, record := range s.records {
+		if now.After(record.ExpiresAt) {
+			delete(s.records, key)
+		}
+	}
+}
+
+func (s *memoryStore) Save(ctx context.Context, key string, record Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records[key] = record
+	return nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, key)
+	return nil
+}
+
+type recorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *recorder) Write(data []byte) (int, error) {
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *recorder) WriteString(data string) (int, error) {
+	r.body.WriteString(data)
+	return r.ResponseWriter.WriteString(data)
+}
+
+// Middleware makes mutating requests that carry an Idempotency-Key header safe
+// to retry. The first response is stored per user and key and replayed for
+// repeated requests with the same payload. Reusing a key for a different
+// payload is rejected. Server errors are only stored once the request has
+// been Changing state elsewhere; before that the key is released so the
+// request can be retried.
+func Middleware(store Store, ttl time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(Header)
+
+		if key == "" || !mutating(c.Request.Method) {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			apierror.Respond(c, apierror.BadRequest("unable to read request body: %s", err.Error()))
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		storeKey := c.GetHeader("X-User-Name") + "\x00" + key
+		fingerprint := fingerprint(c.Request, body)
+
+		existing, reserved, err := store.Reserve(c.Request.Context(), storeKey, Record{
+			Fingerprint: fingerprint,
+			ExpiresAt:   time.Now().Add(ttl),
+		})
+		if err != nil {
+			apierror.Respond(c, apierror.Unavailable(err, "idempotency store is unavailable"))
+			c.Abort()
+			return
+		}
+
+		if !reserved {
+			switch {
+			case existing.Fingerprint != fingerprint:
+				apierror.Respond(c, apierror.Validation("Idempotency-Key was already used for a different request"))
+				c.Abort()
+			case existing.Status == 0:
+				apierror.Respond(c, apierror.Conflict("request with this Idempotency-Key is still in progress"))
+				c.Abort()
+			default:
+				c.Header("Idempotent-Replayed", "true")
+				if existing.ContentType != "" {
+					c.Header("Content-Type", existing.ContentType)
+				}
+				for name, values := range existing.Header {
+					for _, value := range values {
+						c.Writer.Header().Add(name, value)
+					}
+				}
+				c.Status(existing.Status)
+				c.Writer.Write(existing.Body)
+				c.Abort()
+			}
+			return
+		}
+
+		changing := &atomic.Bool{}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), changingKey{}, changing))
+
+		rec := &recorder{ResponseWriter: c.Writer}
+		c.Writer = rec
+
+		// a request that panicked after changing state keeps its key
+		// reserved until it expires
+		completed := false
+		defer func() {
+			if !completed && !changing.Load() {
+				if err := store.Delete(context.WithoutCancel(c.Request.Context()), storeKey); err != nil {
+					slog.ErrorContext(c.Request.Context(), "failed to release idempotency key", "error", err)
+				}
+			}
+		}()
+
+		c.Next()
+
+		status := rec.Status()
+		if status >= http.StatusInternalServerError && !changing.Load() {
+			return
+		}
+		completed = true
+
+		header := http.Header{}
+		for _, name := range ReplayedHeaders {
+			if values := rec.Header().Values(name); len(values) > 0 {
+				header[http.CanonicalHeaderKey(name)] = values
+			}
+		}
+
+		err = store.Save(context.WithoutCancel(c.Request.Context()), storeKey, Record{
+			Fingerprint: fingerprint,
+			Status:      status,
+			ContentType: rec.Header().Get("Content-Type"),
+			Header:      header,
+			Body:        rec.body.Bytes(),
+			ExpiresAt:   time.Now().Add(ttl),
+		})
+		if err != nil {
+			// the key stays reserved until it expires, so retries get a
+			// conflict instead of running the request twice
+			slog.ErrorContext(c.Request.Context(), "failed to store idempotent response", "error", err)
+		}
+	}
+}
+
+func mutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func fingerprint(req *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(req.Method))
+	hash.Write([]byte{0})
+	hash.Write([]byte(req.URL.RequestURI()))
+	hash.Write([]byte{0})
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
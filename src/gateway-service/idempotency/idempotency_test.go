@@ -0,0 +1,176 @@
+package idempotency
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"library-system/src/gateway-service/migrations"
+	"library-system/src/pkg/pgtest"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func newRouter(calls *int) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(Middleware(NewMemoryStore(), time.Hour))
+	router.POST("/reservations", func(c *gin.Context) {
+		*calls++
+		c.Header("ETag", `"1"`)
+		c.Header("Location", "/reservations/1")
+		c.Header("X-Rating-Source", "cache")
+		c.JSON(http.StatusOK, gin.H{"call": *calls})
+	})
+	router.POST("/failing", func(c *gin.Context) {
+		*calls++
+		c.JSON(http.StatusInternalServerError, gin.H{"call": *calls})
+	})
+	router.POST("/failing-after-change", func(c *gin.Context) {
+		*calls++
+		Changing(c.Request.Context())
+		c.JSON(http.StatusServiceUnavailable, gin.H{"call": *calls})
+	})
+
+	return router
+}
+
+func do(router *gin.Engine, path string, user string, key string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("X-User-Name", user)
+	if key != "" {
+		req.Header.Set(Header, key)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestMiddleware(t *testing.T) {
+
+	calls := 0
+	router := newRouter(&calls)
+
+	first := do(router, "/reservations", "reader", "k1", `{"bookUid":"1"}`)
+	replay := do(router, "/reservations", "reader", "k1", `{"bookUid":"1"}`)
+
+	if calls != 1 {
+		t.Fatalf("handler must run once, ran %d times", calls)
+	}
+	if replay.Code != first.Code || replay.Body.String() != first.Body.String() {
+		t.Errorf("replay %d %s differs from first response %d %s", replay.Code, replay.Body, first.Code, first.Body)
+	}
+	if replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("replayed response must be marked")
+	}
+	for _, name := range ReplayedHeaders {
+		if replay.Header().Get(name) == "" || replay.Header().Get(name) != first.Header().Get(name) {
+			t.Errorf("expected %s %q to be replayed, got %q", name, first.Header().Get(name), replay.Header().Get(name))
+		}
+	}
+
+	conflict := do(router, "/reservations", "reader", "k1", `{"bookUid":"2"}`)
+	if conflict.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reused key with other payload: got %d", conflict.Code)
+	}
+
+	do(router, "/reservations", "other reader", "k1", `{"bookUid":"1"}`)
+	do(router, "/reservations", "reader", "", `{"bookUid":"1"}`)
+	if calls != 3 {
+		t.Errorf("keys are per user and optional, handler ran %d times", calls)
+	}
+}
+
+func TestMiddlewareDoesNotStoreServerErrors(t *testing.T) {
+
+	calls := 0
+	router := newRouter(&calls)
+
+	for i := 1; i <= 2; i++ {
+		w := do(router, "/failing", "reader", "k1", "")
+		if w.Body.String() != `{"call":`+strconv.Itoa(i)+`}` {
+			t.Errorf("attempt %d must reach the handler, got %s", i, w.Body)
+		}
+	}
+}
+
+func TestMiddlewareKeepsKeysAfterChanges(t *testing.T) {
+
+	calls := 0
+	router := newRouter(&calls)
+
+	first := do(router, "/failing-after-change", "reader", "k1", "")
+	replay := do(router, "/failing-after-change", "reader", "k1", "")
+
+	if calls != 1 || replay.Code != http.StatusServiceUnavailable || replay.Body.String() != first.Body.String() {
+		t.Errorf("expected the failure to be replayed without running the request again, got %d %s after %d calls",
+			replay.Code, replay.Body, calls)
+	}
+}
+
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+	now := time.Now()
+
+	record := Record{Fingerprint: "a", ExpiresAt: now.Add(time.Hour)}
+	if _, reserved, err := store.Reserve(ctx, "k1", record); err != nil || !reserved {
+		t.Fatalf("expected the key to be reserved, got %v (%v)", reserved, err)
+	}
+
+	existing, reserved, err := store.Reserve(ctx, "k1", Record{Fingerprint: "b", ExpiresAt: now.Add(time.Hour)})
+	if err != nil || reserved || existing.Fingerprint != "a" || existing.Status != 0 {
+		t.Errorf("expected the request in progress, got %+v %v (%v)", existing, reserved, err)
+	}
+
+	record.Status, record.ContentType, record.Body = http.StatusCreated, "application/json", []byte(`{"ok":true}`)
+	record.Header = http.Header{"Etag": {`"1"`}}
+	if err = store.Save(ctx, "k1", record); err != nil {
+		t.Fatal(err)
+	}
+
+	existing, reserved, err = store.Reserve(ctx, "k1", Record{Fingerprint: "a", ExpiresAt: now.Add(time.Hour)})
+	if err != nil || reserved || existing.Status != http.StatusCreated || existing.ContentType != "application/json" ||
+		existing.Header.Get("ETag") != `"1"` || string(existing.Body) != `{"ok":true}` {
+		t.Errorf("expected the stored response, got %+v %v (%v)", existing, reserved, err)
+	}
+
+	if err = store.Delete(ctx, "k1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, reserved, err = store.Reserve(ctx, "k1", record); err != nil || !reserved {
+		t.Errorf("expected a deleted key to be reserved again, got %v (%v)", reserved, err)
+	}
+
+	// expired records are taken over
+	store.Save(ctx, "k2", Record{Fingerprint: "a", Status: http.StatusOK, ExpiresAt: now.Add(-time.Second)})
+	if _, reserved, err = store.Reserve(ctx, "k2", Record{Fingerprint: "b", ExpiresAt: now.Add(time.Hour)}); err != nil || !reserved {
+		t.Errorf("expected an expired key to be reserved again, got %v (%v)", reserved, err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestPgStore(t *testing.T) {
+	connString := pgtest.Open(t, "TEST_POSTGRES_GATEWAY", migrations.Schema)
+
+	pool, err := pgxpool.New(context.Background(), connString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	pgtest.Exec(t, pool, `TRUNCATE idempotency_record`)
+	pgtest.Exec(t, pool, `INSERT INTO idempotency_record (key, fingerprint, status, expires_at) VALUES ('k2', 'a', 200, $1)`,
+		time.Now().UTC().Add(-time.Second))
+
+	testStore(t, NewPgStore(pool))
+}
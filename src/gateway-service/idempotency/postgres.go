@@ -0,0 +1,125 @@
+package idempotency
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type pgStore struct {
+	db *pgxpool.Pool
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// NewPgStore keeps the records in the gateway database, so they survive
+// restarts and are shared by every replica of the gateway.
+func NewPgStore(db *pgxpool.Pool) Store {
+	return &pgStore{db: db}
+}
+
+// Reserve inserts the record or takes over an expired one. When an unexpired
+// record is deleted between the insert and the select, the insert is tried
+// again.
+func (s *pgStore) Reserve(ctx context.Context, key string, record Record) (Record, bool, error) {
+	now := time.Now().UTC()
+
+	if err := s.sweep(ctx, now); err != nil {
+		return Record{}, false, err
+	}
+
+	insert := `INSERT INTO idempotency_record (key, fingerprint, expires_at)
+	VALUES (@key, @fingerprint, @expires_at)
+	ON CONFLICT (key) DO UPDATE SET fingerprint = EXCLUDED.fingerprint, status = 0,
+		content_type = '', header = '{}', body = NULL, expires_at = EXCLUDED.expires_at
+	WHERE idempotency_record.expires_at <= @now
+	RETURNING key`
+	args := pgx.NamedArgs{
+		"key":         key,
+		"fingerprint": record.Fingerprint,
+		"expires_at":  record.ExpiresAt.UTC(),
+		"now":         now,
+	}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		err := s.db.QueryRow(ctx, insert, args).Scan(&key)
+		if err == nil {
+			return record, true, nil
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return Record{}, false, fmt.Errorf("unable to insert row: %w", err)
+		}
+
+		existing := Record{}
+		err = s.db.QueryRow(ctx, `SELECT fingerprint, status, content_type, header, body, expires_at
+		FROM idempotency_record WHERE key = @key`, pgx.NamedArgs{"key": key}).
+			Scan(&existing.Fingerprint, &existing.Status, &existing.ContentType, &existing.Header, &existing.Body, &existing.ExpiresAt)
+		if err == nil {
+			return existing, false, nil
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return Record{}, false, fmt.Errorf("unable to query: %w", err)
+		}
+	}
+
+	return Record{}, false, fmt.Errorf("unable to reserve idempotency key")
+}
+
+// sweep deletes expired records at most once a minute.
+func (s *pgStore) sweep(ctx context.Context, now time.Time) error {
+	s.mu.Lock()
+	if now.Sub(s.lastSweep) < time.Minute {
+		s.mu.Unlock()
+		return nil
+	}
+	s.lastSweep = now
+	s.mu.Unlock()
+
+	_, err := s.db.Exec(ctx, `DELETE FROM idempotency_record WHERE expires_at <= @now`, pgx.NamedArgs{"now": now})
+	if err != nil {
+		return fmt.Errorf("unable to delete expired rows: %w", err)
+	}
+	return nil
+}
+
+func (s *pgStore) Save(ctx context.Context, key string, record Record) error {
+
+	header, err := json.Marshal(record.Header)
+	if err != nil {
+		return fmt.Errorf("unable to marshal header: %w", err)
+	}
+
+	query := `UPDATE idempotency_record SET fingerprint = @fingerprint, status = @status,
+		content_type = @content_type, header = @header, body = @body, expires_at = @expires_at
+	WHERE key = @key`
+
+	_, err = s.db.Exec(ctx, query, pgx.NamedArgs{
+		"key":          key,
+		"fingerprint":  record.Fingerprint,
+		"status":       record.Status,
+		"content_type": record.ContentType,
+		"header":       string(header),
+		"body":         record.Body,
+		"expires_at":   record.ExpiresAt.UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to update row: %w", err)
+	}
+	return nil
+}
+
+func (s *pgStore) Delete(ctx context.Context, key string) error {
+
+	_, err := s.db.Exec(ctx, `DELETE FROM idempotency_record WHERE key = @key`, pgx.NamedArgs{"key": key})
+	if err != nil {
+		return fmt.Errorf("unable to delete row: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package limits
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Tier limits the total number of concurrent loans of readers whose rating
+// is at least MinStars.
+type Tier struct {
+	Name     string `json:"name"`
+	MinStars int    `json:"minStars"`
+	MaxLoans int    `json:"maxLoans"`
+}
+
+// Config holds every borrowing limit. Libraries, Genres and MaterialTypes map
+// a library UID, genre or material type to the maximum number of concurrent
+// loans a reader may hold in it. A zero limit means unlimited.
+type Config struct {
+	Tiers          []Tier         `json:"tiers"`
+	LibraryDefault int            `json:"libraryDefault"`
+	Libraries      map[string]int `json:"libraries"`
+	Genres         map[string]int `json:"genres"`
+	MaterialTypes  map[string]int `json:"materialTypes"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Tiers: []Tier{
+			{Name: "novice", MinStars: 0, MaxLoans: 1},
+			{Name: "regular", MinStars: 20, MaxLoans: 3},
+			{Name: "trusted", MinStars: 50, MaxLoans: 5},
+			{Name: "honored", MinStars: 80, MaxLoans: 10},
+		},
+		LibraryDefault: 5,
+		Libraries:      map[string]int{},
+		Genres:         map[string]int{},
+		MaterialTypes:  map[string]int{},
+	}
+}
+
+// LoadConfig reads the limits from a JSON file. An empty path returns the
+// default limits.
+func LoadConfig(path string) (Config, error) {
+	if path == "" {
+		return DefaultConfig(), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("unable to read limits config: %w", err)
+	}
+
+	var config Config
+	if err = json.Unmarshal(data, &config); err != nil {
+		return Config{}, fmt.Errorf("unable to parse limits config: %w", err)
+	}
+
+	return config, nil
+}
+
+// Item describes a book that is borrowed or about to be borrowed.
+type Item struct {
+	LibraryUid   string
+	Genre        string
+	MaterialType string
+}
+
+type Request struct {
+	Stars int
+	Loans []Item
+	Item  Item
+}
+
+type Decision struct {
+	Allowed bool
+	Reason  string
+}
+
+type Service struct {
+	tiers  []Tier
+	config Config
+}
+
+func NewService(config Config) *Service {
+	tiers := append([]Tier(nil), config.Tiers...)
+	sort.Slice(tiers, func(i, j int) bool {
+		return tiers[i].MinStars > tiers[j].MinStars
+	})
+
+	return &Service{tiers: tiers, config: config}
+}
+
+// Check evaluates every limit against the reader's current loans and returns
+// the first one that the new loan would exceed.
+func (s *Service) Check(req Request) Decision {
+	tier, ok := s.tier(req.Stars)
+	if !ok {
+		return deny("rating of %d stars is too low to take books", req.Stars)
+	}
+	if len(req.Loans) >= tier.MaxLoans {
+		return deny("limit of %d concurrent loans for %s readers reached", tier.MaxLoans, tier.Name)
+	}
+
+	libraryLimit, ok := s.config.Libraries[req.Item.LibraryUid]
+	if !ok {
+		libraryLimit = s.config.LibraryDefault
+	}
+	if exceeded(libraryLimit, count(req.Loans, func(loan Item) bool { return loan.LibraryUid == req.Item.LibraryUid })) {
+		return deny("limit of %d concurrent loans at this branch reached", libraryLimit)
+	}
+
+	genreLimit := s.config.Genres[req.Item.Genre]
+	if exceeded(genreLimit, count(req.Loans, func(loan Item) bool { return loan.Genre == req.Item.Genre })) {
+		return deny("limit of %d concurrent loans in genre %q reached", genreLimit, req.Item.Genre)
+	}
+
+	typeLimit := s.config.MaterialTypes[req.Item.MaterialType]
+	if exceeded(typeLimit, count(req.Loans, func(loan Item) bool { return loan.MaterialType == req.Item.MaterialType })) {
+		return deny("limit of %d concurrent loans of type %s reached", typeLimit, req.Item.MaterialType)
+	}
+
+	return Decision{Allowed: true}
+}
+
+func (s *Service) tier(stars int) (Tier, bool) {
+	for _, tier := range s.tiers {
+		if stars >= tier.MinStars {
+			return tier, true
+		}
+	}
+	return Tier{}, false
+}
+
+func count(loans []Item, match func(Item) bool) int {
+	n := 0
+	for _, loan := range loans {
+		if match(loan) {
+			n++
+		}
+	}
+	return n
+}
+
+func exceeded(limit int, current int) bool {
+	return limit > 0 && current >= limit
+}
+
+func deny(format string, args ...any) Decision {
+	return Decision{Allowed: false, Reason: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,42 @@
+package limits
+
+import (
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+
+	service := NewService(Config{
+		Tiers: []Tier{
+			{Name: "regular", MinStars: 20, MaxLoans: 3},
+			{Name: "novice", MinStars: 5, MaxLoans: 1},
+		},
+		LibraryDefault: 2,
+		Libraries:      map[string]int{"small": 1},
+		Genres:         map[string]int{"poetry": 1},
+		MaterialTypes:  map[string]int{"AUDIOBOOK": 1},
+	})
+
+	novel := Item{LibraryUid: "central", Genre: "novel", MaterialType: "BOOK"}
+
+	tests := []struct {
+		name   string
+		req    Request
+		reason string
+	}{
+		{"allowed", Request{Stars: 20, Item: novel}, ""},
+		{"rating too low", Request{Stars: 1, Item: novel}, "rating of 1 stars is too low to take books"},
+		{"tier", Request{Stars: 10, Loans: []Item{{LibraryUid: "other"}}, Item: novel}, "limit of 1 concurrent loans for novice readers reached"},
+		{"library default", Request{Stars: 20, Loans: []Item{novel, novel}, Item: novel}, "limit of 2 concurrent loans at this branch reached"},
+		{"library override", Request{Stars: 20, Loans: []Item{{LibraryUid: "small"}}, Item: Item{LibraryUid: "small"}}, "limit of 1 concurrent loans at this branch reached"},
+		{"genre", Request{Stars: 20, Loans: []Item{{Genre: "poetry"}}, Item: Item{Genre: "poetry"}}, `limit of 1 concurrent loans in genre "poetry" reached`},
+		{"material type", Request{Stars: 20, Loans: []Item{{MaterialType: "AUDIOBOOK"}}, Item: Item{MaterialType: "AUDIOBOOK"}}, "limit of 1 concurrent loans of type AUDIOBOOK reached"},
+	}
+
+	for _, tt := range tests {
+		decision := service.Check(tt.req)
+		if decision.Allowed != (tt.reason == "") || decision.Reason != tt.reason {
+			t.Errorf("%s: got %+v, want reason %q", tt.name, decision, tt.reason)
+		}
+	}
+}
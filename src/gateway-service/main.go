@@ -1,32 +1,173 @@
 package main
 
 import (
-	"library-system/src/gateway-service/handler"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/gin-contrib/cors"
-	"github.com/gin-gonic/gin"
+	"library-system/src/gateway-service/cache"
+	"library-system/src/gateway-service/downstream"
+	"library-system/src/gateway-service/handler"
+	"library-system/src/gateway-service/idempotency"
+	"library-system/src/gateway-service/limits"
+	"library-system/src/gateway-service/migrations"
+	"library-system/src/gateway-service/openapi"
+	"library-system/src/gateway-service/rating"
+	"library-system/src/pkg/health"
+	"library-system/src/pkg/logging"
+	"library-system/src/pkg/metrics"
+	"library-system/src/pkg/migrate"
+	"library-system/src/pkg/server"
+	"library-system/src/pkg/tracing"
 )
 
 func main() {
+	logging.Setup("gateway-service")
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "gateway-service")
+	if err != nil {
+		slog.Error("tracing init failed", "error", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
+	postgresURL := fmt.Sprintf("host=%s port=%d user=%s dbname=%s password=%s",
+		"postgres", 5432, "program", "gateway", "test")
+	psqlDB, err := tracing.NewPool(context.Background(), postgresURL)
+	if err != nil {
+		slog.Error("postgresql init failed", "error", err)
+		os.Exit(1)
+	}
+	defer psqlDB.Close()
+
+	if err = health.WaitFor(context.Background(), "postgres", psqlDB.Ping); err != nil {
+		slog.Error("postgresql init failed", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("connected to PostgreSQL")
+
+	migrator, err := migrate.New(psqlDB, migrations.Schema, nil)
+	if err != nil {
+		slog.Error("migrations init failed", "error", err)
+		os.Exit(1)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err = migrator.Command(context.Background(), os.Args[2:], os.Stdout); err != nil {
+			slog.Error("migrate failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err = migrator.OnStart(context.Background()); err != nil {
+		slog.Error("migrations failed", "error", err)
+		os.Exit(1)
+	}
+
+	metrics.RegisterPool(psqlDB)
+
+	limitsConfig, err := limits.LoadConfig(os.Getenv("LIMITS_CONFIG"))
+	if err != nil {
+		slog.Error("limits init failed", "error", err)
+		os.Exit(1)
+	}
+
+	specPath := os.Getenv("OPENAPI_SPEC")
+	if specPath == "" {
+		specPath = "tests/library_system.yml"
+	}
+
+	spec, err := openapi.Load(specPath)
+	if err != nil {
+		slog.Error("openapi init failed", "error", err)
+		os.Exit(1)
+	}
+
+	cacheTTL, err := time.ParseDuration(os.Getenv("CACHE_TTL"))
+	if err != nil {
+		cacheTTL = 10 * time.Minute
+	}
+
+	cacheBackend := cache.NewMemory(10000)
+	if size, err := strconv.Atoi(os.Getenv("CACHE_SIZE")); err == nil {
+		cacheBackend = cache.NewMemory(size)
+	}
+	if addr := os.Getenv("CACHE_REDIS_ADDR"); addr != "" {
+		cacheBackend = cache.NewRedis(addr, 16)
+	}
+
+	// rating-service has a fallback and notifications are best effort, so
+	// the gateway stays ready without them
+	optional := map[string]bool{"rating-service": true, "notification-service": true}
+
+	checker := health.New(2 * time.Second)
+	checker.Add("postgres", psqlDB.Ping)
+	checker.Add("migrations", migrator.Check)
+
+	probeClient := &http.Client{}
+
+	services := handler.ServicesFromEnv()
+
+	clients := downstream.NewClients(downstream.DefaultConfig())
+	for name, serviceURL := range services.ByName() {
+		// e.g. RATING_SERVICE_READ_TIMEOUT=2s
+		prefix := strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		if err = clients.Register(name, serviceURL, downstream.ConfigFromEnv(prefix, downstream.DefaultConfig())); err != nil {
+			slog.Error("downstream init failed", "service", name, "error", err)
+			os.Exit(1)
+		}
+
+		check := health.HTTP(probeClient, serviceURL+"/manage/ready")
+		if optional[name] {
+			checker.AddOptional(name, check)
+		} else {
+			checker.Add(name, check)
+		}
+	}
+
+	ratingPolicy := rating.DefaultPolicy()
+	if mode := os.Getenv("RATING_FALLBACK"); mode != "" {
+		ratingPolicy.Mode = rating.Mode(strings.ToUpper(mode))
+	}
+	if stars, err := strconv.Atoi(os.Getenv("RATING_DEFAULT_STARS")); err == nil {
+		ratingPolicy.DefaultStars = stars
+	}
+
+	ratingCacheTTL, err := time.ParseDuration(os.Getenv("RATING_CACHE_TTL"))
+	if err != nil {
+		ratingCacheTTL = 24 * time.Hour
+	}
+
+	ratingReplayInterval, err := time.ParseDuration(os.Getenv("RATING_REPLAY_INTERVAL"))
+	if err != nil {
+		ratingReplayInterval = 30 * time.Second
+	}
 
-	handler := handler.NewHandler()
+	ratings := rating.NewService(clients, services.Rating, ratingPolicy, cache.New(cacheBackend, ratingCacheTTL), rating.NewPgQueue(psqlDB))
 
-	router := gin.Default()
+	handler := handler.NewHandler(services, limits.NewService(limitsConfig), cache.New(cacheBackend, cacheTTL), clients, ratings, os.Getenv("CHANGE_EVENT_TOKEN"))
 
-	router.Use(cors.Default())
+	idempotencyTTL, err := time.ParseDuration(os.Getenv("IDEMPOTENCY_TTL"))
+	if err != nil {
+		idempotencyTTL = 24 * time.Hour
+	}
 
-	// общие методы, для пользователя
-	router.GET("/api/v1/libraries", handler.GetLibrariesByCity)               // получить список библиотек
-	router.GET("/api/v1/libraries/:uid/books/", handler.GetBooksByLibraryUid) // получить список книг выбранной библиотеки
-	router.POST("/api/v1/reservations", handler.CreateReservation)            // забронировать книгу в библиотеке
+	router := handler.Router(spec, idempotency.NewPgStore(psqlDB), idempotencyTTL)
 
-	// приватные методы, для библиотекаря
-	router.GET("/api/v1/reservations", handler.GetReservations)         // получить список забронированных книг пользователя
-	router.POST("/api/v1/reservations/:uid/return", handler.ReturnBook) // получить книгу от пользователя, оценив ее состояние
-	router.GET("/api/v1/rating/", handler.GetRating)                    // получить рейтинг пользователя
+	router.GET("/manage/live", checker.Live)         // процесс отвечает на запросы
+	router.GET("/manage/ready", checker.Ready)       // готовность зависимых сервисов
+	router.GET("/manage/metrics", metrics.Handler()) // метрики для Prometheus
 
-	// сервисные методы
-	router.GET("/manage/health", handler.GetHealth)
+	srv := server.New(server.ConfigFromEnv(":8080"), router, checker)
+	srv.Go(func(ctx context.Context) { ratings.Run(ctx, ratingReplayInterval) })
 
-	router.Run()
+	if err = srv.Run(); err != nil {
+		slog.Error("server stopped with error", "error", err)
+	}
 }
@@ -0,0 +1,13 @@
+-- the first response to every request with an Idempotency-Key, shared by all
+-- replicas of the gateway; a record without a status is still in progress
+CREATE TABLE idempotency_record
+(
+    key          TEXT PRIMARY KEY,
+    fingerprint  VARCHAR(64) NOT NULL,
+    status       INT         NOT NULL DEFAULT 0,
+    content_type TEXT        NOT NULL DEFAULT '',
+    body         BYTEA,
+    expires_at   TIMESTAMP   NOT NULL
+);
+
+CREATE INDEX idempotency_record_expires_idx ON idempotency_record (expires_at);
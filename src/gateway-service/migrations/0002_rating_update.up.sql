@@ -0,0 +1,13 @@
+-- rating updates rating-service has not acknowledged yet, replayed in order
+-- of id; attempts counts the sends started, so an update with attempts may
+-- have been applied already
+CREATE TABLE rating_update
+(
+    id              BIGSERIAL PRIMARY KEY,
+    username        VARCHAR(80) NOT NULL,
+    reservation_uid TEXT        NOT NULL,
+    delta           INT         NOT NULL,
+    queued_at       TIMESTAMP   NOT NULL,
+    attempts        INT         NOT NULL DEFAULT 0,
+    last_error      TEXT        NOT NULL DEFAULT ''
+);
@@ -0,0 +1,2 @@
+-- the headers replayed with a stored response besides its Content-Type
+ALTER TABLE idempotency_record ADD COLUMN header JSONB NOT NULL DEFAULT '{}';
@@ -0,0 +1,7 @@
+// Package migrations holds the schema migrations of the gateway database.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var Schema embed.FS
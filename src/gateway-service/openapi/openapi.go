@@ -0,0 +1,210 @@
+// Package openapi checks requests and responses of the gateway against its
+// OpenAPI specification, tests/library_system.yml.
+package openapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"library-system/src/pkg/apierror"
+	"library-system/src/pkg/etag"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	openapi3.DefineStringFormat("uuid", openapi3.FormatOfStringForUUIDOfRFC4122)
+}
+
+type Spec struct {
+	doc    *openapi3.T
+	router routers.Router
+}
+
+// Load reads and validates the specification at path.
+func Load(path string) (*Spec, error) {
+	loader := openapi3.NewLoader()
+
+	doc, err := loader.LoadFromFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load %s: %w", path, err)
+	}
+
+	if err = doc.Validate(loader.Context); err != nil {
+		return nil, fmt.Errorf("invalid specification %s: %w", path, err)
+	}
+
+	// match requests whatever address the gateway is reached at
+	doc.Servers = nil
+
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Spec{doc: doc, router: router}, nil
+}
+
+// Operations lists the operations of the specification as "METHOD path",
+// e.g. "GET /api/v1/libraries/{libraryUid}/books".
+func (s *Spec) Operations() []string {
+	var operations []string
+	for path, item := range s.doc.Paths.Map() {
+		for method := range item.Operations() {
+			operations = append(operations, method+" "+path)
+		}
+	}
+	sort.Strings(operations)
+
+	return operations
+}
+
+// Operation returns the operation req is sent to, or false if the
+// specification does not describe it.
+func (s *Spec) Operation(req *http.Request) (string, bool) {
+	route, _, err := s.router.FindRoute(req)
+	if err != nil {
+		return "", false
+	}
+
+	return route.Method + " " + route.Path, true
+}
+
+// Middleware rejects requests to the operations of the specification that do
+// not conform to it with 400 and the list of invalid fields, except for a
+// missing If-Match, which is answered with 428 like the services do. Requests
+// to other routes pass unchecked.
+func (s *Spec) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route, params, err := s.router.FindRoute(c.Request)
+		if err != nil {
+			c.Next()
+			return
+		}
+
+		err = openapi3filter.ValidateRequest(c.Request.Context(), &openapi3filter.RequestValidationInput{
+			Request:    c.Request,
+			PathParams: params,
+			Route:      route,
+			Options: &openapi3filter.Options{
+				MultiError:         true,
+				AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+			},
+		})
+		if err != nil && missing(err, etag.IfMatchHeader) {
+			apierror.Respond(c, apierror.PreconditionRequired("%s must be given with the ETag of the record", etag.IfMatchHeader))
+			c.Abort()
+			return
+		}
+		if err != nil {
+			apierror.Respond(c, &apierror.Error{
+				Code:    apierror.CodeBadRequest,
+				Message: "request does not conform to the API specification",
+				Errors:  fieldErrors(err),
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// ValidateResponse checks a response to req against the specification,
+// including that its status is documented.
+func (s *Spec) ValidateResponse(ctx context.Context, req *http.Request, status int, header http.Header, body []byte) error {
+	route, params, err := s.router.FindRoute(req)
+	if err != nil {
+		return fmt.Errorf("%s %s is not described: %w", req.Method, req.URL.Path, err)
+	}
+
+	options := &openapi3filter.Options{
+		IncludeResponseStatus: true,
+		MultiError:            true,
+		AuthenticationFunc:    openapi3filter.NoopAuthenticationFunc,
+	}
+
+	return openapi3filter.ValidateResponse(ctx, &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: &openapi3filter.RequestValidationInput{
+			Request:    req,
+			PathParams: params,
+			Route:      route,
+			Options:    options,
+		},
+		Status:  status,
+		Header:  header,
+		Body:    io.NopCloser(bytes.NewReader(body)),
+		Options: options,
+	})
+}
+
+// missing reports whether the required header is missing from a request the
+// validation of which failed with err.
+func missing(err error, header string) bool {
+	var errs openapi3.MultiError
+	if errors.As(err, &errs) {
+		for _, err := range errs {
+			if missing(err, header) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var requestErr *openapi3filter.RequestError
+	return errors.As(err, &requestErr) && requestErr.Parameter != nil && requestErr.Parameter.In == openapi3.ParameterInHeader &&
+		http.CanonicalHeaderKey(requestErr.Parameter.Name) == http.CanonicalHeaderKey(header) &&
+		errors.Is(requestErr.Err, openapi3filter.ErrInvalidRequired)
+}
+
+// fieldErrors flattens the errors of a request validation.
+func fieldErrors(err error) []apierror.FieldError {
+	switch err := err.(type) {
+	case openapi3.MultiError:
+		var fields []apierror.FieldError
+		for _, err := range err {
+			fields = append(fields, fieldErrors(err)...)
+		}
+		return fields
+
+	case *openapi3filter.RequestError:
+		if err.Parameter != nil {
+			return []apierror.FieldError{{Field: err.Parameter.Name, Error: reason(err)}}
+		}
+		if err.Err != nil {
+			return fieldErrors(err.Err)
+		}
+		return []apierror.FieldError{{Field: "body", Error: err.Reason}}
+
+	case *openapi3.SchemaError:
+		field := strings.Join(err.JSONPointer(), ".")
+		if field == "" {
+			field = "body"
+		}
+		return []apierror.FieldError{{Field: field, Error: err.Reason}}
+	}
+
+	return []apierror.FieldError{{Field: "request", Error: err.Error()}}
+}
+
+// reason describes the error of a parameter without the schema.
+func reason(err *openapi3filter.RequestError) string {
+	var schemaErr *openapi3.SchemaError
+	if errors.As(err.Err, &schemaErr) {
+		return schemaErr.Reason
+	}
+	if err.Err != nil {
+		return err.Err.Error()
+	}
+	return err.Reason
+}
@@ -0,0 +1,134 @@
+package openapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"library-system/src/pkg/apierror"
+
+	"github.com/gin-gonic/gin"
+)
+
+const specPath = "../../../tests/library_system.yml"
+
+func TestLoad(t *testing.T) {
+	spec, err := Load(specPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"GET /api/v1/libraries",
+		"GET /api/v1/libraries/{libraryUid}/books",
+		"GET /api/v1/rating",
+		"GET /api/v1/reservations",
+		"GET /api/v1/reservations/info/{reservationUid}",
+		"POST /api/v1/reservations",
+		"POST /api/v1/reservations/{reservationUid}/return",
+	}
+	if operations := spec.Operations(); strings.Join(operations, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, operations)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/libraries/83575e12-7ce0-48ee-9931-51919ff3c9ee/books", nil)
+	if operation, ok := spec.Operation(req); !ok || operation != expected[1] {
+		t.Errorf("unexpected operation %q", operation)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	spec, err := Load(specPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.Use(spec.Middleware())
+	router.POST("/api/v1/reservations", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/api/v1/libraries", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/api/v1/fines", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.POST("/api/v1/reservations/:uid/return", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header string
+		body   string
+		status int
+		fields []string
+	}{
+		{"valid reservation", http.MethodPost, "/api/v1/reservations", "Test Max",
+			`{"bookUid":"f7cdc58f-2caf-4b15-9727-f89dcc629b27","libraryUid":"83575e12-7ce0-48ee-9931-51919ff3c9ee","tillDate":"2021-10-11"}`, http.StatusOK, nil},
+		{"invalid fields", http.MethodPost, "/api/v1/reservations", "Test Max",
+			`{"bookUid":"book","libraryUid":"83575e12-7ce0-48ee-9931-51919ff3c9ee","tillDate":"11.10.2021"}`, http.StatusBadRequest, []string{"bookUid", "tillDate"}},
+		{"missing field", http.MethodPost, "/api/v1/reservations", "Test Max",
+			`{"bookUid":"f7cdc58f-2caf-4b15-9727-f89dcc629b27","tillDate":"2021-10-11"}`, http.StatusBadRequest, []string{"libraryUid"}},
+		{"missing header", http.MethodPost, "/api/v1/reservations", "",
+			`{"bookUid":"f7cdc58f-2caf-4b15-9727-f89dcc629b27","libraryUid":"83575e12-7ce0-48ee-9931-51919ff3c9ee","tillDate":"2021-10-11"}`, http.StatusBadRequest, []string{"X-User-Name"}},
+		{"missing query parameter", http.MethodGet, "/api/v1/libraries?page=1", "", "", http.StatusBadRequest, []string{"city"}},
+		{"invalid query parameter", http.MethodGet, "/api/v1/libraries?city=Москва&size=1000", "", "", http.StatusBadRequest, []string{"size"}},
+		{"missing If-Match", http.MethodPost, "/api/v1/reservations/3c4d5e6f-0000-4000-8000-000000000001/return", "Test Max",
+			`{"condition":"EXCELLENT","date":"2021-10-11"}`, http.StatusPreconditionRequired, nil},
+		{"route not in the specification", http.MethodGet, "/api/v1/fines?anything=1", "", "", http.StatusOK, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			if tt.header != "" {
+				req.Header.Set("X-User-Name", tt.header)
+			}
+
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.status {
+				t.Fatalf("expected %d, got %d %s", tt.status, recorder.Code, recorder.Body.String())
+			}
+			if tt.fields == nil {
+				return
+			}
+
+			var response apierror.Response
+			json.Unmarshal(recorder.Body.Bytes(), &response)
+
+			fields := make([]string, len(response.Errors))
+			for i, fieldErr := range response.Errors {
+				fields[i] = fieldErr.Field
+			}
+			if response.Code != apierror.CodeBadRequest || strings.Join(fields, ",") != strings.Join(tt.fields, ",") {
+				t.Errorf("expected errors for %v, got %s", tt.fields, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestValidateResponse(t *testing.T) {
+	spec, err := Load(specPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/rating", nil)
+	header := http.Header{"Content-Type": {"application/json"}}
+
+	if err = spec.ValidateResponse(context.Background(), req, http.StatusOK, header, []byte(`{"stars":75}`)); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err = spec.ValidateResponse(context.Background(), req, http.StatusOK, header, []byte(`{"stars":175}`)); err == nil {
+		t.Errorf("expected an error for stars out of range")
+	}
+	if err = spec.ValidateResponse(context.Background(), req, http.StatusTeapot, header, []byte(`{}`)); err == nil {
+		t.Errorf("expected an error for an undocumented status")
+	}
+}
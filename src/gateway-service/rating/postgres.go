@@ -0,0 +1,79 @@
+package rating
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type pgQueue struct {
+	db *pgxpool.Pool
+}
+
+// NewPgQueue keeps the updates in the gateway database, so they are
+// replayed after a restart.
+func NewPgQueue(db *pgxpool.Pool) Queue {
+	return &pgQueue{db: db}
+}
+
+func (q *pgQueue) Add(ctx context.Context, update Update) (Update, error) {
+
+	query := `INSERT INTO rating_update (username, reservation_uid, delta, queued_at)
+	VALUES (@username, @reservation_uid, @delta, @queued_at) RETURNING id`
+
+	err := q.db.QueryRow(ctx, query, pgx.NamedArgs{
+		"username":        update.Username,
+		"reservation_uid": update.ReservationUid,
+		"delta":           update.Delta,
+		"queued_at":       update.QueuedAt.UTC(),
+	}).Scan(&update.Id)
+	if err != nil {
+		return Update{}, fmt.Errorf("unable to insert row: %w", err)
+	}
+
+	return update, nil
+}
+
+func (q *pgQueue) Pending(ctx context.Context) ([]Update, error) {
+
+	query := `SELECT id, username, reservation_uid, delta, queued_at, attempts, last_error
+	FROM rating_update ORDER BY id`
+
+	rows, err := q.db.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query: %w", err)
+	}
+
+	updates, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Update, error) {
+		var update Update
+		err := row.Scan(&update.Id, &update.Username, &update.ReservationUid, &update.Delta,
+			&update.QueuedAt, &update.Attempts, &update.LastError)
+		return update, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to collect rows: %w", err)
+	}
+
+	return updates, nil
+}
+
+func (q *pgQueue) Attempt(ctx context.Context, id int64) error {
+	return q.exec(ctx, `UPDATE rating_update SET attempts = attempts + 1 WHERE id = @id`, pgx.NamedArgs{"id": id})
+}
+
+func (q *pgQueue) Fail(ctx context.Context, id int64, reason string) error {
+	return q.exec(ctx, `UPDATE rating_update SET last_error = @reason WHERE id = @id`, pgx.NamedArgs{"id": id, "reason": reason})
+}
+
+func (q *pgQueue) Remove(ctx context.Context, id int64) error {
+	return q.exec(ctx, `DELETE FROM rating_update WHERE id = @id`, pgx.NamedArgs{"id": id})
+}
+
+func (q *pgQueue) exec(ctx context.Context, query string, args pgx.NamedArgs) error {
+	if _, err := q.db.Exec(ctx, query, args); err != nil {
+		return fmt.Errorf("unable to update rating_update: %w", err)
+	}
+	return nil
+}
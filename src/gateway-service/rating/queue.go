@@ -0,0 +1,87 @@
+package rating
+
+import (
+	"context"
+	"sync"
+)
+
+// Queue keeps the updates that rating-service has not acknowledged yet.
+type Queue interface {
+	// Add queues update and returns it with its Id.
+	Add(ctx context.Context, update Update) (Update, error)
+	// Pending returns the queued updates, oldest first.
+	Pending(ctx context.Context) ([]Update, error)
+	// Attempt counts an attempt to send the update. It is called before the
+	// update is sent, so an update without attempts has never reached
+	// rating-service.
+	Attempt(ctx context.Context, id int64) error
+	// Fail records why the last attempt to send the update failed.
+	Fail(ctx context.Context, id int64, reason string) error
+	// Remove drops an update that rating-service has applied.
+	Remove(ctx context.Context, id int64) error
+}
+
+type memoryQueue struct {
+	mu      sync.Mutex
+	updates []Update
+	lastId  int64
+}
+
+// NewMemoryQueue returns a Queue that is lost on restart, for tests and
+// local development.
+func NewMemoryQueue() Queue {
+	return &memoryQueue{}
+}
+
+func (q *memoryQueue) Add(ctx context.Context, update Update) (Update, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.lastId++
+	update.Id = q.lastId
+	q.updates = append(q.updates, update)
+
+	return update, nil
+}
+
+func (q *memoryQueue) Pending(ctx context.Context) ([]Update, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return append([]Update{}, q.updates...), nil
+}
+
+func (q *memoryQueue) Attempt(ctx context.Context, id int64) error {
+	q.update(id, func(update *Update) { update.Attempts++ })
+	return nil
+}
+
+func (q *memoryQueue) Fail(ctx context.Context, id int64, reason string) error {
+	q.update(id, func(update *Update) { update.LastError = reason })
+	return nil
+}
+
+func (q *memoryQueue) Remove(ctx context.Context, id int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i := range q.updates {
+		if q.updates[i].Id == id {
+			q.updates = append(q.updates[:i], q.updates[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (q *memoryQueue) update(id int64, change func(update *Update)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i := range q.updates {
+		if q.updates[i].Id == id {
+			change(&q.updates[i])
+			break
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package rating
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"library-system/src/gateway-service/migrations"
+	"library-system/src/pkg/pgtest"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func testQueue(t *testing.T, queue Queue) {
+	ctx := context.Background()
+	queuedAt := time.Date(2021, 10, 11, 15, 30, 0, 0, time.UTC)
+
+	first, err := queue.Add(ctx, Update{Username: "Test Max", ReservationUid: "reservation-1", Delta: -10, QueuedAt: queuedAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := queue.Add(ctx, Update{Username: "Test Min", ReservationUid: "reservation-2", Delta: 1, QueuedAt: queuedAt})
+	if err != nil || second.Id <= first.Id {
+		t.Fatalf("expected increasing ids, got %d and %d (%v)", first.Id, second.Id, err)
+	}
+
+	queue.Attempt(ctx, first.Id)
+	queue.Fail(ctx, first.Id, "rating-service is down")
+
+	updates, err := queue.Pending(ctx)
+	if err != nil || len(updates) != 2 {
+		t.Fatalf("expected 2 updates, got %+v (%v)", updates, err)
+	}
+	if updates[0].Id != first.Id || updates[0].Username != "Test Max" || updates[0].Delta != -10 || !updates[0].QueuedAt.Equal(queuedAt) ||
+		updates[0].Attempts != 1 || updates[0].LastError != "rating-service is down" {
+		t.Errorf("unexpected update %+v", updates[0])
+	}
+	if updates[1].Id != second.Id || updates[1].Attempts != 0 {
+		t.Errorf("unexpected update %+v", updates[1])
+	}
+
+	queue.Remove(ctx, first.Id)
+	if updates, _ = queue.Pending(ctx); len(updates) != 1 || updates[0].Id != second.Id {
+		t.Errorf("expected only the second update, got %+v", updates)
+	}
+}
+
+func TestMemoryQueue(t *testing.T) {
+	testQueue(t, NewMemoryQueue())
+}
+
+func TestPgQueue(t *testing.T) {
+	connString := pgtest.Open(t, "TEST_POSTGRES_GATEWAY", migrations.Schema)
+
+	pool, err := pgxpool.New(context.Background(), connString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	pgtest.Exec(t, pool, `TRUNCATE rating_update RESTART IDENTITY`)
+
+	testQueue(t, NewPgQueue(pool))
+}
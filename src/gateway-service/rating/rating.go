@@ -0,0 +1,375 @@
+// Package rating reads and updates reader ratings in rating-service and keeps
+// the gateway usable while that service is down: reads fall back to the
+// last-known or a default rating, and updates are queued and replayed once
+// the service recovers. The queue is kept in the gateway database, so the
+// updates survive restarts of the gateway.
+package rating
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"library-system/src/gateway-service/cache"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	penaltiesApplied = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rating_penalties_applied_total",
+		Help: "Rating penalties written to rating-service, including replayed ones.",
+	})
+
+	penaltyStars = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rating_penalty_stars_total",
+		Help: "Stars taken from readers by applied penalties.",
+	})
+)
+
+const (
+	MinStars = 0
+	MaxStars = 100
+)
+
+type Mode string
+
+const (
+	// ModeCached uses the last-known rating, or DefaultStars if none is known.
+	ModeCached Mode = "CACHED"
+	// ModeDefault always uses DefaultStars.
+	ModeDefault Mode = "DEFAULT"
+	// ModeOff reports the failure to the caller.
+	ModeOff Mode = "OFF"
+)
+
+type Source string
+
+const (
+	SourceService Source = "SERVICE"
+	SourceCached  Source = "CACHED"
+	SourceDefault Source = "DEFAULT"
+)
+
+type Policy struct {
+	Mode         Mode
+	DefaultStars int
+}
+
+func DefaultPolicy() Policy {
+	return Policy{Mode: ModeCached, DefaultStars: MinStars}
+}
+
+// Update changes the rating of Username by Delta stars.
+type Update struct {
+	Id             int64     `json:"id"`
+	Username       string    `json:"username"`
+	ReservationUid string    `json:"reservationUid"`
+	Delta          int       `json:"delta"`
+	QueuedAt       time.Time `json:"queuedAt"`
+	Attempts       int       `json:"attempts"`
+	LastError      string    `json:"lastError,omitempty"`
+}
+
+type doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+type ratingBody struct {
+	Stars int `json:"stars"`
+}
+
+type changeBody struct {
+	ReservationUid string `json:"reservationUid"`
+	Delta          int    `json:"delta"`
+}
+
+// knownRating is a rating read from rating-service and when it was read.
+type knownRating struct {
+	Stars  int       `json:"stars"`
+	ReadAt time.Time `json:"readAt"`
+}
+
+type Service struct {
+	client  doer
+	baseURL string
+	policy  Policy
+	known   *cache.Cache
+	queue   Queue
+
+	// replayMu makes sure a queued update is never sent twice concurrently
+	// by this gateway.
+	replayMu sync.Mutex
+}
+
+// NewService returns a Service calling rating-service at baseURL. known keeps
+// the last rating read for every reader and queue the updates rating-service
+// has not acknowledged yet.
+func NewService(client doer, baseURL string, policy Policy, known *cache.Cache, queue Queue) *Service {
+	return &Service{client: client, baseURL: baseURL, policy: policy, known: known, queue: queue}
+}
+
+// Get returns the rating of username, including queued updates that are not
+// part of it yet, and where it was taken from.
+func (s *Service) Get(ctx context.Context, username string) (int, Source, error) {
+	stars, err := s.fetch(ctx, username)
+	if err == nil {
+		readAt := time.Now()
+		s.remember(ctx, username, stars, readAt)
+		return clamp(stars + s.pendingDelta(ctx, username, readAt, true)), SourceService, nil
+	}
+
+	slog.WarnContext(ctx, "failed to get rating, falling back", "username", username, "mode", s.policy.Mode, "error", err)
+
+	switch s.policy.Mode {
+	case ModeCached:
+		if value, ok := s.known.GetMany(ctx, []string{knownKey(username)})[knownKey(username)]; ok {
+			var known knownRating
+			if err := json.Unmarshal(value, &known); err == nil {
+				return clamp(known.Stars + s.pendingDelta(ctx, username, known.ReadAt, false)), SourceCached, nil
+			}
+		}
+		return clamp(s.policy.DefaultStars + s.pendingDelta(ctx, username, time.Time{}, false)), SourceDefault, nil
+	case ModeDefault:
+		return clamp(s.policy.DefaultStars + s.pendingDelta(ctx, username, time.Time{}, false)), SourceDefault, nil
+	}
+
+	return 0, "", err
+}
+
+// Apply queues the update and sends the queued updates of the reader in
+// order. Updates that cannot be sent now stay queued for Replay. An update
+// that cannot be queued is sent once and lost if that fails.
+func (s *Service) Apply(ctx context.Context, username string, reservationUid string, delta int) {
+	update := Update{
+		Username:       username,
+		ReservationUid: reservationUid,
+		Delta:          delta,
+		QueuedAt:       time.Now(),
+	}
+
+	queued, err := s.queue.Add(ctx, update)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to queue rating update, sending it once", "username", username, "reservation_uid", reservationUid, "error", err)
+		if err = s.send(ctx, update); err != nil {
+			slog.ErrorContext(ctx, "rating update lost", "username", username, "reservation_uid", reservationUid, "delta", delta, "error", err)
+		}
+		return
+	}
+
+	s.replay(ctx, queued.Username)
+}
+
+// Replay sends every queued update, stopping at the first failure of each
+// reader so that updates are applied in order.
+func (s *Service) Replay(ctx context.Context) {
+	s.replay(ctx, "")
+}
+
+// Run replays the queued updates at once, which picks up the updates left by
+// a previous run of the gateway, and then every interval until ctx is
+// cancelled.
+func (s *Service) Run(ctx context.Context, interval time.Duration) {
+	s.Replay(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.Replay(ctx)
+		}
+	}
+}
+
+// Pending returns the queued updates.
+func (s *Service) Pending(ctx context.Context) ([]Update, error) {
+	return s.queue.Pending(ctx)
+}
+
+func (s *Service) replay(ctx context.Context, username string) {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+
+	pending, err := s.queue.Pending(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to read queued rating updates", "error", err)
+		return
+	}
+
+	failed := make(map[string]bool)
+
+	for _, update := range pending {
+		if (username != "" && update.Username != username) || failed[update.Username] {
+			continue
+		}
+
+		if err = s.queue.Attempt(ctx, update.Id); err == nil {
+			if err = s.send(ctx, update); err == nil {
+				if update.Delta < 0 {
+					penaltiesApplied.Inc()
+					penaltyStars.Add(float64(-update.Delta))
+				}
+				err = s.queue.Remove(ctx, update.Id)
+			} else if failErr := s.queue.Fail(ctx, update.Id, err.Error()); failErr != nil {
+				slog.ErrorContext(ctx, "failed to record rating update failure", "error", failErr)
+			}
+		}
+
+		if err != nil {
+			slog.WarnContext(ctx, "failed to update rating, queued", "username", update.Username, "reservation_uid", update.ReservationUid, "error", err)
+			failed[update.Username] = true
+		}
+	}
+}
+
+// send applies update in rating-service, which adds the delta atomically and
+// only once per reservation, so resending an update after a lost response
+// is safe.
+func (s *Service) send(ctx context.Context, update Update) error {
+	marshalled, err := json.Marshal(changeBody{ReservationUid: update.ReservationUid, Delta: update.Delta})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.baseURL+"/api/v1/rating/changes", bytes.NewReader(marshalled))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-User-Name", update.Username)
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("rating-service responded with status %d", res.StatusCode)
+	}
+
+	var rating ratingBody
+	if err = json.NewDecoder(res.Body).Decode(&rating); err != nil {
+		return err
+	}
+
+	s.remember(ctx, update.Username, rating.Stars, time.Now())
+	return nil
+}
+
+// applied asks rating-service whether the update has been applied.
+func (s *Service) applied(ctx context.Context, update Update) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.baseURL+"/api/v1/rating/changes/"+url.PathEscape(update.ReservationUid), nil)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("rating-service responded with status %d", res.StatusCode)
+}
+
+func (s *Service) fetch(ctx context.Context, username string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.baseURL+"/api/v1/rating/", nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("X-User-Name", username)
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("rating-service responded with status %d", res.StatusCode)
+	}
+
+	var rating ratingBody
+	if err = json.NewDecoder(res.Body).Decode(&rating); err != nil {
+		return 0, err
+	}
+
+	return rating.Stars, nil
+}
+
+// remember keeps stars as the last-known rating of username.
+func (s *Service) remember(ctx context.Context, username string, stars int, readAt time.Time) {
+	value, err := json.Marshal(knownRating{Stars: stars, ReadAt: readAt})
+	if err != nil {
+		return
+	}
+	s.known.Set(ctx, knownKey(username), value)
+}
+
+// pendingDelta sums the queued updates of username that a rating read at
+// readAt cannot include: those never sent and those queued after it was
+// read. Any other update may have been applied although its response was
+// lost, so it is counted only when confirm is set and rating-service
+// confirms that it has not been applied.
+func (s *Service) pendingDelta(ctx context.Context, username string, readAt time.Time, confirm bool) int {
+	pending, err := s.queue.Pending(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to read queued rating updates", "error", err)
+		return 0
+	}
+
+	delta := 0
+	for _, update := range pending {
+		if update.Username != username {
+			continue
+		}
+		if update.Attempts == 0 || update.QueuedAt.After(readAt) {
+			delta += update.Delta
+			continue
+		}
+		if !confirm {
+			continue
+		}
+
+		applied, err := s.applied(ctx, update)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to confirm rating update", "reservation_uid", update.ReservationUid, "error", err)
+			continue
+		}
+		if !applied {
+			delta += update.Delta
+		}
+	}
+	return delta
+}
+
+func knownKey(username string) string {
+	return "rating:" + username
+}
+
+func clamp(stars int) int {
+	if stars < MinStars {
+		return MinStars
+	}
+	if stars > MaxStars {
+		return MaxStars
+	}
+	return stars
+}
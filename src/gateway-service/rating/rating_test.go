@@ -0,0 +1,228 @@
+package rating
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"library-system/src/gateway-service/cache"
+)
+
+// fakeRatingService keeps ratings in memory and answers 503 while down. Like
+// rating-service it applies a change once per reservation.
+type fakeRatingService struct {
+	mu      sync.Mutex
+	stars   map[string]int
+	applied map[string]bool
+	down    atomic.Bool
+	// loseResponses applies changes but answers 503 as if the response was
+	// lost on the way.
+	loseResponses atomic.Bool
+	// refuseChanges answers 503 to changes without applying them.
+	refuseChanges atomic.Bool
+}
+
+func (f *fakeRatingService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.down.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	username := r.Header.Get("X-User-Name")
+
+	if reservationUid, ok := strings.CutPrefix(r.URL.Path, "/api/v1/rating/changes/"); ok {
+		if !f.applied[reservationUid] {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if f.refuseChanges.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var body changeBody
+		json.NewDecoder(r.Body).Decode(&body)
+		if !f.applied[body.ReservationUid] {
+			f.applied[body.ReservationUid] = true
+			f.stars[username] = clamp(f.stars[username] + body.Delta)
+		}
+		if f.loseResponses.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(ratingBody{Stars: f.stars[username]})
+}
+
+func newTestService(t *testing.T, policy Policy) (*Service, *fakeRatingService) {
+	fake := &fakeRatingService{stars: map[string]int{"Test Max": 50}, applied: map[string]bool{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	known := cache.New(cache.NewMemory(100), time.Hour)
+	return NewService(http.DefaultClient, server.URL, policy, known, NewMemoryQueue()), fake
+}
+
+func pending(t *testing.T, service *Service) []Update {
+	t.Helper()
+
+	updates, err := service.Pending(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return updates
+}
+
+func TestGetFallsBackToLastKnownRating(t *testing.T) {
+	service, fake := newTestService(t, DefaultPolicy())
+	ctx := context.Background()
+
+	if stars, source, _ := service.Get(ctx, "Test Max"); stars != 50 || source != SourceService {
+		t.Fatalf("expected 50 from the service, got %d from %s", stars, source)
+	}
+
+	fake.down.Store(true)
+
+	if stars, source, err := service.Get(ctx, "Test Max"); err != nil || stars != 50 || source != SourceCached {
+		t.Errorf("expected last-known 50, got %d from %s (%v)", stars, source, err)
+	}
+	if stars, source, err := service.Get(ctx, "Unknown"); err != nil || stars != MinStars || source != SourceDefault {
+		t.Errorf("expected default rating, got %d from %s (%v)", stars, source, err)
+	}
+}
+
+func TestGetFailsWhenFallbackIsOff(t *testing.T) {
+	service, fake := newTestService(t, Policy{Mode: ModeOff})
+	fake.down.Store(true)
+
+	if _, _, err := service.Get(context.Background(), "Test Max"); err == nil {
+		t.Errorf("expected an error with fallback off")
+	}
+}
+
+func TestUpdatesAreQueuedAndReplayed(t *testing.T) {
+	service, fake := newTestService(t, DefaultPolicy())
+	ctx := context.Background()
+
+	service.Get(ctx, "Test Max")
+	fake.down.Store(true)
+
+	service.Apply(ctx, "Test Max", "reservation-1", -10)
+	service.Apply(ctx, "Test Max", "reservation-2", 1)
+
+	// every Apply retries the oldest update of the reader first
+	if updates := pending(t, service); len(updates) != 2 || updates[0].Attempts != 2 || updates[1].Attempts != 0 {
+		t.Fatalf("expected 2 queued updates with only the oldest one attempted, got %+v", updates)
+	}
+	if stars, _, _ := service.Get(ctx, "Test Max"); stars != 41 {
+		t.Errorf("queued updates must be reflected in the fallback rating, got %d", stars)
+	}
+
+	fake.down.Store(false)
+	service.Replay(ctx)
+
+	if updates := pending(t, service); len(updates) != 0 {
+		t.Errorf("expected the queue to be drained, got %+v", updates)
+	}
+	if fake.stars["Test Max"] != 41 {
+		t.Errorf("expected 41 stars after replay, got %d", fake.stars["Test Max"])
+	}
+}
+
+func TestResentUpdatesAreAppliedOnce(t *testing.T) {
+	service, fake := newTestService(t, DefaultPolicy())
+	ctx := context.Background()
+
+	fake.loseResponses.Store(true)
+	service.Apply(ctx, "Test Max", "reservation-1", -10)
+
+	if updates := pending(t, service); len(updates) != 1 {
+		t.Fatalf("expected the unacknowledged update to stay queued, got %+v", updates)
+	}
+
+	// rating-service confirms the update is part of the rating already
+	if stars, source, _ := service.Get(ctx, "Test Max"); stars != 40 || source != SourceService {
+		t.Errorf("expected 40 from the service, got %d from %s", stars, source)
+	}
+
+	fake.loseResponses.Store(false)
+	service.Replay(ctx)
+
+	if updates := pending(t, service); len(updates) != 0 {
+		t.Errorf("expected the queue to be drained, got %+v", updates)
+	}
+	if fake.stars["Test Max"] != 40 {
+		t.Errorf("expected the update to be applied once, got %d stars", fake.stars["Test Max"])
+	}
+}
+
+func TestRefusedUpdatesAreReflected(t *testing.T) {
+	service, fake := newTestService(t, DefaultPolicy())
+	ctx := context.Background()
+
+	fake.refuseChanges.Store(true)
+	service.Apply(ctx, "Test Max", "reservation-1", -10)
+
+	// rating-service confirms the update has not been applied
+	if stars, source, _ := service.Get(ctx, "Test Max"); stars != 40 || source != SourceService {
+		t.Errorf("expected 40 from the service, got %d from %s", stars, source)
+	}
+}
+
+func TestQueuedUpdatesSurviveRestart(t *testing.T) {
+	service, fake := newTestService(t, DefaultPolicy())
+
+	fake.down.Store(true)
+	service.Apply(context.Background(), "Test Max", "reservation-1", -10)
+	fake.down.Store(false)
+
+	// a new gateway with the same queue replays the update when it starts
+	restarted := NewService(http.DefaultClient, service.baseURL, DefaultPolicy(), service.known, service.queue)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go restarted.Run(ctx, time.Hour)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(pending(t, restarted)) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.stars["Test Max"] != 40 {
+		t.Errorf("expected the update to be replayed on start, got %d stars", fake.stars["Test Max"])
+	}
+}
+
+func TestConcurrentUpdatesAreNotLost(t *testing.T) {
+	service, fake := newTestService(t, DefaultPolicy())
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for _, reservationUid := range []string{"reservation-1", "reservation-2", "reservation-3"} {
+		wg.Add(1)
+		go func(reservationUid string) {
+			defer wg.Done()
+			service.Apply(ctx, "Test Max", reservationUid, 1)
+		}(reservationUid)
+	}
+	wg.Wait()
+
+	if fake.stars["Test Max"] != 53 {
+		t.Errorf("expected every update to be applied, got %d stars", fake.stars["Test Max"])
+	}
+}
@@ -1,21 +1,22 @@
 package handler
 
 import (
-	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"log/slog"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"library-system/src/library-service/storage"
+	"library-system/src/pkg/apierror"
+	"library-system/src/pkg/audit"
+	"library-system/src/pkg/etag"
 
 	"github.com/gin-gonic/gin"
 )
 
-type ErrorResponse struct {
-	Message string `json:"message"`
-}
-
 type MessageResponse struct {
 	Message string `json:"message"`
 }
@@ -33,21 +34,85 @@ type BookResponse struct {
 	Author          string `json:"author"`
 	Genre           string `json:"genre"`
 	Condition       string `json:"condition"`
+	Material_type   string `json:"materialType"`
 	Available_count int    `json:"availableCount"`
 }
 
 type BookToUserResponse struct {
-	Book_uid string `json:"bookUid"`
-	Name     string `json:"name"`
-	Author   string `json:"author"`
-	Genre    string `json:"genre"`
+	Book_uid      string `json:"bookUid"`
+	Name          string `json:"name"`
+	Author        string `json:"author"`
+	Genre         string `json:"genre"`
+	Material_type string `json:"materialType"`
+}
+
+type BookConditionResponse struct {
+	Condition string `json:"condition"`
+}
+
+// AssessConditionRequest records the condition of a book, e.g. on the return
+// of ReservationUid. Date defaults to today.
+type AssessConditionRequest struct {
+	Condition      string   `json:"condition"`
+	Date           string   `json:"date"`
+	ReservationUid string   `json:"reservationUid"`
+	Notes          string   `json:"notes"`
+	Photos         []string `json:"photos"`
+}
+
+type AssessmentResponse struct {
+	Condition      string   `json:"condition"`
+	Assessor       string   `json:"assessor"`
+	Date           string   `json:"date"`
+	ReservationUid string   `json:"reservationUid,omitempty"`
+	Notes          string   `json:"notes"`
+	Photos         []string `json:"photos"`
 }
 
-type RequestUpdateReservation struct {
+type DamageReportRequest struct {
+	LibraryUid string   `json:"libraryUid"`
+	Notes      string   `json:"notes"`
+	Photos     []string `json:"photos"`
+}
+
+// ResolveDamageReportRequest puts a repaired copy back on the shelf in
+// Condition, or writes it off.
+type ResolveDamageReportRequest struct {
+	Status    string `json:"status"`
 	Condition string `json:"condition"`
 	Date      string `json:"date"`
+	Notes     string `json:"notes"`
+}
+
+type DamageReportResponse struct {
+	ReportUid  string     `json:"reportUid"`
+	BookUid    string     `json:"bookUid"`
+	LibraryUid string     `json:"libraryUid"`
+	ReportedBy string     `json:"reportedBy"`
+	Notes      string     `json:"notes"`
+	Photos     []string   `json:"photos"`
+	Status     string     `json:"status"`
+	ResolvedBy string     `json:"resolvedBy,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty"`
 }
 
+type UpdateBookRequest struct {
+	Name          string `json:"name"`
+	Author        string `json:"author"`
+	Genre         string `json:"genre"`
+	Material_type string `json:"materialType"`
+}
+
+type UpdateLibraryRequest struct {
+	Name    string `json:"name"`
+	City    string `json:"city"`
+	Address string `json:"address"`
+}
+
+// maxBatchSize bounds the number of UIDs accepted by batch lookups.
+const maxBatchSize = 100
+
 type Handler struct {
 	storage storage.Storage
 }
@@ -58,19 +123,99 @@ func NewHandler(storage storage.Storage) *Handler {
 
 func (h *Handler) GetLibrariesByCity(c *gin.Context) {
 
-	libraries, err := h.storage.GetLibrariesByCity(context.Background(), c.Query("city"))
+	if c.Query("uids") != "" {
+		h.GetLibrariesByUids(c)
+		return
+	}
+
+	libraries, err := h.storage.GetLibrariesByCity(c.Request.Context(), c.Query("city"))
 
 	if err != nil {
-		fmt.Printf("failed to get libraries %s\n", err.Error())
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		slog.ErrorContext(c.Request.Context(), "failed to get libraries", "error", err)
+		apierror.Respond(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, LibrariesToResponse(libraries))
 }
 
+func (h *Handler) GetLibrariesByUids(c *gin.Context) {
+
+	uids, err := batchUids(c)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
+	libraries, err := h.storage.GetLibrariesByUids(c.Request.Context(), uids)
+
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to get libraries", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	res := LibrariesToResponse(libraries)
+	if res == nil {
+		res = make([]LibraryResponse, 0)
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) GetBooksByUids(c *gin.Context) {
+
+	uids, err := batchUids(c)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
+	books, err := h.storage.GetBooksByUids(c.Request.Context(), uids)
+
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to get books", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	res := make([]BookToUserResponse, len(books))
+
+	for index, book := range books {
+		res[index] = BookToUserResponse{
+			Book_uid:      book.Book_uid,
+			Name:          book.Name,
+			Author:        book.Author,
+			Genre:         book.Genre,
+			Material_type: book.Material_type,
+		}
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// batchUids parses the comma separated uids query parameter.
+func batchUids(c *gin.Context) ([]string, error) {
+	uids := make([]string, 0)
+
+	for _, uid := range strings.Split(c.Query("uids"), ",") {
+		uid = strings.TrimSpace(uid)
+		if uid != "" {
+			uids = append(uids, uid)
+		}
+	}
+
+	if len(uids) == 0 {
+		return nil, apierror.Validation("uids must be given")
+	}
+
+	if len(uids) > maxBatchSize {
+		return nil, apierror.Validation("at most %d uids can be requested at once", maxBatchSize)
+	}
+
+	return uids, nil
+}
+
 func (h *Handler) GetBooksByLibraryUid(c *gin.Context) {
 
 	showAll, err := strconv.ParseBool(c.Query("showAll"))
@@ -78,13 +223,11 @@ func (h *Handler) GetBooksByLibraryUid(c *gin.Context) {
 		showAll = false
 	}
 
-	books, err := h.storage.GetBooksByLibraryUid(context.Background(), c.Param("uid"), showAll)
+	books, err := h.storage.GetBooksByLibraryUid(c.Request.Context(), c.Param("uid"), showAll)
 
 	if err != nil {
-		fmt.Printf("failed to get libraries %s\n", err.Error())
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		slog.ErrorContext(c.Request.Context(), "failed to get libraries", "error", err)
+		apierror.Respond(c, err)
 		return
 	}
 
@@ -93,13 +236,11 @@ func (h *Handler) GetBooksByLibraryUid(c *gin.Context) {
 
 func (h *Handler) UpdateBookCount(c *gin.Context) {
 
-	book, err := h.storage.GetBookByUid(context.Background(), c.Param("uid"))
+	book, err := h.storage.GetBookByUid(c.Request.Context(), c.Param("uid"))
 
 	if err != nil {
-		fmt.Printf("failed to get libraries %s\n", err.Error())
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		slog.ErrorContext(c.Request.Context(), "failed to get libraries", "error", err)
+		apierror.Respond(c, err)
 		return
 	}
 
@@ -108,13 +249,11 @@ func (h *Handler) UpdateBookCount(c *gin.Context) {
 		count = -1
 	}
 
-	err = h.storage.UpdateBookCount(context.Background(), book.ID, book.Available_count-count)
+	err = h.storage.UpdateBookCount(c.Request.Context(), book.ID, book.Available_count-count)
 
 	if err != nil {
-		fmt.Printf("failed to update book count %s\n", err.Error())
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		slog.ErrorContext(c.Request.Context(), "failed to update book count", "error", err)
+		apierror.Respond(c, err)
 		return
 	}
 
@@ -125,37 +264,38 @@ func (h *Handler) UpdateBookCount(c *gin.Context) {
 
 func (h *Handler) UpdateBookCondition(c *gin.Context) {
 
-	book, err := h.storage.GetBookInfoByUid(context.Background(), c.Param("uid"))
+	var request AssessConditionRequest
 
+	err := json.NewDecoder(c.Request.Body).Decode(&request)
 	if err != nil {
-		fmt.Printf("failed to get libraries %s\n", err.Error())
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		slog.ErrorContext(c.Request.Context(), "failed to decode body", "error", err)
+		apierror.Respond(c, apierror.BadRequest("invalid request body: %s", err.Error()))
 		return
 	}
 
-	var reqUpdRes RequestUpdateReservation
-
-	err = json.NewDecoder(c.Request.Body).Decode(&reqUpdRes)
+	date, err := parseDate(request.Date)
 	if err != nil {
-		fmt.Printf("failed to decode body %s\n", err.Error())
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, err)
 		return
 	}
 
-	if reqUpdRes.Condition != book.Condition {
-		err = h.storage.UpdateBookCondition(context.Background(), c.Param("uid"), reqUpdRes.Condition)
+	previousCondition, err := h.storage.UpdateBookCondition(c.Request.Context(), storage.Assessment{
+		Book_uid:        c.Param("uid"),
+		Condition:       request.Condition,
+		Assessor:        audit.Actor(c.Request.Context()),
+		Assessed_on:     date,
+		Reservation_uid: request.ReservationUid,
+		Notes:           request.Notes,
+		Photos:          request.Photos,
+	})
 
-		if err != nil {
-			fmt.Printf("failed to update reservation %s\n", err.Error())
-			c.JSON(http.StatusBadRequest, ErrorResponse{
-				Message: err.Error(),
-			})
-			return
-		}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to update condition", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	if previousCondition != request.Condition {
 		c.JSON(http.StatusCreated, MessageResponse{
 			Message: "condition updated",
 		})
@@ -167,38 +307,304 @@ func (h *Handler) UpdateBookCondition(c *gin.Context) {
 	})
 }
 
+// parseDate parses a YYYY-MM-DD date, today if it is empty.
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Now().UTC().Truncate(24 * time.Hour), nil
+	}
+
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, apierror.Validation("date must be formatted as YYYY-MM-DD")
+	}
+
+	return date, nil
+}
+
+func (h *Handler) GetConditionHistory(c *gin.Context) {
+
+	if _, err := h.storage.GetBookInfoByUid(c.Request.Context(), c.Param("uid")); err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
+	history, err := h.storage.GetConditionHistory(c.Request.Context(), c.Param("uid"))
+
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to get condition history", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	res := make([]AssessmentResponse, len(history))
+
+	for index, assessment := range history {
+		res[index] = AssessmentResponse{
+			Condition:      assessment.Condition,
+			Assessor:       assessment.Assessor,
+			Date:           assessment.Assessed_on.Format("2006-01-02"),
+			ReservationUid: assessment.Reservation_uid,
+			Notes:          assessment.Notes,
+			Photos:         assessment.Photos,
+		}
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) CreateDamageReport(c *gin.Context) {
+
+	var request DamageReportRequest
+
+	err := json.NewDecoder(c.Request.Body).Decode(&request)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to decode body", "error", err)
+		apierror.Respond(c, apierror.BadRequest("invalid request body: %s", err.Error()))
+		return
+	}
+
+	if request.LibraryUid == "" {
+		apierror.Respond(c, apierror.Validation("libraryUid must be given"))
+		return
+	}
+
+	report, err := h.storage.CreateDamageReport(c.Request.Context(), storage.DamageReport{
+		Book_uid:    c.Param("uid"),
+		Library_uid: request.LibraryUid,
+		Reported_by: audit.Actor(c.Request.Context()),
+		Notes:       request.Notes,
+		Photos:      request.Photos,
+	})
+
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to create damage report", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, DamageReportToResponse(report))
+}
+
+func (h *Handler) GetDamageReports(c *gin.Context) {
+
+	reports, err := h.storage.GetDamageReports(c.Request.Context(), storage.DamageReportFilter{
+		Library_uid: c.Query("libraryUid"),
+		Book_uid:    c.Query("bookUid"),
+		Status:      c.Query("status"),
+	})
+
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to get damage reports", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	res := make([]DamageReportResponse, len(reports))
+
+	for index, report := range reports {
+		res[index] = DamageReportToResponse(report)
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) ResolveDamageReport(c *gin.Context) {
+
+	var request ResolveDamageReportRequest
+
+	err := json.NewDecoder(c.Request.Body).Decode(&request)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to decode body", "error", err)
+		apierror.Respond(c, apierror.BadRequest("invalid request body: %s", err.Error()))
+		return
+	}
+
+	date, err := parseDate(request.Date)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
+	report, err := h.storage.ResolveDamageReport(c.Request.Context(), storage.Resolution{
+		Report_uid:  c.Param("uid"),
+		Status:      request.Status,
+		Condition:   request.Condition,
+		Resolved_by: audit.Actor(c.Request.Context()),
+		Resolved_on: date,
+		Notes:       request.Notes,
+	})
+
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to resolve damage report", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, DamageReportToResponse(report))
+}
+
+func DamageReportToResponse(report storage.DamageReport) DamageReportResponse {
+	return DamageReportResponse{
+		ReportUid:  report.Report_uid,
+		BookUid:    report.Book_uid,
+		LibraryUid: report.Library_uid,
+		ReportedBy: report.Reported_by,
+		Notes:      report.Notes,
+		Photos:     report.Photos,
+		Status:     report.Status,
+		ResolvedBy: report.Resolved_by,
+		CreatedAt:  report.Created_at,
+		ResolvedAt: report.Resolved_at,
+	}
+}
+
 func (h *Handler) GetBookInfoByUid(c *gin.Context) {
 
-	book, err := h.storage.GetBookInfoByUid(context.Background(), c.Param("uid"))
+	book, err := h.storage.GetBookInfoByUid(c.Request.Context(), c.Param("uid"))
 
 	if err != nil {
-		fmt.Printf("failed to get libraries %s\n", err.Error())
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		slog.ErrorContext(c.Request.Context(), "failed to get libraries", "error", err)
+		apierror.Respond(c, err)
 		return
 	}
 
+	etag.Set(c, book.Version)
 	c.JSON(http.StatusOK, BookToUserResponse{
-		Book_uid: book.Book_uid,
-		Name:     book.Name,
-		Author:   book.Author,
-		Genre:    book.Genre,
+		Book_uid:      book.Book_uid,
+		Name:          book.Name,
+		Author:        book.Author,
+		Genre:         book.Genre,
+		Material_type: book.Material_type,
+	})
+}
+
+func (h *Handler) GetBookCondition(c *gin.Context) {
+
+	book, err := h.storage.GetBookInfoByUid(c.Request.Context(), c.Param("uid"))
+
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to get book", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, BookConditionResponse{
+		Condition: book.Condition,
 	})
 }
 
 func (h *Handler) GetLibraryByUid(c *gin.Context) {
 
-	library, err := h.storage.GetLibraryByUid(context.Background(), c.Param("uid"))
+	library, err := h.storage.GetLibraryByUid(c.Request.Context(), c.Param("uid"))
 
 	if err != nil {
-		fmt.Printf("failed to get libraries %s\n", err.Error())
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		slog.ErrorContext(c.Request.Context(), "failed to get libraries", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	etag.Set(c, library.Version)
+	c.JSON(http.StatusOK, LibraryToResponse(library))
+}
+
+func (h *Handler) UpdateBook(c *gin.Context) {
+
+	version, err := etag.IfMatch(c)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
+	var reqUpdBook UpdateBookRequest
+
+	err = json.NewDecoder(c.Request.Body).Decode(&reqUpdBook)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to decode body", "error", err)
+		apierror.Respond(c, apierror.BadRequest("invalid request body: %s", err.Error()))
+		return
+	}
+
+	if reqUpdBook.Name == "" || reqUpdBook.Author == "" || reqUpdBook.Genre == "" || reqUpdBook.Material_type == "" {
+		apierror.Respond(c, apierror.Validation("name, author, genre and materialType must be given"))
+		return
+	}
+
+	book := storage.BookInfo{
+		Book_uid:      c.Param("uid"),
+		Name:          reqUpdBook.Name,
+		Author:        reqUpdBook.Author,
+		Genre:         reqUpdBook.Genre,
+		Material_type: reqUpdBook.Material_type,
+		Version:       version,
+	}
+
+	book.Version, err = h.storage.UpdateBook(c.Request.Context(), book)
+
+	if errors.Is(err, storage.ErrNotFound) {
+		apierror.Respond(c, apierror.NotFound("book not found"))
+		return
+	}
+
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to update book", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	etag.Set(c, book.Version)
+	c.JSON(http.StatusOK, BookToUserResponse{
+		Book_uid:      book.Book_uid,
+		Name:          book.Name,
+		Author:        book.Author,
+		Genre:         book.Genre,
+		Material_type: book.Material_type,
+	})
+}
+
+func (h *Handler) UpdateLibrary(c *gin.Context) {
+
+	version, err := etag.IfMatch(c)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
+	var reqUpdLibrary UpdateLibraryRequest
+
+	err = json.NewDecoder(c.Request.Body).Decode(&reqUpdLibrary)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to decode body", "error", err)
+		apierror.Respond(c, apierror.BadRequest("invalid request body: %s", err.Error()))
+		return
+	}
+
+	if reqUpdLibrary.Name == "" || reqUpdLibrary.City == "" || reqUpdLibrary.Address == "" {
+		apierror.Respond(c, apierror.Validation("name, city and address must be given"))
+		return
+	}
+
+	library := storage.Library{
+		Library_uid: c.Param("uid"),
+		Name:        reqUpdLibrary.Name,
+		City:        reqUpdLibrary.City,
+		Address:     reqUpdLibrary.Address,
+		Version:     version,
+	}
+
+	library.Version, err = h.storage.UpdateLibrary(c.Request.Context(), library)
+
+	if errors.Is(err, storage.ErrNotFound) {
+		apierror.Respond(c, apierror.NotFound("library not found"))
+		return
+	}
+
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to update library", "error", err)
+		apierror.Respond(c, err)
 		return
 	}
 
+	etag.Set(c, library.Version)
 	c.JSON(http.StatusOK, LibraryToResponse(library))
 }
 
@@ -232,6 +638,7 @@ func BookToResponse(book storage.Book) BookResponse {
 		Author:          book.Author,
 		Genre:           book.Genre,
 		Condition:       book.Condition,
+		Material_type:   book.Material_type,
 		Available_count: book.Available_count,
 	}
 }
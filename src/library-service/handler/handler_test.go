@@ -1,47 +1,310 @@
 package handler
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"library-system/src/library-service/storage"
+	"library-system/src/pkg/audit"
+
+	"github.com/gin-gonic/gin"
 )
 
-func TestGetLibrariesByCity(t *testing.T) {
+const (
+	libraryUid  = "83575e12-7ce0-48ee-9931-51919ff3c9ee"
+	bookUid     = "f7cdc58f-2caf-4b15-9727-f89dcc629b27"
+	soldOutUid  = "2a3b4c5d-0000-4000-8000-000000000002"
+	unknownUid  = "00000000-0000-4000-8000-000000000000"
+	libraryJSON = `{"libraryUid":"83575e12-7ce0-48ee-9931-51919ff3c9ee","name":"Библиотека имени 7 Непьющих","address":"2-я Бауманская ул., д.5, стр.1","city":"Москва"}`
+)
+
+type testCase struct {
+	name   string
+	method string
+	path   string
+	body   string
+	status int
+	// response is the expected body, or a part of it
+	response string
+}
+
+func newTestRouter() (*gin.Engine, storage.Storage) {
+	gin.SetMode(gin.TestMode)
+
+	memory := storage.NewMemory()
+	memory.AddLibrary(storage.Library{Library_uid: libraryUid, Name: "Библиотека имени 7 Непьющих", City: "Москва", Address: "2-я Бауманская ул., д.5, стр.1"})
+	memory.AddBook(libraryUid, storage.BookInfo{Book_uid: bookUid, Name: "Краткий курс C++ в 7 томах", Author: "Бьерн Страуструп", Genre: "Научная фантастика"}, 1)
+	memory.AddBook(libraryUid, storage.BookInfo{Book_uid: soldOutUid, Name: "The Go Programming Language", Author: "Alan Donovan", Genre: "Programming", Condition: "GOOD"}, 0)
+
+	handler := NewHandler(memory)
+
+	router := gin.New()
+	router.Use(audit.Middleware())
+	handler.Register(router)
 
-	if 2+2 != 4 {
-		t.Errorf("Unexpected situation")
+	return router, memory
+}
+
+func serve(router *gin.Engine, method, path, body string) *httptest.ResponseRecorder {
+	return serveWithHeader(router, method, path, nil, body)
+}
+
+func serveWithHeader(router *gin.Engine, method, path string, header http.Header, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for key, values := range header {
+		req.Header[key] = values
 	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
 }
 
-func TestGetBooksByLibraryUid(t *testing.T) {
+// ifMatch is the header of updates based on the version of a fresh record.
+var ifMatch = http.Header{"If-Match": {`"1"`}}
+
+func run(t *testing.T, tests []testCase) {
+	t.Helper()
+
+	runWithHeader(t, nil, tests)
+}
+
+func runWithHeader(t *testing.T, header http.Header, tests []testCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, _ := newTestRouter()
 
-	if 2+2 != 4 {
-		t.Errorf("Unexpected situation")
+			recorder := serveWithHeader(router, tt.method, tt.path, header, tt.body)
+
+			if recorder.Code != tt.status || !strings.Contains(recorder.Body.String(), tt.response) {
+				t.Errorf("expected %d %s, got %d %s", tt.status, tt.response, recorder.Code, recorder.Body.String())
+			}
+		})
 	}
 }
 
-func TestUpdateBookCount(t *testing.T) {
+func TestGetLibrariesByCity(t *testing.T) {
+	run(t, []testCase{
+		{"by city", http.MethodGet, "/api/v1/libraries?city=Москва", "", http.StatusOK, "[" + libraryJSON + "]"},
+		{"unknown city", http.MethodGet, "/api/v1/libraries?city=Тверь", "", http.StatusOK, "[]"},
+		{"by uids", http.MethodGet, "/api/v1/libraries?uids=" + libraryUid + "," + unknownUid, "", http.StatusOK, "[" + libraryJSON + "]"},
+		{"invalid uid", http.MethodGet, "/api/v1/libraries?uids=abc", "", http.StatusUnprocessableEntity, `"code":"VALIDATION_FAILED"`},
+		{"too many uids", http.MethodGet, "/api/v1/libraries?uids=" + strings.Repeat(libraryUid+",", maxBatchSize+1), "", http.StatusUnprocessableEntity, "at most 100 uids"},
+	})
+}
+
+func TestGetBooksByLibraryUid(t *testing.T) {
+	run(t, []testCase{
+		{"available books", http.MethodGet, "/api/v1/libraries/" + libraryUid + "/books/", "", http.StatusOK,
+			`[{"bookUid":"f7cdc58f-2caf-4b15-9727-f89dcc629b27","name":"Краткий курс C++ в 7 томах","author":"Бьерн Страуструп","genre":"Научная фантастика","condition":"EXCELLENT","materialType":"BOOK","availableCount":1}]`},
+		{"all books", http.MethodGet, "/api/v1/libraries/" + libraryUid + "/books/?showAll=true", "", http.StatusOK, `"availableCount":0`},
+		{"unknown library", http.MethodGet, "/api/v1/libraries/" + unknownUid + "/books/", "", http.StatusOK, "[]"},
+		{"invalid uid", http.MethodGet, "/api/v1/libraries/abc/books/", "", http.StatusUnprocessableEntity, `"code":"VALIDATION_FAILED"`},
+	})
+}
+
+func TestGetLibraryByUid(t *testing.T) {
+	run(t, []testCase{
+		{"existing library", http.MethodGet, "/api/v1/libraries/" + libraryUid + "/", "", http.StatusOK, libraryJSON},
+		{"unknown library", http.MethodGet, "/api/v1/libraries/" + unknownUid + "/", "", http.StatusNotFound, `"code":"NOT_FOUND"`},
+	})
+}
+
+func TestUpdateLibrary(t *testing.T) {
+	runWithHeader(t, ifMatch, []testCase{
+		{"valid update", http.MethodPut, "/api/v1/libraries/" + libraryUid + "/", `{"name":"Центральная","city":"Москва","address":"ул. Арбат, д.1"}`, http.StatusOK, `"name":"Центральная"`},
+		{"missing fields", http.MethodPut, "/api/v1/libraries/" + libraryUid + "/", `{"name":"Центральная"}`, http.StatusUnprocessableEntity, "name, city and address must be given"},
+		{"malformed body", http.MethodPut, "/api/v1/libraries/" + libraryUid + "/", `{"name":`, http.StatusBadRequest, `"code":"BAD_REQUEST"`},
+		{"unknown library", http.MethodPut, "/api/v1/libraries/" + unknownUid + "/", `{"name":"Центральная","city":"Москва","address":"ул. Арбат, д.1"}`, http.StatusNotFound, "library not found"},
+	})
+}
+
+func TestGetBooksByUids(t *testing.T) {
+	run(t, []testCase{
+		{"known books", http.MethodGet, "/api/v1/books?uids=" + bookUid + "," + unknownUid, "", http.StatusOK,
+			`[{"bookUid":"f7cdc58f-2caf-4b15-9727-f89dcc629b27","name":"Краткий курс C++ в 7 томах","author":"Бьерн Страуструп","genre":"Научная фантастика","materialType":"BOOK"}]`},
+		{"no uids", http.MethodGet, "/api/v1/books", "", http.StatusUnprocessableEntity, "uids must be given"},
+	})
+}
+
+func TestGetBookInfoByUid(t *testing.T) {
+	run(t, []testCase{
+		{"existing book", http.MethodGet, "/api/v1/books/" + soldOutUid + "/", "", http.StatusOK, `"name":"The Go Programming Language"`},
+		{"unknown book", http.MethodGet, "/api/v1/books/" + unknownUid + "/", "", http.StatusNotFound, `"code":"NOT_FOUND"`},
+	})
+}
+
+func TestUpdateBook(t *testing.T) {
+	runWithHeader(t, ifMatch, []testCase{
+		{"valid update", http.MethodPut, "/api/v1/books/" + bookUid + "/", `{"name":"C++","author":"Бьерн Страуструп","genre":"Учебник","materialType":"EBOOK"}`, http.StatusOK, `"materialType":"EBOOK"`},
+		{"invalid material type", http.MethodPut, "/api/v1/books/" + bookUid + "/", `{"name":"C++","author":"Бьерн Страуструп","genre":"Учебник","materialType":"SCROLL"}`, http.StatusUnprocessableEntity, `"code":"VALIDATION_FAILED"`},
+		{"missing fields", http.MethodPut, "/api/v1/books/" + bookUid + "/", `{"name":"C++"}`, http.StatusUnprocessableEntity, "must be given"},
+		{"unknown book", http.MethodPut, "/api/v1/books/" + unknownUid + "/", `{"name":"C++","author":"Бьерн Страуструп","genre":"Учебник","materialType":"BOOK"}`, http.StatusNotFound, "book not found"},
+	})
+}
 
-	if 2+2 != 4 {
-		t.Errorf("Unexpected situation")
+func TestUpdatesRequireTheCurrentVersion(t *testing.T) {
+	bookBody := `{"name":"C++","author":"Бьерн Страуструп","genre":"Учебник","materialType":"EBOOK"}`
+	libraryBody := `{"name":"Центральная","city":"Москва","address":"ул. Арбат, д.1"}`
+
+	run(t, []testCase{
+		{"book without If-Match", http.MethodPut, "/api/v1/books/" + bookUid + "/", bookBody, http.StatusPreconditionRequired, `"code":"PRECONDITION_REQUIRED"`},
+		{"library without If-Match", http.MethodPut, "/api/v1/libraries/" + libraryUid + "/", libraryBody, http.StatusPreconditionRequired, `"code":"PRECONDITION_REQUIRED"`},
+	})
+	runWithHeader(t, http.Header{"If-Match": {`"2"`}}, []testCase{
+		{"book of another version", http.MethodPut, "/api/v1/books/" + bookUid + "/", bookBody, http.StatusPreconditionFailed, `"code":"PRECONDITION_FAILED"`},
+		{"library of another version", http.MethodPut, "/api/v1/libraries/" + libraryUid + "/", libraryBody, http.StatusPreconditionFailed, `"code":"PRECONDITION_FAILED"`},
+	})
+	runWithHeader(t, http.Header{"If-Match": {"*"}}, []testCase{
+		{"book of any version", http.MethodPut, "/api/v1/books/" + bookUid + "/", bookBody, http.StatusOK, `"materialType":"EBOOK"`},
+	})
+
+	router, _ := newTestRouter()
+
+	recorder := serve(router, http.MethodGet, "/api/v1/books/"+bookUid+"/", "")
+	tag := recorder.Header().Get("ETag")
+	if tag != `"1"` {
+		t.Fatalf(`expected ETag "1", got %q`, tag)
+	}
+
+	recorder = serveWithHeader(router, http.MethodPut, "/api/v1/books/"+bookUid+"/", http.Header{"If-Match": {tag}}, bookBody)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("ETag") != `"2"` {
+		t.Fatalf(`expected 200 with ETag "2", got %d %q %s`, recorder.Code, recorder.Header().Get("ETag"), recorder.Body.String())
 	}
+
+	// the ETag read before the update is stale now
+	recorder = serveWithHeader(router, http.MethodPut, "/api/v1/books/"+bookUid+"/", http.Header{"If-Match": {tag}}, bookBody)
+	if recorder.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected 412, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	if tag = serve(router, http.MethodGet, "/api/v1/libraries/"+libraryUid+"/", "").Header().Get("ETag"); tag != `"1"` {
+		t.Errorf(`expected ETag "1", got %q`, tag)
+	}
+}
+
+func TestGetBookCondition(t *testing.T) {
+	run(t, []testCase{
+		{"existing book", http.MethodGet, "/api/v1/books/" + soldOutUid + "/condition", "", http.StatusOK, `{"condition":"GOOD"}`},
+		{"unknown book", http.MethodGet, "/api/v1/books/" + unknownUid + "/condition", "", http.StatusNotFound, `"code":"NOT_FOUND"`},
+	})
 }
 
 func TestUpdateBookCondition(t *testing.T) {
+	run(t, []testCase{
+		{"changed condition", http.MethodPut, "/api/v1/books/" + bookUid + "/condition", `{"condition":"BAD"}`, http.StatusCreated, "condition updated"},
+		{"same condition", http.MethodPut, "/api/v1/books/" + bookUid + "/condition", `{"condition":"EXCELLENT"}`, http.StatusOK, "condition already updated"},
+		{"invalid condition", http.MethodPut, "/api/v1/books/" + bookUid + "/condition", `{"condition":"TORN"}`, http.StatusUnprocessableEntity, `"code":"VALIDATION_FAILED"`},
+		{"malformed body", http.MethodPut, "/api/v1/books/" + bookUid + "/condition", `{`, http.StatusBadRequest, `"code":"BAD_REQUEST"`},
+		{"unknown book", http.MethodPut, "/api/v1/books/" + unknownUid + "/condition", `{"condition":"BAD"}`, http.StatusNotFound, `"code":"NOT_FOUND"`},
+	})
+}
+
+func TestConditionHistory(t *testing.T) {
+	router, _ := newTestRouter()
 
-	if 2+2 != 4 {
-		t.Errorf("Unexpected situation")
+	req := httptest.NewRequest(http.MethodPut, "/api/v1/books/"+bookUid+"/condition",
+		strings.NewReader(`{"condition":"BAD","date":"2021-10-11","reservationUid":"3c4d5e6f-0000-4000-8000-000000000001","notes":"torn cover","photos":["s3://photos/1.jpg"]}`))
+	req.Header.Set("X-Actor", "admin")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	recorder := serve(router, http.MethodGet, "/api/v1/books/"+bookUid+"/condition/history", "")
+	expected := `[{"condition":"BAD","assessor":"admin","date":"2021-10-11","reservationUid":"3c4d5e6f-0000-4000-8000-000000000001","notes":"torn cover","photos":["s3://photos/1.jpg"]}]`
+	if recorder.Code != http.StatusOK || recorder.Body.String() != expected {
+		t.Errorf("expected %s, got %d %s", expected, recorder.Code, recorder.Body.String())
 	}
+
+	run(t, []testCase{
+		{"no assessments", http.MethodGet, "/api/v1/books/" + soldOutUid + "/condition/history", "", http.StatusOK, "[]"},
+		{"unknown book", http.MethodGet, "/api/v1/books/" + unknownUid + "/condition/history", "", http.StatusNotFound, `"code":"NOT_FOUND"`},
+		{"invalid date", http.MethodPut, "/api/v1/books/" + bookUid + "/condition", `{"condition":"BAD","date":"11.10.2021"}`, http.StatusUnprocessableEntity, "YYYY-MM-DD"},
+	})
 }
 
-func TestGetBookInfoByUid(t *testing.T) {
+func TestDamageReports(t *testing.T) {
+	run(t, []testCase{
+		{"report a copy", http.MethodPost, "/api/v1/books/" + bookUid + "/damage-reports", `{"libraryUid":"` + libraryUid + `","notes":"water damage"}`, http.StatusCreated, `"status":"IN_REPAIR"`},
+		{"no copy on the shelf", http.MethodPost, "/api/v1/books/" + soldOutUid + "/damage-reports", `{"libraryUid":"` + libraryUid + `"}`, http.StatusConflict, `"code":"CONFLICT"`},
+		{"missing library", http.MethodPost, "/api/v1/books/" + bookUid + "/damage-reports", `{}`, http.StatusUnprocessableEntity, "libraryUid must be given"},
+		{"unknown report", http.MethodPost, "/api/v1/damage-reports/" + unknownUid + "/resolve", `{"status":"WRITTEN_OFF"}`, http.StatusNotFound, `"code":"NOT_FOUND"`},
+		{"invalid status", http.MethodPost, "/api/v1/damage-reports/" + unknownUid + "/resolve", `{"status":"LOST"}`, http.StatusUnprocessableEntity, `"code":"VALIDATION_FAILED"`},
+	})
+}
+
+func TestRepairedCopyGoesBackOnTheShelf(t *testing.T) {
+	router, memory := newTestRouter()
+	ctx := context.Background()
 
-	if 2+2 != 4 {
-		t.Errorf("Unexpected situation")
+	recorder := serve(router, http.MethodPost, "/api/v1/books/"+bookUid+"/damage-reports", `{"libraryUid":"`+libraryUid+`"}`)
+	var report DamageReportResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil || recorder.Code != http.StatusCreated {
+		t.Fatalf("unexpected report %d %s", recorder.Code, recorder.Body.String())
+	}
+	if book, _ := memory.GetBookByUid(ctx, bookUid); book.Available_count != 0 {
+		t.Errorf("expected the copy to be taken off the shelf, got %d", book.Available_count)
+	}
+
+	recorder = serve(router, http.MethodGet, "/api/v1/damage-reports?status=IN_REPAIR&libraryUid="+libraryUid, "")
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), report.ReportUid) {
+		t.Errorf("expected the report to be in repair, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = serve(router, http.MethodPost, "/api/v1/damage-reports/"+report.ReportUid+"/resolve", `{"status":"ON_SHELF","condition":"GOOD","notes":"rebound"}`)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"status":"ON_SHELF"`) {
+		t.Fatalf("expected the report to be resolved, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	if book, _ := memory.GetBookByUid(ctx, bookUid); book.Available_count != 1 || book.Condition != "GOOD" {
+		t.Errorf("expected the copy back on the shelf in GOOD condition, got %+v", book)
+	}
+	if history, _ := memory.GetConditionHistory(ctx, bookUid); len(history) != 1 || history[0].Notes != "rebound" {
+		t.Errorf("expected the repair to be assessed, got %+v", history)
+	}
+
+	recorder = serve(router, http.MethodPost, "/api/v1/damage-reports/"+report.ReportUid+"/resolve", `{"status":"WRITTEN_OFF"}`)
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("expected a resolved report to stay resolved, got %d %s", recorder.Code, recorder.Body.String())
 	}
 }
 
-func TestGetLibraryByUid(t *testing.T) {
+func TestUpdateBookCount(t *testing.T) {
+	run(t, []testCase{
+		{"take a copy", http.MethodPut, "/api/v1/books/" + bookUid + "/count/0/", "", http.StatusOK, "count updated"},
+		{"return a copy", http.MethodPut, "/api/v1/books/" + bookUid + "/count/1/", "", http.StatusOK, "count updated"},
+		{"unknown book", http.MethodPut, "/api/v1/books/" + unknownUid + "/count/1/", "", http.StatusNotFound, `"code":"NOT_FOUND"`},
+	})
+}
+
+func TestUpdateBookCountChangesAvailability(t *testing.T) {
+	router, memory := newTestRouter()
+
+	serve(router, http.MethodPut, "/api/v1/books/"+bookUid+"/count/0/", "")
+	if book, _ := memory.GetBookByUid(context.Background(), bookUid); book.Available_count != 0 {
+		t.Errorf("expected the last copy to be taken, got %d", book.Available_count)
+	}
+
+	serve(router, http.MethodPut, "/api/v1/books/"+bookUid+"/count/1/", "")
+	if book, _ := memory.GetBookByUid(context.Background(), bookUid); book.Available_count != 1 {
+		t.Errorf("expected the copy to be returned, got %d", book.Available_count)
+	}
+}
+
+func TestUpdatesWriteEvents(t *testing.T) {
+	router, memory := newTestRouter()
+
+	serveWithHeader(router, http.MethodPut, "/api/v1/books/"+bookUid+"/", ifMatch, `{"name":"C++","author":"Бьерн Страуструп","genre":"Учебник","materialType":"BOOK"}`)
+	serveWithHeader(router, http.MethodPut, "/api/v1/libraries/"+unknownUid+"/", ifMatch, `{"name":"Центральная","city":"Москва","address":"ул. Арбат, д.1"}`)
+	serveWithHeader(router, http.MethodPut, "/api/v1/libraries/"+libraryUid+"/", ifMatch, `{"name":"Центральная","city":"Москва","address":"ул. Арбат, д.1"}`)
 
-	if 2+2 != 4 {
-		t.Errorf("Unexpected situation")
+	// the gateway drops its cached copies when the relay publishes these
+	events, _ := memory.Outbox().Pending(context.Background(), 10)
+	if len(events) != 2 || events[0].Type != storage.BookUpdated || events[0].EntityUid != bookUid ||
+		events[1].Type != storage.LibraryUpdated || events[1].EntityUid != libraryUid {
+		t.Errorf("expected a book and a library event, got %+v", events)
 	}
 }
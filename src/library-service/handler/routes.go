@@ -0,0 +1,29 @@
+package handler
+
+import (
+	"library-system/src/pkg/audit"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Register adds the routes of library-service to router. Probes and metrics are
+// registered by the caller.
+func (h *Handler) Register(router gin.IRoutes) {
+	router.GET("/api/v1/libraries", h.GetLibrariesByCity)
+	router.GET("/api/v1/libraries/:uid/books/", h.GetBooksByLibraryUid)
+	router.GET("/api/v1/libraries/:uid/", h.GetLibraryByUid)
+	router.PUT("/api/v1/libraries/:uid/", h.UpdateLibrary)
+	router.GET("/api/v1/books", h.GetBooksByUids)
+	router.GET("/api/v1/books/:uid/", h.GetBookInfoByUid)
+	router.PUT("/api/v1/books/:uid/", h.UpdateBook)
+	router.GET("/api/v1/books/:uid/condition", h.GetBookCondition)
+	router.PUT("/api/v1/books/:uid/condition", h.UpdateBookCondition)
+	router.GET("/api/v1/books/:uid/condition/history", h.GetConditionHistory)
+	router.POST("/api/v1/books/:uid/damage-reports", h.CreateDamageReport)
+	router.GET("/api/v1/damage-reports", h.GetDamageReports)
+	router.POST("/api/v1/damage-reports/:uid/resolve", h.ResolveDamageReport)
+	router.PUT("/api/v1/books/:uid/count/:inc/", h.UpdateBookCount)
+	router.GET("/api/v1/audit", audit.Handler(h.storage.Audit(), "library-service"))
+
+	router.GET("/manage/health", h.GetHealth)
+}
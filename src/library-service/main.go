@@ -3,39 +3,105 @@ package main
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"os"
+	"time"
 
 	"library-system/src/library-service/handler"
+	"library-system/src/library-service/migrations"
 	"library-system/src/library-service/storage"
+	"library-system/src/pkg/audit"
+	"library-system/src/pkg/health"
+	"library-system/src/pkg/logging"
+	"library-system/src/pkg/metrics"
+	"library-system/src/pkg/migrate"
+	"library-system/src/pkg/outbox"
+	"library-system/src/pkg/server"
+	"library-system/src/pkg/tracing"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
+	logging.Setup("library-service")
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "library-service")
+	if err != nil {
+		slog.Error("tracing init failed", "error", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
 	postgresURL := fmt.Sprintf("host=%s port=%d user=%s dbname=%s password=%s",
 		"postgres", 5432, "program", "libraries", "test")
 	psqlDB, err := storage.NewPgStorage(context.Background(), postgresURL)
 	if err != nil {
-		fmt.Printf("Postgresql init: %s", err)
-	} else {
-		fmt.Println("Connected to PostreSQL")
+		slog.Error("postgresql init failed", "error", err)
+		os.Exit(1)
 	}
 	defer psqlDB.Close()
 
+	if err = health.WaitFor(context.Background(), "postgres", psqlDB.Ping); err != nil {
+		slog.Error("postgresql init failed", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("connected to PostgreSQL")
+
+	migrator, err := migrate.New(psqlDB.Pool(), migrations.Schema, migrations.Seeds)
+	if err != nil {
+		slog.Error("migrations init failed", "error", err)
+		os.Exit(1)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err = migrator.Command(context.Background(), os.Args[2:], os.Stdout); err != nil {
+			slog.Error("migrate failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err = migrator.OnStart(context.Background()); err != nil {
+		slog.Error("migrations failed", "error", err)
+		os.Exit(1)
+	}
+
+	metrics.RegisterPool(psqlDB)
+
+	checker := health.New(2 * time.Second)
+	checker.Add("postgres", psqlDB.Ping)
+	checker.Add("migrations", migrator.Check)
+
 	handler := handler.NewHandler(psqlDB)
 
-	router := gin.Default()
+	router := gin.New()
+	router.Use(gin.Recovery(), tracing.Middleware("library-service"), logging.Middleware(), audit.Middleware(), metrics.Middleware())
 
 	router.Use(cors.Default())
 
-	router.GET("/api/v1/libraries", handler.GetLibrariesByCity)
-	router.GET("/api/v1/libraries/:uid/books/", handler.GetBooksByLibraryUid)
-	router.GET("/api/v1/libraries/:uid/", handler.GetLibraryByUid)
-	router.GET("/api/v1/books/:uid/", handler.GetBookInfoByUid)
-	router.PUT("/api/v1/books/:uid/condition", handler.UpdateBookCondition)
-	router.PUT("/api/v1/books/:uid/count/:inc/", handler.UpdateBookCount)
+	handler.Register(router)
 
-	router.GET("/manage/health", handler.GetHealth)
+	router.GET("/manage/live", checker.Live)
+	router.GET("/manage/ready", checker.Ready)
+	router.GET("/manage/metrics", metrics.Handler())
 
-	router.Run(":8060")
+	// publish the events of the outbox to the services listening on the
+	// library_events channel and to the webhook subscribers, e.g. the gateway
+	// dropping its cached copies of changed books and libraries
+	outboxInterval, err := time.ParseDuration(os.Getenv("OUTBOX_INTERVAL"))
+	if err != nil {
+		outboxInterval = time.Second
+	}
+	relay := outbox.NewRelay(psqlDB.Outbox(), outbox.Fanout(
+		outbox.NewPgBroker(psqlDB.Pool(), "library_events"),
+		outbox.NewWebhookBroker(os.Getenv("CHANGE_EVENT_SUBSCRIBERS"), os.Getenv("CHANGE_EVENT_TOKEN"), 5*time.Second),
+	))
+
+	srv := server.New(server.ConfigFromEnv(":8060"), router, checker)
+	srv.Go(func(ctx context.Context) { relay.Run(ctx, outboxInterval) })
+
+	if err = srv.Run(); err != nil {
+		slog.Error("server stopped with error", "error", err)
+	}
 }
@@ -0,0 +1,3 @@
+DROP TABLE library_books;
+DROP TABLE books;
+DROP TABLE library;
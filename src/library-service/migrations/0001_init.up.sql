@@ -0,0 +1,33 @@
+-- IF NOT EXISTS adopts databases created by the former init script
+CREATE TABLE IF NOT EXISTS library
+(
+    id          SERIAL PRIMARY KEY,
+    library_uid uuid UNIQUE  NOT NULL,
+    name        VARCHAR(80)  NOT NULL,
+    city        VARCHAR(255) NOT NULL,
+    address     VARCHAR(255) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS books
+(
+    id        SERIAL PRIMARY KEY,
+    book_uid  uuid UNIQUE  NOT NULL,
+    name      VARCHAR(255) NOT NULL,
+    author    VARCHAR(255),
+    genre     VARCHAR(255),
+    condition VARCHAR(20) DEFAULT 'EXCELLENT'
+        CHECK (condition IN ('EXCELLENT', 'GOOD', 'BAD'))
+);
+
+-- the former init script created books without the material type, which
+-- the gateway limits loans by
+ALTER TABLE books
+    ADD COLUMN IF NOT EXISTS material_type VARCHAR(20) NOT NULL DEFAULT 'BOOK'
+        CHECK (material_type IN ('BOOK', 'MAGAZINE', 'AUDIOBOOK', 'EBOOK'));
+
+CREATE TABLE IF NOT EXISTS library_books
+(
+    book_id         INT REFERENCES books (id),
+    library_id      INT REFERENCES library (id),
+    available_count INT NOT NULL
+);
@@ -0,0 +1,2 @@
+DROP TABLE damage_report;
+DROP TABLE book_condition;
@@ -0,0 +1,36 @@
+-- every condition assessment of a book, e.g. on its return or after repair
+CREATE TABLE book_condition
+(
+    id              BIGSERIAL PRIMARY KEY,
+    book_uid        uuid         NOT NULL REFERENCES books (book_uid),
+    condition       VARCHAR(20)  NOT NULL
+        CHECK (condition IN ('EXCELLENT', 'GOOD', 'BAD')),
+    assessor        VARCHAR(80)  NOT NULL,
+    assessed_on     DATE         NOT NULL,
+    reservation_uid uuid,
+    notes           TEXT         NOT NULL DEFAULT '',
+    photos          TEXT[]       NOT NULL DEFAULT '{}',
+    created_at      TIMESTAMP    NOT NULL DEFAULT now()
+);
+
+CREATE INDEX book_condition_book_idx ON book_condition (book_uid, id);
+
+-- copies taken off the shelf for repair, until they are back on it or
+-- written off
+CREATE TABLE damage_report
+(
+    id          BIGSERIAL PRIMARY KEY,
+    report_uid  uuid UNIQUE  NOT NULL,
+    book_uid    uuid         NOT NULL REFERENCES books (book_uid),
+    library_uid uuid         NOT NULL REFERENCES library (library_uid),
+    reported_by VARCHAR(80)  NOT NULL,
+    notes       TEXT         NOT NULL DEFAULT '',
+    photos      TEXT[]       NOT NULL DEFAULT '{}',
+    status      VARCHAR(20)  NOT NULL DEFAULT 'IN_REPAIR'
+        CHECK (status IN ('IN_REPAIR', 'ON_SHELF', 'WRITTEN_OFF')),
+    resolved_by VARCHAR(80)  NOT NULL DEFAULT '',
+    created_at  TIMESTAMP    NOT NULL DEFAULT now(),
+    resolved_at TIMESTAMP
+);
+
+CREATE INDEX damage_report_open_idx ON damage_report (library_uid) WHERE status = 'IN_REPAIR';
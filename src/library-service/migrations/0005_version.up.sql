@@ -0,0 +1,6 @@
+-- version of the record, sent as its ETag and bumped by every update
+ALTER TABLE books
+    ADD COLUMN version INT NOT NULL DEFAULT 1 CHECK (version > 0);
+
+ALTER TABLE library
+    ADD COLUMN version INT NOT NULL DEFAULT 1 CHECK (version > 0);
@@ -0,0 +1,16 @@
+// Package migrations holds the schema migrations of the service database and
+// the seed data loaded in dev mode.
+package migrations
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed *.sql
+var Schema embed.FS
+
+//go:embed seeds/*.sql
+var seeds embed.FS
+
+var Seeds, _ = fs.Sub(seeds, "seeds")
@@ -0,0 +1,15 @@
+INSERT INTO library (id, library_uid, name, city, address)
+VALUES (1, '83575e12-7ce0-48ee-9931-51919ff3c9ee', 'Библиотека имени 7 Непьющих', 'Москва', '2-я Бауманская ул., д.5, стр.1')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO books (id, book_uid, name, author, genre, condition, material_type)
+VALUES (1, 'f7cdc58f-2caf-4b15-9727-f89dcc629b27', 'Краткий курс C++ в 7 томах', 'Бьерн Страуструп', 'Научная фантастика', 'EXCELLENT', 'BOOK')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO library_books (book_id, library_id, available_count)
+SELECT 1, 1, 1
+WHERE NOT EXISTS (SELECT 1 FROM library_books WHERE book_id = 1 AND library_id = 1);
+
+-- the rows above are inserted with explicit ids
+SELECT setval('library_id_seq', (SELECT MAX(id) FROM library));
+SELECT setval('books_id_seq', (SELECT MAX(id) FROM books));
@@ -0,0 +1,417 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"library-system/src/pkg/apierror"
+	"library-system/src/pkg/audit"
+	"library-system/src/pkg/outbox"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Assessment records the condition a book was found in, e.g. on its return
+// or after a repair.
+type Assessment struct {
+	ID              int64     `json:"id"`
+	Book_uid        string    `json:"book_uid"`
+	Condition       string    `json:"condition"`
+	Assessor        string    `json:"assessor"`
+	Assessed_on     time.Time `json:"assessed_on"`
+	Reservation_uid string    `json:"reservation_uid"`
+	Notes           string    `json:"notes"`
+	Photos          []string  `json:"photos"`
+}
+
+// Statuses of a damage report. A reported copy is taken off the shelf and
+// stays IN_REPAIR until it is put back ON_SHELF or WRITTEN_OFF.
+const (
+	RepairInProgress = "IN_REPAIR"
+	RepairOnShelf    = "ON_SHELF"
+	RepairWrittenOff = "WRITTEN_OFF"
+)
+
+type DamageReport struct {
+	ID          int64      `json:"id"`
+	Report_uid  string     `json:"report_uid"`
+	Book_uid    string     `json:"book_uid"`
+	Library_uid string     `json:"library_uid"`
+	Reported_by string     `json:"reported_by"`
+	Notes       string     `json:"notes"`
+	Photos      []string   `json:"photos"`
+	Status      string     `json:"status"`
+	Resolved_by string     `json:"resolved_by"`
+	Created_at  time.Time  `json:"created_at"`
+	Resolved_at *time.Time `json:"resolved_at"`
+}
+
+// DamageReportFilter narrows down damage reports. Empty fields match all.
+type DamageReportFilter struct {
+	Library_uid string
+	Book_uid    string
+	Status      string
+}
+
+// Resolution ends the repair of a damage report: the copy is put back on the
+// shelf in Condition, which is recorded as an assessment, or written off.
+type Resolution struct {
+	Report_uid  string
+	Status      string
+	Condition   string
+	Resolved_by string
+	Resolved_on time.Time
+	Notes       string
+}
+
+// BookConditionChanged is written to the outbox with a BookConditionEvent as
+// payload whenever an assessment changes the condition of a book.
+const BookConditionChanged = "book.condition_changed"
+
+type BookConditionEvent struct {
+	BookUid           string `json:"bookUid"`
+	Condition         string `json:"condition"`
+	PreviousCondition string `json:"previousCondition"`
+	ReservationUid    string `json:"reservationUid,omitempty"`
+}
+
+// Actions on damage reports recorded in the audit log.
+const (
+	AuditDamageReported = "damage_report.created"
+	AuditDamageResolved = "damage_report.resolved"
+)
+
+type repairAudit struct {
+	Status    string `json:"status"`
+	Condition string `json:"condition,omitempty"`
+}
+
+// assessed returns the event and the audit entry of assessment of a book
+// previously in previousCondition. The event is empty if the condition has not
+// changed.
+func assessed(ctx context.Context, assessment Assessment, previousCondition string) (*outbox.Event, audit.Entry, error) {
+	entry, err := audit.New(ctx, AuditBookConditionUpdated, "book", assessment.Book_uid,
+		conditionAudit{Condition: previousCondition}, conditionAudit{Condition: assessment.Condition})
+	if err != nil || previousCondition == assessment.Condition {
+		return nil, entry, err
+	}
+
+	event, err := outbox.New(BookConditionChanged, assessment.Book_uid, BookConditionEvent{
+		BookUid:           assessment.Book_uid,
+		Condition:         assessment.Condition,
+		PreviousCondition: previousCondition,
+		ReservationUid:    assessment.Reservation_uid,
+	})
+	if err != nil {
+		return nil, audit.Entry{}, err
+	}
+
+	return &event, entry, nil
+}
+
+// countChanged returns the event and the audit entry of the change of the
+// copies of a book available in a library.
+func countChanged(ctx context.Context, change BookCountEvent, previousCount int) (outbox.Event, audit.Entry, error) {
+	event, err := bookCountChangedEvent(change)
+	if err != nil {
+		return outbox.Event{}, audit.Entry{}, err
+	}
+
+	entry, err := audit.New(ctx, AuditBookCountUpdated, "book", change.BookUid,
+		countAudit{LibraryUid: change.LibraryUid, AvailableCount: previousCount},
+		countAudit{LibraryUid: change.LibraryUid, AvailableCount: change.AvailableCount})
+	if err != nil {
+		return outbox.Event{}, audit.Entry{}, err
+	}
+
+	return event, entry, nil
+}
+
+func (pg *postgres) UpdateBookCondition(ctx context.Context, assessment Assessment) (string, error) {
+	var previousCondition string
+
+	err := pgx.BeginFunc(ctx, pg.db, func(tx pgx.Tx) (err error) {
+		previousCondition, err = pg.assess(ctx, tx, assessment)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return previousCondition, nil
+}
+
+// assess records assessment and sets the condition of the book to it as part
+// of tx, returning the previous condition.
+func (pg *postgres) assess(ctx context.Context, tx pgx.Tx, assessment Assessment) (string, error) {
+	query := `UPDATE books SET condition = @condition
+		FROM (SELECT id, condition FROM books WHERE book_uid = @book_uid FOR UPDATE) previous
+		WHERE books.id = previous.id RETURNING previous.condition`
+
+	photos := assessment.Photos
+	if photos == nil {
+		photos = []string{}
+	}
+
+	args := pgx.NamedArgs{
+		"book_uid":        assessment.Book_uid,
+		"condition":       assessment.Condition,
+		"assessor":        assessment.Assessor,
+		"assessed_on":     assessment.Assessed_on,
+		"reservation_uid": assessment.Reservation_uid,
+		"notes":           assessment.Notes,
+		"photos":          photos,
+	}
+
+	var previousCondition string
+
+	err := tx.QueryRow(ctx, query, args).Scan(&previousCondition)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to update row: %w", err)
+	}
+
+	query = `INSERT INTO book_condition (book_uid, condition, assessor, assessed_on, reservation_uid, notes, photos)
+		VALUES (@book_uid, @condition, @assessor, @assessed_on, NULLIF(@reservation_uid, '')::uuid, @notes, @photos)`
+
+	if _, err = tx.Exec(ctx, query, args); err != nil {
+		return "", fmt.Errorf("unable to insert row: %w", err)
+	}
+
+	event, entry, err := assessed(ctx, assessment, previousCondition)
+	if err != nil {
+		return "", err
+	}
+	if event != nil {
+		if err = outbox.Write(ctx, tx, *event); err != nil {
+			return "", err
+		}
+	}
+
+	return previousCondition, audit.Write(ctx, tx, entry)
+}
+
+// moveCopy changes the copies of a book on the shelf of a library by delta as
+// part of tx. It fails with a conflict if there is no copy left to take.
+func (pg *postgres) moveCopy(ctx context.Context, tx pgx.Tx, bookUid string, libraryUid string, delta int) error {
+	query := `UPDATE library_books SET available_count = available_count + @delta FROM books, library
+		WHERE library_books.book_id = books.id AND library_books.library_id = library.id
+		AND books.book_uid = @book_uid AND library.library_uid = @library_uid
+		RETURNING library_books.available_count`
+
+	args := pgx.NamedArgs{"book_uid": bookUid, "library_uid": libraryUid, "delta": delta}
+
+	var count int
+
+	err := tx.QueryRow(ctx, query, args).Scan(&count)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return apierror.NotFound("book %s is not held by library %s", bookUid, libraryUid)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to update row: %w", err)
+	}
+	if count < 0 {
+		// rolls the update back with the transaction
+		return apierror.Conflict("no copy of book %s is on the shelf of library %s", bookUid, libraryUid)
+	}
+
+	event, entry, err := countChanged(ctx, BookCountEvent{BookUid: bookUid, LibraryUid: libraryUid, AvailableCount: count}, count-delta)
+	if err != nil {
+		return err
+	}
+	if err = outbox.Write(ctx, tx, event); err != nil {
+		return err
+	}
+
+	return audit.Write(ctx, tx, entry)
+}
+
+func (pg *postgres) GetConditionHistory(ctx context.Context, bookUid string) ([]Assessment, error) {
+	query := `SELECT id, book_uid::text, condition, assessor, assessed_on, COALESCE(reservation_uid::text, ''), notes, photos
+		FROM book_condition WHERE book_uid = @book_uid ORDER BY id DESC`
+
+	rows, err := pg.db.Query(ctx, query, pgx.NamedArgs{"book_uid": bookUid})
+	if err != nil {
+		return nil, fmt.Errorf("unable to query: %w", err)
+	}
+
+	history, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Assessment, error) {
+		var assessment Assessment
+		err := row.Scan(&assessment.ID, &assessment.Book_uid, &assessment.Condition, &assessment.Assessor, &assessment.Assessed_on,
+			&assessment.Reservation_uid, &assessment.Notes, &assessment.Photos)
+		return assessment, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to query: %w", err)
+	}
+
+	return history, nil
+}
+
+const damageReportColumns = `id, report_uid::text, book_uid::text, library_uid::text, reported_by, notes, photos,
+	status, resolved_by, created_at, resolved_at`
+
+func scanDamageReport(row pgx.Row) (DamageReport, error) {
+	var report DamageReport
+	err := row.Scan(&report.ID, &report.Report_uid, &report.Book_uid, &report.Library_uid, &report.Reported_by, &report.Notes,
+		&report.Photos, &report.Status, &report.Resolved_by, &report.Created_at, &report.Resolved_at)
+	return report, err
+}
+
+func (pg *postgres) CreateDamageReport(ctx context.Context, report DamageReport) (DamageReport, error) {
+	report.Report_uid = uuid.New().String()
+	report.Status = RepairInProgress
+	if report.Photos == nil {
+		report.Photos = []string{}
+	}
+
+	query := `INSERT INTO damage_report (report_uid, book_uid, library_uid, reported_by, notes, photos)
+		VALUES (@report_uid, @book_uid, @library_uid, @reported_by, @notes, @photos)
+		RETURNING ` + damageReportColumns
+
+	err := pgx.BeginFunc(ctx, pg.db, func(tx pgx.Tx) error {
+		if err := pg.moveCopy(ctx, tx, report.Book_uid, report.Library_uid, -1); err != nil {
+			return err
+		}
+
+		created, err := scanDamageReport(tx.QueryRow(ctx, query, pgx.NamedArgs{
+			"report_uid":  report.Report_uid,
+			"book_uid":    report.Book_uid,
+			"library_uid": report.Library_uid,
+			"reported_by": report.Reported_by,
+			"notes":       report.Notes,
+			"photos":      report.Photos,
+		}))
+		if err != nil {
+			return fmt.Errorf("unable to insert row: %w", err)
+		}
+		report = created
+
+		entry, err := audit.New(ctx, AuditDamageReported, "damage_report", report.Report_uid, nil, report)
+		if err != nil {
+			return err
+		}
+
+		return audit.Write(ctx, tx, entry)
+	})
+	if err != nil {
+		return DamageReport{}, err
+	}
+
+	return report, nil
+}
+
+func (pg *postgres) GetDamageReports(ctx context.Context, filter DamageReportFilter) ([]DamageReport, error) {
+	query := `SELECT ` + damageReportColumns + ` FROM damage_report
+		WHERE (@library_uid = '' OR library_uid::text = @library_uid)
+		AND (@book_uid = '' OR book_uid::text = @book_uid)
+		AND (@status = '' OR status = @status)
+		ORDER BY id`
+
+	rows, err := pg.db.Query(ctx, query, pgx.NamedArgs{
+		"library_uid": filter.Library_uid,
+		"book_uid":    filter.Book_uid,
+		"status":      filter.Status,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to query: %w", err)
+	}
+
+	reports, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (DamageReport, error) {
+		return scanDamageReport(row)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to query: %w", err)
+	}
+
+	return reports, nil
+}
+
+func (pg *postgres) ResolveDamageReport(ctx context.Context, resolution Resolution) (DamageReport, error) {
+	if err := validResolution(resolution); err != nil {
+		return DamageReport{}, err
+	}
+
+	var report DamageReport
+
+	err := pgx.BeginFunc(ctx, pg.db, func(tx pgx.Tx) error {
+		query := `SELECT ` + damageReportColumns + ` FROM damage_report WHERE report_uid = @report_uid FOR UPDATE`
+
+		previous, err := scanDamageReport(tx.QueryRow(ctx, query, pgx.NamedArgs{"report_uid": resolution.Report_uid}))
+		if errors.Is(err, pgx.ErrNoRows) {
+			return apierror.NotFound("damage report %s not found", resolution.Report_uid)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to query: %w", err)
+		}
+		if previous.Status != RepairInProgress {
+			return apierror.Conflict("damage report %s is %s already", resolution.Report_uid, previous.Status)
+		}
+
+		query = `UPDATE damage_report SET status = @status, resolved_by = @resolved_by, resolved_at = now()
+			WHERE report_uid = @report_uid RETURNING ` + damageReportColumns
+
+		report, err = scanDamageReport(tx.QueryRow(ctx, query, pgx.NamedArgs{
+			"report_uid":  resolution.Report_uid,
+			"status":      resolution.Status,
+			"resolved_by": resolution.Resolved_by,
+		}))
+		if err != nil {
+			return fmt.Errorf("unable to update row: %w", err)
+		}
+
+		if resolution.Status == RepairOnShelf {
+			if _, err = pg.assess(ctx, tx, repairedAssessment(report, resolution)); err != nil {
+				return err
+			}
+			if err = pg.moveCopy(ctx, tx, report.Book_uid, report.Library_uid, 1); err != nil {
+				return err
+			}
+		}
+
+		entry, err := audit.New(ctx, AuditDamageResolved, "damage_report", report.Report_uid,
+			repairAudit{Status: previous.Status}, repairAudit{Status: report.Status, Condition: resolution.Condition})
+		if err != nil {
+			return err
+		}
+
+		return audit.Write(ctx, tx, entry)
+	})
+	if err != nil {
+		return DamageReport{}, err
+	}
+
+	return report, nil
+}
+
+// repairedAssessment is the assessment of the copy of report put back on the
+// shelf by resolution.
+func repairedAssessment(report DamageReport, resolution Resolution) Assessment {
+	return Assessment{
+		Book_uid:    report.Book_uid,
+		Condition:   resolution.Condition,
+		Assessor:    resolution.Resolved_by,
+		Assessed_on: resolution.Resolved_on,
+		Notes:       resolution.Notes,
+	}
+}
+
+// validResolution reports the validation errors of resolution like postgres
+// does, and that a copy put back on the shelf needs a condition.
+func validResolution(resolution Resolution) error {
+	switch resolution.Status {
+	case RepairOnShelf:
+		if !conditions[resolution.Condition] {
+			return apierror.Validation("invalid condition %q", resolution.Condition)
+		}
+	case RepairWrittenOff:
+	default:
+		return apierror.Validation("status must be %s or %s", RepairOnShelf, RepairWrittenOff)
+	}
+	return nil
+}
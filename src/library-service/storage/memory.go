@@ -0,0 +1,572 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"library-system/src/pkg/apierror"
+	"library-system/src/pkg/audit"
+	"library-system/src/pkg/etag"
+	"library-system/src/pkg/outbox"
+
+	"github.com/google/uuid"
+)
+
+var (
+	conditions    = map[string]bool{"EXCELLENT": true, "GOOD": true, "BAD": true}
+	materialTypes = map[string]bool{"BOOK": true, "MAGAZINE": true, "AUDIOBOOK": true, "EBOOK": true}
+)
+
+type libraryBook struct {
+	bookId          int
+	libraryId       int
+	available_count int
+}
+
+// memory is a Storage kept in memory with the semantics of postgres, for
+// tests and local development.
+type memory struct {
+	mu           sync.Mutex
+	libraries    []Library
+	books        []BookInfo
+	libraryBooks []libraryBook
+	outbox       outbox.MemoryStore
+	audit        audit.MemoryLog
+
+	assessments   []Assessment
+	damageReports []DamageReport
+}
+
+func NewMemory() *memory {
+	return &memory{outbox: outbox.NewMemoryStore(), audit: audit.NewMemoryLog()}
+}
+
+func (m *memory) Outbox() outbox.Store {
+	return m.outbox
+}
+
+func (m *memory) Audit() audit.Log {
+	return m.audit
+}
+
+// AddLibrary inserts a library and returns it with its id.
+func (m *memory) AddLibrary(library Library) Library {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	library.ID = len(m.libraries) + 1
+	library.Version = 1
+	m.libraries = append(m.libraries, library)
+
+	return library
+}
+
+// AddBook inserts a book and puts count copies of it into the library.
+func (m *memory) AddBook(libraryUid string, book BookInfo, count int) BookInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if book.Condition == "" {
+		book.Condition = "EXCELLENT"
+	}
+	if book.Material_type == "" {
+		book.Material_type = "BOOK"
+	}
+
+	book.ID = len(m.books) + 1
+	book.Version = 1
+	m.books = append(m.books, book)
+
+	for _, library := range m.libraries {
+		if library.Library_uid == libraryUid {
+			m.libraryBooks = append(m.libraryBooks, libraryBook{bookId: book.ID, libraryId: library.ID, available_count: count})
+		}
+	}
+
+	return book
+}
+
+// validUids reports a validation error like postgres does for malformed uuids.
+func validUids(uids ...string) error {
+	for _, uid := range uids {
+		if _, err := uuid.Parse(uid); err != nil {
+			return apierror.Validation("invalid input syntax for type uuid: %q", uid)
+		}
+	}
+	return nil
+}
+
+func (m *memory) bookByUid(bookUid string) (BookInfo, bool) {
+	for _, book := range m.books {
+		if book.Book_uid == bookUid {
+			return book, true
+		}
+	}
+	return BookInfo{}, false
+}
+
+func (m *memory) bookById(bookId int) BookInfo {
+	return m.books[bookId-1]
+}
+
+func withCount(book BookInfo, count int) Book {
+	return Book{
+		ID:              book.ID,
+		Book_uid:        book.Book_uid,
+		Name:            book.Name,
+		Author:          book.Author,
+		Genre:           book.Genre,
+		Condition:       book.Condition,
+		Material_type:   book.Material_type,
+		Version:         book.Version,
+		Available_count: count,
+	}
+}
+
+func (m *memory) GetLibrariesByCity(ctx context.Context, city string) ([]Library, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	libraries := []Library{}
+	for _, library := range m.libraries {
+		if library.City == city {
+			libraries = append(libraries, library)
+		}
+	}
+
+	return libraries, nil
+}
+
+func (m *memory) GetBooksByLibraryUid(ctx context.Context, libraryUid string, showAll bool) ([]Book, error) {
+	if err := validUids(libraryUid); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	books := []Book{}
+	for _, library := range m.libraries {
+		if library.Library_uid != libraryUid {
+			continue
+		}
+		for _, lb := range m.libraryBooks {
+			if lb.libraryId == library.ID && (showAll || lb.available_count > 0) {
+				books = append(books, withCount(m.bookById(lb.bookId), lb.available_count))
+			}
+		}
+	}
+
+	return books, nil
+}
+
+func (m *memory) GetBookByUid(ctx context.Context, bookUid string) (Book, error) {
+	if err := validUids(bookUid); err != nil {
+		return Book{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if book, ok := m.bookByUid(bookUid); ok {
+		for _, lb := range m.libraryBooks {
+			if lb.bookId == book.ID {
+				return withCount(book, lb.available_count), nil
+			}
+		}
+	}
+
+	return Book{}, apierror.NotFound("book not found")
+}
+
+func (m *memory) GetBookInfoByUid(ctx context.Context, bookUid string) (BookInfo, error) {
+	if err := validUids(bookUid); err != nil {
+		return BookInfo{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	book, ok := m.bookByUid(bookUid)
+	if !ok {
+		return BookInfo{}, apierror.NotFound("book not found")
+	}
+
+	return book, nil
+}
+
+func (m *memory) GetLibraryByUid(ctx context.Context, libraryUid string) (Library, error) {
+	if err := validUids(libraryUid); err != nil {
+		return Library{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, library := range m.libraries {
+		if library.Library_uid == libraryUid {
+			return library, nil
+		}
+	}
+
+	return Library{}, apierror.NotFound("library not found")
+}
+
+func (m *memory) GetBooksByUids(ctx context.Context, bookUids []string) ([]BookInfo, error) {
+	if err := validUids(bookUids...); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	books := []BookInfo{}
+	for _, book := range m.books {
+		for _, uid := range bookUids {
+			if book.Book_uid == uid {
+				books = append(books, book)
+				break
+			}
+		}
+	}
+
+	return books, nil
+}
+
+func (m *memory) GetLibrariesByUids(ctx context.Context, libraryUids []string) ([]Library, error) {
+	if err := validUids(libraryUids...); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	libraries := []Library{}
+	for _, library := range m.libraries {
+		for _, uid := range libraryUids {
+			if library.Library_uid == uid {
+				libraries = append(libraries, library)
+				break
+			}
+		}
+	}
+
+	return libraries, nil
+}
+
+func (m *memory) UpdateBookCount(ctx context.Context, bookId int, count int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.libraryBooks {
+		if m.libraryBooks[i].bookId == bookId {
+			previousCount := m.libraryBooks[i].available_count
+			m.libraryBooks[i].available_count = count
+
+			change := BookCountEvent{
+				BookUid:        m.bookById(bookId).Book_uid,
+				LibraryUid:     m.libraries[m.libraryBooks[i].libraryId-1].Library_uid,
+				AvailableCount: count,
+			}
+
+			event, err := bookCountChangedEvent(change)
+			if err != nil {
+				return err
+			}
+			m.outbox.Add(event)
+
+			entry, err := audit.New(ctx, AuditBookCountUpdated, "book", change.BookUid,
+				countAudit{LibraryUid: change.LibraryUid, AvailableCount: previousCount},
+				countAudit{LibraryUid: change.LibraryUid, AvailableCount: count})
+			if err != nil {
+				return err
+			}
+			m.audit.Add(entry)
+		}
+	}
+
+	return nil
+}
+
+func (m *memory) UpdateBookCondition(ctx context.Context, assessment Assessment) (string, error) {
+	if err := validAssessment(assessment); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.assess(ctx, assessment)
+}
+
+func validAssessment(assessment Assessment) error {
+	if err := validUids(assessment.Book_uid); err != nil {
+		return err
+	}
+	if assessment.Reservation_uid != "" {
+		if err := validUids(assessment.Reservation_uid); err != nil {
+			return err
+		}
+	}
+	if !conditions[assessment.Condition] {
+		return apierror.Validation("invalid condition %q", assessment.Condition)
+	}
+	return nil
+}
+
+// assess is UpdateBookCondition with m.mu held.
+func (m *memory) assess(ctx context.Context, assessment Assessment) (string, error) {
+	for i := range m.books {
+		if m.books[i].Book_uid == assessment.Book_uid {
+			previousCondition := m.books[i].Condition
+
+			event, entry, err := assessed(ctx, assessment, previousCondition)
+			if err != nil {
+				return "", err
+			}
+
+			if assessment.Photos == nil {
+				assessment.Photos = []string{}
+			}
+			assessment.ID = int64(len(m.assessments) + 1)
+			assessment.Assessed_on = assessment.Assessed_on.Truncate(24 * time.Hour)
+
+			m.books[i].Condition = assessment.Condition
+			m.assessments = append(m.assessments, assessment)
+			if event != nil {
+				m.outbox.Add(*event)
+			}
+			m.audit.Add(entry)
+
+			return previousCondition, nil
+		}
+	}
+
+	return "", ErrNotFound
+}
+
+// moveCopy changes the copies of a book on the shelf of a library by delta
+// with m.mu held, like postgres does.
+func (m *memory) moveCopy(ctx context.Context, bookUid string, libraryUid string, delta int) error {
+	book, _ := m.bookByUid(bookUid)
+
+	for i := range m.libraryBooks {
+		shelf := &m.libraryBooks[i]
+		if shelf.bookId != book.ID || m.libraries[shelf.libraryId-1].Library_uid != libraryUid {
+			continue
+		}
+
+		if shelf.available_count+delta < 0 {
+			return apierror.Conflict("no copy of book %s is on the shelf of library %s", bookUid, libraryUid)
+		}
+
+		event, entry, err := countChanged(ctx, BookCountEvent{BookUid: bookUid, LibraryUid: libraryUid, AvailableCount: shelf.available_count + delta}, shelf.available_count)
+		if err != nil {
+			return err
+		}
+
+		shelf.available_count += delta
+		m.outbox.Add(event)
+		m.audit.Add(entry)
+
+		return nil
+	}
+
+	return apierror.NotFound("book %s is not held by library %s", bookUid, libraryUid)
+}
+
+func (m *memory) GetConditionHistory(ctx context.Context, bookUid string) ([]Assessment, error) {
+	if err := validUids(bookUid); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	history := []Assessment{}
+	for i := len(m.assessments) - 1; i >= 0; i-- {
+		if m.assessments[i].Book_uid == bookUid {
+			history = append(history, m.assessments[i])
+		}
+	}
+
+	return history, nil
+}
+
+func (m *memory) CreateDamageReport(ctx context.Context, report DamageReport) (DamageReport, error) {
+	if err := validUids(report.Book_uid, report.Library_uid); err != nil {
+		return DamageReport{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	report.ID = int64(len(m.damageReports) + 1)
+	report.Report_uid = uuid.New().String()
+	report.Status = RepairInProgress
+	report.Created_at = time.Now().UTC()
+	if report.Photos == nil {
+		report.Photos = []string{}
+	}
+
+	entry, err := audit.New(ctx, AuditDamageReported, "damage_report", report.Report_uid, nil, report)
+	if err != nil {
+		return DamageReport{}, err
+	}
+
+	if err = m.moveCopy(ctx, report.Book_uid, report.Library_uid, -1); err != nil {
+		return DamageReport{}, err
+	}
+
+	m.damageReports = append(m.damageReports, report)
+	m.audit.Add(entry)
+
+	return report, nil
+}
+
+func (m *memory) GetDamageReports(ctx context.Context, filter DamageReportFilter) ([]DamageReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reports := []DamageReport{}
+	for _, report := range m.damageReports {
+		if (filter.Library_uid == "" || report.Library_uid == filter.Library_uid) &&
+			(filter.Book_uid == "" || report.Book_uid == filter.Book_uid) &&
+			(filter.Status == "" || report.Status == filter.Status) {
+			reports = append(reports, report)
+		}
+	}
+
+	return reports, nil
+}
+
+func (m *memory) ResolveDamageReport(ctx context.Context, resolution Resolution) (DamageReport, error) {
+	if err := validUids(resolution.Report_uid); err != nil {
+		return DamageReport{}, err
+	}
+	if err := validResolution(resolution); err != nil {
+		return DamageReport{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.damageReports {
+		report := m.damageReports[i]
+		if report.Report_uid != resolution.Report_uid {
+			continue
+		}
+
+		if report.Status != RepairInProgress {
+			return DamageReport{}, apierror.Conflict("damage report %s is %s already", resolution.Report_uid, report.Status)
+		}
+
+		resolvedAt := time.Now().UTC()
+		report.Status = resolution.Status
+		report.Resolved_by = resolution.Resolved_by
+		report.Resolved_at = &resolvedAt
+
+		entry, err := audit.New(ctx, AuditDamageResolved, "damage_report", report.Report_uid,
+			repairAudit{Status: RepairInProgress}, repairAudit{Status: report.Status, Condition: resolution.Condition})
+		if err != nil {
+			return DamageReport{}, err
+		}
+
+		if resolution.Status == RepairOnShelf {
+			if _, err = m.assess(ctx, repairedAssessment(report, resolution)); err != nil {
+				return DamageReport{}, err
+			}
+			if err = m.moveCopy(ctx, report.Book_uid, report.Library_uid, 1); err != nil {
+				return DamageReport{}, err
+			}
+		}
+
+		m.damageReports[i] = report
+		m.audit.Add(entry)
+
+		return report, nil
+	}
+
+	return DamageReport{}, apierror.NotFound("damage report %s not found", resolution.Report_uid)
+}
+
+func (m *memory) UpdateBook(ctx context.Context, book BookInfo) (int, error) {
+	if err := validUids(book.Book_uid); err != nil {
+		return 0, err
+	}
+	if !materialTypes[book.Material_type] {
+		return 0, apierror.Validation("invalid material type %q", book.Material_type)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.books {
+		if m.books[i].Book_uid == book.Book_uid {
+			if !etag.Matches(book.Version, m.books[i].Version) {
+				return 0, apierror.PreconditionFailed("book %s has changed since version %d", book.Book_uid, book.Version)
+			}
+
+			entry, err := audit.New(ctx, AuditBookUpdated, "book", book.Book_uid, bookAudit(m.books[i]), bookAudit(book))
+			if err != nil {
+				return 0, err
+			}
+
+			m.books[i].Name = book.Name
+			m.books[i].Author = book.Author
+			m.books[i].Genre = book.Genre
+			m.books[i].Material_type = book.Material_type
+			m.books[i].Version++
+
+			event, err := bookUpdatedEvent(book)
+			if err != nil {
+				return 0, err
+			}
+			m.outbox.Add(event)
+			m.audit.Add(entry)
+
+			return m.books[i].Version, nil
+		}
+	}
+
+	return 0, ErrNotFound
+}
+
+func (m *memory) UpdateLibrary(ctx context.Context, library Library) (int, error) {
+	if err := validUids(library.Library_uid); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.libraries {
+		if m.libraries[i].Library_uid == library.Library_uid {
+			if !etag.Matches(library.Version, m.libraries[i].Version) {
+				return 0, apierror.PreconditionFailed("library %s has changed since version %d", library.Library_uid, library.Version)
+			}
+
+			entry, err := audit.New(ctx, AuditLibraryUpdated, "library", library.Library_uid, libraryAudit(m.libraries[i]), libraryAudit(library))
+			if err != nil {
+				return 0, err
+			}
+
+			m.libraries[i].Name = library.Name
+			m.libraries[i].City = library.City
+			m.libraries[i].Address = library.Address
+			m.libraries[i].Version++
+
+			event, err := libraryUpdatedEvent(library)
+			if err != nil {
+				return 0, err
+			}
+			m.outbox.Add(event)
+			m.audit.Add(entry)
+
+			return m.libraries[i].Version, nil
+		}
+	}
+
+	return 0, ErrNotFound
+}
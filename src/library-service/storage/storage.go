@@ -2,19 +2,29 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"sync"
+	"log/slog"
+
+	"library-system/src/pkg/apierror"
+	"library-system/src/pkg/audit"
+	"library-system/src/pkg/etag"
+	"library-system/src/pkg/outbox"
+	"library-system/src/pkg/tracing"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+var ErrNotFound = apierror.NotFound("not found")
+
 type Library struct {
 	ID          int    `json:"id"`
 	Library_uid string `json:"library_uid"`
 	Name        string `json:"name"`
 	City        string `json:"city"`
 	Address     string `json:"address"`
+	Version     int    `json:"version"`
 }
 
 type Book struct {
@@ -24,26 +34,128 @@ type Book struct {
 	Author          string `json:"author"`
 	Genre           string `json:"genre"`
 	Condition       string `json:"condition"`
+	Material_type   string `json:"material_type"`
+	Version         int    `json:"version"`
 	Available_count int    `json:"available_count"`
 }
 
 type BookInfo struct {
-	ID        int    `json:"id"`
-	Book_uid  string `json:"book_uid"`
-	Name      string `json:"name"`
-	Author    string `json:"author"`
-	Genre     string `json:"genre"`
+	ID            int    `json:"id"`
+	Book_uid      string `json:"book_uid"`
+	Name          string `json:"name"`
+	Author        string `json:"author"`
+	Genre         string `json:"genre"`
+	Condition     string `json:"condition"`
+	Material_type string `json:"material_type"`
+	Version       int    `json:"version"`
+}
+
+// Events written to the outbox.
+const (
+	BookUpdated      = "book.updated"       // BookEvent
+	BookCountChanged = "book.count_changed" // BookCountEvent
+	LibraryUpdated   = "library.updated"    // LibraryEvent
+)
+
+type BookEvent struct {
+	BookUid      string `json:"bookUid"`
+	Name         string `json:"name"`
+	Author       string `json:"author"`
+	Genre        string `json:"genre"`
+	MaterialType string `json:"materialType"`
+}
+
+type BookCountEvent struct {
+	BookUid        string `json:"bookUid"`
+	LibraryUid     string `json:"libraryUid"`
+	AvailableCount int    `json:"availableCount"`
+}
+
+type LibraryEvent struct {
+	LibraryUid string `json:"libraryUid"`
+	Name       string `json:"name"`
+	City       string `json:"city"`
+	Address    string `json:"address"`
+}
+
+func bookUpdatedEvent(book BookInfo) (outbox.Event, error) {
+	return outbox.New(BookUpdated, book.Book_uid, bookAudit(book))
+}
+
+func libraryUpdatedEvent(library Library) (outbox.Event, error) {
+	return outbox.New(LibraryUpdated, library.Library_uid, libraryAudit(library))
+}
+
+func bookCountChangedEvent(count BookCountEvent) (outbox.Event, error) {
+	return outbox.New(BookCountChanged, count.BookUid, count)
+}
+
+// Actions recorded in the audit log.
+const (
+	AuditBookConditionUpdated = "book.condition_updated"
+	AuditBookUpdated          = "book.updated"
+	AuditBookCountUpdated     = "book.count_updated"
+	AuditLibraryUpdated       = "library.updated"
+)
+
+type conditionAudit struct {
 	Condition string `json:"condition"`
 }
 
+type countAudit struct {
+	LibraryUid     string `json:"libraryUid"`
+	AvailableCount int    `json:"availableCount"`
+}
+
+func bookAudit(book BookInfo) BookEvent {
+	return BookEvent{
+		BookUid:      book.Book_uid,
+		Name:         book.Name,
+		Author:       book.Author,
+		Genre:        book.Genre,
+		MaterialType: book.Material_type,
+	}
+}
+
+func libraryAudit(library Library) LibraryEvent {
+	return LibraryEvent{
+		LibraryUid: library.Library_uid,
+		Name:       library.Name,
+		City:       library.City,
+		Address:    library.Address,
+	}
+}
+
 type Storage interface {
 	GetLibrariesByCity(ctx context.Context, city string) ([]Library, error)
 	GetBooksByLibraryUid(ctx context.Context, libraryUid string, showAll bool) ([]Book, error)
 	GetBookByUid(ctx context.Context, bookUid string) (Book, error)
 	GetBookInfoByUid(ctx context.Context, bookUid string) (BookInfo, error)
 	GetLibraryByUid(ctx context.Context, libraryUid string) (Library, error)
+	GetBooksByUids(ctx context.Context, bookUids []string) ([]BookInfo, error)
+	GetLibrariesByUids(ctx context.Context, libraryUids []string) ([]Library, error)
 	UpdateBookCount(ctx context.Context, bookId int, count int) error
-	UpdateBookCondition(ctx context.Context, bookUid string, condition string) error
+	// UpdateBookCondition records assessment and sets the condition of the
+	// book to it, returning the condition it had before.
+	UpdateBookCondition(ctx context.Context, assessment Assessment) (string, error)
+	// GetConditionHistory returns the assessments of a book, newest first.
+	GetConditionHistory(ctx context.Context, bookUid string) ([]Assessment, error)
+	// UpdateBook updates the book unless it has changed since book.Version,
+	// which is etag.Any to update it whatever its version, and returns its
+	// new version.
+	UpdateBook(ctx context.Context, book BookInfo) (int, error)
+	// UpdateLibrary updates the library like UpdateBook.
+	UpdateLibrary(ctx context.Context, library Library) (int, error)
+	// CreateDamageReport takes a copy of the book off the shelf of the library
+	// for repair.
+	CreateDamageReport(ctx context.Context, report DamageReport) (DamageReport, error)
+	GetDamageReports(ctx context.Context, filter DamageReportFilter) ([]DamageReport, error)
+	// ResolveDamageReport puts the copy back on the shelf or writes it off.
+	ResolveDamageReport(ctx context.Context, resolution Resolution) (DamageReport, error)
+	// Outbox holds the events of the changes above.
+	Outbox() outbox.Store
+	// Audit holds the audit trail of the changes above.
+	Audit() audit.Log
 }
 
 type postgres struct {
@@ -51,31 +163,40 @@ type postgres struct {
 }
 
 func NewPgStorage(ctx context.Context, connString string) (*postgres, error) {
-	var pgInstance *postgres
-	var pgOnce sync.Once
-	pgOnce.Do(func() {
-		db, err := pgxpool.New(ctx, connString)
-		if err != nil {
-			fmt.Printf("Unable to create connection pool: %v\n", err)
-			return
-		}
-
-		pgInstance = &postgres{db}
-	})
+	db, err := tracing.NewPool(ctx, connString)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create connection pool: %w", err)
+	}
 
-	return pgInstance, nil
+	return &postgres{db}, nil
 }
 
 func (pg *postgres) Ping(ctx context.Context) error {
 	return pg.db.Ping(ctx)
 }
 
+func (pg *postgres) Stat() *pgxpool.Stat {
+	return pg.db.Stat()
+}
+
+func (pg *postgres) Pool() *pgxpool.Pool {
+	return pg.db
+}
+
 func (pg *postgres) Close() {
 	pg.db.Close()
 }
 
+func (pg *postgres) Outbox() outbox.Store {
+	return outbox.NewPgStore(pg.db)
+}
+
+func (pg *postgres) Audit() audit.Log {
+	return audit.NewPgLog(pg.db)
+}
+
 func (pg *postgres) GetLibrariesByCity(ctx context.Context, city string) ([]Library, error) {
-	query := fmt.Sprintf(`SELECT id, library_uid, name, city, address FROM library WHERE city = '%s'`, city)
+	query := fmt.Sprintf(`SELECT id, library_uid, name, city, address, version FROM library WHERE city = '%s'`, city)
 
 	rows, err := pg.db.Query(ctx, query)
 
@@ -88,7 +209,7 @@ func (pg *postgres) GetLibrariesByCity(ctx context.Context, city string) ([]Libr
 
 	libraries, err = pgx.CollectRows(rows, pgx.RowToStructByName[Library])
 	if err != nil {
-		fmt.Printf("CollectRows error: %v", err)
+		slog.ErrorContext(ctx, "CollectRows error", "error", err)
 		return libraries, err
 	}
 
@@ -118,7 +239,7 @@ func (pg *postgres) GetBooksByLibraryUid(ctx context.Context, libraryUid string,
 
 	books, err = pgx.CollectRows(rows, pgx.RowToStructByName[Book])
 	if err != nil {
-		fmt.Printf("CollectRows error: %v", err)
+		slog.ErrorContext(ctx, "CollectRows error", "error", err)
 		return books, err
 	}
 
@@ -142,7 +263,7 @@ func (pg *postgres) GetBookByUid(ctx context.Context, bookUid string) (Book, err
 
 	book, err = pgx.CollectOneRow(rows, pgx.RowToStructByName[Book])
 	if err != nil {
-		fmt.Printf("CollectRows error: %v", err)
+		slog.ErrorContext(ctx, "CollectRows error", "error", err)
 		return book, err
 	}
 
@@ -164,7 +285,7 @@ func (pg *postgres) GetBookInfoByUid(ctx context.Context, bookUid string) (BookI
 
 	book, err = pgx.CollectOneRow(rows, pgx.RowToStructByName[BookInfo])
 	if err != nil {
-		fmt.Printf("CollectRows error: %v", err)
+		slog.ErrorContext(ctx, "CollectRows error", "error", err)
 		return book, err
 	}
 
@@ -173,7 +294,7 @@ func (pg *postgres) GetBookInfoByUid(ctx context.Context, bookUid string) (BookI
 
 func (pg *postgres) GetLibraryByUid(ctx context.Context, libraryUid string) (Library, error) {
 
-	query := fmt.Sprintf(`SELECT id, library_uid, name, city, address FROM library WHERE library_uid = '%s'`, libraryUid)
+	query := fmt.Sprintf(`SELECT id, library_uid, name, city, address, version FROM library WHERE library_uid = '%s'`, libraryUid)
 
 	rows, err := pg.db.Query(ctx, query)
 
@@ -186,38 +307,230 @@ func (pg *postgres) GetLibraryByUid(ctx context.Context, libraryUid string) (Lib
 
 	library, err = pgx.CollectOneRow(rows, pgx.RowToStructByName[Library])
 	if err != nil {
-		fmt.Printf("CollectRows error: %v", err)
+		slog.ErrorContext(ctx, "CollectRows error", "error", err)
 		return library, err
 	}
 
 	return library, nil
 }
 
+func (pg *postgres) GetBooksByUids(ctx context.Context, bookUids []string) ([]BookInfo, error) {
+
+	query := `SELECT * FROM books WHERE book_uid = ANY(@book_uids::text[]::uuid[])`
+
+	rows, err := pg.db.Query(ctx, query, pgx.NamedArgs{"book_uids": bookUids})
+
+	var books []BookInfo
+
+	if err != nil {
+		return books, fmt.Errorf("unable to query: %w", err)
+	}
+	defer rows.Close()
+
+	books, err = pgx.CollectRows(rows, pgx.RowToStructByName[BookInfo])
+	if err != nil {
+		slog.ErrorContext(ctx, "CollectRows error", "error", err)
+		return books, err
+	}
+
+	return books, nil
+}
+
+func (pg *postgres) GetLibrariesByUids(ctx context.Context, libraryUids []string) ([]Library, error) {
+
+	query := `SELECT id, library_uid, name, city, address, version FROM library WHERE library_uid = ANY(@library_uids::text[]::uuid[])`
+
+	rows, err := pg.db.Query(ctx, query, pgx.NamedArgs{"library_uids": libraryUids})
+
+	var libraries []Library
+
+	if err != nil {
+		return libraries, fmt.Errorf("unable to query: %w", err)
+	}
+	defer rows.Close()
+
+	libraries, err = pgx.CollectRows(rows, pgx.RowToStructByName[Library])
+	if err != nil {
+		slog.ErrorContext(ctx, "CollectRows error", "error", err)
+		return libraries, err
+	}
+
+	return libraries, nil
+}
+
 func (pg *postgres) UpdateBookCount(ctx context.Context, bookId int, count int) error {
-	query := fmt.Sprintf(`UPDATE library_books SET available_count = %d WHERE book_id = %d`, count, bookId)
+	query := `SELECT books.book_uid::text, library.library_uid::text, library_books.available_count
+		FROM library_books, books, library
+		WHERE library_books.book_id = @book_id AND books.id = library_books.book_id AND library.id = library_books.library_id
+		FOR UPDATE OF library_books`
+
+	return pgx.BeginFunc(ctx, pg.db, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, query, pgx.NamedArgs{"book_id": bookId})
+		if err != nil {
+			return fmt.Errorf("unable to query: %w", err)
+		}
+
+		var previousCounts []int
+		counts, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (BookCountEvent, error) {
+			change := BookCountEvent{AvailableCount: count}
+			var previousCount int
+			err := row.Scan(&change.BookUid, &change.LibraryUid, &previousCount)
+			previousCounts = append(previousCounts, previousCount)
+			return change, err
+		})
+		if err != nil {
+			return fmt.Errorf("unable to query: %w", err)
+		}
+
+		query = `UPDATE library_books SET available_count = @count WHERE book_id = @book_id`
+		if _, err = tx.Exec(ctx, query, pgx.NamedArgs{"count": count, "book_id": bookId}); err != nil {
+			return fmt.Errorf("unable to update row: %w", err)
+		}
 
-	_, err := pg.db.Exec(ctx, query)
+		for i, change := range counts {
+			event, err := bookCountChangedEvent(change)
+			if err != nil {
+				return err
+			}
+			if err = outbox.Write(ctx, tx, event); err != nil {
+				return err
+			}
+
+			entry, err := audit.New(ctx, AuditBookCountUpdated, "book", change.BookUid,
+				countAudit{LibraryUid: change.LibraryUid, AvailableCount: previousCounts[i]},
+				countAudit{LibraryUid: change.LibraryUid, AvailableCount: count})
+			if err != nil {
+				return err
+			}
+			if err = audit.Write(ctx, tx, entry); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (pg *postgres) UpdateBook(ctx context.Context, book BookInfo) (int, error) {
+	query := `SELECT * FROM books WHERE book_uid = @book_uid FOR UPDATE`
+
+	event, err := bookUpdatedEvent(book)
 	if err != nil {
-		return fmt.Errorf("unable to insert row: %w", err)
+		return 0, err
 	}
 
-	return nil
+	var version int
+
+	err = pgx.BeginFunc(ctx, pg.db, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, query, pgx.NamedArgs{"book_uid": book.Book_uid})
+		if err != nil {
+			return fmt.Errorf("unable to query: %w", err)
+		}
+
+		previous, err := pgx.CollectOneRow(rows, pgx.RowToStructByName[BookInfo])
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("unable to query: %w", err)
+		}
+		if !etag.Matches(book.Version, previous.Version) {
+			return apierror.PreconditionFailed("book %s has changed since version %d", book.Book_uid, book.Version)
+		}
+
+		query = `UPDATE books SET name = @name, author = @author, genre = @genre, material_type = @material_type,
+			version = version + 1 WHERE book_uid = @book_uid RETURNING version`
+
+		err = tx.QueryRow(ctx, query, pgx.NamedArgs{
+			"book_uid":      book.Book_uid,
+			"name":          book.Name,
+			"author":        book.Author,
+			"genre":         book.Genre,
+			"material_type": book.Material_type,
+		}).Scan(&version)
+		if err != nil {
+			return fmt.Errorf("unable to update row: %w", err)
+		}
+
+		if err = outbox.Write(ctx, tx, event); err != nil {
+			return err
+		}
+
+		entry, err := audit.New(ctx, AuditBookUpdated, "book", book.Book_uid, bookAudit(previous), bookAudit(book))
+		if err != nil {
+			return err
+		}
+
+		return audit.Write(ctx, tx, entry)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return version, nil
 }
 
-func (pg *postgres) UpdateBookCondition(ctx context.Context, bookUid string, condition string) error {
-	query := fmt.Sprintf(`UPDATE books SET condition = '%s' WHERE book_id = '%s'`, condition, bookUid)
+func (pg *postgres) UpdateLibrary(ctx context.Context, library Library) (int, error) {
+	query := `SELECT id, library_uid, name, city, address, version FROM library WHERE library_uid = @library_uid FOR UPDATE`
+
+	event, err := libraryUpdatedEvent(library)
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
 
-	_, err := pg.db.Exec(ctx, query)
+	err = pgx.BeginFunc(ctx, pg.db, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, query, pgx.NamedArgs{"library_uid": library.Library_uid})
+		if err != nil {
+			return fmt.Errorf("unable to query: %w", err)
+		}
+
+		previous, err := pgx.CollectOneRow(rows, pgx.RowToStructByName[Library])
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("unable to query: %w", err)
+		}
+		if !etag.Matches(library.Version, previous.Version) {
+			return apierror.PreconditionFailed("library %s has changed since version %d", library.Library_uid, library.Version)
+		}
+
+		query = `UPDATE library SET name = @name, city = @city, address = @address, version = version + 1
+			WHERE library_uid = @library_uid RETURNING version`
+
+		err = tx.QueryRow(ctx, query, pgx.NamedArgs{
+			"library_uid": library.Library_uid,
+			"name":        library.Name,
+			"city":        library.City,
+			"address":     library.Address,
+		}).Scan(&version)
+		if err != nil {
+			return fmt.Errorf("unable to update row: %w", err)
+		}
+
+		if err = outbox.Write(ctx, tx, event); err != nil {
+			return err
+		}
+
+		entry, err := audit.New(ctx, AuditLibraryUpdated, "library", library.Library_uid, libraryAudit(previous), libraryAudit(library))
+		if err != nil {
+			return err
+		}
+
+		return audit.Write(ctx, tx, entry)
+	})
 	if err != nil {
-		return fmt.Errorf("unable to insert row: %w", err)
+		return 0, err
 	}
 
-	return nil
+	return version, nil
 }
 
 // func (pg *postgres) UpdateBookCount(ctx context.Context, bookUid string) error {
 
-// 	query := fmt.Sprintf(`SELECT id, library_uid, name, city, address FROM library WHERE library_uid = '%s'`, libraryUid)
+// 	query := fmt.Sprintf(`SELECT id, library_uid, name, city, address, version FROM library WHERE library_uid = '%s'`, libraryUid)
 
 // 	rows, err := pg.db.Query(ctx, query)
 
@@ -0,0 +1,50 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"library-system/src/library-service/migrations"
+	"library-system/src/library-service/storage"
+	"library-system/src/library-service/storage/storagetest"
+	"library-system/src/pkg/pgtest"
+)
+
+func TestMemory(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T, fixture storagetest.Fixture) storage.Storage {
+		memory := storage.NewMemory()
+		for _, library := range fixture.Libraries {
+			memory.AddLibrary(library)
+		}
+		for _, book := range fixture.Books {
+			memory.AddBook(book.Library_uid, book.Book, book.Count)
+		}
+		return memory
+	})
+}
+
+func TestPostgres(t *testing.T) {
+	connString := pgtest.Open(t, "TEST_POSTGRES_LIBRARIES", migrations.Schema)
+
+	pg, err := storage.NewPgStorage(context.Background(), connString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Close()
+
+	storagetest.Run(t, func(t *testing.T, fixture storagetest.Fixture) storage.Storage {
+		pgtest.Exec(t, pg.Pool(), `TRUNCATE library_books, book_condition, damage_report, books, library, outbox, audit_log RESTART IDENTITY CASCADE`)
+		for _, library := range fixture.Libraries {
+			pgtest.Exec(t, pg.Pool(), `INSERT INTO library (library_uid, name, city, address) VALUES ($1, $2, $3, $4)`,
+				library.Library_uid, library.Name, library.City, library.Address)
+		}
+		for _, book := range fixture.Books {
+			pgtest.Exec(t, pg.Pool(), `INSERT INTO books (book_uid, name, author, genre, condition, material_type) VALUES ($1, $2, $3, $4, $5, $6)`,
+				book.Book.Book_uid, book.Book.Name, book.Book.Author, book.Book.Genre, book.Book.Condition, book.Book.Material_type)
+			pgtest.Exec(t, pg.Pool(), `INSERT INTO library_books (book_id, library_id, available_count)
+				SELECT books.id, library.id, $3 FROM books, library WHERE books.book_uid = $1 AND library.library_uid = $2`,
+				book.Book.Book_uid, book.Library_uid, book.Count)
+		}
+		return pg
+	})
+}
@@ -0,0 +1,508 @@
+// Package storagetest is the conformance suite that every implementation of
+// the library-service Storage must pass.
+package storagetest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"library-system/src/library-service/storage"
+	"library-system/src/pkg/apierror"
+	"library-system/src/pkg/audit"
+	"library-system/src/pkg/etag"
+)
+
+const (
+	moscowUid   = "83575e12-7ce0-48ee-9931-51919ff3c9ee"
+	arbatUid    = "1b2c3d4e-0000-4000-8000-000000000002"
+	kazanUid    = "1b2c3d4e-0000-4000-8000-000000000003"
+	cppUid      = "f7cdc58f-2caf-4b15-9727-f89dcc629b27"
+	goUid       = "2a3b4c5d-0000-4000-8000-000000000002"
+	magazineUid = "2a3b4c5d-0000-4000-8000-000000000003"
+	unknownUid  = "00000000-0000-4000-8000-000000000000"
+)
+
+type FixtureBook struct {
+	Library_uid string
+	Book        storage.BookInfo
+	Count       int
+}
+
+type Fixture struct {
+	Libraries []storage.Library
+	Books     []FixtureBook
+}
+
+// Factory returns a storage holding exactly the fixture.
+type Factory func(t *testing.T, fixture Fixture) storage.Storage
+
+var fixture = Fixture{
+	Libraries: []storage.Library{
+		{Library_uid: moscowUid, Name: "Библиотека имени 7 Непьющих", City: "Москва", Address: "2-я Бауманская ул., д.5, стр.1"},
+		{Library_uid: arbatUid, Name: "Арбатская библиотека", City: "Москва", Address: "ул. Арбат, д.1"},
+		{Library_uid: kazanUid, Name: "Казанская библиотека", City: "Казань", Address: "ул. Баумана, д.2"},
+	},
+	Books: []FixtureBook{
+		{moscowUid, storage.BookInfo{Book_uid: cppUid, Name: "Краткий курс C++ в 7 томах", Author: "Бьерн Страуструп", Genre: "Научная фантастика", Condition: "EXCELLENT", Material_type: "BOOK"}, 1},
+		{moscowUid, storage.BookInfo{Book_uid: goUid, Name: "The Go Programming Language", Author: "Alan Donovan", Genre: "Programming", Condition: "GOOD", Material_type: "BOOK"}, 0},
+		{kazanUid, storage.BookInfo{Book_uid: magazineUid, Name: "Наука и жизнь", Author: "", Genre: "Science", Condition: "BAD", Material_type: "MAGAZINE"}, 3},
+	},
+}
+
+func bookUids(books []storage.Book) []string {
+	uids := make([]string, len(books))
+	for i, book := range books {
+		uids[i] = book.Book_uid
+	}
+	sort.Strings(uids)
+	return uids
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func expectCode(t *testing.T, err error, code apierror.Code) {
+	t.Helper()
+
+	if err == nil || apierror.From(err).Code != code {
+		t.Errorf("expected %s, got %v", code, err)
+	}
+}
+
+var today = time.Date(2021, 10, 11, 0, 0, 0, 0, time.UTC)
+
+func Run(t *testing.T, newStorage Factory) {
+	ctx := context.Background()
+
+	t.Run("GetLibrariesByCity", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		libraries, err := s.GetLibrariesByCity(ctx, "Москва")
+		if err != nil || len(libraries) != 2 {
+			t.Fatalf("expected 2 libraries in Москва, got %+v (%v)", libraries, err)
+		}
+		for _, library := range libraries {
+			if library.ID == 0 || library.City != "Москва" {
+				t.Errorf("unexpected library %+v", library)
+			}
+		}
+
+		libraries, err = s.GetLibrariesByCity(ctx, "Тверь")
+		if err != nil || len(libraries) != 0 {
+			t.Errorf("expected no libraries, got %+v (%v)", libraries, err)
+		}
+	})
+
+	t.Run("GetLibraryByUid", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		library, err := s.GetLibraryByUid(ctx, kazanUid)
+		if err != nil || library != (storage.Library{ID: library.ID, Library_uid: kazanUid, Name: "Казанская библиотека", City: "Казань", Address: "ул. Баумана, д.2", Version: 1}) {
+			t.Errorf("unexpected library %+v (%v)", library, err)
+		}
+
+		_, err = s.GetLibraryByUid(ctx, unknownUid)
+		expectCode(t, err, apierror.CodeNotFound)
+
+		_, err = s.GetLibraryByUid(ctx, "not-a-uid")
+		expectCode(t, err, apierror.CodeValidation)
+	})
+
+	t.Run("GetBooksByLibraryUid", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		books, err := s.GetBooksByLibraryUid(ctx, moscowUid, false)
+		if err != nil || !equal(bookUids(books), []string{cppUid}) {
+			t.Errorf("expected only available books, got %+v (%v)", books, err)
+		}
+		if len(books) == 1 && (books[0].Available_count != 1 || books[0].Author != "Бьерн Страуструп" || books[0].ID == 0) {
+			t.Errorf("unexpected book %+v", books[0])
+		}
+
+		books, err = s.GetBooksByLibraryUid(ctx, moscowUid, true)
+		if err != nil || !equal(bookUids(books), []string{goUid, cppUid}) {
+			t.Errorf("expected all books, got %+v (%v)", books, err)
+		}
+
+		books, err = s.GetBooksByLibraryUid(ctx, arbatUid, true)
+		if err != nil || len(books) != 0 {
+			t.Errorf("expected no books, got %+v (%v)", books, err)
+		}
+
+		_, err = s.GetBooksByLibraryUid(ctx, "not-a-uid", true)
+		expectCode(t, err, apierror.CodeValidation)
+	})
+
+	t.Run("GetBookByUid", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		book, err := s.GetBookByUid(ctx, magazineUid)
+		if err != nil || book.Available_count != 3 || book.Material_type != "MAGAZINE" || book.Condition != "BAD" {
+			t.Errorf("unexpected book %+v (%v)", book, err)
+		}
+
+		_, err = s.GetBookByUid(ctx, unknownUid)
+		expectCode(t, err, apierror.CodeNotFound)
+	})
+
+	t.Run("GetBookInfoByUid", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		book, err := s.GetBookInfoByUid(ctx, goUid)
+		if err != nil || book.Name != "The Go Programming Language" || book.Condition != "GOOD" || book.ID == 0 {
+			t.Errorf("unexpected book %+v (%v)", book, err)
+		}
+
+		_, err = s.GetBookInfoByUid(ctx, unknownUid)
+		expectCode(t, err, apierror.CodeNotFound)
+
+		_, err = s.GetBookInfoByUid(ctx, "not-a-uid")
+		expectCode(t, err, apierror.CodeValidation)
+	})
+
+	t.Run("GetBooksByUids", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		books, err := s.GetBooksByUids(ctx, []string{cppUid, magazineUid, unknownUid})
+		if err != nil || len(books) != 2 {
+			t.Errorf("expected the 2 known books, got %+v (%v)", books, err)
+		}
+
+		_, err = s.GetBooksByUids(ctx, []string{cppUid, "not-a-uid"})
+		expectCode(t, err, apierror.CodeValidation)
+	})
+
+	t.Run("GetLibrariesByUids", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		libraries, err := s.GetLibrariesByUids(ctx, []string{kazanUid, unknownUid})
+		if err != nil || len(libraries) != 1 || libraries[0].Library_uid != kazanUid {
+			t.Errorf("expected the known library, got %+v (%v)", libraries, err)
+		}
+
+		_, err = s.GetLibrariesByUids(ctx, []string{"not-a-uid"})
+		expectCode(t, err, apierror.CodeValidation)
+	})
+
+	t.Run("UpdateBookCount", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		book, err := s.GetBookByUid(ctx, cppUid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.UpdateBookCount(ctx, book.ID, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		if book, _ = s.GetBookByUid(ctx, cppUid); book.Available_count != 0 {
+			t.Errorf("expected no copies left, got %d", book.Available_count)
+		}
+		if books, _ := s.GetBooksByLibraryUid(ctx, moscowUid, false); len(books) != 0 {
+			t.Errorf("unavailable books must be hidden, got %+v", books)
+		}
+		if book, _ = s.GetBookByUid(ctx, magazineUid); book.Available_count != 3 {
+			t.Errorf("other books must not change, got %d", book.Available_count)
+		}
+	})
+
+	t.Run("UpdateBook", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		update := storage.BookInfo{Book_uid: goUid, Name: "Go", Author: "Alan Donovan, Brian Kernighan", Genre: "Programming", Material_type: "EBOOK", Version: 1}
+		if version, err := s.UpdateBook(ctx, update); err != nil || version != 2 {
+			t.Fatalf("expected version 2, got %d (%v)", version, err)
+		}
+
+		book, err := s.GetBookInfoByUid(ctx, goUid)
+		if err != nil || book.Name != "Go" || book.Author != update.Author || book.Material_type != "EBOOK" || book.Condition != "GOOD" || book.Version != 2 {
+			t.Errorf("unexpected book %+v (%v)", book, err)
+		}
+
+		update.Book_uid = unknownUid
+		if _, err := s.UpdateBook(ctx, update); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+
+		update.Book_uid, update.Material_type = goUid, "SCROLL"
+		_, err = s.UpdateBook(ctx, update)
+		expectCode(t, err, apierror.CodeValidation)
+	})
+
+	t.Run("UpdateBookVersion", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		update := storage.BookInfo{Book_uid: goUid, Name: "Go", Author: "Alan Donovan", Genre: "Programming", Material_type: "EBOOK", Version: 1}
+		if _, err := s.UpdateBook(ctx, update); err != nil {
+			t.Fatal(err)
+		}
+
+		// a second update based on the same version is refused
+		update.Name = "Go, 2nd edition"
+		_, err := s.UpdateBook(ctx, update)
+		expectCode(t, err, apierror.CodePreconditionFailed)
+
+		if book, _ := s.GetBookInfoByUid(ctx, goUid); book.Name != "Go" || book.Version != 2 {
+			t.Errorf("a refused update must change nothing, got %+v", book)
+		}
+
+		update.Version = etag.Any
+		if version, err := s.UpdateBook(ctx, update); err != nil || version != 3 {
+			t.Errorf("expected an unconditional update to version 3, got %d (%v)", version, err)
+		}
+
+		// other books keep their version
+		if book, _ := s.GetBookInfoByUid(ctx, cppUid); book.Version != 1 {
+			t.Errorf("expected version 1, got %+v", book)
+		}
+	})
+
+	t.Run("UpdateLibrary", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		update := storage.Library{Library_uid: arbatUid, Name: "Арбатская", City: "Москва", Address: "ул. Арбат, д.3", Version: 1}
+		if version, err := s.UpdateLibrary(ctx, update); err != nil || version != 2 {
+			t.Fatalf("expected version 2, got %d (%v)", version, err)
+		}
+
+		library, err := s.GetLibraryByUid(ctx, arbatUid)
+		if err != nil || library.Name != "Арбатская" || library.Address != "ул. Арбат, д.3" || library.Version != 2 {
+			t.Errorf("unexpected library %+v (%v)", library, err)
+		}
+
+		_, err = s.UpdateLibrary(ctx, update)
+		expectCode(t, err, apierror.CodePreconditionFailed)
+
+		update.Library_uid = unknownUid
+		if _, err := s.UpdateLibrary(ctx, update); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Outbox", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		book, err := s.GetBookByUid(ctx, magazineUid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.UpdateBookCount(ctx, book.ID, 2); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = s.UpdateBook(ctx, storage.BookInfo{Book_uid: goUid, Name: "Go", Author: "Alan Donovan", Genre: "Programming", Material_type: "EBOOK"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = s.UpdateLibrary(ctx, storage.Library{Library_uid: arbatUid, Name: "Арбатская", City: "Москва", Address: "ул. Арбат, д.3"}); err != nil {
+			t.Fatal(err)
+		}
+
+		// failed changes write no events
+		s.UpdateBook(ctx, storage.BookInfo{Book_uid: goUid, Name: "Go", Material_type: "SCROLL"})
+		s.UpdateLibrary(ctx, storage.Library{Library_uid: unknownUid, Name: "Нет такой"})
+
+		events, err := s.Outbox().Pending(ctx, 10)
+		if err != nil || len(events) != 3 {
+			t.Fatalf("expected 3 events, got %+v (%v)", events, err)
+		}
+
+		var count storage.BookCountEvent
+		if err = events[0].Decode(&count); err != nil || events[0].Type != storage.BookCountChanged ||
+			count != (storage.BookCountEvent{BookUid: magazineUid, LibraryUid: kazanUid, AvailableCount: 2}) {
+			t.Errorf("unexpected event %+v %+v (%v)", events[0], count, err)
+		}
+
+		var updated storage.BookEvent
+		if err = events[1].Decode(&updated); err != nil || events[1].Type != storage.BookUpdated || events[1].EntityUid != goUid || updated.MaterialType != "EBOOK" {
+			t.Errorf("unexpected event %+v %+v (%v)", events[1], updated, err)
+		}
+
+		var library storage.LibraryEvent
+		if err = events[2].Decode(&library); err != nil || events[2].Type != storage.LibraryUpdated || library.Address != "ул. Арбат, д.3" {
+			t.Errorf("unexpected event %+v %+v (%v)", events[2], library, err)
+		}
+	})
+
+	t.Run("Audit", func(t *testing.T) {
+		s := newStorage(t, fixture)
+		ctx := audit.WithActor(ctx, "admin")
+
+		if _, err := s.UpdateBookCondition(ctx, storage.Assessment{Book_uid: cppUid, Condition: "BAD", Assessor: "admin", Assessed_on: today}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.UpdateBook(ctx, storage.BookInfo{Book_uid: goUid, Name: "Go", Author: "Alan Donovan", Genre: "Programming", Material_type: "EBOOK"}); err != nil {
+			t.Fatal(err)
+		}
+
+		// failed changes are not recorded
+		s.UpdateBook(ctx, storage.BookInfo{Book_uid: goUid, Name: "Go", Material_type: "SCROLL"})
+		s.UpdateLibrary(ctx, storage.Library{Library_uid: unknownUid, Name: "Нет такой"})
+
+		if book, err := s.GetBookInfoByUid(ctx, cppUid); err != nil || book.Condition != "BAD" {
+			t.Errorf("expected the condition to be updated, got %+v (%v)", book, err)
+		}
+
+		entries, err := s.Audit().Query(ctx, audit.Filter{Limit: 10})
+		if err != nil || len(entries) != 2 {
+			t.Fatalf("expected 2 entries, got %+v (%v)", entries, err)
+		}
+
+		updated, condition := entries[0], entries[1]
+		var before, after storage.BookEvent
+		json.Unmarshal(updated.Before, &before)
+		json.Unmarshal(updated.After, &after)
+		if updated.Action != storage.AuditBookUpdated || updated.EntityUid != goUid || updated.Actor != "admin" ||
+			before.MaterialType != "BOOK" || after.MaterialType != "EBOOK" {
+			t.Errorf("unexpected entry %+v", updated)
+		}
+
+		var previous map[string]string
+		json.Unmarshal(condition.Before, &previous)
+		if condition.Action != storage.AuditBookConditionUpdated || condition.EntityType != "book" || condition.EntityUid != cppUid ||
+			previous["condition"] != "EXCELLENT" {
+			t.Errorf("unexpected entry %+v", condition)
+		}
+
+		if entries, _ = s.Audit().Query(ctx, audit.Filter{EntityUid: cppUid, Limit: 10}); len(entries) != 1 {
+			t.Errorf("expected the entry of %s, got %+v", cppUid, entries)
+		}
+		if entries, _ = s.Audit().Query(ctx, audit.Filter{Actor: "Test Max", Limit: 10}); len(entries) != 0 {
+			t.Errorf("expected no entries of another actor, got %+v", entries)
+		}
+	})
+	t.Run("ConditionHistory", func(t *testing.T) {
+		s := newStorage(t, fixture)
+		reservationUid := "3c4d5e6f-0000-4000-8000-000000000001"
+
+		previous, err := s.UpdateBookCondition(ctx, storage.Assessment{
+			Book_uid: goUid, Condition: "BAD", Assessor: "admin", Assessed_on: today,
+			Reservation_uid: reservationUid, Notes: "torn cover", Photos: []string{"s3://photos/1.jpg", "s3://photos/2.jpg"},
+		})
+		if err != nil || previous != "GOOD" {
+			t.Fatalf("expected GOOD before, got %q (%v)", previous, err)
+		}
+		if previous, err = s.UpdateBookCondition(ctx, storage.Assessment{Book_uid: goUid, Condition: "BAD", Assessor: "librarian", Assessed_on: today.AddDate(0, 0, 1)}); err != nil || previous != "BAD" {
+			t.Fatalf("expected BAD before, got %q (%v)", previous, err)
+		}
+
+		_, err = s.UpdateBookCondition(ctx, storage.Assessment{Book_uid: unknownUid, Condition: "BAD", Assessor: "admin", Assessed_on: today})
+		expectCode(t, err, apierror.CodeNotFound)
+		_, err = s.UpdateBookCondition(ctx, storage.Assessment{Book_uid: goUid, Condition: "TORN", Assessor: "admin", Assessed_on: today})
+		expectCode(t, err, apierror.CodeValidation)
+
+		if book, _ := s.GetBookInfoByUid(ctx, goUid); book.Condition != "BAD" {
+			t.Errorf("expected the book to be BAD, got %s", book.Condition)
+		}
+
+		history, err := s.GetConditionHistory(ctx, goUid)
+		if err != nil || len(history) != 2 {
+			t.Fatalf("expected 2 assessments, got %+v (%v)", history, err)
+		}
+		if latest := history[0]; latest.Assessor != "librarian" || !latest.Assessed_on.Equal(today.AddDate(0, 0, 1)) || latest.Reservation_uid != "" || len(latest.Photos) != 0 {
+			t.Errorf("unexpected latest assessment %+v", latest)
+		}
+		if first := history[1]; first.Condition != "BAD" || first.Reservation_uid != reservationUid || first.Notes != "torn cover" ||
+			!equal(first.Photos, []string{"s3://photos/1.jpg", "s3://photos/2.jpg"}) || !first.Assessed_on.Equal(today) {
+			t.Errorf("unexpected first assessment %+v", first)
+		}
+
+		if history, _ = s.GetConditionHistory(ctx, cppUid); len(history) != 0 {
+			t.Errorf("expected no assessments of another book, got %+v", history)
+		}
+
+		// only the change of the condition is an event
+		events, _ := s.Outbox().Pending(ctx, 10)
+		var changed storage.BookConditionEvent
+		if len(events) != 1 || events[0].Type != storage.BookConditionChanged || events[0].Decode(&changed) != nil ||
+			changed != (storage.BookConditionEvent{BookUid: goUid, Condition: "BAD", PreviousCondition: "GOOD", ReservationUid: reservationUid}) {
+			t.Errorf("unexpected events %+v", events)
+		}
+	})
+
+	t.Run("DamageReports", func(t *testing.T) {
+		s := newStorage(t, fixture)
+		ctx := audit.WithActor(ctx, "admin")
+
+		report, err := s.CreateDamageReport(ctx, storage.DamageReport{Book_uid: magazineUid, Library_uid: kazanUid, Reported_by: "admin", Notes: "water damage"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Report_uid == "" || report.Status != storage.RepairInProgress || report.Notes != "water damage" || report.Resolved_at != nil {
+			t.Errorf("unexpected report %+v", report)
+		}
+		if book, _ := s.GetBookByUid(ctx, magazineUid); book.Available_count != 2 {
+			t.Errorf("expected the copy to be taken off the shelf, got %d", book.Available_count)
+		}
+
+		_, err = s.CreateDamageReport(ctx, storage.DamageReport{Book_uid: goUid, Library_uid: moscowUid, Reported_by: "admin"})
+		expectCode(t, err, apierror.CodeConflict)
+		_, err = s.CreateDamageReport(ctx, storage.DamageReport{Book_uid: magazineUid, Library_uid: moscowUid, Reported_by: "admin"})
+		expectCode(t, err, apierror.CodeNotFound)
+
+		written, err := s.CreateDamageReport(ctx, storage.DamageReport{Book_uid: magazineUid, Library_uid: kazanUid, Reported_by: "admin"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		open, err := s.GetDamageReports(ctx, storage.DamageReportFilter{Library_uid: kazanUid, Status: storage.RepairInProgress})
+		if err != nil || len(open) != 2 || open[0].Report_uid != report.Report_uid || open[1].Report_uid != written.Report_uid {
+			t.Errorf("expected both reports, got %+v (%v)", open, err)
+		}
+
+		resolved, err := s.ResolveDamageReport(ctx, storage.Resolution{Report_uid: report.Report_uid, Status: storage.RepairOnShelf, Condition: "GOOD", Resolved_by: "admin", Resolved_on: today, Notes: "pages dried"})
+		if err != nil || resolved.Status != storage.RepairOnShelf || resolved.Resolved_by != "admin" || resolved.Resolved_at == nil {
+			t.Fatalf("unexpected resolved report %+v (%v)", resolved, err)
+		}
+		if _, err = s.ResolveDamageReport(ctx, storage.Resolution{Report_uid: written.Report_uid, Status: storage.RepairWrittenOff, Resolved_by: "admin", Resolved_on: today}); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = s.ResolveDamageReport(ctx, storage.Resolution{Report_uid: report.Report_uid, Status: storage.RepairWrittenOff, Resolved_by: "admin", Resolved_on: today})
+		expectCode(t, err, apierror.CodeConflict)
+		_, err = s.ResolveDamageReport(ctx, storage.Resolution{Report_uid: unknownUid, Status: storage.RepairWrittenOff, Resolved_by: "admin", Resolved_on: today})
+		expectCode(t, err, apierror.CodeNotFound)
+		_, err = s.ResolveDamageReport(ctx, storage.Resolution{Report_uid: written.Report_uid, Status: storage.RepairOnShelf, Resolved_by: "admin", Resolved_on: today})
+		expectCode(t, err, apierror.CodeValidation)
+
+		// the repaired copy is back on the shelf, the written off one is not
+		book, _ := s.GetBookByUid(ctx, magazineUid)
+		if book.Available_count != 2 || book.Condition != "GOOD" {
+			t.Errorf("expected 2 copies in GOOD condition, got %+v", book)
+		}
+		if history, _ := s.GetConditionHistory(ctx, magazineUid); len(history) != 1 || history[0].Condition != "GOOD" || history[0].Notes != "pages dried" {
+			t.Errorf("expected the repair to be assessed, got %+v", history)
+		}
+
+		if open, _ = s.GetDamageReports(ctx, storage.DamageReportFilter{Status: storage.RepairInProgress}); len(open) != 0 {
+			t.Errorf("expected no reports in repair, got %+v", open)
+		}
+		if all, _ := s.GetDamageReports(ctx, storage.DamageReportFilter{Book_uid: magazineUid}); len(all) != 2 || all[1].Status != storage.RepairWrittenOff {
+			t.Errorf("expected both reports, got %+v", all)
+		}
+
+		// availability follows the copies taken off and put back on the shelf
+		events, _ := s.Outbox().Pending(ctx, 10)
+		var counts []int
+		for _, event := range events {
+			var count storage.BookCountEvent
+			if event.Type == storage.BookCountChanged && event.Decode(&count) == nil {
+				counts = append(counts, count.AvailableCount)
+			}
+		}
+		if len(counts) != 3 || counts[0] != 2 || counts[1] != 1 || counts[2] != 2 {
+			t.Errorf("expected the count to go 2, 1, 2, got %v", counts)
+		}
+	})
+}
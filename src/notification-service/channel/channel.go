@@ -0,0 +1,283 @@
+package channel
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrNoAddress = errors.New("recipient has no address for this channel")
+	// ErrInternalAddress is returned for webhooks on the internal network,
+	// which readers must not be able to reach through the service.
+	ErrInternalAddress = errors.New("webhook address is not public")
+)
+
+type Recipient struct {
+	Username   string
+	Email      string
+	WebhookURL string
+}
+
+type Message struct {
+	Kind      string `json:"kind"`
+	Reference string `json:"reference"`
+	Subject   string `json:"subject"`
+	Text      string `json:"text"`
+}
+
+// Channel delivers a message to a recipient, e.g. by email or webhook.
+type Channel interface {
+	Name() string
+	Send(ctx context.Context, recipient Recipient, message Message) error
+}
+
+type SMTPConfig struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+	// Timeout bounds connecting to the server and sending a message,
+	// 10 seconds if zero.
+	Timeout time.Duration
+}
+
+type smtpChannel struct {
+	config SMTPConfig
+}
+
+func NewSMTP(config SMTPConfig) Channel {
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	return &smtpChannel{config: config}
+}
+
+func (ch *smtpChannel) Name() string {
+	return "EMAIL"
+}
+
+func (ch *smtpChannel) Send(ctx context.Context, recipient Recipient, message Message) error {
+	if recipient.Email == "" {
+		return ErrNoAddress
+	}
+
+	host, _, err := net.SplitHostPort(ch.config.Addr)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ch.config.Timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", ch.config.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// the deadline bounds every read and write of the conversation, and
+	// closing the connection aborts it once ctx is cancelled
+	deadline, _ := ctx.Deadline()
+	if err = conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err = ch.send(conn, host, recipient, message); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("smtp: %w", ctx.Err())
+		}
+		return err
+	}
+
+	return nil
+}
+
+// send talks SMTP over conn like smtp.SendMail does.
+func (ch *smtpChannel) send(conn net.Conn, host string, recipient Recipient, message Message) error {
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err = client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+
+	if ch.config.Username != "" {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err = client.Auth(smtp.PlainAuth("", ch.config.Username, ch.config.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err = client.Mail(ch.config.From); err != nil {
+		return err
+	}
+	if err = client.Rcpt(recipient.Email); err != nil {
+		return err
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		ch.config.From, recipient.Email, message.Subject, message.Text)
+
+	if _, err = writer.Write([]byte(body)); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+type webhookChannel struct {
+	client *http.Client
+	// allowInternal lets tests deliver to servers on the loopback address.
+	allowInternal bool
+}
+
+// NewWebhook returns a Channel posting messages to the webhook of the
+// recipient. Only https webhooks on public addresses are called; the address
+// is checked again when connecting, so a host name cannot resolve to the
+// internal network either.
+func NewWebhook(timeout time.Duration) Channel {
+	dialer := &net.Dialer{Timeout: timeout, Control: checkDialAddress}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &webhookChannel{client: &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		// a redirect could lead anywhere, the webhook must answer itself
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+}
+
+// ValidateWebhookURL accepts https URLs whose host is a name or a public IP
+// address, and rejects loopback, private, link-local and unspecified ones.
+func ValidateWebhookURL(raw string) error {
+	return validateWebhookURL(raw, false)
+}
+
+func validateWebhookURL(raw string, allowInternal bool) error {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid webhook url: %w", err)
+	}
+	if parsed.Scheme != "https" {
+		return errors.New("webhook url must use https")
+	}
+
+	host := strings.ToLower(parsed.Hostname())
+	if host == "" {
+		return errors.New("webhook url must have a host")
+	}
+	if allowInternal {
+		return nil
+	}
+
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrInternalAddress
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && !public(addr) {
+		return ErrInternalAddress
+	}
+
+	return nil
+}
+
+// checkDialAddress refuses connections to addresses that are not public.
+func checkDialAddress(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !public(addr) {
+		return ErrInternalAddress
+	}
+	return nil
+}
+
+// sharedAddressSpace is 100.64.0.0/10, used for carrier-grade NAT.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+func public(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
+
+func (ch *webhookChannel) Name() string {
+	return "WEBHOOK"
+}
+
+type webhookPayload struct {
+	Username string `json:"username"`
+	Message
+}
+
+func (ch *webhookChannel) Send(ctx context.Context, recipient Recipient, message Message) error {
+	if recipient.WebhookURL == "" {
+		return ErrNoAddress
+	}
+	if err := validateWebhookURL(recipient.WebhookURL, ch.allowInternal); err != nil {
+		return err
+	}
+
+	marshalled, err := json.Marshal(webhookPayload{
+		Username: recipient.Username,
+		Message:  message,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, recipient.WebhookURL, bytes.NewReader(marshalled))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := ch.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+package channel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"library-system/src/notification-service/smtpsink"
+)
+
+func TestSMTPSend(t *testing.T) {
+
+	sink, err := smtpsink.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start smtp sink: %v", err)
+	}
+	defer sink.Close()
+
+	ch := NewSMTP(SMTPConfig{Addr: sink.Addr(), From: "library@localhost"})
+
+	err = ch.Send(context.Background(), Recipient{Email: "reader@example.com"}, Message{
+		Subject: "Your book is due soon",
+		Text:    "Please return it.",
+	})
+	if err != nil {
+		t.Fatalf("failed to send email: %v", err)
+	}
+
+	messages := sink.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("expected one message, got %d", len(messages))
+	}
+	if messages[0].From != "library@localhost" || len(messages[0].To) != 1 || messages[0].To[0] != "reader@example.com" {
+		t.Errorf("unexpected envelope %+v", messages[0])
+	}
+	if !strings.Contains(messages[0].Data, "Subject: Your book is due soon") {
+		t.Errorf("subject missing from %q", messages[0].Data)
+	}
+
+	if err = ch.Send(context.Background(), Recipient{}, Message{}); err != ErrNoAddress {
+		t.Errorf("expected ErrNoAddress, got %v", err)
+	}
+}
+
+func TestSMTPSendTimesOut(t *testing.T) {
+
+	// a server that accepts connections but never greets
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ch := NewSMTP(SMTPConfig{Addr: listener.Addr().String(), From: "library@localhost", Timeout: 100 * time.Millisecond})
+
+	start := time.Now()
+	if err = ch.Send(context.Background(), Recipient{Email: "reader@example.com"}, Message{}); err == nil {
+		t.Fatal("expected a timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("send took %v despite the timeout", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	ch = NewSMTP(SMTPConfig{Addr: listener.Addr().String(), From: "library@localhost", Timeout: time.Minute})
+
+	start = time.Now()
+	if err = ch.Send(ctx, Recipient{Email: "reader@example.com"}, Message{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("send took %v after ctx was cancelled", elapsed)
+	}
+}
+
+func TestWebhookSend(t *testing.T) {
+
+	var received webhookPayload
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		if received.Kind == "FAIL" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	ch := &webhookChannel{client: server.Client(), allowInternal: true}
+	recipient := Recipient{Username: "reader", WebhookURL: server.URL}
+
+	err := ch.Send(context.Background(), recipient, Message{Kind: "OVERDUE", Reference: "r1"})
+	if err != nil {
+		t.Fatalf("failed to call webhook: %v", err)
+	}
+	if received.Username != "reader" || received.Kind != "OVERDUE" || received.Reference != "r1" {
+		t.Errorf("unexpected payload %+v", received)
+	}
+
+	if err = ch.Send(context.Background(), recipient, Message{Kind: "FAIL"}); err == nil {
+		t.Errorf("non 2xx response must fail the delivery")
+	}
+}
+
+func TestValidateWebhookURL(t *testing.T) {
+
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://hooks.example.com/library", true},
+		{"https://93.184.216.34:8443/hook", true},
+		{"http://hooks.example.com/library", false},
+		{"https:///library", false},
+		{"ftp://hooks.example.com", false},
+		{"https://localhost/hook", false},
+		{"https://gateway.localhost/hook", false},
+		{"https://127.0.0.1/hook", false},
+		{"https://10.0.0.5/hook", false},
+		{"https://192.168.1.1/hook", false},
+		{"https://169.254.169.254/latest/meta-data", false},
+		{"https://0.0.0.0/hook", false},
+		{"https://[::1]/hook", false},
+		{"https://[::ffff:127.0.0.1]/hook", false},
+		{"https://[fe80::1]/hook", false},
+	}
+
+	for _, tt := range tests {
+		if err := ValidateWebhookURL(tt.url); (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid %v, got %v", tt.url, tt.valid, err)
+		}
+	}
+}
+
+func TestWebhookRefusesInternalAddresses(t *testing.T) {
+
+	called := false
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	ch := NewWebhook(time.Second)
+
+	err := ch.Send(context.Background(), Recipient{WebhookURL: server.URL}, Message{Kind: "OVERDUE"})
+	if !errors.Is(err, ErrInternalAddress) {
+		t.Errorf("expected ErrInternalAddress, got %v", err)
+	}
+
+	// without the url check the connection itself is refused, as it is for
+	// host names that resolve to the loopback address
+	ch.(*webhookChannel).allowInternal = true
+
+	err = ch.Send(context.Background(), Recipient{WebhookURL: server.URL}, Message{Kind: "OVERDUE"})
+	if !errors.Is(err, ErrInternalAddress) {
+		t.Errorf("expected ErrInternalAddress when dialing, got %v", err)
+	}
+	if called {
+		t.Errorf("the webhook on the loopback address must not be called")
+	}
+}
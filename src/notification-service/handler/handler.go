@@ -0,0 +1,254 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"library-system/src/notification-service/channel"
+	"library-system/src/notification-service/notifier"
+	"library-system/src/notification-service/storage"
+	"library-system/src/pkg/apierror"
+
+	"github.com/gin-gonic/gin"
+)
+
+type MessageResponse struct {
+	Message string `json:"message"`
+}
+
+type Handler struct {
+	storage           storage.Storage
+	notifier          *notifier.Notifier
+	defaultDaysBefore int
+}
+
+type PreferenceResponse struct {
+	Email            string `json:"email"`
+	WebhookUrl       string `json:"webhookUrl"`
+	EmailEnabled     bool   `json:"emailEnabled"`
+	WebhookEnabled   bool   `json:"webhookEnabled"`
+	RemindDaysBefore int    `json:"remindDaysBefore"`
+}
+
+type DeliveryResponse struct {
+	Delivery_uid string `json:"deliveryUid"`
+	Kind         string `json:"kind"`
+	Reference    string `json:"reference"`
+	Channel      string `json:"channel"`
+	Status       string `json:"status"`
+	Error        string `json:"error,omitempty"`
+	Created_at   string `json:"createdAt"`
+}
+
+type RequestCreateSubscription struct {
+	BookUid    string `json:"bookUid"`
+	LibraryUid string `json:"libraryUid"`
+}
+
+type SubscriptionResponse struct {
+	BookUid    string `json:"bookUid"`
+	LibraryUid string `json:"libraryUid"`
+	CreatedAt  string `json:"createdAt"`
+}
+
+type RequestBookAvailable struct {
+	BookUid    string `json:"bookUid"`
+	LibraryUid string `json:"libraryUid"`
+}
+
+func NewHandler(storage storage.Storage, notifier *notifier.Notifier, defaultDaysBefore int) *Handler {
+	return &Handler{storage: storage, notifier: notifier, defaultDaysBefore: defaultDaysBefore}
+}
+
+func (h *Handler) GetPreferences(c *gin.Context) {
+
+	username := c.GetHeader("X-User-Name")
+
+	if username == "" {
+		apierror.Respond(c, apierror.BadRequest("username must be given as X-User-Name Header"))
+		return
+	}
+
+	preference, err := h.storage.GetPreference(c.Request.Context(), username)
+
+	if errors.Is(err, storage.ErrPreferenceNotFound) {
+		c.JSON(http.StatusOK, PreferenceResponse{
+			RemindDaysBefore: h.defaultDaysBefore,
+		})
+		return
+	}
+
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to get preferences", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, PreferenceToResponse(preference))
+}
+
+func (h *Handler) UpdatePreferences(c *gin.Context) {
+
+	username := c.GetHeader("X-User-Name")
+
+	if username == "" {
+		apierror.Respond(c, apierror.BadRequest("username must be given as X-User-Name Header"))
+		return
+	}
+
+	reqPreference := PreferenceResponse{RemindDaysBefore: h.defaultDaysBefore}
+
+	err := json.NewDecoder(c.Request.Body).Decode(&reqPreference)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to decode body", "error", err)
+		apierror.Respond(c, apierror.BadRequest("invalid request body: %s", err.Error()))
+		return
+	}
+
+	if reqPreference.RemindDaysBefore < 1 || reqPreference.RemindDaysBefore > notifier.MaxRemindDays {
+		apierror.Respond(c, apierror.Validation("remindDaysBefore must be between 1 and %d", notifier.MaxRemindDays))
+		return
+	}
+
+	if reqPreference.EmailEnabled && reqPreference.Email == "" {
+		apierror.Respond(c, apierror.Validation("email must be given to enable email notifications"))
+		return
+	}
+
+	if reqPreference.WebhookEnabled && reqPreference.WebhookUrl == "" {
+		apierror.Respond(c, apierror.Validation("webhookUrl must be given to enable webhook notifications"))
+		return
+	}
+
+	if reqPreference.WebhookUrl != "" {
+		if err = channel.ValidateWebhookURL(reqPreference.WebhookUrl); err != nil {
+			apierror.Respond(c, apierror.Validation("webhookUrl must be a public https url: %s", err.Error()))
+			return
+		}
+	}
+
+	preference, err := h.storage.UpsertPreference(c.Request.Context(), storage.Preference{
+		Username:           username,
+		Email:              reqPreference.Email,
+		Webhook_url:        reqPreference.WebhookUrl,
+		Email_enabled:      reqPreference.EmailEnabled,
+		Webhook_enabled:    reqPreference.WebhookEnabled,
+		Remind_days_before: reqPreference.RemindDaysBefore,
+	})
+
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to update preferences", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, PreferenceToResponse(preference))
+}
+
+func (h *Handler) GetDeliveries(c *gin.Context) {
+
+	username := c.GetHeader("X-User-Name")
+
+	if username == "" {
+		apierror.Respond(c, apierror.BadRequest("username must be given as X-User-Name Header"))
+		return
+	}
+
+	deliveries, err := h.storage.GetDeliveries(c.Request.Context(), username)
+
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to get deliveries", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	res := make([]DeliveryResponse, len(deliveries))
+
+	for index, value := range deliveries {
+		res[index] = DeliveryResponse{
+			Delivery_uid: value.Delivery_uid,
+			Kind:         value.Kind,
+			Reference:    value.Reference,
+			Channel:      value.Channel,
+			Status:       value.Status,
+			Error:        value.Error,
+			Created_at:   value.Created_at.Format(time.RFC3339),
+		}
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) CreateSubscription(c *gin.Context) {
+
+	username := c.GetHeader("X-User-Name")
+
+	if username == "" {
+		apierror.Respond(c, apierror.BadRequest("username must be given as X-User-Name Header"))
+		return
+	}
+
+	var reqSubscription RequestCreateSubscription
+
+	err := json.NewDecoder(c.Request.Body).Decode(&reqSubscription)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to decode body", "error", err)
+		apierror.Respond(c, apierror.BadRequest("invalid request body: %s", err.Error()))
+		return
+	}
+
+	subscription, err := h.storage.CreateSubscription(c.Request.Context(), username, reqSubscription.BookUid, reqSubscription.LibraryUid)
+
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to create subscription", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, SubscriptionResponse{
+		BookUid:    subscription.Book_uid,
+		LibraryUid: subscription.Library_uid,
+		CreatedAt:  subscription.Created_at.Format(time.RFC3339),
+	})
+}
+
+func (h *Handler) BookAvailable(c *gin.Context) {
+
+	var reqAvailable RequestBookAvailable
+
+	err := json.NewDecoder(c.Request.Body).Decode(&reqAvailable)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to decode body", "error", err)
+		apierror.Respond(c, apierror.BadRequest("invalid request body: %s", err.Error()))
+		return
+	}
+
+	err = h.notifier.BookAvailable(c.Request.Context(), reqAvailable.BookUid, reqAvailable.LibraryUid)
+
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to notify subscribers", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, MessageResponse{
+		Message: "subscribers will be notified",
+	})
+}
+
+func PreferenceToResponse(preference storage.Preference) PreferenceResponse {
+	return PreferenceResponse{
+		Email:            preference.Email,
+		WebhookUrl:       preference.Webhook_url,
+		EmailEnabled:     preference.Email_enabled,
+		WebhookEnabled:   preference.Webhook_enabled,
+		RemindDaysBefore: preference.Remind_days_before,
+	}
+}
+
+func (h *Handler) GetHealth(c *gin.Context) {
+	c.Status(http.StatusOK)
+}
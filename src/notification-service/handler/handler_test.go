@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"library-system/src/notification-service/notifier"
+	"library-system/src/notification-service/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	bookUid     = "f7cdc58f-2caf-4b15-9727-f89dcc629b27"
+	libraryUid  = "83575e12-7ce0-48ee-9931-51919ff3c9ee"
+	deliveryUid = "6a7b8c9d-0000-4000-8000-000000000001"
+)
+
+type testCase struct {
+	name   string
+	method string
+	path   string
+	header http.Header
+	body   string
+	status int
+	// response is the expected body, or a part of it
+	response string
+}
+
+var (
+	reader   = http.Header{"X-User-Name": {"Test Max"}}
+	newcomer = http.Header{"X-User-Name": {"Test Min"}}
+)
+
+func newTestRouter() (*gin.Engine, storage.Storage) {
+	gin.SetMode(gin.TestMode)
+
+	memory := storage.NewMemory()
+	memory.AddPreference(storage.Preference{
+		Username: "Test Max", Email: "max@example.com", Email_enabled: true, Remind_days_before: 5,
+	})
+	memory.AddDelivery(storage.Delivery{
+		Delivery_uid: deliveryUid, Username: "Test Max", Kind: notifier.KindDueSoon, Reference: "3c4d5e6f-0000-4000-8000-000000000001",
+		Channel: "EMAIL", Status: "SENT", Created_at: time.Date(2021, 10, 8, 9, 0, 0, 0, time.UTC),
+	})
+
+	handler := NewHandler(memory, notifier.New(memory, nil, "http://reservation-service"), 3)
+
+	router := gin.New()
+	handler.Register(router)
+
+	return router, memory
+}
+
+func serve(router *gin.Engine, method, path string, header http.Header, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func run(t *testing.T, tests []testCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, _ := newTestRouter()
+
+			recorder := serve(router, tt.method, tt.path, tt.header, tt.body)
+
+			if recorder.Code != tt.status || !strings.Contains(recorder.Body.String(), tt.response) {
+				t.Errorf("expected %d %s, got %d %s", tt.status, tt.response, recorder.Code, recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestGetPreferences(t *testing.T) {
+	run(t, []testCase{
+		{"reader with preferences", http.MethodGet, "/api/v1/notifications/preferences", reader, "", http.StatusOK,
+			`{"email":"max@example.com","webhookUrl":"","emailEnabled":true,"webhookEnabled":false,"remindDaysBefore":5}`},
+		{"reader without preferences", http.MethodGet, "/api/v1/notifications/preferences", newcomer, "", http.StatusOK,
+			`{"email":"","webhookUrl":"","emailEnabled":false,"webhookEnabled":false,"remindDaysBefore":3}`},
+		{"missing username", http.MethodGet, "/api/v1/notifications/preferences", nil, "", http.StatusBadRequest, "X-User-Name"},
+	})
+}
+
+func TestUpdatePreferences(t *testing.T) {
+	path := "/api/v1/notifications/preferences"
+
+	run(t, []testCase{
+		{"webhook", http.MethodPut, path, newcomer, `{"webhookUrl":"https://example.com/hook","webhookEnabled":true}`, http.StatusOK,
+			`{"email":"","webhookUrl":"https://example.com/hook","emailEnabled":false,"webhookEnabled":true,"remindDaysBefore":3}`},
+		{"update", http.MethodPut, path, reader, `{"email":"max@example.org","emailEnabled":true,"remindDaysBefore":1}`, http.StatusOK,
+			`"email":"max@example.org","webhookUrl":"","emailEnabled":true,"webhookEnabled":false,"remindDaysBefore":1`},
+		{"too many days", http.MethodPut, path, reader, `{"remindDaysBefore":31}`, http.StatusUnprocessableEntity, "remindDaysBefore must be between 1 and 30"},
+		{"no days", http.MethodPut, path, reader, `{"remindDaysBefore":0}`, http.StatusUnprocessableEntity, "remindDaysBefore must be between 1 and 30"},
+		{"email without address", http.MethodPut, path, reader, `{"emailEnabled":true}`, http.StatusUnprocessableEntity, "email must be given"},
+		{"webhook without url", http.MethodPut, path, reader, `{"webhookEnabled":true}`, http.StatusUnprocessableEntity, "webhookUrl must be given"},
+		{"plain http webhook", http.MethodPut, path, reader, `{"webhookUrl":"http://example.com/hook"}`, http.StatusUnprocessableEntity, "https"},
+		{"internal webhook", http.MethodPut, path, reader, `{"webhookUrl":"https://10.0.0.1/hook"}`, http.StatusUnprocessableEntity, "not public"},
+		{"malformed body", http.MethodPut, path, reader, `{"email":`, http.StatusBadRequest, `"code":"BAD_REQUEST"`},
+		{"missing username", http.MethodPut, path, nil, `{}`, http.StatusBadRequest, "X-User-Name"},
+	})
+}
+
+func TestUpdatePreferencesKeepsOthers(t *testing.T) {
+	router, memory := newTestRouter()
+
+	recorder := serve(router, http.MethodPut, "/api/v1/notifications/preferences", newcomer, `{"remindDaysBefore":7}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	if preference, err := memory.GetPreference(context.Background(), "Test Max"); err != nil || preference.Remind_days_before != 5 {
+		t.Errorf("the preferences of other readers must be kept, got %+v (%v)", preference, err)
+	}
+	if preference, err := memory.GetPreference(context.Background(), "Test Min"); err != nil || preference.Remind_days_before != 7 {
+		t.Errorf("unexpected preference %+v (%v)", preference, err)
+	}
+}
+
+func TestGetDeliveries(t *testing.T) {
+	run(t, []testCase{
+		{"reader with deliveries", http.MethodGet, "/api/v1/notifications", reader, "", http.StatusOK,
+			`[{"deliveryUid":"` + deliveryUid + `","kind":"DUE_SOON","reference":"3c4d5e6f-0000-4000-8000-000000000001","channel":"EMAIL","status":"SENT","createdAt":"2021-10-08T09:00:00Z"}]`},
+		{"reader without deliveries", http.MethodGet, "/api/v1/notifications", newcomer, "", http.StatusOK, `[]`},
+		{"missing username", http.MethodGet, "/api/v1/notifications", nil, "", http.StatusBadRequest, "X-User-Name"},
+	})
+}
+
+func TestCreateSubscription(t *testing.T) {
+	path := "/api/v1/notifications/subscriptions"
+	body := `{"bookUid":"` + bookUid + `","libraryUid":"` + libraryUid + `"}`
+
+	run(t, []testCase{
+		{"subscription", http.MethodPost, path, reader, body, http.StatusCreated, `{"bookUid":"` + bookUid + `","libraryUid":"` + libraryUid + `","createdAt":"`},
+		{"invalid book", http.MethodPost, path, reader, `{"bookUid":"book","libraryUid":"` + libraryUid + `"}`, http.StatusUnprocessableEntity, `"code":"VALIDATION_FAILED"`},
+		{"malformed body", http.MethodPost, path, reader, `{"bookUid":`, http.StatusBadRequest, `"code":"BAD_REQUEST"`},
+		{"missing username", http.MethodPost, path, nil, body, http.StatusBadRequest, "X-User-Name"},
+	})
+}
+
+func TestBookAvailable(t *testing.T) {
+	router, memory := newTestRouter()
+
+	recorder := serve(router, http.MethodPost, "/api/v1/notifications/subscriptions", reader, `{"bookUid":"`+bookUid+`","libraryUid":"`+libraryUid+`"}`)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("unexpected response %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = serve(router, http.MethodPost, "/api/v1/notifications/events/book-available", nil, `{"bookUid":"`+bookUid+`","libraryUid":"`+libraryUid+`"}`)
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("unexpected response %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	// the notice is left to the notifier loop
+	subscriptions, err := memory.GetAvailable(context.Background())
+	if err != nil || len(subscriptions) != 1 || subscriptions[0].Username != "Test Max" || subscriptions[0].Available_at == nil {
+		t.Errorf("expected a pending notice for Test Max, got %+v (%v)", subscriptions, err)
+	}
+
+	run(t, []testCase{
+		{"invalid book", http.MethodPost, "/api/v1/notifications/events/book-available", nil, `{"bookUid":"book","libraryUid":"` + libraryUid + `"}`,
+			http.StatusUnprocessableEntity, `"code":"VALIDATION_FAILED"`},
+		{"malformed body", http.MethodPost, "/api/v1/notifications/events/book-available", nil, `{"bookUid":`, http.StatusBadRequest, `"code":"BAD_REQUEST"`},
+	})
+}
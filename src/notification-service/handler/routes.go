@@ -0,0 +1,15 @@
+package handler
+
+import "github.com/gin-gonic/gin"
+
+// Register adds the routes of notification-service to router. Probes and metrics are
+// registered by the caller.
+func (h *Handler) Register(router gin.IRoutes) {
+	router.GET("/api/v1/notifications", h.GetDeliveries)
+	router.GET("/api/v1/notifications/preferences", h.GetPreferences)
+	router.PUT("/api/v1/notifications/preferences", h.UpdatePreferences)
+	router.POST("/api/v1/notifications/subscriptions", h.CreateSubscription)
+	router.POST("/api/v1/notifications/events/book-available", h.BookAvailable)
+
+	router.GET("/manage/health", h.GetHealth)
+}
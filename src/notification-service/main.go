@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"library-system/src/notification-service/channel"
+	"library-system/src/notification-service/handler"
+	"library-system/src/notification-service/migrations"
+	"library-system/src/notification-service/notifier"
+	"library-system/src/notification-service/storage"
+	"library-system/src/pkg/health"
+	"library-system/src/pkg/logging"
+	"library-system/src/pkg/metrics"
+	"library-system/src/pkg/migrate"
+	"library-system/src/pkg/outbox"
+	"library-system/src/pkg/server"
+	"library-system/src/pkg/tracing"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+)
+
+func main() {
+	logging.Setup("notification-service")
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "notification-service")
+	if err != nil {
+		slog.Error("tracing init failed", "error", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
+	postgresURL := fmt.Sprintf("host=%s port=%d user=%s dbname=%s password=%s",
+		"postgres", 5432, "program", "notifications", "test")
+	psqlDB, err := storage.NewPgStorage(context.Background(), postgresURL)
+	if err != nil {
+		slog.Error("postgresql init failed", "error", err)
+		os.Exit(1)
+	}
+	defer psqlDB.Close()
+
+	if err = health.WaitFor(context.Background(), "postgres", psqlDB.Ping); err != nil {
+		slog.Error("postgresql init failed", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("connected to PostgreSQL")
+
+	migrator, err := migrate.New(psqlDB.Pool(), migrations.Schema, nil)
+	if err != nil {
+		slog.Error("migrations init failed", "error", err)
+		os.Exit(1)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err = migrator.Command(context.Background(), os.Args[2:], os.Stdout); err != nil {
+			slog.Error("migrate failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err = migrator.OnStart(context.Background()); err != nil {
+		slog.Error("migrations failed", "error", err)
+		os.Exit(1)
+	}
+
+	metrics.RegisterPool(psqlDB)
+
+	checker := health.New(2 * time.Second)
+	checker.Add("postgres", psqlDB.Ping)
+	checker.Add("migrations", migrator.Check)
+
+	channels := []channel.Channel{
+		channel.NewWebhook(10 * time.Second),
+	}
+	if smtpAddr := os.Getenv("SMTP_ADDR"); smtpAddr != "" {
+		channels = append(channels, channel.NewSMTP(channel.SMTPConfig{
+			Addr:     smtpAddr,
+			From:     envString("SMTP_FROM", "library@localhost"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			Timeout:  10 * time.Second,
+		}))
+	}
+
+	reservationService := envString("RESERVATION_SERVICE_URL", "http://reservation-service:8070")
+	notify := notifier.New(psqlDB, channels, reservationService)
+	checker.AddOptional("reservation-service", health.HTTP(&http.Client{}, reservationService+"/manage/ready"))
+
+	interval, err := time.ParseDuration(os.Getenv("NOTIFY_INTERVAL"))
+	if err != nil {
+		interval = time.Hour
+	}
+
+	daysBefore, err := strconv.Atoi(os.Getenv("NOTIFY_DAYS_BEFORE"))
+	if err != nil {
+		daysBefore = 3
+	}
+
+	handler := handler.NewHandler(psqlDB, notify, daysBefore)
+
+	router := gin.New()
+	router.Use(gin.Recovery(), tracing.Middleware("notification-service"), logging.Middleware(), metrics.Middleware())
+
+	router.Use(cors.Default())
+
+	handler.Register(router)
+
+	router.GET("/manage/live", checker.Live)
+	router.GET("/manage/ready", checker.Ready)
+	router.GET("/manage/metrics", metrics.Handler())
+
+	// publish the events of the outbox to the services listening on the
+	// notification_events channel
+	outboxInterval, err := time.ParseDuration(os.Getenv("OUTBOX_INTERVAL"))
+	if err != nil {
+		outboxInterval = time.Second
+	}
+	relay := outbox.NewRelay(psqlDB.Outbox(), outbox.NewPgBroker(psqlDB.Pool(), "notification_events"))
+
+	// returned books are announced on reservation_events of the reservations
+	// database; the gateway still posts book-available as well, since LISTEN
+	// misses the events published while the connection is down
+	reservationsURL := fmt.Sprintf("host=%s port=%d user=%s dbname=%s password=%s",
+		"postgres", 5432, "program", "reservations", "test")
+	reservationsDB, err := tracing.NewPool(context.Background(), reservationsURL)
+	if err != nil {
+		slog.Error("reservations database init failed", "error", err)
+		os.Exit(1)
+	}
+	defer reservationsDB.Close()
+	reservationEvents := outbox.NewPgBroker(reservationsDB, "reservation_events")
+
+	srv := server.New(server.ConfigFromEnv(":8030"), router, checker)
+	srv.Go(func(ctx context.Context) { notify.Run(ctx, interval) })
+	srv.Go(func(ctx context.Context) { relay.Run(ctx, outboxInterval) })
+	srv.Go(func(ctx context.Context) {
+		outbox.Listen(ctx, reservationEvents, notify.HandleReservationEvent, 5*time.Second)
+	})
+
+	if err = srv.Run(); err != nil {
+		slog.Error("server stopped with error", "error", err)
+	}
+}
+
+func envString(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,3 @@
+DROP TABLE subscription;
+DROP TABLE delivery;
+DROP TABLE preference;
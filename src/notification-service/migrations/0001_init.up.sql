@@ -0,0 +1,38 @@
+CREATE TABLE preference
+(
+    id                 SERIAL PRIMARY KEY,
+    username           VARCHAR(80) UNIQUE NOT NULL,
+    email              VARCHAR(255)       NOT NULL,
+    webhook_url        VARCHAR(255)       NOT NULL,
+    email_enabled      BOOLEAN            NOT NULL,
+    webhook_enabled    BOOLEAN            NOT NULL,
+    remind_days_before INT                NOT NULL
+        CHECK (remind_days_before BETWEEN 1 AND 30)
+);
+
+CREATE TABLE delivery
+(
+    id           SERIAL PRIMARY KEY,
+    delivery_uid uuid UNIQUE  NOT NULL,
+    username     VARCHAR(80)  NOT NULL,
+    kind         VARCHAR(20)  NOT NULL
+        CHECK (kind IN ('DUE_SOON', 'DUE_TODAY', 'OVERDUE', 'AVAILABLE')),
+    reference    VARCHAR(255) NOT NULL,
+    channel      VARCHAR(20)  NOT NULL,
+    status       VARCHAR(20)  NOT NULL
+        CHECK (status IN ('SENT', 'FAILED')),
+    error        TEXT         NOT NULL,
+    created_at   TIMESTAMP    NOT NULL
+);
+
+CREATE INDEX delivery_reference_idx ON delivery (kind, reference, channel);
+
+CREATE TABLE subscription
+(
+    id          SERIAL PRIMARY KEY,
+    username    VARCHAR(80) NOT NULL,
+    book_uid    uuid        NOT NULL,
+    library_uid uuid        NOT NULL,
+    created_at  TIMESTAMP   NOT NULL,
+    notified_at TIMESTAMP
+);
@@ -0,0 +1,2 @@
+DROP INDEX subscription_available_idx;
+ALTER TABLE subscription DROP COLUMN available_at;
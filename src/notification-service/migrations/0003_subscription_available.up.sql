@@ -0,0 +1,5 @@
+-- the book of the subscription became available; the notice is pending until
+-- notified_at is set
+ALTER TABLE subscription ADD COLUMN available_at TIMESTAMP;
+
+CREATE INDEX subscription_available_idx ON subscription (id) WHERE available_at IS NOT NULL AND notified_at IS NULL;
@@ -0,0 +1,362 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"library-system/src/notification-service/channel"
+	"library-system/src/notification-service/storage"
+	"library-system/src/pkg/outbox"
+	"library-system/src/pkg/tracing"
+)
+
+const (
+	KindDueSoon   string = "DUE_SOON"
+	KindDueToday  string = "DUE_TODAY"
+	KindOverdue   string = "OVERDUE"
+	KindAvailable string = "AVAILABLE"
+)
+
+// MaxRemindDays bounds how many days before the due date a reader may ask
+// to be reminded.
+const MaxRemindDays = 30
+
+const (
+	// MaxAttempts bounds how often a notice is tried through a channel.
+	MaxAttempts = 5
+	// RetryBackoff is the wait after the first failed attempt, doubled after
+	// every further one.
+	RetryBackoff = 10 * time.Minute
+)
+
+type Reservation struct {
+	Reservation_uid string `json:"reservationUid"`
+	Username        string `json:"username"`
+	Book_uid        string `json:"bookUid"`
+	Library_uid     string `json:"libraryUid"`
+	Status          string `json:"status"`
+	Till_date       string `json:"tillDate"`
+}
+
+type Notifier struct {
+	storage            storage.Storage
+	channels           []channel.Channel
+	reservationService string
+	client             *http.Client
+	// available wakes Run when a book became available.
+	available chan struct{}
+}
+
+func New(storage storage.Storage, channels []channel.Channel, reservationService string) *Notifier {
+	return &Notifier{
+		storage:            storage,
+		channels:           channels,
+		reservationService: reservationService,
+		client:             &http.Client{Transport: tracing.Transport(http.DefaultTransport), Timeout: 10 * time.Second},
+		available:          make(chan struct{}, 1),
+	}
+}
+
+// Run scans due reservations and pending availability notices immediately
+// and then on every tick until ctx is cancelled. A book becoming available
+// sends its notices without waiting for the tick.
+func (n *Notifier) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	scanDue := true
+	for {
+		if scanDue {
+			if err := n.ScanDue(ctx, time.Now().UTC()); err != nil {
+				slog.ErrorContext(ctx, "failed to scan due reservations", "error", err)
+			}
+		}
+		if err := n.ScanAvailable(ctx); err != nil {
+			slog.ErrorContext(ctx, "failed to scan available books", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			scanDue = true
+		case <-n.available:
+			scanDue = false
+		}
+	}
+}
+
+// ScanDue sends due date reminders and overdue notices for every rented
+// reservation. Each notice is delivered at most once per channel and failed
+// deliveries are retried with a backoff up to MaxAttempts times.
+func (n *Notifier) ScanDue(ctx context.Context, today time.Time) error {
+	reservations, err := n.dueReservations(ctx, today.AddDate(0, 0, MaxRemindDays))
+	if err != nil {
+		return err
+	}
+
+	preferences := make(map[string]*storage.Preference)
+
+	for _, reservation := range reservations {
+		preference, ok := preferences[reservation.Username]
+		if !ok {
+			found, err := n.storage.GetPreference(ctx, reservation.Username)
+			if err != nil && !errors.Is(err, storage.ErrPreferenceNotFound) {
+				return err
+			}
+			if err == nil {
+				preference = &found
+			}
+			preferences[reservation.Username] = preference
+		}
+		if preference == nil {
+			continue
+		}
+
+		tillDate, err := time.Parse("2006-01-02", reservation.Till_date)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to parse till date", "reservation_uid", reservation.Reservation_uid, "error", err)
+			continue
+		}
+
+		kind := ReminderKind(today, tillDate, preference.Remind_days_before)
+		if kind == "" {
+			continue
+		}
+
+		n.deliver(ctx, *preference, reminderMessage(kind, reservation))
+	}
+
+	return nil
+}
+
+// BookAvailable marks the notices to every reader waiting for the book in
+// the library as pending and wakes Run to send them, so that a failed
+// delivery is retried like a reminder instead of being lost.
+func (n *Notifier) BookAvailable(ctx context.Context, bookUid string, libraryUid string) error {
+	if err := n.storage.MarkAvailable(ctx, bookUid, libraryUid); err != nil {
+		return err
+	}
+
+	select {
+	case n.available <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// ReservationReturned is the event reservation-service publishes on its
+// reservation_events channel when a book is returned.
+const ReservationReturned = "reservation.returned"
+
+// HandleReservationEvent is the outbox.Handler of the events of
+// reservation-service: a returned book is available to its subscribers.
+func (n *Notifier) HandleReservationEvent(ctx context.Context, event outbox.Event) error {
+	if event.Type != ReservationReturned {
+		return nil
+	}
+
+	var returned struct {
+		BookUid    string `json:"bookUid"`
+		LibraryUid string `json:"libraryUid"`
+	}
+	if err := event.Decode(&returned); err != nil {
+		return err
+	}
+
+	return n.BookAvailable(ctx, returned.BookUid, returned.LibraryUid)
+}
+
+// ScanAvailable sends the pending availability notices. A subscription is
+// kept pending until its notice is sent through every channel the reader
+// enabled or has failed there MaxAttempts times.
+func (n *Notifier) ScanAvailable(ctx context.Context) error {
+	subscriptions, err := n.storage.GetAvailable(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, subscription := range subscriptions {
+		settled := true
+
+		preference, err := n.storage.GetPreference(ctx, subscription.Username)
+		if err != nil && !errors.Is(err, storage.ErrPreferenceNotFound) {
+			return err
+		}
+		if err == nil {
+			settled = n.deliver(ctx, preference, availableMessage(subscription))
+		}
+		if !settled {
+			continue
+		}
+
+		if err = n.storage.MarkNotified(ctx, subscription.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReminderKind returns which notice is due today for a book due on tillDate,
+// or an empty string when there is nothing to send.
+func ReminderKind(today time.Time, tillDate time.Time, daysBefore int) string {
+	days := int(tillDate.Truncate(24*time.Hour).Sub(today.Truncate(24*time.Hour)).Hours() / 24)
+
+	switch {
+	case days < 0:
+		return KindOverdue
+	case days == 0:
+		return KindDueToday
+	case days <= daysBefore:
+		return KindDueSoon
+	}
+	return ""
+}
+
+func reminderMessage(kind string, reservation Reservation) channel.Message {
+	message := channel.Message{
+		Kind:      kind,
+		Reference: reservation.Reservation_uid,
+	}
+
+	switch kind {
+	case KindDueSoon:
+		message.Subject = "Your book is due soon"
+		message.Text = fmt.Sprintf("Please return book %s by %s.", reservation.Book_uid, reservation.Till_date)
+	case KindDueToday:
+		message.Subject = "Your book is due today"
+		message.Text = fmt.Sprintf("Book %s is due today, %s.", reservation.Book_uid, reservation.Till_date)
+	case KindOverdue:
+		message.Subject = "Your book is overdue"
+		message.Text = fmt.Sprintf("Book %s was due on %s. Fines are charged for late returns.", reservation.Book_uid, reservation.Till_date)
+	}
+
+	return message
+}
+
+func availableMessage(subscription storage.Subscription) channel.Message {
+	return channel.Message{
+		Kind:      KindAvailable,
+		Reference: fmt.Sprintf("%s/%d", subscription.Book_uid, subscription.ID),
+		Subject:   "The book you are waiting for is available",
+		Text:      fmt.Sprintf("Book %s is available again in library %s.", subscription.Book_uid, subscription.Library_uid),
+	}
+}
+
+// deliver sends the message through every channel the reader enabled and
+// records the outcome in the delivery log. It reports whether the message is
+// settled: sent or given up on through every channel.
+func (n *Notifier) deliver(ctx context.Context, preference storage.Preference, message channel.Message) bool {
+	settled := true
+
+	recipient := channel.Recipient{
+		Username:   preference.Username,
+		Email:      preference.Email,
+		WebhookURL: preference.Webhook_url,
+	}
+
+	for _, ch := range n.channels {
+		if !enabled(preference, ch.Name()) {
+			continue
+		}
+
+		attempts, err := n.storage.GetAttempts(ctx, message.Kind, message.Reference, ch.Name())
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to check delivery log", "error", err)
+			settled = false
+			continue
+		}
+		if !RetryDue(attempts, time.Now().UTC()) {
+			if !attempts.Sent && attempts.Failed < MaxAttempts {
+				settled = false
+			}
+			continue
+		}
+
+		delivery := storage.Delivery{
+			Username:  preference.Username,
+			Kind:      message.Kind,
+			Reference: message.Reference,
+			Channel:   ch.Name(),
+			Status:    "SENT",
+		}
+
+		if err = ch.Send(ctx, recipient, message); err != nil {
+			delivery.Status = "FAILED"
+			delivery.Error = err.Error()
+
+			if attempts.Failed+1 >= MaxAttempts {
+				slog.WarnContext(ctx, "giving up delivery", "kind", message.Kind, "reference", message.Reference,
+					"channel", ch.Name(), "attempts", MaxAttempts, "error", err)
+			} else {
+				settled = false
+			}
+		}
+
+		if err = n.storage.CreateDelivery(ctx, delivery); err != nil {
+			slog.ErrorContext(ctx, "failed to record delivery", "error", err)
+		}
+	}
+
+	return settled
+}
+
+// RetryDue reports whether a notice with the given attempts is to be sent
+// through their channel at now: it has not been sent, has failed fewer than
+// MaxAttempts times and the backoff after its last failure has passed.
+func RetryDue(attempts storage.Attempts, now time.Time) bool {
+	if attempts.Sent || attempts.Failed >= MaxAttempts {
+		return false
+	}
+	if attempts.Failed == 0 || attempts.LastFailed == nil {
+		return true
+	}
+
+	backoff := RetryBackoff << (attempts.Failed - 1)
+	return !now.Before(attempts.LastFailed.Add(backoff))
+}
+
+func enabled(preference storage.Preference, channelName string) bool {
+	switch channelName {
+	case "EMAIL":
+		return preference.Email_enabled
+	case "WEBHOOK":
+		return preference.Webhook_enabled
+	}
+	return false
+}
+
+func (n *Notifier) dueReservations(ctx context.Context, until time.Time) ([]Reservation, error) {
+	requestURL := fmt.Sprintf("%s/api/v1/reservations/due?until=%s", n.reservationService,
+		url.QueryEscape(until.Format("2006-01-02")))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("reservation service responded with status %d", res.StatusCode)
+	}
+
+	var reservations []Reservation
+	if err = json.NewDecoder(res.Body).Decode(&reservations); err != nil {
+		return nil, err
+	}
+
+	return reservations, nil
+}
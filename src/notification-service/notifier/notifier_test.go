@@ -0,0 +1,210 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"library-system/src/notification-service/channel"
+	"library-system/src/notification-service/storage"
+	"library-system/src/pkg/outbox"
+)
+
+func TestReminderKind(t *testing.T) {
+
+	today := time.Date(2021, 10, 11, 15, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		days int
+		want string
+	}{
+		{5, ""},
+		{3, KindDueSoon},
+		{1, KindDueSoon},
+		{0, KindDueToday},
+		{-1, KindOverdue},
+	}
+
+	for _, tt := range tests {
+		tillDate := time.Date(2021, 10, 11+tt.days, 0, 0, 0, 0, time.UTC)
+		if got := ReminderKind(today, tillDate, 3); got != tt.want {
+			t.Errorf("ReminderKind(%d days) = %q, want %q", tt.days, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDue(t *testing.T) {
+
+	now := time.Date(2021, 10, 11, 15, 30, 0, 0, time.UTC)
+	ago := func(d time.Duration) *time.Time {
+		at := now.Add(-d)
+		return &at
+	}
+
+	tests := []struct {
+		name     string
+		attempts storage.Attempts
+		want     bool
+	}{
+		{"never attempted", storage.Attempts{}, true},
+		{"sent", storage.Attempts{Sent: true}, false},
+		{"sent after failures", storage.Attempts{Sent: true, Failed: 2, LastFailed: ago(time.Hour)}, false},
+		{"failed once, waiting", storage.Attempts{Failed: 1, LastFailed: ago(5 * time.Minute)}, false},
+		{"failed once, backed off", storage.Attempts{Failed: 1, LastFailed: ago(RetryBackoff)}, true},
+		{"failed three times, waiting", storage.Attempts{Failed: 3, LastFailed: ago(30 * time.Minute)}, false},
+		{"failed three times, backed off", storage.Attempts{Failed: 3, LastFailed: ago(4 * RetryBackoff)}, true},
+		{"failed too often", storage.Attempts{Failed: MaxAttempts, LastFailed: ago(24 * time.Hour)}, false},
+	}
+
+	for _, tt := range tests {
+		if got := RetryDue(tt.attempts, now); got != tt.want {
+			t.Errorf("%s: RetryDue = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// fakeChannel is an EMAIL channel that fails while err is set.
+type fakeChannel struct {
+	err  error
+	sent []channel.Message
+}
+
+func (ch *fakeChannel) Name() string {
+	return "EMAIL"
+}
+
+func (ch *fakeChannel) Send(ctx context.Context, recipient channel.Recipient, message channel.Message) error {
+	if ch.err != nil {
+		return ch.err
+	}
+	ch.sent = append(ch.sent, message)
+	return nil
+}
+
+// memoryStorage is the storage.NewMemory fixture API used below.
+type memoryStorage interface {
+	storage.Storage
+	AddDelivery(delivery storage.Delivery) storage.Delivery
+}
+
+func TestScanAvailable(t *testing.T) {
+
+	const (
+		bookUid    = "f7cdc58f-2caf-4b15-9727-f89dcc629b27"
+		libraryUid = "83575e12-7ce0-48ee-9931-51919ff3c9ee"
+	)
+	ctx := context.Background()
+
+	newNotifier := func(ch *fakeChannel) (*Notifier, memoryStorage) {
+		memory := storage.NewMemory()
+		memory.AddPreference(storage.Preference{Username: "Test Max", Email: "max@example.com", Email_enabled: true, Remind_days_before: 3})
+		memory.AddSubscription(storage.Subscription{Username: "Test Max", Book_uid: bookUid, Library_uid: libraryUid})
+		memory.AddSubscription(storage.Subscription{Username: "Test Min", Book_uid: bookUid, Library_uid: libraryUid})
+
+		notifier := New(memory, []channel.Channel{ch}, "http://reservation-service")
+		if err := notifier.BookAvailable(ctx, bookUid, libraryUid); err != nil {
+			t.Fatal(err)
+		}
+		return notifier, memory
+	}
+
+	pending := func(s storage.Storage) []string {
+		subscriptions, _ := s.GetAvailable(ctx)
+		usernames := make([]string, len(subscriptions))
+		for i, subscription := range subscriptions {
+			usernames[i] = subscription.Username
+		}
+		return usernames
+	}
+
+	t.Run("sent", func(t *testing.T) {
+		ch := &fakeChannel{}
+		notifier, memory := newNotifier(ch)
+
+		if err := notifier.ScanAvailable(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if len(ch.sent) != 1 || ch.sent[0].Kind != KindAvailable || ch.sent[0].Reference != bookUid+"/1" {
+			t.Errorf("expected the notice to be sent, got %+v", ch.sent)
+		}
+		// readers without preferences have nothing to be sent
+		if usernames := pending(memory); len(usernames) != 0 {
+			t.Errorf("expected no pending notices, got %v", usernames)
+		}
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		ch := &fakeChannel{err: errors.New("connection refused")}
+		notifier, memory := newNotifier(ch)
+
+		if err := notifier.ScanAvailable(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if usernames := pending(memory); len(usernames) != 1 || usernames[0] != "Test Max" {
+			t.Errorf("a failed notice must stay pending, got %v", usernames)
+		}
+		attempts, _ := memory.GetAttempts(ctx, KindAvailable, bookUid+"/1", "EMAIL")
+		if attempts.Failed != 1 {
+			t.Errorf("expected one failed attempt, got %+v", attempts)
+		}
+
+		// the retry waits for the backoff
+		ch.err = nil
+		notifier.ScanAvailable(ctx)
+		if len(ch.sent) != 0 || len(pending(memory)) != 1 {
+			t.Errorf("expected the retry to wait, got %+v", ch.sent)
+		}
+	})
+
+	t.Run("given up", func(t *testing.T) {
+		ch := &fakeChannel{err: errors.New("connection refused")}
+		notifier, memory := newNotifier(ch)
+
+		for i := 0; i < MaxAttempts-1; i++ {
+			memory.AddDelivery(storage.Delivery{
+				Delivery_uid: fmt.Sprintf("6a7b8c9d-0000-4000-8000-%012d", i), Username: "Test Max", Kind: KindAvailable,
+				Reference: bookUid + "/1", Channel: "EMAIL", Status: "FAILED", Created_at: time.Now().Add(-24 * time.Hour),
+			})
+		}
+
+		if err := notifier.ScanAvailable(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if usernames := pending(memory); len(usernames) != 0 {
+			t.Errorf("expected the notice to be given up after %d attempts, got %v", MaxAttempts, usernames)
+		}
+	})
+}
+
+func TestHandleReservationEvent(t *testing.T) {
+
+	const (
+		bookUid    = "f7cdc58f-2caf-4b15-9727-f89dcc629b27"
+		libraryUid = "83575e12-7ce0-48ee-9931-51919ff3c9ee"
+	)
+	ctx := context.Background()
+
+	memory := storage.NewMemory()
+	memory.AddSubscription(storage.Subscription{Username: "Test Max", Book_uid: bookUid, Library_uid: libraryUid})
+	notifier := New(memory, nil, "http://reservation-service")
+
+	payload := map[string]string{"reservationUid": "3c4d5e6f-0000-4000-8000-000000000001", "bookUid": bookUid, "libraryUid": libraryUid}
+
+	rented, _ := outbox.New("reservation.created", payload["reservationUid"], payload)
+	if err := notifier.HandleReservationEvent(ctx, rented); err != nil {
+		t.Fatal(err)
+	}
+	if subscriptions, _ := memory.GetAvailable(ctx); len(subscriptions) != 0 {
+		t.Errorf("a rented book is not available, got %+v", subscriptions)
+	}
+
+	returned, _ := outbox.New(ReservationReturned, payload["reservationUid"], payload)
+	if err := notifier.HandleReservationEvent(ctx, returned); err != nil {
+		t.Fatal(err)
+	}
+	if subscriptions, _ := memory.GetAvailable(ctx); len(subscriptions) != 1 || subscriptions[0].Username != "Test Max" {
+		t.Errorf("expected a pending notice for Test Max, got %+v", subscriptions)
+	}
+}
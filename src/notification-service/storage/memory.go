@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"library-system/src/pkg/apierror"
+	"library-system/src/pkg/outbox"
+
+	"github.com/google/uuid"
+)
+
+var (
+	kinds    = map[string]bool{"DUE_SOON": true, "DUE_TODAY": true, "OVERDUE": true, "AVAILABLE": true}
+	statuses = map[string]bool{"SENT": true, "FAILED": true}
+)
+
+// memory is a Storage kept in memory with the semantics of postgres, for
+// tests and local development.
+type memory struct {
+	mu            sync.Mutex
+	preferences   []Preference
+	deliveries    []Delivery
+	subscriptions []Subscription
+	outbox        outbox.MemoryStore
+}
+
+func NewMemory() *memory {
+	return &memory{outbox: outbox.NewMemoryStore()}
+}
+
+func (m *memory) Outbox() outbox.Store {
+	return m.outbox
+}
+
+// AddPreference inserts preference as is and returns it with its id.
+func (m *memory) AddPreference(preference Preference) Preference {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	preference.ID = len(m.preferences) + 1
+	m.preferences = append(m.preferences, preference)
+
+	return preference
+}
+
+// AddDelivery inserts delivery as is and returns it with its id.
+func (m *memory) AddDelivery(delivery Delivery) Delivery {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delivery.ID = len(m.deliveries) + 1
+	delivery.Created_at = delivery.Created_at.UTC()
+	m.deliveries = append(m.deliveries, delivery)
+
+	return delivery
+}
+
+// AddSubscription inserts subscription as is and returns it with its id.
+func (m *memory) AddSubscription(subscription Subscription) Subscription {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	subscription.ID = len(m.subscriptions) + 1
+	subscription.Created_at = subscription.Created_at.UTC()
+	m.subscriptions = append(m.subscriptions, subscription)
+
+	return subscription
+}
+
+// validUids reports a validation error like postgres does for malformed uuids.
+func validUids(uids ...string) error {
+	for _, uid := range uids {
+		if _, err := uuid.Parse(uid); err != nil {
+			return apierror.Validation("invalid input syntax for type uuid: %q", uid)
+		}
+	}
+	return nil
+}
+
+func (m *memory) GetPreference(ctx context.Context, username string) (Preference, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, preference := range m.preferences {
+		if preference.Username == username {
+			return preference, nil
+		}
+	}
+
+	return Preference{}, ErrPreferenceNotFound
+}
+
+func (m *memory) UpsertPreference(ctx context.Context, preference Preference) (Preference, error) {
+	if preference.Remind_days_before < 1 || preference.Remind_days_before > 30 {
+		return Preference{}, apierror.Validation("remind_days_before must be between 1 and 30")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	event, err := preferenceUpdatedEvent(preference)
+	if err != nil {
+		return Preference{}, err
+	}
+
+	for i, existing := range m.preferences {
+		if existing.Username == preference.Username {
+			preference.ID = existing.ID
+			m.preferences[i] = preference
+			m.outbox.Add(event)
+			return preference, nil
+		}
+	}
+
+	preference.ID = len(m.preferences) + 1
+	m.preferences = append(m.preferences, preference)
+	m.outbox.Add(event)
+
+	return preference, nil
+}
+
+func (m *memory) GetDeliveries(ctx context.Context, username string) ([]Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deliveries := []Delivery{}
+	for _, delivery := range m.deliveries {
+		if delivery.Username == username {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		if !deliveries[i].Created_at.Equal(deliveries[j].Created_at) {
+			return deliveries[i].Created_at.After(deliveries[j].Created_at)
+		}
+		return deliveries[i].ID > deliveries[j].ID
+	})
+
+	return deliveries, nil
+}
+
+func (m *memory) CreateDelivery(ctx context.Context, delivery Delivery) error {
+	if !kinds[delivery.Kind] {
+		return apierror.Validation("invalid kind %q", delivery.Kind)
+	}
+	if !statuses[delivery.Status] {
+		return apierror.Validation("invalid status %q", delivery.Status)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delivery.ID = len(m.deliveries) + 1
+	delivery.Delivery_uid = uuid.New().String()
+	delivery.Created_at = time.Now().UTC()
+
+	event, err := outbox.New(DeliveryRecorded, delivery.Delivery_uid, delivery)
+	if err != nil {
+		return err
+	}
+
+	m.deliveries = append(m.deliveries, delivery)
+	m.outbox.Add(event)
+
+	return nil
+}
+
+func (m *memory) GetAttempts(ctx context.Context, kind string, reference string, channel string) (Attempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var attempts Attempts
+	for _, delivery := range m.deliveries {
+		if delivery.Kind != kind || delivery.Reference != reference || delivery.Channel != channel {
+			continue
+		}
+
+		switch delivery.Status {
+		case "SENT":
+			attempts.Sent = true
+		case "FAILED":
+			attempts.Failed++
+			if attempts.LastFailed == nil || delivery.Created_at.After(*attempts.LastFailed) {
+				createdAt := delivery.Created_at
+				attempts.LastFailed = &createdAt
+			}
+		}
+	}
+
+	return attempts, nil
+}
+
+func (m *memory) CreateSubscription(ctx context.Context, username string, bookUid string, libraryUid string) (Subscription, error) {
+	if err := validUids(bookUid, libraryUid); err != nil {
+		return Subscription{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	subscription := Subscription{
+		ID:          len(m.subscriptions) + 1,
+		Username:    username,
+		Book_uid:    bookUid,
+		Library_uid: libraryUid,
+		Created_at:  time.Now().UTC(),
+	}
+
+	event, err := outbox.New(SubscriptionCreated, subscription.Book_uid, subscription)
+	if err != nil {
+		return Subscription{}, err
+	}
+
+	m.subscriptions = append(m.subscriptions, subscription)
+	m.outbox.Add(event)
+
+	return subscription, nil
+}
+
+func (m *memory) MarkAvailable(ctx context.Context, bookUid string, libraryUid string) error {
+	if err := validUids(bookUid, libraryUid); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UTC()
+	for i, subscription := range m.subscriptions {
+		if subscription.Book_uid == bookUid && subscription.Library_uid == libraryUid &&
+			subscription.Available_at == nil && subscription.Notified_at == nil {
+			m.subscriptions[i].Available_at = &now
+		}
+	}
+
+	return nil
+}
+
+func (m *memory) GetAvailable(ctx context.Context) ([]Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	subscriptions := []Subscription{}
+	for _, subscription := range m.subscriptions {
+		if subscription.Available_at != nil && subscription.Notified_at == nil {
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+
+	return subscriptions, nil
+}
+
+func (m *memory) MarkNotified(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UTC()
+	for i := range m.subscriptions {
+		if m.subscriptions[i].ID == id {
+			m.subscriptions[i].Notified_at = &now
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,366 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"library-system/src/pkg/apierror"
+	"library-system/src/pkg/outbox"
+	"library-system/src/pkg/tracing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var ErrPreferenceNotFound = apierror.NotFound("notification preferences not found")
+
+type Preference struct {
+	ID                 int    `json:"id"`
+	Username           string `json:"username"`
+	Email              string `json:"email"`
+	Webhook_url        string `json:"webhook_url"`
+	Email_enabled      bool   `json:"email_enabled"`
+	Webhook_enabled    bool   `json:"webhook_enabled"`
+	Remind_days_before int    `json:"remind_days_before"`
+}
+
+type Delivery struct {
+	ID           int       `json:"id"`
+	Delivery_uid string    `json:"delivery_uid"`
+	Username     string    `json:"username"`
+	Kind         string    `json:"kind"`
+	Reference    string    `json:"reference"`
+	Channel      string    `json:"channel"`
+	Status       string    `json:"status"`
+	Error        string    `json:"error"`
+	Created_at   time.Time `json:"created_at"`
+}
+
+// Attempts sums up the deliveries of a notice through a channel.
+type Attempts struct {
+	Sent   bool
+	Failed int
+	// LastFailed is when the last failed delivery was attempted, nil if none
+	// has failed.
+	LastFailed *time.Time
+}
+
+type Subscription struct {
+	ID          int        `json:"id"`
+	Username    string     `json:"username"`
+	Book_uid    string     `json:"book_uid"`
+	Library_uid string     `json:"library_uid"`
+	Created_at  time.Time  `json:"created_at"`
+	Notified_at *time.Time `json:"notified_at"`
+	// Available_at is when the book became available; the notice is pending
+	// while Notified_at is nil.
+	Available_at *time.Time `json:"available_at"`
+}
+
+// Events written to the outbox. PreferenceUpdated has a PreferenceEvent as
+// payload, DeliveryRecorded the Delivery and SubscriptionCreated the
+// Subscription.
+const (
+	PreferenceUpdated   = "preference.updated"
+	DeliveryRecorded    = "delivery.recorded"
+	SubscriptionCreated = "subscription.created"
+)
+
+// PreferenceEvent leaves out the addresses of the reader, which are of no
+// concern to other services.
+type PreferenceEvent struct {
+	Username         string `json:"username"`
+	EmailEnabled     bool   `json:"emailEnabled"`
+	WebhookEnabled   bool   `json:"webhookEnabled"`
+	RemindDaysBefore int    `json:"remindDaysBefore"`
+}
+
+func preferenceUpdatedEvent(preference Preference) (outbox.Event, error) {
+	return outbox.New(PreferenceUpdated, preference.Username, PreferenceEvent{
+		Username:         preference.Username,
+		EmailEnabled:     preference.Email_enabled,
+		WebhookEnabled:   preference.Webhook_enabled,
+		RemindDaysBefore: preference.Remind_days_before,
+	})
+}
+
+type Storage interface {
+	GetPreference(ctx context.Context, username string) (Preference, error)
+	UpsertPreference(ctx context.Context, preference Preference) (Preference, error)
+	GetDeliveries(ctx context.Context, username string) ([]Delivery, error)
+	CreateDelivery(ctx context.Context, delivery Delivery) error
+	GetAttempts(ctx context.Context, kind string, reference string, channel string) (Attempts, error)
+	CreateSubscription(ctx context.Context, username string, bookUid string, libraryUid string) (Subscription, error)
+	// MarkAvailable records that the book became available in the library
+	// for every subscription to it that was not notified yet.
+	MarkAvailable(ctx context.Context, bookUid string, libraryUid string) error
+	// GetAvailable returns the subscriptions whose book became available and
+	// that were not notified yet.
+	GetAvailable(ctx context.Context) ([]Subscription, error)
+	MarkNotified(ctx context.Context, id int) error
+	// Outbox holds the events of the changes above.
+	Outbox() outbox.Store
+}
+
+type postgres struct {
+	db *pgxpool.Pool
+}
+
+func NewPgStorage(ctx context.Context, connString string) (*postgres, error) {
+	db, err := tracing.NewPool(ctx, connString)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create connection pool: %w", err)
+	}
+
+	return &postgres{db}, nil
+}
+
+func (pg *postgres) Ping(ctx context.Context) error {
+	return pg.db.Ping(ctx)
+}
+
+func (pg *postgres) Stat() *pgxpool.Stat {
+	return pg.db.Stat()
+}
+
+func (pg *postgres) Pool() *pgxpool.Pool {
+	return pg.db
+}
+
+func (pg *postgres) Close() {
+	pg.db.Close()
+}
+
+func (pg *postgres) Outbox() outbox.Store {
+	return outbox.NewPgStore(pg.db)
+}
+
+func (pg *postgres) GetPreference(ctx context.Context, username string) (Preference, error) {
+
+	query := `SELECT * FROM preference WHERE username = @username`
+
+	rows, err := pg.db.Query(ctx, query, pgx.NamedArgs{"username": username})
+
+	var preference Preference
+
+	if err != nil {
+		return preference, fmt.Errorf("unable to query: %w", err)
+	}
+	defer rows.Close()
+
+	preference, err = pgx.CollectOneRow(rows, pgx.RowToStructByName[Preference])
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return preference, ErrPreferenceNotFound
+	}
+
+	if err != nil {
+		slog.ErrorContext(ctx, "CollectRows error", "error", err)
+		return preference, err
+	}
+
+	return preference, nil
+}
+
+func (pg *postgres) UpsertPreference(ctx context.Context, preference Preference) (Preference, error) {
+
+	query := `INSERT INTO preference (username, email, webhook_url, email_enabled, webhook_enabled, remind_days_before)
+	VALUES (@username, @email, @webhook_url, @email_enabled, @webhook_enabled, @remind_days_before)
+	ON CONFLICT (username) DO UPDATE SET email = EXCLUDED.email, webhook_url = EXCLUDED.webhook_url,
+		email_enabled = EXCLUDED.email_enabled, webhook_enabled = EXCLUDED.webhook_enabled,
+		remind_days_before = EXCLUDED.remind_days_before
+	RETURNING id`
+	args := pgx.NamedArgs{
+		"username":           preference.Username,
+		"email":              preference.Email,
+		"webhook_url":        preference.Webhook_url,
+		"email_enabled":      preference.Email_enabled,
+		"webhook_enabled":    preference.Webhook_enabled,
+		"remind_days_before": preference.Remind_days_before,
+	}
+
+	err := pgx.BeginFunc(ctx, pg.db, func(tx pgx.Tx) error {
+		if err := tx.QueryRow(ctx, query, args).Scan(&preference.ID); err != nil {
+			return fmt.Errorf("unable to insert row: %w", err)
+		}
+
+		event, err := preferenceUpdatedEvent(preference)
+		if err != nil {
+			return err
+		}
+		return outbox.Write(ctx, tx, event)
+	})
+	if err != nil {
+		return preference, err
+	}
+
+	return preference, nil
+}
+
+func (pg *postgres) GetDeliveries(ctx context.Context, username string) ([]Delivery, error) {
+
+	query := `SELECT * FROM delivery WHERE username = @username ORDER BY created_at DESC, id DESC`
+
+	rows, err := pg.db.Query(ctx, query, pgx.NamedArgs{"username": username})
+
+	var deliveries []Delivery
+
+	if err != nil {
+		return deliveries, fmt.Errorf("unable to query: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries, err = pgx.CollectRows(rows, pgx.RowToStructByName[Delivery])
+	if err != nil {
+		slog.ErrorContext(ctx, "CollectRows error", "error", err)
+		return deliveries, err
+	}
+
+	return deliveries, nil
+}
+
+func (pg *postgres) CreateDelivery(ctx context.Context, delivery Delivery) error {
+
+	delivery.Delivery_uid = uuid.New().String()
+	delivery.Created_at = time.Now().UTC()
+
+	query := `INSERT INTO delivery (delivery_uid, username, kind, reference, channel, status, error, created_at)
+	VALUES (@delivery_uid, @username, @kind, @reference, @channel, @status, @error, @created_at) RETURNING id`
+	args := pgx.NamedArgs{
+		"delivery_uid": delivery.Delivery_uid,
+		"username":     delivery.Username,
+		"kind":         delivery.Kind,
+		"reference":    delivery.Reference,
+		"channel":      delivery.Channel,
+		"status":       delivery.Status,
+		"error":        delivery.Error,
+		"created_at":   delivery.Created_at,
+	}
+
+	return pgx.BeginFunc(ctx, pg.db, func(tx pgx.Tx) error {
+		if err := tx.QueryRow(ctx, query, args).Scan(&delivery.ID); err != nil {
+			return fmt.Errorf("unable to insert row: %w", err)
+		}
+
+		event, err := outbox.New(DeliveryRecorded, delivery.Delivery_uid, delivery)
+		if err != nil {
+			return err
+		}
+		return outbox.Write(ctx, tx, event)
+	})
+}
+
+func (pg *postgres) GetAttempts(ctx context.Context, kind string, reference string, channel string) (Attempts, error) {
+
+	query := `SELECT COALESCE(bool_or(status = 'SENT'), false), COUNT(*) FILTER (WHERE status = 'FAILED'),
+	MAX(created_at) FILTER (WHERE status = 'FAILED')
+	FROM delivery WHERE kind = @kind AND reference = @reference AND channel = @channel`
+	args := pgx.NamedArgs{
+		"kind":      kind,
+		"reference": reference,
+		"channel":   channel,
+	}
+
+	var attempts Attempts
+
+	err := pg.db.QueryRow(ctx, query, args).Scan(&attempts.Sent, &attempts.Failed, &attempts.LastFailed)
+	if err != nil {
+		return attempts, fmt.Errorf("unable to query: %w", err)
+	}
+
+	return attempts, nil
+}
+
+func (pg *postgres) CreateSubscription(ctx context.Context, username string, bookUid string, libraryUid string) (Subscription, error) {
+
+	subscription := Subscription{
+		Username:    username,
+		Book_uid:    bookUid,
+		Library_uid: libraryUid,
+		Created_at:  time.Now().UTC(),
+	}
+
+	query := `INSERT INTO subscription (username, book_uid, library_uid, created_at)
+	VALUES (@username, @book_uid, @library_uid, @created_at) RETURNING id`
+	args := pgx.NamedArgs{
+		"username":    subscription.Username,
+		"book_uid":    subscription.Book_uid,
+		"library_uid": subscription.Library_uid,
+		"created_at":  subscription.Created_at,
+	}
+
+	err := pgx.BeginFunc(ctx, pg.db, func(tx pgx.Tx) error {
+		if err := tx.QueryRow(ctx, query, args).Scan(&subscription.ID); err != nil {
+			return fmt.Errorf("unable to insert row: %w", err)
+		}
+
+		event, err := outbox.New(SubscriptionCreated, subscription.Book_uid, subscription)
+		if err != nil {
+			return err
+		}
+		return outbox.Write(ctx, tx, event)
+	})
+	if err != nil {
+		return subscription, err
+	}
+
+	return subscription, nil
+}
+
+func (pg *postgres) MarkAvailable(ctx context.Context, bookUid string, libraryUid string) error {
+
+	query := `UPDATE subscription SET available_at = @available_at
+	WHERE book_uid = @book_uid AND library_uid = @library_uid AND available_at IS NULL AND notified_at IS NULL`
+	args := pgx.NamedArgs{
+		"book_uid":     bookUid,
+		"library_uid":  libraryUid,
+		"available_at": time.Now().UTC(),
+	}
+
+	if _, err := pg.db.Exec(ctx, query, args); err != nil {
+		return fmt.Errorf("unable to update: %w", err)
+	}
+
+	return nil
+}
+
+func (pg *postgres) GetAvailable(ctx context.Context) ([]Subscription, error) {
+
+	query := `SELECT * FROM subscription WHERE available_at IS NOT NULL AND notified_at IS NULL ORDER BY id`
+
+	rows, err := pg.db.Query(ctx, query)
+
+	var subscriptions []Subscription
+
+	if err != nil {
+		return subscriptions, fmt.Errorf("unable to query: %w", err)
+	}
+	defer rows.Close()
+
+	subscriptions, err = pgx.CollectRows(rows, pgx.RowToStructByName[Subscription])
+	if err != nil {
+		slog.ErrorContext(ctx, "CollectRows error", "error", err)
+		return subscriptions, err
+	}
+
+	return subscriptions, nil
+}
+
+func (pg *postgres) MarkNotified(ctx context.Context, id int) error {
+
+	query := `UPDATE subscription SET notified_at = @notified_at WHERE id = @id`
+	args := pgx.NamedArgs{
+		"id":          id,
+		"notified_at": time.Now().UTC(),
+	}
+
+	if _, err := pg.db.Exec(ctx, query, args); err != nil {
+		return fmt.Errorf("unable to update: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"library-system/src/notification-service/migrations"
+	"library-system/src/notification-service/storage"
+	"library-system/src/notification-service/storage/storagetest"
+	"library-system/src/pkg/pgtest"
+)
+
+func TestMemory(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T, fixture storagetest.Fixture) storage.Storage {
+		memory := storage.NewMemory()
+		for _, preference := range fixture.Preferences {
+			memory.AddPreference(preference)
+		}
+		for _, delivery := range fixture.Deliveries {
+			memory.AddDelivery(delivery)
+		}
+		for _, subscription := range fixture.Subscriptions {
+			memory.AddSubscription(subscription)
+		}
+		return memory
+	})
+}
+
+func TestPostgres(t *testing.T) {
+	connString := pgtest.Open(t, "TEST_POSTGRES_NOTIFICATIONS", migrations.Schema)
+
+	pg, err := storage.NewPgStorage(context.Background(), connString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Close()
+
+	storagetest.Run(t, func(t *testing.T, fixture storagetest.Fixture) storage.Storage {
+		pgtest.Exec(t, pg.Pool(), `TRUNCATE preference, delivery, subscription, outbox RESTART IDENTITY`)
+		for _, p := range fixture.Preferences {
+			pgtest.Exec(t, pg.Pool(), `INSERT INTO preference (username, email, webhook_url, email_enabled, webhook_enabled, remind_days_before)
+				VALUES ($1, $2, $3, $4, $5, $6)`,
+				p.Username, p.Email, p.Webhook_url, p.Email_enabled, p.Webhook_enabled, p.Remind_days_before)
+		}
+		for _, d := range fixture.Deliveries {
+			pgtest.Exec(t, pg.Pool(), `INSERT INTO delivery (delivery_uid, username, kind, reference, channel, status, error, created_at)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+				d.Delivery_uid, d.Username, d.Kind, d.Reference, d.Channel, d.Status, d.Error, d.Created_at)
+		}
+		for _, s := range fixture.Subscriptions {
+			pgtest.Exec(t, pg.Pool(), `INSERT INTO subscription (username, book_uid, library_uid, created_at, notified_at, available_at)
+				VALUES ($1, $2, $3, $4, $5, $6)`,
+				s.Username, s.Book_uid, s.Library_uid, s.Created_at, s.Notified_at, s.Available_at)
+		}
+		return pg
+	})
+}
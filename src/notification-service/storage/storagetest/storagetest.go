@@ -0,0 +1,274 @@
+// Package storagetest is the conformance suite that every implementation of
+// the notification-service Storage must pass.
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"library-system/src/notification-service/storage"
+	"library-system/src/pkg/apierror"
+)
+
+const (
+	bookUid    = "f7cdc58f-2caf-4b15-9727-f89dcc629b27"
+	libraryUid = "83575e12-7ce0-48ee-9931-51919ff3c9ee"
+	otherUid   = "1b2c3d4e-0000-4000-8000-000000000002"
+)
+
+type Fixture struct {
+	// Preferences, Deliveries and Subscriptions are inserted in order, so
+	// their ids are 1, 2, ...
+	Preferences   []storage.Preference
+	Deliveries    []storage.Delivery
+	Subscriptions []storage.Subscription
+}
+
+// Factory returns a storage holding exactly the fixture.
+type Factory func(t *testing.T, fixture Fixture) storage.Storage
+
+func date(day int) time.Time {
+	return time.Date(2021, 10, day, 0, 0, 0, 0, time.UTC)
+}
+
+func deliveryUid(n int) string {
+	return fmt.Sprintf("6a7b8c9d-0000-4000-8000-%012d", n)
+}
+
+func reservationUid(n int) string {
+	return fmt.Sprintf("3c4d5e6f-0000-4000-8000-%012d", n)
+}
+
+var fixture = Fixture{
+	Preferences: []storage.Preference{
+		{Username: "Test Max", Email: "max@example.com", Email_enabled: true, Remind_days_before: 3},
+		{Username: "Test Min", Webhook_url: "https://example.com/hook", Webhook_enabled: true, Remind_days_before: 1},
+	},
+	Deliveries: []storage.Delivery{
+		{Delivery_uid: deliveryUid(1), Username: "Test Max", Kind: "DUE_SOON", Reference: reservationUid(1), Channel: "EMAIL", Status: "FAILED", Error: "timeout", Created_at: date(1)},
+		{Delivery_uid: deliveryUid(2), Username: "Test Max", Kind: "DUE_SOON", Reference: reservationUid(1), Channel: "EMAIL", Status: "FAILED", Error: "timeout", Created_at: date(2)},
+		{Delivery_uid: deliveryUid(3), Username: "Test Min", Kind: "OVERDUE", Reference: reservationUid(2), Channel: "WEBHOOK", Status: "SENT", Created_at: date(3)},
+	},
+	Subscriptions: []storage.Subscription{
+		{Username: "Test Max", Book_uid: bookUid, Library_uid: libraryUid, Created_at: date(1)},
+		{Username: "Test Min", Book_uid: bookUid, Library_uid: otherUid, Created_at: date(2)},
+		{Username: "Test Min", Book_uid: bookUid, Library_uid: libraryUid, Created_at: date(3), Notified_at: timePtr(date(4))},
+	},
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func deliveryUids(deliveries []storage.Delivery) []string {
+	uids := make([]string, len(deliveries))
+	for i, delivery := range deliveries {
+		uids[i] = delivery.Delivery_uid
+	}
+	return uids
+}
+
+func subscriptionIds(subscriptions []storage.Subscription) []int {
+	ids := make([]int, len(subscriptions))
+	for i, subscription := range subscriptions {
+		ids[i] = subscription.ID
+	}
+	return ids
+}
+
+func equal[T comparable](a, b []T) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func expectCode(t *testing.T, err error, code apierror.Code) {
+	t.Helper()
+
+	if err == nil || apierror.From(err).Code != code {
+		t.Errorf("expected %s, got %v", code, err)
+	}
+}
+
+func Run(t *testing.T, newStorage Factory) {
+	ctx := context.Background()
+
+	t.Run("GetPreference", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		preference, err := s.GetPreference(ctx, "Test Min")
+		if err != nil || preference.ID != 2 || preference.Webhook_url != "https://example.com/hook" || !preference.Webhook_enabled ||
+			preference.Email_enabled || preference.Remind_days_before != 1 {
+			t.Errorf("unexpected preference %+v (%v)", preference, err)
+		}
+
+		_, err = s.GetPreference(ctx, "Unknown")
+		expectCode(t, err, apierror.CodeNotFound)
+	})
+
+	t.Run("UpsertPreference", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		created, err := s.UpsertPreference(ctx, storage.Preference{Username: "Test New", Email: "new@example.com", Email_enabled: true, Remind_days_before: 5})
+		if err != nil || created.ID == 0 {
+			t.Fatalf("unexpected preference %+v (%v)", created, err)
+		}
+
+		updated, err := s.UpsertPreference(ctx, storage.Preference{Username: "Test Max", Email: "max@example.org", Remind_days_before: 7})
+		if err != nil || updated.ID != 1 {
+			t.Errorf("expected the preference of Test Max to be updated, got %+v (%v)", updated, err)
+		}
+		if preference, _ := s.GetPreference(ctx, "Test Max"); preference.Email != "max@example.org" || preference.Email_enabled || preference.Remind_days_before != 7 {
+			t.Errorf("unexpected preference %+v", preference)
+		}
+
+		_, err = s.UpsertPreference(ctx, storage.Preference{Username: "Test Max", Remind_days_before: 31})
+		expectCode(t, err, apierror.CodeValidation)
+	})
+
+	t.Run("GetDeliveries", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		deliveries, err := s.GetDeliveries(ctx, "Test Max")
+		if err != nil || !equal(deliveryUids(deliveries), []string{deliveryUid(2), deliveryUid(1)}) {
+			t.Errorf("expected the deliveries of Test Max newest first, got %v (%v)", deliveryUids(deliveries), err)
+		}
+		if len(deliveries) > 0 && (deliveries[0].Error != "timeout" || !deliveries[0].Created_at.Equal(date(2))) {
+			t.Errorf("unexpected delivery %+v", deliveries[0])
+		}
+
+		deliveries, err = s.GetDeliveries(ctx, "Unknown")
+		if err != nil || len(deliveries) != 0 {
+			t.Errorf("expected no deliveries, got %+v (%v)", deliveries, err)
+		}
+	})
+
+	t.Run("Attempts", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		attempts, err := s.GetAttempts(ctx, "DUE_SOON", reservationUid(1), "EMAIL")
+		if err != nil || attempts.Sent || attempts.Failed != 2 || attempts.LastFailed == nil || !attempts.LastFailed.Equal(date(2)) {
+			t.Errorf("expected two failed attempts, got %+v (%v)", attempts, err)
+		}
+
+		err = s.CreateDelivery(ctx, storage.Delivery{Username: "Test Max", Kind: "DUE_SOON", Reference: reservationUid(1), Channel: "EMAIL", Status: "SENT"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if attempts, _ = s.GetAttempts(ctx, "DUE_SOON", reservationUid(1), "EMAIL"); !attempts.Sent || attempts.Failed != 2 {
+			t.Errorf("expected the notice to be sent, got %+v", attempts)
+		}
+		if deliveries, _ := s.GetDeliveries(ctx, "Test Max"); len(deliveries) != 3 || deliveries[0].Delivery_uid == "" || deliveries[0].Status != "SENT" {
+			t.Errorf("expected the new delivery first, got %+v", deliveries)
+		}
+
+		// attempts are counted per notice and channel
+		if attempts, _ = s.GetAttempts(ctx, "DUE_SOON", reservationUid(1), "WEBHOOK"); attempts.Sent || attempts.Failed != 0 || attempts.LastFailed != nil {
+			t.Errorf("expected no attempts, got %+v", attempts)
+		}
+		if attempts, _ = s.GetAttempts(ctx, "OVERDUE", reservationUid(1), "EMAIL"); attempts.Sent || attempts.Failed != 0 {
+			t.Errorf("expected no attempts, got %+v", attempts)
+		}
+
+		err = s.CreateDelivery(ctx, storage.Delivery{Username: "Test Max", Kind: "LOST", Reference: reservationUid(1), Channel: "EMAIL", Status: "SENT"})
+		expectCode(t, err, apierror.CodeValidation)
+	})
+
+	t.Run("CreateSubscription", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		subscription, err := s.CreateSubscription(ctx, "Test New", bookUid, otherUid)
+		if err != nil || subscription.ID != 4 || subscription.Username != "Test New" || subscription.Created_at.IsZero() ||
+			subscription.Notified_at != nil || subscription.Available_at != nil {
+			t.Errorf("unexpected subscription %+v (%v)", subscription, err)
+		}
+
+		_, err = s.CreateSubscription(ctx, "Test New", "not-a-uid", libraryUid)
+		expectCode(t, err, apierror.CodeValidation)
+	})
+
+	t.Run("Available", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		if subscriptions, err := s.GetAvailable(ctx); err != nil || len(subscriptions) != 0 {
+			t.Errorf("expected no pending notices, got %+v (%v)", subscriptions, err)
+		}
+
+		// notified subscriptions and those to other libraries are left alone
+		if err := s.MarkAvailable(ctx, bookUid, libraryUid); err != nil {
+			t.Fatal(err)
+		}
+
+		subscriptions, err := s.GetAvailable(ctx)
+		if err != nil || !equal(subscriptionIds(subscriptions), []int{1}) {
+			t.Fatalf("expected subscription 1 to be pending, got %v (%v)", subscriptionIds(subscriptions), err)
+		}
+		if subscriptions[0].Available_at == nil || subscriptions[0].Username != "Test Max" {
+			t.Errorf("unexpected subscription %+v", subscriptions[0])
+		}
+
+		if err = s.MarkNotified(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		if subscriptions, _ = s.GetAvailable(ctx); len(subscriptions) != 0 {
+			t.Errorf("expected no pending notices after the notice, got %+v", subscriptions)
+		}
+
+		// a notified subscription is not notified again
+		s.MarkAvailable(ctx, bookUid, libraryUid)
+		if subscriptions, _ = s.GetAvailable(ctx); len(subscriptions) != 0 {
+			t.Errorf("expected no pending notices, got %+v", subscriptions)
+		}
+
+		expectCode(t, s.MarkAvailable(ctx, "not-a-uid", libraryUid), apierror.CodeValidation)
+	})
+
+	t.Run("Outbox", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		if _, err := s.UpsertPreference(ctx, storage.Preference{Username: "Test Max", Email: "max@example.org", Email_enabled: true, Remind_days_before: 2}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CreateDelivery(ctx, storage.Delivery{Username: "Test Max", Kind: "AVAILABLE", Reference: bookUid + "/1", Channel: "EMAIL", Status: "SENT"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.CreateSubscription(ctx, "Test Max", bookUid, otherUid); err != nil {
+			t.Fatal(err)
+		}
+
+		// failed changes are not published
+		s.UpsertPreference(ctx, storage.Preference{Username: "Test Max", Remind_days_before: 0})
+
+		events, err := s.Outbox().Pending(ctx, 10)
+		if err != nil || len(events) != 3 {
+			t.Fatalf("expected 3 events, got %+v (%v)", events, err)
+		}
+
+		var preference storage.PreferenceEvent
+		if err = events[0].Decode(&preference); err != nil || events[0].Type != storage.PreferenceUpdated ||
+			events[0].EntityUid != "Test Max" || !preference.EmailEnabled || preference.RemindDaysBefore != 2 {
+			t.Errorf("unexpected event %+v (%v)", events[0], err)
+		}
+
+		var delivery storage.Delivery
+		if err = events[1].Decode(&delivery); err != nil || events[1].Type != storage.DeliveryRecorded ||
+			events[1].EntityUid != delivery.Delivery_uid || delivery.Kind != "AVAILABLE" {
+			t.Errorf("unexpected event %+v (%v)", events[1], err)
+		}
+
+		var subscription storage.Subscription
+		if err = events[2].Decode(&subscription); err != nil || events[2].Type != storage.SubscriptionCreated ||
+			events[2].EntityUid != bookUid || subscription.Library_uid != otherUid {
+			t.Errorf("unexpected event %+v (%v)", events[2], err)
+		}
+	})
+}
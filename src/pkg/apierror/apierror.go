@@ -0,0 +1,208 @@
+// Package apierror is the error model shared by every service. Errors carry
+// a machine-readable code that maps to an HTTP status, and are written as
+// {"code": ..., "message": ...} so that the gateway can pass them on
+// unchanged.
+package apierror
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type Code string
+
+const (
+	CodeBadRequest   Code = "BAD_REQUEST"
+	CodeUnauthorized Code = "UNAUTHORIZED"
+	CodeNotFound     Code = "NOT_FOUND"
+	CodeConflict     Code = "CONFLICT"
+	CodeValidation   Code = "VALIDATION_FAILED"
+	CodeUnavailable  Code = "SERVICE_UNAVAILABLE"
+	CodeInternal     Code = "INTERNAL"
+
+	CodePreconditionFailed   Code = "PRECONDITION_FAILED"
+	CodePreconditionRequired Code = "PRECONDITION_REQUIRED"
+)
+
+var statuses = map[Code]int{
+	CodeBadRequest:   http.StatusBadRequest,
+	CodeUnauthorized: http.StatusUnauthorized,
+	CodeNotFound:     http.StatusNotFound,
+	CodeConflict:     http.StatusConflict,
+	CodeValidation:   http.StatusUnprocessableEntity,
+	CodeUnavailable:  http.StatusServiceUnavailable,
+	CodeInternal:     http.StatusInternalServerError,
+
+	CodePreconditionFailed:   http.StatusPreconditionFailed,
+	CodePreconditionRequired: http.StatusPreconditionRequired,
+}
+
+type Error struct {
+	Code    Code
+	Message string
+	// Status overrides the status of Code, e.g. for errors received from
+	// another service.
+	Status int
+	// Errors lists the invalid fields of a request, if known.
+	Errors []FieldError
+	Err    error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) HTTPStatus() int {
+	if e.Status != 0 {
+		return e.Status
+	}
+	if status, ok := statuses[e.Code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// FieldError describes why a field of a request is invalid.
+type FieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+// Response is the body of every error response.
+type Response struct {
+	Code    Code         `json:"code"`
+	Message string       `json:"message"`
+	Errors  []FieldError `json:"errors,omitempty"`
+}
+
+func New(code Code, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func BadRequest(format string, args ...any) *Error {
+	return New(CodeBadRequest, format, args...)
+}
+
+func Unauthorized(format string, args ...any) *Error {
+	return New(CodeUnauthorized, format, args...)
+}
+
+func NotFound(format string, args ...any) *Error {
+	return New(CodeNotFound, format, args...)
+}
+
+func Conflict(format string, args ...any) *Error {
+	return New(CodeConflict, format, args...)
+}
+
+func Validation(format string, args ...any) *Error {
+	return New(CodeValidation, format, args...)
+}
+
+// PreconditionFailed is returned when an update is based on a version of a
+// record that is no longer current.
+func PreconditionFailed(format string, args ...any) *Error {
+	return New(CodePreconditionFailed, format, args...)
+}
+
+// PreconditionRequired is returned when an update does not name the version
+// it is based on.
+func PreconditionRequired(format string, args ...any) *Error {
+	return New(CodePreconditionRequired, format, args...)
+}
+
+// Unavailable wraps a failure to reach a dependency.
+func Unavailable(err error, format string, args ...any) *Error {
+	return &Error{Code: CodeUnavailable, Message: fmt.Sprintf(format, args...), Err: err}
+}
+
+// From classifies err. Errors that are not an *Error are mapped from pgx and
+// network errors; anything else is an internal error.
+func From(err error) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return &Error{Code: CodeNotFound, Message: "not found", Err: err}
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "23505", "40001":
+			// unique_violation, serialization_failure
+			return &Error{Code: CodeConflict, Message: pgErr.Message, Err: err}
+		case "23502", "23503", "23514", "22P02", "22007", "22008", "22001":
+			// not_null, foreign_key and check violations, malformed values
+			return &Error{Code: CodeValidation, Message: pgErr.Message, Err: err}
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return &Error{Code: CodeUnavailable, Message: "dependency unavailable", Err: err}
+	}
+
+	return &Error{Code: CodeInternal, Message: "internal error", Err: err}
+}
+
+// Respond writes err as an error response.
+func Respond(c *gin.Context, err error) {
+	apiErr := From(err)
+
+	c.JSON(apiErr.HTTPStatus(), Response{
+		Code:    apiErr.Code,
+		Message: apiErr.Message,
+		Errors:  apiErr.Errors,
+	})
+}
+
+// FromResponse returns the error carried by a response of another service,
+// or nil for a 2xx or 3xx response. The status and code are kept as they are.
+func FromResponse(res *http.Response) error {
+	if res.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+
+	body, _ := io.ReadAll(res.Body)
+
+	var response Response
+	if json.Unmarshal(body, &response) != nil || response.Code == "" {
+		response.Code = codeForStatus(res.StatusCode)
+		if response.Message == "" {
+			response.Message = http.StatusText(res.StatusCode)
+		}
+	}
+
+	return &Error{Code: response.Code, Message: response.Message, Status: res.StatusCode, Errors: response.Errors}
+}
+
+func codeForStatus(status int) Code {
+	for code, codeStatus := range statuses {
+		if codeStatus == status {
+			return code
+		}
+	}
+	if status >= http.StatusInternalServerError {
+		return CodeUnavailable
+	}
+	return CodeBadRequest
+}
@@ -0,0 +1,108 @@
+package apierror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestFrom(t *testing.T) {
+	notFound := NotFound("fine not found")
+
+	tests := []struct {
+		name   string
+		err    error
+		code   Code
+		status int
+	}{
+		{"typed error", notFound, CodeNotFound, http.StatusNotFound},
+		{"wrapped typed error", fmt.Errorf("create payment: %w", notFound), CodeNotFound, http.StatusNotFound},
+		{"no rows", fmt.Errorf("unable to query: %w", pgx.ErrNoRows), CodeNotFound, http.StatusNotFound},
+		{"unique violation", &pgconn.PgError{Code: "23505"}, CodeConflict, http.StatusConflict},
+		{"check violation", &pgconn.PgError{Code: "23514"}, CodeValidation, http.StatusUnprocessableEntity},
+		{"invalid uuid", &pgconn.PgError{Code: "22P02"}, CodeValidation, http.StatusUnprocessableEntity},
+		{"precondition failed", PreconditionFailed("book has changed"), CodePreconditionFailed, http.StatusPreconditionFailed},
+		{"precondition required", PreconditionRequired("If-Match must be given"), CodePreconditionRequired, http.StatusPreconditionRequired},
+		{"timeout", context.DeadlineExceeded, CodeUnavailable, http.StatusServiceUnavailable},
+		{"unavailable", Unavailable(errors.New("connection refused"), "rating-service is unavailable"), CodeUnavailable, http.StatusServiceUnavailable},
+		{"unknown", errors.New("boom"), CodeInternal, http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := From(tt.err)
+			if err.Code != tt.code || err.HTTPStatus() != tt.status {
+				t.Errorf("expected %s/%d, got %s/%d", tt.code, tt.status, err.Code, err.HTTPStatus())
+			}
+		})
+	}
+}
+
+func TestRespondAndFromResponse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/fines/1", nil)
+
+	Respond(c, NotFound("fine %s not found", "1"))
+
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", recorder.Code)
+	}
+	if body := recorder.Body.String(); body != `{"code":"NOT_FOUND","message":"fine 1 not found"}` {
+		t.Fatalf("unexpected body %s", body)
+	}
+
+	err := FromResponse(recorder.Result())
+
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Code != CodeNotFound || apiErr.HTTPStatus() != http.StatusNotFound || apiErr.Message != "fine 1 not found" {
+		t.Errorf("error must be passed on unchanged, got %+v", err)
+	}
+}
+
+func TestFieldErrorsArePassedOn(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/reservations", nil)
+
+	Respond(c, &Error{Code: CodeBadRequest, Message: "invalid request", Errors: []FieldError{{Field: "tillDate", Error: "must be a date"}}})
+
+	if body := recorder.Body.String(); body != `{"code":"BAD_REQUEST","message":"invalid request","errors":[{"field":"tillDate","error":"must be a date"}]}` {
+		t.Fatalf("unexpected body %s", body)
+	}
+
+	var apiErr *Error
+	if err := FromResponse(recorder.Result()); !errors.As(err, &apiErr) || len(apiErr.Errors) != 1 || apiErr.Errors[0].Field != "tillDate" {
+		t.Errorf("field errors must be passed on, got %+v", err)
+	}
+}
+
+func TestFromResponseWithoutErrorBody(t *testing.T) {
+	res := &http.Response{
+		StatusCode: http.StatusBadGateway,
+		Body:       io.NopCloser(strings.NewReader("upstream failed")),
+	}
+
+	err := From(FromResponse(res))
+	if err.Code != CodeUnavailable || err.HTTPStatus() != http.StatusBadGateway {
+		t.Errorf("expected SERVICE_UNAVAILABLE with status 502, got %s/%d", err.Code, err.HTTPStatus())
+	}
+
+	res = &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}"))}
+	if err := FromResponse(res); err != nil {
+		t.Errorf("successful response must not be an error, got %v", err)
+	}
+}
@@ -0,0 +1,291 @@
+// Package audit keeps the append-only audit trail of a service.
+//
+// Storages record an Entry in the transaction of every state change, with
+// the values before and after it. The actor and the request ID are taken
+// from the request context, where Middleware puts them. The gateway works the
+// actor out with GatewayMiddleware and passes it on to the services in the
+// X-Actor header.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"library-system/src/pkg/logging"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const ActorHeader = "X-Actor"
+
+// System is the actor of changes made without a request, e.g. by workers.
+const System = "system"
+
+// MaxActorLength bounds the actor of an entry, longer ones are cut.
+const MaxActorLength = 80
+
+type Entry struct {
+	ID         int64           `json:"id"`
+	Service    string          `json:"service,omitempty"`
+	Actor      string          `json:"actor"`
+	Action     string          `json:"action"`
+	EntityType string          `json:"entityType"`
+	EntityUid  string          `json:"entityUid"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	RequestID  string          `json:"requestId,omitempty"`
+	CreatedAt  time.Time       `json:"createdAt"`
+}
+
+// New returns the entry of action on the entity, e.g. "book.condition_updated"
+// on the book with the given uid. before is nil for created entities.
+func New(ctx context.Context, action string, entityType string, entityUid string, before any, after any) (Entry, error) {
+	entry := Entry{
+		Actor:      Actor(ctx),
+		Action:     action,
+		EntityType: entityType,
+		EntityUid:  entityUid,
+		RequestID:  logging.RequestID(ctx),
+		CreatedAt:  time.Now().UTC(),
+	}
+
+	var err error
+	if before != nil {
+		if entry.Before, err = json.Marshal(before); err != nil {
+			return Entry{}, fmt.Errorf("unable to marshal %s audit entry: %w", action, err)
+		}
+	}
+	if after != nil {
+		if entry.After, err = json.Marshal(after); err != nil {
+			return Entry{}, fmt.Errorf("unable to marshal %s audit entry: %w", action, err)
+		}
+	}
+
+	return entry, nil
+}
+
+// Filter narrows down the entries of a query. Zero values disable the
+// corresponding filter.
+type Filter struct {
+	EntityUid string
+	Actor     string
+	From      time.Time
+	To        time.Time
+	Limit     int
+}
+
+func (f Filter) matches(entry Entry) bool {
+	return (f.EntityUid == "" || entry.EntityUid == f.EntityUid) &&
+		(f.Actor == "" || entry.Actor == f.Actor) &&
+		(f.From.IsZero() || !entry.CreatedAt.Before(f.From)) &&
+		(f.To.IsZero() || entry.CreatedAt.Before(f.To))
+}
+
+// Log is the audit trail of a service.
+type Log interface {
+	// Query returns the entries matching filter, newest first.
+	Query(ctx context.Context, filter Filter) ([]Entry, error)
+}
+
+// MemoryLog is a Log that in-memory storages add their entries to while
+// holding their own lock.
+type MemoryLog interface {
+	Log
+	Add(entry Entry)
+}
+
+// Write records entry in the audit_log table as part of tx.
+func Write(ctx context.Context, tx pgx.Tx, entry Entry) error {
+	query := `INSERT INTO audit_log (actor, action, entity_type, entity_uid, before, after, request_id, created_at)
+		VALUES (@actor, @action, @entity_type, @entity_uid, @before, @after, @request_id, @created_at)`
+
+	_, err := tx.Exec(ctx, query, pgx.NamedArgs{
+		"actor":       entry.Actor,
+		"action":      entry.Action,
+		"entity_type": entry.EntityType,
+		"entity_uid":  entry.EntityUid,
+		"before":      jsonb(entry.Before),
+		"after":       jsonb(entry.After),
+		"request_id":  entry.RequestID,
+		"created_at":  entry.CreatedAt,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write %s audit entry: %w", entry.Action, err)
+	}
+
+	return nil
+}
+
+// jsonb returns value as a jsonb parameter, NULL if it is empty.
+func jsonb(value json.RawMessage) any {
+	if len(value) == 0 {
+		return nil
+	}
+	return string(value)
+}
+
+type pgLog struct {
+	db *pgxpool.Pool
+}
+
+// NewPgLog returns the Log of the audit_log table in db.
+func NewPgLog(db *pgxpool.Pool) Log {
+	return &pgLog{db: db}
+}
+
+func (l *pgLog) Query(ctx context.Context, filter Filter) ([]Entry, error) {
+	conditions := []string{"TRUE"}
+	args := pgx.NamedArgs{"limit": filter.Limit}
+
+	if filter.EntityUid != "" {
+		conditions = append(conditions, "entity_uid = @entity_uid")
+		args["entity_uid"] = filter.EntityUid
+	}
+	if filter.Actor != "" {
+		conditions = append(conditions, "actor = @actor")
+		args["actor"] = filter.Actor
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "created_at >= @from")
+		args["from"] = filter.From
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "created_at < @to")
+		args["to"] = filter.To
+	}
+
+	query := `SELECT id, actor, action, entity_type, entity_uid, before, after, request_id, created_at FROM audit_log
+		WHERE ` + strings.Join(conditions, " AND ") + ` ORDER BY created_at DESC, id DESC LIMIT @limit`
+
+	rows, err := l.db.Query(ctx, query, args)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []Entry{}
+	for rows.Next() {
+		var entry Entry
+		var before, after []byte
+		err = rows.Scan(&entry.ID, &entry.Actor, &entry.Action, &entry.EntityType, &entry.EntityUid, &before, &after, &entry.RequestID, &entry.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan audit entry: %w", err)
+		}
+		entry.Before, entry.After = before, after
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+type memoryLog struct {
+	mu      sync.Mutex
+	entries []Entry
+}
+
+func NewMemoryLog() MemoryLog {
+	return &memoryLog{}
+}
+
+func (l *memoryLog) Add(entry Entry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry.ID = int64(len(l.entries) + 1)
+	l.entries = append(l.entries, entry)
+}
+
+func (l *memoryLog) Query(ctx context.Context, filter Filter) ([]Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := []Entry{}
+	for _, entry := range l.entries {
+		if filter.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if !entries[i].CreatedAt.Equal(entries[j].CreatedAt) {
+			return entries[i].CreatedAt.After(entries[j].CreatedAt)
+		}
+		return entries[i].ID > entries[j].ID
+	})
+
+	if len(entries) > filter.Limit {
+		entries = entries[:filter.Limit]
+	}
+
+	return entries, nil
+}
+
+type actorKey struct{}
+
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// Actor returns the actor of the request context, System if there is none.
+func Actor(ctx context.Context) string {
+	if actor, _ := ctx.Value(actorKey{}).(string); actor != "" {
+		return actor
+	}
+	return System
+}
+
+// Propagate copies the actor of the request context into its headers.
+func Propagate(req *http.Request) {
+	if actor, _ := req.Context().Value(actorKey{}).(string); actor != "" {
+		req.Header.Set(ActorHeader, actor)
+	}
+}
+
+// Middleware puts the actor of the request into its context: the X-Actor
+// header set by the gateway, or else "admin" for requests with the librarian
+// token and the reader in X-User-Name for the others.
+func Middleware() gin.HandlerFunc {
+	return middleware(true)
+}
+
+// GatewayMiddleware is Middleware for the gateway, which faces the clients.
+// It never trusts X-Actor, since only the gateway itself may set it, and
+// works the actor out from the other headers.
+func GatewayMiddleware() gin.HandlerFunc {
+	return middleware(false)
+}
+
+func middleware(trustActor bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var actor string
+		if trustActor {
+			actor = c.GetHeader(ActorHeader)
+		} else {
+			c.Request.Header.Del(ActorHeader)
+		}
+		if actor == "" && c.GetHeader("X-Authorization") == "admin" {
+			actor = "admin"
+		}
+		if actor == "" {
+			actor = c.GetHeader("X-User-Name")
+		}
+
+		if runes := []rune(actor); len(runes) > MaxActorLength {
+			actor = string(runes[:MaxActorLength])
+		}
+
+		if actor != "" {
+			c.Request = c.Request.WithContext(WithActor(c.Request.Context(), actor))
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,134 @@
+package audit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"library-system/src/pkg/apierror"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		gateway  bool
+		header   http.Header
+		expected string
+	}{
+		{false, http.Header{}, System},
+		{false, http.Header{"X-User-Name": {"Test Max"}}, "Test Max"},
+		{false, http.Header{"X-User-Name": {"Test Max"}, "X-Authorization": {"admin"}}, "admin"},
+		{false, http.Header{"X-User-Name": {"Test Max"}, "X-Actor": {"librarian"}}, "librarian"},
+
+		// clients of the gateway can not pose as someone else
+		{true, http.Header{"X-User-Name": {"Test Max"}, "X-Actor": {"librarian"}}, "Test Max"},
+		{true, http.Header{"X-User-Name": {"Test Max"}, "X-Authorization": {"admin"}, "X-Actor": {"librarian"}}, "admin"},
+		{true, http.Header{"X-Actor": {"librarian"}}, System},
+
+		// actors are cut to fit the audit log
+		{true, http.Header{"X-User-Name": {strings.Repeat("я", MaxActorLength+1)}}, strings.Repeat("я", MaxActorLength)},
+	}
+
+	for _, test := range tests {
+		router := gin.New()
+		if test.gateway {
+			router.Use(GatewayMiddleware())
+		} else {
+			router.Use(Middleware())
+		}
+
+		var actor string
+		var propagated http.Header
+		router.GET("/", func(c *gin.Context) {
+			actor = Actor(c.Request.Context())
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(c.Request.Context())
+			Propagate(req)
+			propagated = req.Header
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header = test.header
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		if actor != test.expected {
+			t.Errorf("%v: expected actor %q, got %q", test.header, test.expected, actor)
+		}
+		if test.expected != System && propagated.Get(ActorHeader) != test.expected {
+			t.Errorf("%v: expected %s to be propagated, got %v", test.header, test.expected, propagated)
+		}
+		if test.expected == System && propagated.Get(ActorHeader) != "" {
+			t.Errorf("%v: expected no actor to be propagated, got %v", test.header, propagated)
+		}
+	}
+}
+
+func TestMemoryLog(t *testing.T) {
+	ctx := context.Background()
+	log := NewMemoryLog()
+
+	start := time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)
+	for i, actor := range []string{"admin", "Test Max", "admin"} {
+		entry, err := New(WithActor(ctx, actor), "book.updated", "book", "f7cdc58f-2caf-4b15-9727-f89dcc629b27", nil, map[string]int{"n": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry.CreatedAt = start.AddDate(0, 0, i)
+		log.Add(entry)
+	}
+
+	entries, _ := log.Query(ctx, Filter{Actor: "admin", Limit: 10})
+	if len(entries) != 2 || entries[0].ID != 3 || entries[1].ID != 1 {
+		t.Errorf("expected the entries of admin newest first, got %+v", entries)
+	}
+
+	entries, _ = log.Query(ctx, Filter{From: start.AddDate(0, 0, 1), To: start.AddDate(0, 0, 2), Limit: 10})
+	if len(entries) != 1 || entries[0].ID != 2 || string(entries[0].After) != `{"n":1}` || entries[0].Before != nil {
+		t.Errorf("expected the entry of the second day, got %+v", entries)
+	}
+
+	if entries, _ = log.Query(ctx, Filter{Limit: 1}); len(entries) != 1 || entries[0].ID != 3 {
+		t.Errorf("expected the newest entry, got %+v", entries)
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	parse := func(query string) (Filter, error) {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/audit?"+query, nil)
+		return ParseFilter(c)
+	}
+
+	filter, err := parse("entityUid=f7cdc58f-2caf-4b15-9727-f89dcc629b27&actor=admin&from=2021-10-01&to=2021-10-02T12:00:00Z&limit=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Filter{
+		EntityUid: "f7cdc58f-2caf-4b15-9727-f89dcc629b27",
+		Actor:     "admin",
+		From:      time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC),
+		To:        time.Date(2021, 10, 2, 12, 0, 0, 0, time.UTC),
+		Limit:     5,
+	}
+	if filter != expected {
+		t.Errorf("expected %+v, got %+v", expected, filter)
+	}
+
+	if filter, _ = parse(""); filter.Limit != DefaultLimit {
+		t.Errorf("expected the default limit, got %+v", filter)
+	}
+
+	for _, query := range []string{"from=yesterday", "to=2021-13-01", "limit=0", "limit=1001", "limit=ten"} {
+		if _, err = parse(query); apierror.From(err).Code != apierror.CodeValidation {
+			t.Errorf("%s: expected a validation error, got %v", query, err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package audit
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"library-system/src/pkg/apierror"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// ParseFilter reads a filter from the query parameters entityUid, actor,
+// from, to and limit. from and to are RFC 3339 timestamps or dates.
+func ParseFilter(c *gin.Context) (Filter, error) {
+	filter := Filter{
+		EntityUid: c.Query("entityUid"),
+		Actor:     c.Query("actor"),
+		Limit:     DefaultLimit,
+	}
+
+	var err error
+	if filter.From, err = parseTime(c.Query("from")); err != nil {
+		return Filter{}, apierror.Validation("from must be a date or an RFC 3339 timestamp")
+	}
+	if filter.To, err = parseTime(c.Query("to")); err != nil {
+		return Filter{}, apierror.Validation("to must be a date or an RFC 3339 timestamp")
+	}
+
+	if value := c.Query("limit"); value != "" {
+		filter.Limit, err = strconv.Atoi(value)
+		if err != nil || filter.Limit < 1 || filter.Limit > MaxLimit {
+			return Filter{}, apierror.Validation("limit must be between 1 and %d", MaxLimit)
+		}
+	}
+
+	return filter, nil
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if date, err := time.Parse("2006-01-02", value); err == nil {
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// Handler serves the entries of log matching the query parameters, newest
+// first, each tagged with the name of service.
+func Handler(log Log, service string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter, err := ParseFilter(c)
+		if err != nil {
+			apierror.Respond(c, err)
+			return
+		}
+
+		entries, err := log.Query(c.Request.Context(), filter)
+		if err != nil {
+			apierror.Respond(c, err)
+			return
+		}
+
+		for i := range entries {
+			entries[i].Service = service
+		}
+
+		c.JSON(http.StatusOK, entries)
+	}
+}
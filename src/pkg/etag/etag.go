@@ -0,0 +1,86 @@
+// Package etag implements optimistic concurrency on versioned records. The
+// version of a record is sent as a strong ETag with every GET of it, and an
+// update must send it back in If-Match so that it fails with 412 instead of
+// overwriting a change made since.
+package etag
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"library-system/src/pkg/apierror"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	Header        = "ETag"
+	IfMatchHeader = "If-Match"
+)
+
+// Any is the version of If-Match: *, which matches every version. Storages
+// update unconditionally when they are given it.
+const Any = 0
+
+// Matches reports whether an update based on version expected may be applied
+// to a record at version current.
+func Matches(expected int, current int) bool {
+	return expected == Any || expected == current
+}
+
+// Format returns the ETag of version.
+func Format(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// Set puts the ETag of version on the response.
+func Set(c *gin.Context, version int) {
+	c.Header(Header, Format(version))
+}
+
+// IfMatch returns the version named by the If-Match header of the request.
+// It fails with 428 if the header is missing, and with 412 if it names no
+// version that can match, e.g. a weak or unknown tag.
+func IfMatch(c *gin.Context) (int, error) {
+	value := strings.TrimSpace(c.GetHeader(IfMatchHeader))
+	if value == "" {
+		return 0, apierror.PreconditionRequired("%s must be given with the ETag of the record", IfMatchHeader)
+	}
+	if value == "*" {
+		return Any, nil
+	}
+
+	return Parse(value)
+}
+
+// Parse returns the version of a strong ETag.
+func Parse(tag string) (int, error) {
+	unquoted, ok := strings.CutPrefix(tag, `"`)
+	if ok {
+		unquoted, ok = strings.CutSuffix(unquoted, `"`)
+	}
+
+	version, err := strconv.Atoi(unquoted)
+	if !ok || err != nil || version < 1 {
+		return 0, apierror.PreconditionFailed("%s %s does not match the record", IfMatchHeader, tag)
+	}
+
+	return version, nil
+}
+
+// Forward passes the If-Match header of the request on to req, which the
+// gateway sends to a service.
+func Forward(c *gin.Context, req *http.Request) {
+	if value := c.GetHeader(IfMatchHeader); value != "" {
+		req.Header.Set(IfMatchHeader, value)
+	}
+}
+
+// Copy passes the ETag of a service response on to the response of the
+// gateway.
+func Copy(c *gin.Context, res *http.Response) {
+	if value := res.Header.Get(Header); value != "" {
+		c.Header(Header, value)
+	}
+}
@@ -0,0 +1,66 @@
+package etag
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"library-system/src/pkg/apierror"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIfMatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		header  string
+		version int
+		code    apierror.Code
+	}{
+		{`"3"`, 3, ""},
+		{` "12" `, 12, ""},
+		{`*`, Any, ""},
+		{``, 0, apierror.CodePreconditionRequired},
+		{`W/"3"`, 0, apierror.CodePreconditionFailed},
+		{`"3", "4"`, 0, apierror.CodePreconditionFailed},
+		{`3`, 0, apierror.CodePreconditionFailed},
+		{`"0"`, 0, apierror.CodePreconditionFailed},
+		{`"abc"`, 0, apierror.CodePreconditionFailed},
+	}
+
+	for _, test := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPut, "/api/v1/books/1/", nil)
+		if test.header != "" {
+			c.Request.Header.Set(IfMatchHeader, test.header)
+		}
+
+		version, err := IfMatch(c)
+		if test.code == "" {
+			if err != nil || version != test.version {
+				t.Errorf("%s: expected version %d, got %d, %v", test.header, test.version, version, err)
+			}
+			continue
+		}
+		if apierror.From(err).Code != test.code {
+			t.Errorf("%s: expected %s, got %v", test.header, test.code, err)
+		}
+	}
+}
+
+func TestSetAndParse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	Set(c, 7)
+
+	tag := recorder.Header().Get(Header)
+	if tag != `"7"` {
+		t.Fatalf(`expected "7", got %s`, tag)
+	}
+	if version, err := Parse(tag); err != nil || version != 7 {
+		t.Errorf("expected version 7, got %d, %v", version, err)
+	}
+}
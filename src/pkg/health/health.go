@@ -0,0 +1,198 @@
+// Package health serves the liveness and readiness probes of a service.
+// Liveness only reports that the process serves requests; readiness runs the
+// registered dependency checks and reports each of them.
+package health
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	StatusUp   = "UP"
+	StatusDown = "DOWN"
+)
+
+// Check returns nil while the dependency is usable.
+type Check func(ctx context.Context) error
+
+type CheckResponse struct {
+	Status    string  `json:"status"`
+	Optional  bool    `json:"optional,omitempty"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type Response struct {
+	Status string                   `json:"status"`
+	Checks map[string]CheckResponse `json:"checks,omitempty"`
+}
+
+type namedCheck struct {
+	name     string
+	check    Check
+	optional bool
+}
+
+type Checker struct {
+	timeout  time.Duration
+	checks   []namedCheck
+	draining atomic.Bool
+}
+
+// New returns a checker that gives every check at most timeout.
+func New(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout}
+}
+
+// Add registers a check the service cannot work without.
+func (ch *Checker) Add(name string, check Check) {
+	ch.checks = append(ch.checks, namedCheck{name: name, check: check})
+}
+
+// AddOptional registers a check that is reported but does not make the
+// service unready, e.g. for dependencies the service has a fallback for.
+func (ch *Checker) AddOptional(name string, check Check) {
+	ch.checks = append(ch.checks, namedCheck{name: name, check: check, optional: true})
+}
+
+// Run runs all checks concurrently.
+func (ch *Checker) Run(ctx context.Context) Response {
+	response := Response{Status: StatusUp, Checks: make(map[string]CheckResponse, len(ch.checks))}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, nc := range ch.checks {
+		wg.Add(1)
+		go func(nc namedCheck) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, ch.timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := nc.check(checkCtx)
+
+			result := CheckResponse{
+				Status:    StatusUp,
+				Optional:  nc.optional,
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				result.Status = StatusDown
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			response.Checks[nc.name] = result
+			if err != nil && !nc.optional {
+				response.Status = StatusDown
+			}
+		}(nc)
+	}
+
+	wg.Wait()
+
+	return response
+}
+
+// Drain makes the service unready for good, so that load balancers stop
+// sending requests to it before it shuts down.
+func (ch *Checker) Drain() {
+	ch.draining.Store(true)
+}
+
+// Live handles /manage/live.
+func (ch *Checker) Live(c *gin.Context) {
+	c.JSON(http.StatusOK, Response{Status: StatusUp})
+}
+
+// Ready handles /manage/ready, answering 503 if a required check fails.
+func (ch *Checker) Ready(c *gin.Context) {
+	if ch.draining.Load() {
+		c.JSON(http.StatusServiceUnavailable, Response{Status: StatusDown, Checks: map[string]CheckResponse{
+			"shutdown": {Status: StatusDown, Error: "shutting down"},
+		}})
+		return
+	}
+
+	response := ch.Run(c.Request.Context())
+
+	if response.Status != StatusUp {
+		c.JSON(http.StatusServiceUnavailable, response)
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// HTTP checks that url answers with a 2xx status.
+func HTTP(client *http.Client, url string) Check {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+
+		if res.StatusCode < 200 || res.StatusCode >= 300 {
+			return fmt.Errorf("%s answered %d", url, res.StatusCode)
+		}
+		return nil
+	}
+}
+
+// WaitFor runs check until it succeeds, giving up after STARTUP_ATTEMPTS
+// attempts (10 by default). The delay between attempts starts at
+// STARTUP_RETRY_DELAY (1s by default) and doubles up to 5 times that.
+func WaitFor(ctx context.Context, name string, check Check) error {
+	attempts, err := strconv.Atoi(os.Getenv("STARTUP_ATTEMPTS"))
+	if err != nil || attempts < 1 {
+		attempts = 10
+	}
+
+	delay, err := time.ParseDuration(os.Getenv("STARTUP_RETRY_DELAY"))
+	if err != nil || delay <= 0 {
+		delay = time.Second
+	}
+	maxDelay := 5 * delay
+
+	for attempt := 1; ; attempt++ {
+		err = check(ctx)
+		if err == nil {
+			return nil
+		}
+		if attempt == attempts {
+			return fmt.Errorf("%s is unreachable after %d attempts: %w", name, attempts, err)
+		}
+
+		slog.WarnContext(ctx, "dependency is unreachable, retrying", "dependency", name, "attempt", attempt, "delay", delay.String(), "error", err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+
+		if delay = 2 * delay; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
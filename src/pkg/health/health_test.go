@@ -0,0 +1,109 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func ready(t *testing.T, checker *Checker) (int, Response) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.GET("/manage/ready", checker.Ready)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/manage/ready", nil))
+
+	var response Response
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid body %s", recorder.Body.String())
+	}
+	return recorder.Code, response
+}
+
+func TestReady(t *testing.T) {
+	up := func(context.Context) error { return nil }
+	down := func(context.Context) error { return errors.New("connection refused") }
+
+	checker := New(time.Second)
+	checker.Add("postgres", up)
+	checker.AddOptional("rating-service", down)
+
+	code, response := ready(t, checker)
+	if code != http.StatusOK || response.Status != StatusUp {
+		t.Errorf("a failing optional check must not make the service unready, got %d %+v", code, response)
+	}
+	if check := response.Checks["rating-service"]; check.Status != StatusDown || check.Error != "connection refused" || !check.Optional {
+		t.Errorf("unexpected optional check %+v", check)
+	}
+
+	checker.Add("schema", down)
+
+	code, response = ready(t, checker)
+	if code != http.StatusServiceUnavailable || response.Status != StatusDown {
+		t.Errorf("expected 503 DOWN, got %d %+v", code, response)
+	}
+	if len(response.Checks) != 3 || response.Checks["postgres"].Status != StatusUp {
+		t.Errorf("expected every check to be reported, got %+v", response.Checks)
+	}
+}
+
+func TestReadyTimesOutSlowChecks(t *testing.T) {
+	checker := New(10 * time.Millisecond)
+	checker.Add("postgres", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	if code, response := ready(t, checker); code != http.StatusServiceUnavailable || response.Checks["postgres"].Error != context.DeadlineExceeded.Error() {
+		t.Errorf("expected the check to time out, got %d %+v", code, response)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	check := HTTP(server.Client(), server.URL+"/manage/ready")
+
+	if err := check(context.Background()); err != nil {
+		t.Errorf("expected ready, got %s", err)
+	}
+
+	status = http.StatusServiceUnavailable
+	if err := check(context.Background()); err == nil {
+		t.Errorf("expected an error for 503")
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	t.Setenv("STARTUP_ATTEMPTS", "3")
+	t.Setenv("STARTUP_RETRY_DELAY", "1ms")
+
+	calls := 0
+	flaky := func(context.Context) error {
+		if calls++; calls < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	if err := WaitFor(context.Background(), "postgres", flaky); err != nil || calls != 3 {
+		t.Errorf("expected success on the third attempt, got %v after %d calls", err, calls)
+	}
+
+	calls = -10
+	if err := WaitFor(context.Background(), "postgres", flaky); err == nil || calls != -7 {
+		t.Errorf("expected to give up after 3 attempts, got %v after %d calls", err, calls+10)
+	}
+}
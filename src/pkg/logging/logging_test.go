@@ -0,0 +1,133 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestRouter(t *testing.T) (*gin.Engine, *bytes.Buffer) {
+	gin.SetMode(gin.TestMode)
+
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(New(&buf, "test-service", slog.LevelDebug))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	router := gin.New()
+	router.Use(Middleware())
+	router.GET("/api/v1/books/:uid", func(c *gin.Context) {
+		slog.InfoContext(c.Request.Context(), "handled")
+		c.Status(http.StatusNotFound)
+	})
+
+	return router, &buf
+}
+
+func records(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	var result []map[string]any
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var record map[string]any
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatalf("record is not JSON: %s", line)
+		}
+		result = append(result, record)
+	}
+	return result
+}
+
+func TestMiddlewareAcceptsRequestID(t *testing.T) {
+	router, buf := newTestRouter(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/books/1", nil)
+	req.Header.Set(RequestIDHeader, "borrow-1")
+	req.Header.Set("X-User-Name", "Test Max")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+
+	if got := recorder.Header().Get(RequestIDHeader); got != "borrow-1" {
+		t.Fatalf("expected the request ID to be echoed, got %q", got)
+	}
+
+	logged := records(t, buf)
+	if len(logged) != 2 {
+		t.Fatalf("expected handler and access records, got %d", len(logged))
+	}
+	for _, record := range logged {
+		if record["request_id"] != "borrow-1" || record["service"] != "test-service" {
+			t.Errorf("record misses request_id or service: %v", record)
+		}
+	}
+
+	access := logged[1]
+	if access["level"] != "WARN" || access["status"] != float64(http.StatusNotFound) ||
+		access["route"] != "/api/v1/books/:uid" || access["username"] != "Test Max" {
+		t.Errorf("unexpected access record %v", access)
+	}
+	if _, ok := access["latency_ms"]; !ok {
+		t.Errorf("access record misses latency_ms: %v", access)
+	}
+}
+
+func TestMiddlewareGeneratesRequestID(t *testing.T) {
+	router, buf := newTestRouter(t)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/books/1", nil))
+
+	requestID := recorder.Header().Get(RequestIDHeader)
+	if requestID == "" {
+		t.Fatalf("expected a generated request ID")
+	}
+	if logged := records(t, buf); logged[0]["request_id"] != requestID {
+		t.Errorf("expected records with request_id %s, got %v", requestID, logged[0])
+	}
+}
+
+func TestMiddlewareReplacesInvalidRequestID(t *testing.T) {
+	for _, invalid := range []string{strings.Repeat("a", MaxRequestIDLength+1), "borrow 1", "borrow-\u00e9"} {
+		router, _ := newTestRouter(t)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/books/1", nil)
+		req.Header.Set(RequestIDHeader, invalid)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+
+		if got := recorder.Header().Get(RequestIDHeader); got == invalid || got == "" {
+			t.Errorf("expected %q to be replaced, got %q", invalid, got)
+		}
+	}
+}
+
+func TestPropagate(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://rating-service:8050/api/v1/rating/", nil)
+	req = req.WithContext(WithRequestID(req.Context(), "borrow-1"))
+
+	Propagate(req)
+
+	if got := req.Header.Get(RequestIDHeader); got != "borrow-1" {
+		t.Errorf("expected %s header borrow-1, got %q", RequestIDHeader, got)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := map[string]slog.Level{
+		"":      slog.LevelInfo,
+		"DEBUG": slog.LevelDebug,
+		"warn":  slog.LevelWarn,
+		"error": slog.LevelError,
+		"loud":  slog.LevelInfo,
+	}
+
+	for value, expected := range tests {
+		if got := ParseLevel(value); got != expected {
+			t.Errorf("ParseLevel(%q) = %s, expected %s", value, got, expected)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Package metrics exposes Prometheus metrics of a service on
+// /manage/metrics: request latency per route and status, connection pool
+// stats and the Go runtime metrics of the default registry. Business
+// counters are registered by the packages that own them.
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// LatencyBuckets are fine-grained below one second, where latency SLOs of
+// the services are set.
+var LatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "http_request_duration_seconds",
+	Help:    "Latency of handled HTTP requests by method, route and status.",
+	Buckets: LatencyBuckets,
+}, []string{"method", "route", "status"})
+
+// Middleware observes the latency of every request. Requests that match no
+// route are recorded with the route "unmatched", so that scans of random
+// paths do not create new series.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		requestDuration.
+			WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// Handler serves the metrics of the default registry.
+func Handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
+
+// PoolStater is implemented by the storages backed by a pgxpool.Pool.
+type PoolStater interface {
+	Stat() *pgxpool.Stat
+}
+
+// RegisterPool exports the stats of the connection pool of storage.
+func RegisterPool(storage PoolStater) {
+	prometheus.MustRegister(&poolCollector{storage: storage})
+}
+
+var (
+	poolAcquiredConns = prometheus.NewDesc("pgxpool_acquired_conns",
+		"Connections currently acquired from the pool.", nil, nil)
+	poolIdleConns = prometheus.NewDesc("pgxpool_idle_conns",
+		"Idle connections in the pool.", nil, nil)
+	poolTotalConns = prometheus.NewDesc("pgxpool_total_conns",
+		"Connections in the pool, including those being constructed.", nil, nil)
+	poolMaxConns = prometheus.NewDesc("pgxpool_max_conns",
+		"Maximum size of the pool.", nil, nil)
+	poolAcquires = prometheus.NewDesc("pgxpool_acquires_total",
+		"Successful acquires from the pool.", nil, nil)
+	poolEmptyAcquires = prometheus.NewDesc("pgxpool_empty_acquires_total",
+		"Acquires that had to wait for a connection.", nil, nil)
+	poolCanceledAcquires = prometheus.NewDesc("pgxpool_canceled_acquires_total",
+		"Acquires canceled by their context.", nil, nil)
+	poolAcquireDuration = prometheus.NewDesc("pgxpool_acquire_duration_seconds_total",
+		"Total time spent waiting for connections.", nil, nil)
+)
+
+type poolCollector struct {
+	storage PoolStater
+}
+
+func (pc *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolAcquiredConns
+	ch <- poolIdleConns
+	ch <- poolTotalConns
+	ch <- poolMaxConns
+	ch <- poolAcquires
+	ch <- poolEmptyAcquires
+	ch <- poolCanceledAcquires
+	ch <- poolAcquireDuration
+}
+
+func (pc *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := pc.storage.Stat()
+
+	ch <- prometheus.MustNewConstMetric(poolAcquiredConns, prometheus.GaugeValue, float64(stat.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(poolIdleConns, prometheus.GaugeValue, float64(stat.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(poolTotalConns, prometheus.GaugeValue, float64(stat.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(poolMaxConns, prometheus.GaugeValue, float64(stat.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(poolAcquires, prometheus.CounterValue, float64(stat.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolEmptyAcquires, prometheus.CounterValue, float64(stat.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolCanceledAcquires, prometheus.CounterValue, float64(stat.CanceledAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolAcquireDuration, prometheus.CounterValue, stat.AcquireDuration().Seconds())
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMiddlewareRecordsRouteAndStatus(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(Middleware())
+	router.GET("/api/v1/books/:uid", func(c *gin.Context) {
+		c.Status(http.StatusNotFound)
+	})
+	router.GET("/manage/metrics", Handler())
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/books/1", nil))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/books/2", nil))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/wp-login.php", nil))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/manage/metrics", nil))
+
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		`http_request_duration_seconds_count{method="GET",route="/api/v1/books/:uid",status="404"} 2`,
+		`http_request_duration_seconds_count{method="GET",route="unmatched",status="404"} 1`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected %s in\n%s", expected, body)
+		}
+	}
+}
+
+func TestPoolCollector(t *testing.T) {
+	// the pool connects lazily, so stats are available without a database
+	pool, err := pgxpool.New(context.Background(), "host=localhost dbname=metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	collector := &poolCollector{storage: pool}
+
+	if count := testutil.CollectAndCount(collector); count != 8 {
+		t.Errorf("expected 8 pool metrics, got %d", count)
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	if err := registry.Register(collector); err != nil {
+		t.Fatalf("collector must be consistent: %s", err)
+	}
+	if _, err := registry.Gather(); err != nil {
+		t.Errorf("failed to gather pool metrics: %s", err)
+	}
+}
@@ -0,0 +1,379 @@
+// Package migrate applies the versioned schema migrations of a service.
+//
+// Migrations are pairs of files named <version>_<name>.up.sql and
+// <version>_<name>.down.sql, usually embedded with embed.FS. Applied versions
+// are recorded in the schema_migrations table. Every migration runs in its own
+// transaction under an advisory lock, so that replicas starting at the same
+// time apply it once.
+//
+// Seeds are plain SQL files with development data. They are run in name
+// order after the migrations and must be idempotent.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// lockID is the key of the advisory lock held while migrating.
+const lockID = 7_041_001
+
+var fileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+type Status struct {
+	Version   int64
+	Name      string
+	AppliedAt *time.Time
+}
+
+// DB is implemented by *pgxpool.Pool and pgx.Conn.
+type DB interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+type Migrator struct {
+	db         DB
+	migrations []Migration
+	seeds      fs.FS
+}
+
+// New loads the migrations of schema. seeds may be nil.
+func New(db DB, schema fs.FS, seeds fs.FS) (*Migrator, error) {
+	migrations, err := Load(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{db: db, migrations: migrations, seeds: seeds}, nil
+}
+
+// Load reads the migrations in the root of fsys, ordered by version.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file %s", entry.Name())
+		}
+
+		version, _ := strconv.ParseInt(match[1], 10, 64)
+
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, migration.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+func (m *Migrator) createTable(ctx context.Context) error {
+	_, err := m.db.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations
+(
+    version    BIGINT PRIMARY KEY,
+    name       VARCHAR(255) NOT NULL,
+    applied_at TIMESTAMP    NOT NULL
+)`)
+	return err
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[int64]time.Time, error) {
+	rows, err := m.db.Query(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// step runs fn in a transaction holding the migration lock, unless the
+// version is already in the wanted state.
+func (m *Migrator) step(ctx context.Context, version int64, wantApplied bool, fn func(tx pgx.Tx) error) (bool, error) {
+	tx, err := m.db.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, lockID); err != nil {
+		return false, err
+	}
+
+	var isApplied bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, version).Scan(&isApplied)
+	if err != nil {
+		return false, err
+	}
+	if isApplied == wantApplied {
+		return false, nil
+	}
+
+	if err = fn(tx); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit(ctx)
+}
+
+// Up applies all pending migrations and returns how many were applied.
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	if err := m.createTable(ctx); err != nil {
+		return 0, fmt.Errorf("unable to create schema_migrations: %w", err)
+	}
+
+	count := 0
+	for _, migration := range m.migrations {
+		migration := migration
+
+		done, err := m.step(ctx, migration.Version, true, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, migration.Up); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`,
+				migration.Version, migration.Name, time.Now().UTC())
+			return err
+		})
+		if err != nil {
+			return count, fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+		}
+		if done {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// Down reverts the last steps applied migrations.
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	if err := m.createTable(ctx); err != nil {
+		return 0, fmt.Errorf("unable to create schema_migrations: %w", err)
+	}
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := len(m.migrations) - 1; i >= 0 && count < steps; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+
+		done, err := m.step(ctx, migration.Version, false, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, migration.Down); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, migration.Version)
+			return err
+		})
+		if err != nil {
+			return count, fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+		}
+		if done {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// Status lists every known migration and when it was applied.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	if err := m.createTable(ctx); err != nil {
+		return nil, fmt.Errorf("unable to create schema_migrations: %w", err)
+	}
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]Status, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		entry := Status{Version: migration.Version, Name: migration.Name}
+		if appliedAt, ok := applied[migration.Version]; ok {
+			entry.AppliedAt = &appliedAt
+		}
+		status = append(status, entry)
+	}
+
+	return status, nil
+}
+
+// Check reports an error while a migration is pending. It is meant to be
+// used as a readiness check.
+func (m *Migrator) Check(ctx context.Context) error {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; !ok {
+			return fmt.Errorf("migration %d_%s is not applied", migration.Version, migration.Name)
+		}
+	}
+
+	return nil
+}
+
+// Seed runs the seed files in one transaction.
+func (m *Migrator) Seed(ctx context.Context) error {
+	if m.seeds == nil {
+		return nil
+	}
+
+	names, err := fs.Glob(m.seeds, "*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	return pgx.BeginFunc(ctx, m.db, func(tx pgx.Tx) error {
+		for _, name := range names {
+			content, err := fs.ReadFile(m.seeds, name)
+			if err != nil {
+				return err
+			}
+			if _, err = tx.Exec(ctx, string(content)); err != nil {
+				return fmt.Errorf("seed %s failed: %w", name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Command runs "up", "down [steps]", "status" or "seed" and reports to out.
+func (m *Migrator) Command(ctx context.Context, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		args = []string{"up"}
+	}
+
+	switch args[0] {
+	case "up":
+		count, err := m.Up(ctx)
+		fmt.Fprintf(out, "applied %d migrations\n", count)
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		count, err := m.Down(ctx, steps)
+		fmt.Fprintf(out, "reverted %d migrations\n", count)
+		return err
+	case "status":
+		status, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, entry := range status {
+			appliedAt := "pending"
+			if entry.AppliedAt != nil {
+				appliedAt = entry.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(out, "%04d_%s\t%s\n", entry.Version, entry.Name, appliedAt)
+		}
+		return nil
+	case "seed":
+		return m.Seed(ctx)
+	}
+
+	return errors.New("usage: migrate [up | down [steps] | status | seed]")
+}
+
+// OnStart applies pending migrations unless MIGRATE_ON_START is "false", and
+// loads the seeds if APP_ENV is "dev".
+func (m *Migrator) OnStart(ctx context.Context) error {
+	if os.Getenv("MIGRATE_ON_START") != "false" {
+		count, err := m.Up(ctx)
+		if err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "migrations applied", "count", count)
+	}
+
+	if os.Getenv("APP_ENV") == "dev" {
+		if err := m.Seed(ctx); err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "seed data loaded")
+	}
+
+	return nil
+}
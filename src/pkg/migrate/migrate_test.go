@@ -0,0 +1,65 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0002_add_index.up.sql":   {Data: []byte("CREATE INDEX rating_username_idx ON rating (username);")},
+		"0002_add_index.down.sql": {Data: []byte("DROP INDEX rating_username_idx;")},
+		"0001_init.up.sql":        {Data: []byte("CREATE TABLE rating (id SERIAL PRIMARY KEY);")},
+		"0001_init.down.sql":      {Data: []byte("DROP TABLE rating;")},
+		"seeds/0001_ratings.sql":  {Data: []byte("INSERT INTO rating DEFAULT VALUES;")},
+	}
+
+	loaded, err := Load(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(loaded) != 2 || loaded[0].Version != 1 || loaded[0].Name != "init" || loaded[1].Version != 2 {
+		t.Fatalf("expected migrations 1 and 2 in order, got %+v", loaded)
+	}
+	if loaded[1].Down != "DROP INDEX rating_username_idx;" {
+		t.Errorf("unexpected down migration %q", loaded[1].Down)
+	}
+}
+
+func TestLoadRejectsInvalidMigrations(t *testing.T) {
+	tests := map[string]fstest.MapFS{
+		"missing down": {
+			"0001_init.up.sql": {Data: []byte("CREATE TABLE rating ();")},
+		},
+		"unexpected name": {
+			"init.sql": {Data: []byte("CREATE TABLE rating ();")},
+		},
+		"two names": {
+			"0001_init.up.sql":     {Data: []byte("CREATE TABLE rating ();")},
+			"0001_rating.down.sql": {Data: []byte("DROP TABLE rating;")},
+		},
+	}
+
+	for name, fsys := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Load(fsys); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestCommandUsage(t *testing.T) {
+	migrator := &Migrator{}
+
+	var out bytes.Buffer
+	if err := migrator.Command(context.Background(), []string{"sideways"}, &out); err == nil {
+		t.Errorf("expected a usage error")
+	}
+	if err := migrator.Command(context.Background(), []string{"down", "zero"}, &out); err == nil {
+		t.Errorf("expected an error for invalid steps")
+	}
+}
@@ -0,0 +1,182 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Handler reacts to an event. Events whose handler fails are not redelivered
+// by the broker.
+type Handler func(ctx context.Context, event Event) error
+
+// Broker carries the events of a service to the services reacting to them.
+type Broker interface {
+	Publish(ctx context.Context, event Event) error
+	// Subscribe passes every event published from now on to handle until
+	// ctx is done.
+	Subscribe(ctx context.Context, handle Handler) error
+}
+
+// Listen subscribes handle to broker until ctx is done and subscribes again
+// after retry whenever the subscription fails, e.g. because the connection
+// to the database was lost. Events published in between are missed.
+func Listen(ctx context.Context, broker Broker, handle Handler, retry time.Duration) {
+	for {
+		err := broker.Subscribe(ctx, handle)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.WarnContext(ctx, "subscription failed", "error", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+	}
+}
+
+type memoryBroker struct {
+	mu       sync.Mutex
+	next     int
+	handlers map[int]Handler
+}
+
+// NewMemoryBroker returns a broker that delivers events to the subscribers of
+// the same process synchronously, for tests and local development.
+func NewMemoryBroker() Broker {
+	return &memoryBroker{handlers: map[int]Handler{}}
+}
+
+func (b *memoryBroker) Publish(ctx context.Context, event Event) error {
+	b.mu.Lock()
+	handlers := make([]Handler, 0, len(b.handlers))
+	for id := 0; id < b.next; id++ {
+		if handle, ok := b.handlers[id]; ok {
+			handlers = append(handlers, handle)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, handle := range handlers {
+		if err := handle(ctx, event); err != nil {
+			slog.WarnContext(ctx, "failed to handle event", "type", event.Type, "uid", event.Uid, "error", err)
+		}
+	}
+
+	return nil
+}
+
+func (b *memoryBroker) Subscribe(ctx context.Context, handle Handler) error {
+	b.mu.Lock()
+	id := b.next
+	b.next++
+	b.handlers[id] = handle
+	b.mu.Unlock()
+
+	<-ctx.Done()
+
+	b.mu.Lock()
+	delete(b.handlers, id)
+	b.mu.Unlock()
+
+	return ctx.Err()
+}
+
+type pgBroker struct {
+	db      *pgxpool.Pool
+	channel string
+}
+
+// NewPgBroker returns a broker that announces events on channel of the
+// database of db, whose outbox table holds them. Subscribers LISTEN on a
+// connection of their own and miss the events published while they are
+// disconnected.
+//
+// NOTIFY payloads are limited to 8000 bytes, so only the id of an event is
+// sent and subscribers read the event itself from the outbox table.
+func NewPgBroker(db *pgxpool.Pool, channel string) Broker {
+	return &pgBroker{db: db, channel: channel}
+}
+
+func (b *pgBroker) Publish(ctx context.Context, event Event) error {
+	if _, err := b.db.Exec(ctx, `SELECT pg_notify($1, $2)`, b.channel, strconv.FormatInt(event.ID, 10)); err != nil {
+		return fmt.Errorf("unable to notify %s: %w", b.channel, err)
+	}
+
+	return nil
+}
+
+func (b *pgBroker) Subscribe(ctx context.Context, handle Handler) error {
+	conn, err := b.db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	if _, err = conn.Exec(ctx, "LISTEN "+pgx.Identifier{b.channel}.Sanitize()); err != nil {
+		return fmt.Errorf("unable to listen on %s: %w", b.channel, err)
+	}
+
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				// the connection is unusable after an interrupted wait
+				conn.Hijack().Close(context.Background())
+				return ctx.Err()
+			}
+			return fmt.Errorf("unable to wait for notifications on %s: %w", b.channel, err)
+		}
+
+		id, err := strconv.ParseInt(notification.Payload, 10, 64)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to decode event id", "channel", b.channel, "error", err)
+			continue
+		}
+
+		event, err := get(ctx, b.db, id)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to read event", "channel", b.channel, "id", id, "error", err)
+			continue
+		}
+
+		if err = handle(ctx, event); err != nil {
+			slog.WarnContext(ctx, "failed to handle event", "type", event.Type, "uid", event.Uid, "error", err)
+		}
+	}
+}
+
+type fanout struct {
+	brokers []Broker
+}
+
+// Fanout returns a broker that publishes every event to each of brokers in
+// turn. It fails as soon as one of them does, so that the relay publishes
+// the event again later; consumers already handle redeliveries. Subscribers
+// subscribe to the brokers themselves.
+func Fanout(brokers ...Broker) Broker {
+	return &fanout{brokers: brokers}
+}
+
+func (b *fanout) Publish(ctx context.Context, event Event) error {
+	for _, broker := range b.brokers {
+		if err := broker.Publish(ctx, event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *fanout) Subscribe(ctx context.Context, handle Handler) error {
+	return errors.New("subscribe to the brokers of a fanout instead")
+}
@@ -0,0 +1,239 @@
+// Package outbox implements the transactional outbox of a service.
+//
+// Storages write domain events to the outbox table in the same transaction as
+// the state change they describe, so an event is recorded if and only if the
+// change is committed. A Relay then publishes the recorded events to a Broker
+// in order. Delivery is at least once: an event may be published again if
+// the relay stops between publishing and marking it, so consumers must be
+// idempotent, e.g. by remembering the Uid of handled events.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type Event struct {
+	ID int64 `json:"id"`
+	// Uid identifies the event across redeliveries.
+	Uid  string `json:"uid"`
+	Type string `json:"type"`
+	// EntityUid is the uid of the book, reservation, ... the event is about.
+	EntityUid string          `json:"entityUid"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// New returns an event of eventType about the entity with the given uid.
+func New(eventType string, entityUid string, payload any) (Event, error) {
+	marshalled, err := json.Marshal(payload)
+	if err != nil {
+		return Event{}, fmt.Errorf("unable to marshal %s event: %w", eventType, err)
+	}
+
+	return Event{
+		Uid:       uuid.New().String(),
+		Type:      eventType,
+		EntityUid: entityUid,
+		Payload:   marshalled,
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
+
+// Decode unmarshals the payload of the event into out.
+func (e Event) Decode(out any) error {
+	if err := json.Unmarshal(e.Payload, out); err != nil {
+		return fmt.Errorf("unable to decode %s event %s: %w", e.Type, e.Uid, err)
+	}
+	return nil
+}
+
+// Store holds the events of a service until the relay has published them.
+type Store interface {
+	// Pending returns at most limit unpublished events, oldest first.
+	Pending(ctx context.Context, limit int) ([]Event, error)
+	MarkPublished(ctx context.Context, ids []int64) error
+	// Prune deletes the events published more than age ago and returns how
+	// many it deleted.
+	Prune(ctx context.Context, age time.Duration) (int64, error)
+}
+
+// MemoryStore is a Store that in-memory storages add their events to while
+// holding their own lock.
+type MemoryStore interface {
+	Store
+	Add(event Event)
+	// Events returns every event added and not pruned so far, published or
+	// not.
+	Events() []Event
+}
+
+// Write records event in the outbox as part of tx.
+func Write(ctx context.Context, tx pgx.Tx, event Event) error {
+	query := `INSERT INTO outbox (event_uid, type, entity_uid, payload, created_at)
+		VALUES (@event_uid, @type, @entity_uid, @payload, @created_at)`
+
+	_, err := tx.Exec(ctx, query, pgx.NamedArgs{
+		"event_uid":  event.Uid,
+		"type":       event.Type,
+		"entity_uid": event.EntityUid,
+		"payload":    string(event.Payload),
+		"created_at": event.CreatedAt,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write %s event: %w", event.Type, err)
+	}
+
+	return nil
+}
+
+type pgStore struct {
+	db *pgxpool.Pool
+}
+
+// NewPgStore returns the Store of the outbox table in db.
+func NewPgStore(db *pgxpool.Pool) Store {
+	return &pgStore{db: db}
+}
+
+func (s *pgStore) Pending(ctx context.Context, limit int) ([]Event, error) {
+	query := `SELECT id, event_uid::text, type, entity_uid, payload, created_at FROM outbox
+		WHERE published_at IS NULL ORDER BY id LIMIT @limit`
+
+	rows, err := s.db.Query(ctx, query, pgx.NamedArgs{"limit": limit})
+	if err != nil {
+		return nil, fmt.Errorf("unable to query: %w", err)
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var event Event
+		if err = rows.Scan(&event.ID, &event.Uid, &event.Type, &event.EntityUid, &event.Payload, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("unable to scan event: %w", err)
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// get reads the event with id from the outbox table in db.
+func get(ctx context.Context, db *pgxpool.Pool, id int64) (Event, error) {
+	query := `SELECT id, event_uid::text, type, entity_uid, payload, created_at FROM outbox WHERE id = @id`
+
+	var event Event
+
+	err := db.QueryRow(ctx, query, pgx.NamedArgs{"id": id}).
+		Scan(&event.ID, &event.Uid, &event.Type, &event.EntityUid, &event.Payload, &event.CreatedAt)
+	if err != nil {
+		return Event{}, fmt.Errorf("unable to query: %w", err)
+	}
+
+	return event, nil
+}
+
+func (s *pgStore) MarkPublished(ctx context.Context, ids []int64) error {
+	query := `UPDATE outbox SET published_at = now() WHERE id = ANY(@ids)`
+
+	if _, err := s.db.Exec(ctx, query, pgx.NamedArgs{"ids": ids}); err != nil {
+		return fmt.Errorf("unable to update rows: %w", err)
+	}
+
+	return nil
+}
+
+func (s *pgStore) Prune(ctx context.Context, age time.Duration) (int64, error) {
+	query := `DELETE FROM outbox WHERE published_at < now() - make_interval(secs => @age)`
+
+	tag, err := s.db.Exec(ctx, query, pgx.NamedArgs{"age": age.Seconds()})
+	if err != nil {
+		return 0, fmt.Errorf("unable to delete rows: %w", err)
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+type memoryStore struct {
+	mu     sync.Mutex
+	next   int64
+	events []Event
+	// published holds when the published events were published.
+	published map[int64]time.Time
+}
+
+func NewMemoryStore() MemoryStore {
+	return &memoryStore{published: map[int64]time.Time{}}
+}
+
+func (s *memoryStore) Add(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.next++
+	event.ID = s.next
+	s.events = append(s.events, event)
+}
+
+func (s *memoryStore) Events() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Event{}, s.events...)
+}
+
+func (s *memoryStore) Pending(ctx context.Context, limit int) ([]Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := []Event{}
+	for _, event := range s.events {
+		if len(events) == limit {
+			break
+		}
+		if _, ok := s.published[event.ID]; !ok {
+			events = append(events, event)
+		}
+	}
+
+	return events, nil
+}
+
+func (s *memoryStore) MarkPublished(ctx context.Context, ids []int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, id := range ids {
+		s.published[id] = now
+	}
+
+	return nil
+}
+
+func (s *memoryStore) Prune(ctx context.Context, age time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pruned int64
+	events := s.events[:0]
+	for _, event := range s.events {
+		publishedAt, ok := s.published[event.ID]
+		if ok && time.Since(publishedAt) > age {
+			delete(s.published, event.ID)
+			pruned++
+			continue
+		}
+		events = append(events, event)
+	}
+	s.events = events
+
+	return pruned, nil
+}
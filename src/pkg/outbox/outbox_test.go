@@ -0,0 +1,263 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingBroker takes failAfter events and then fails.
+type failingBroker struct {
+	failAfter int
+	published []Event
+}
+
+func (b *failingBroker) Publish(ctx context.Context, event Event) error {
+	if len(b.published) == b.failAfter {
+		return errors.New("broker is down")
+	}
+	b.published = append(b.published, event)
+	return nil
+}
+
+func (b *failingBroker) Subscribe(ctx context.Context, handle Handler) error {
+	return nil
+}
+
+func addEvents(t *testing.T, store MemoryStore, count int) {
+	for i := 0; i < count; i++ {
+		event, err := New("book.updated", "f7cdc58f-2caf-4b15-9727-f89dcc629b27", map[string]int{"n": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Add(event)
+	}
+}
+
+func TestRelayPublishesInOrder(t *testing.T) {
+	store := NewMemoryStore()
+	addEvents(t, store, 250)
+
+	broker := &failingBroker{failAfter: -1}
+	relay := NewRelay(store, broker)
+
+	published, err := relay.Flush(context.Background())
+	if err != nil || published != 250 {
+		t.Fatalf("expected 250 events to be published, got %d %v", published, err)
+	}
+	for i, event := range broker.published {
+		var payload map[string]int
+		if err = event.Decode(&payload); err != nil || payload["n"] != i {
+			t.Fatalf("expected event %d at %d, got %s %v", i, i, event.Payload, err)
+		}
+	}
+
+	if published, _ = relay.Flush(context.Background()); published != 0 {
+		t.Errorf("expected published events to be published once, got %d again", published)
+	}
+}
+
+func TestRelayStopsAtFailure(t *testing.T) {
+	store := NewMemoryStore()
+	addEvents(t, store, 5)
+
+	broker := &failingBroker{failAfter: 2}
+	relay := NewRelay(store, broker)
+
+	if published, err := relay.Flush(context.Background()); err == nil || published != 2 {
+		t.Fatalf("expected 2 events and an error, got %d %v", published, err)
+	}
+
+	broker.failAfter = -1
+	if published, err := relay.Flush(context.Background()); err != nil || published != 3 {
+		t.Fatalf("expected the remaining 3 events, got %d %v", published, err)
+	}
+	if broker.published[2].ID != 3 {
+		t.Errorf("expected the publishing to resume at event 3, got %d", broker.published[2].ID)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	store := NewMemoryStore()
+	addEvents(t, store, 3)
+
+	if err := store.MarkPublished(context.Background(), []int64{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// recently published events are kept for late subscribers
+	if pruned, err := NewRelay(store, &failingBroker{}).Prune(context.Background()); err != nil || pruned != 0 {
+		t.Errorf("expected nothing to be pruned, got %d %v", pruned, err)
+	}
+
+	time.Sleep(time.Millisecond)
+	if pruned, err := store.Prune(context.Background(), 0); err != nil || pruned != 2 {
+		t.Errorf("expected 2 events to be pruned, got %d %v", pruned, err)
+	}
+
+	events := store.Events()
+	if len(events) != 1 || events[0].ID != 3 {
+		t.Fatalf("expected the pending event to be kept, got %+v", events)
+	}
+
+	addEvents(t, store, 1)
+	if pending, _ := store.Pending(context.Background(), 10); len(pending) != 2 || pending[1].ID != 4 {
+		t.Errorf("expected ids not to be reused, got %+v", pending)
+	}
+}
+
+func TestMemoryBroker(t *testing.T) {
+	broker := NewMemoryBroker()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan Event, 1)
+	done := make(chan error)
+	go func() {
+		done <- broker.Subscribe(ctx, func(ctx context.Context, event Event) error {
+			received <- event
+			return nil
+		})
+	}()
+
+	event, _ := New("reservation.returned", "3c4d5e6f-0000-4000-8000-000000000001", nil)
+
+	// the subscription starts asynchronously
+	deadline := time.Now().Add(time.Second)
+	for len(received) == 0 && time.Now().Before(deadline) {
+		broker.Publish(context.Background(), event)
+		time.Sleep(time.Millisecond)
+	}
+
+	if got := <-received; got.Uid != event.Uid {
+		t.Errorf("expected event %s, got %s", event.Uid, got.Uid)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the subscription to end with the context, got %v", err)
+	}
+}
+
+// droppingBroker fails its first subscriptions as if the connection was lost.
+type droppingBroker struct {
+	Broker
+	mu    sync.Mutex
+	drops int
+	tries int
+}
+
+func (b *droppingBroker) Subscribe(ctx context.Context, handle Handler) error {
+	b.mu.Lock()
+	b.tries++
+	drop := b.tries <= b.drops
+	b.mu.Unlock()
+
+	if drop {
+		return errors.New("connection lost")
+	}
+	return b.Broker.Subscribe(ctx, handle)
+}
+
+func TestListenResubscribes(t *testing.T) {
+	broker := &droppingBroker{Broker: NewMemoryBroker(), drops: 2}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan Event, 1)
+	done := make(chan struct{})
+	go func() {
+		Listen(ctx, broker, func(ctx context.Context, event Event) error {
+			received <- event
+			return nil
+		}, time.Millisecond)
+		close(done)
+	}()
+
+	event, _ := New("reservation.returned", "3c4d5e6f-0000-4000-8000-000000000001", nil)
+
+	deadline := time.Now().Add(time.Second)
+	for len(received) == 0 && time.Now().Before(deadline) {
+		broker.Publish(context.Background(), event)
+		time.Sleep(time.Millisecond)
+	}
+
+	if len(received) == 0 {
+		t.Fatalf("expected the event after %d failed subscriptions", broker.drops)
+	}
+
+	cancel()
+	<-done
+}
+
+func TestWebhookBroker(t *testing.T) {
+	var mu sync.Mutex
+	var received []Event
+	status := http.StatusServiceUnavailable
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.Header.Get(TokenHeader) != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var event Event
+		json.NewDecoder(r.Body).Decode(&event)
+		if status == http.StatusNoContent {
+			received = append(received, event)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	store := NewMemoryStore()
+	addEvents(t, store, 2)
+	relay := NewRelay(store, NewWebhookBroker(" "+server.URL+", ", "secret", time.Second))
+
+	if published, err := relay.Flush(context.Background()); err == nil || published != 0 {
+		t.Fatalf("expected the events to wait for the subscriber, got %d %v", published, err)
+	}
+
+	status = http.StatusNoContent
+	if published, err := relay.Flush(context.Background()); err != nil || published != 2 {
+		t.Fatalf("expected 2 events to be published, got %d %v", published, err)
+	}
+	if len(received) != 2 || received[0].Uid != store.Events()[0].Uid || received[1].EntityUid != store.Events()[1].EntityUid {
+		t.Errorf("unexpected events %+v", received)
+	}
+
+	// a refused event would be refused forever, so it is skipped
+	status = http.StatusBadRequest
+	addEvents(t, store, 1)
+	if published, err := relay.Flush(context.Background()); err != nil || published != 1 {
+		t.Errorf("expected the refused event to be skipped, got %d %v", published, err)
+	}
+}
+
+func TestFanout(t *testing.T) {
+	store := NewMemoryStore()
+	addEvents(t, store, 3)
+
+	first, second := &failingBroker{failAfter: -1}, &failingBroker{failAfter: 1}
+	relay := NewRelay(store, Fanout(first, second))
+
+	if published, err := relay.Flush(context.Background()); err == nil || published != 1 {
+		t.Fatalf("expected 1 event and an error, got %d %v", published, err)
+	}
+
+	second.failAfter = -1
+	if published, err := relay.Flush(context.Background()); err != nil || published != 2 {
+		t.Fatalf("expected the remaining 2 events, got %d %v", published, err)
+	}
+
+	// the event the second broker failed is published to the first one again
+	if len(first.published) != 4 || len(second.published) != 3 || first.published[1].ID != first.published[2].ID {
+		t.Errorf("unexpected events %+v and %+v", first.published, second.published)
+	}
+}
@@ -0,0 +1,89 @@
+package outbox
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Retention is how long published events are kept in the outbox, so that
+// subscribers reading them by id after a notification still find them.
+const Retention = 7 * 24 * time.Hour
+
+// pruneInterval is how often Run deletes the events older than Retention.
+const pruneInterval = time.Hour
+
+// Relay publishes the events of a store to a broker in the order they were
+// written.
+type Relay struct {
+	store  Store
+	broker Broker
+	batch  int
+}
+
+func NewRelay(store Store, broker Broker) *Relay {
+	return &Relay{store: store, broker: broker, batch: 100}
+}
+
+// Prune deletes the events published more than Retention ago.
+func (r *Relay) Prune(ctx context.Context) (int64, error) {
+	return r.store.Prune(ctx, Retention)
+}
+
+// Flush publishes the pending events and returns how many it published. It
+// stops at the first event the broker does not take, so that later events
+// are not published before it.
+func (r *Relay) Flush(ctx context.Context) (int, error) {
+	published := 0
+
+	for {
+		events, err := r.store.Pending(ctx, r.batch)
+		if err != nil || len(events) == 0 {
+			return published, err
+		}
+
+		ids := make([]int64, 0, len(events))
+		for _, event := range events {
+			if err = r.broker.Publish(ctx, event); err != nil {
+				break
+			}
+			ids = append(ids, event.ID)
+		}
+
+		if len(ids) > 0 {
+			if markErr := r.store.MarkPublished(ctx, ids); markErr != nil {
+				return published, markErr
+			}
+			published += len(ids)
+		}
+
+		if err != nil || len(events) < r.batch {
+			return published, err
+		}
+	}
+}
+
+// Run flushes the store every interval and prunes it every hour until ctx
+// is done.
+func (r *Relay) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	pruner := time.NewTicker(pruneInterval)
+	defer pruner.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := r.Flush(ctx); err != nil && ctx.Err() == nil {
+				slog.WarnContext(ctx, "failed to publish events", "error", err)
+			}
+		case <-pruner.C:
+			if _, err := r.Prune(ctx); err != nil && ctx.Err() == nil {
+				slog.WarnContext(ctx, "failed to prune published events", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"library-system/src/pkg/tracing"
+)
+
+// TokenHeader carries the token that webhook subscribers accept events with.
+const TokenHeader = "X-Events-Token"
+
+type webhookBroker struct {
+	client      *http.Client
+	subscribers []string
+	token       string
+}
+
+// NewWebhookBroker returns a broker that POSTs every event as JSON with token
+// to each of the comma-separated subscriber URLs. An event is published once
+// every subscriber has taken it; a subscriber that refuses an event with a
+// client error will refuse it again, so such events are logged and skipped
+// instead of holding up the events after them.
+func NewWebhookBroker(subscribers string, token string, timeout time.Duration) Broker {
+	broker := &webhookBroker{client: &http.Client{Transport: tracing.Transport(http.DefaultTransport), Timeout: timeout}, token: token}
+
+	for _, subscriber := range strings.Split(subscribers, ",") {
+		if subscriber = strings.TrimSpace(subscriber); subscriber != "" {
+			broker.subscribers = append(broker.subscribers, subscriber)
+		}
+	}
+
+	return broker
+}
+
+func (b *webhookBroker) Publish(ctx context.Context, event Event) error {
+	if len(b.subscribers) == 0 {
+		return nil
+	}
+
+	marshalled, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("unable to marshal event: %w", err)
+	}
+
+	for _, subscriber := range b.subscribers {
+		if err = b.send(ctx, subscriber, marshalled); err != nil {
+			return fmt.Errorf("unable to publish %s event to %s: %w", event.Type, subscriber, err)
+		}
+	}
+
+	return nil
+}
+
+func (b *webhookBroker) send(ctx context.Context, subscriber string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscriber, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TokenHeader, b.token)
+
+	res, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode < 300:
+		return nil
+	case res.StatusCode < 500 && res.StatusCode != http.StatusRequestTimeout && res.StatusCode != http.StatusTooManyRequests:
+		slog.ErrorContext(ctx, "subscriber refused event, skipping it", "subscriber", subscriber, "status", res.StatusCode)
+		return nil
+	}
+
+	return fmt.Errorf("subscriber responded with status %d", res.StatusCode)
+}
+
+func (b *webhookBroker) Subscribe(ctx context.Context, handle Handler) error {
+	return errors.New("webhook subscribers receive events over HTTP")
+}
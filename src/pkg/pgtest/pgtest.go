@@ -0,0 +1,55 @@
+// Package pgtest prepares the Postgres databases used by the storage
+// conformance tests. Tests are skipped unless the environment variable
+// naming the database is set, e.g.
+//
+//	TEST_POSTGRES_RATINGS="host=localhost user=program password=test dbname=ratings_test"
+package pgtest
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"testing"
+
+	"library-system/src/pkg/migrate"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Open connects to the database named by env, applies schema and returns
+// the connection string.
+func Open(t *testing.T, env string, schema fs.FS) string {
+	t.Helper()
+
+	connString := os.Getenv(env)
+	if connString == "" {
+		t.Skipf("%s is not set", env)
+	}
+
+	ctx := context.Background()
+
+	pool, err := pgxpool.New(ctx, connString)
+	if err != nil {
+		t.Fatalf("unable to connect: %s", err)
+	}
+	defer pool.Close()
+
+	migrator, err := migrate.New(pool, schema, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	return connString
+}
+
+// Exec runs sql, failing the test on error.
+func Exec(t *testing.T, pool *pgxpool.Pool, sql string, args ...any) {
+	t.Helper()
+
+	if _, err := pool.Exec(context.Background(), sql, args...); err != nil {
+		t.Fatalf("%s: %s", sql, err)
+	}
+}
@@ -0,0 +1,150 @@
+// Package server runs the HTTP server of a service and shuts it down
+// gracefully on SIGINT or SIGTERM: the service first reports itself as not
+// ready, then drains in-flight requests and finally stops its background
+// workers.
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"library-system/src/pkg/health"
+)
+
+type Config struct {
+	Addr string
+	// ShutdownDelay is how long the service keeps serving while reported as
+	// not ready, so that load balancers can take it out of rotation.
+	ShutdownDelay time.Duration
+	// ShutdownTimeout bounds draining of in-flight requests and stopping of
+	// background workers.
+	ShutdownTimeout time.Duration
+}
+
+// ConfigFromEnv reads SHUTDOWN_DELAY (1s by default) and SHUTDOWN_TIMEOUT
+// (8s by default, so that shutdown fits into the 10s grace period of docker).
+func ConfigFromEnv(addr string) Config {
+	config := Config{
+		Addr:            addr,
+		ShutdownDelay:   time.Second,
+		ShutdownTimeout: 8 * time.Second,
+	}
+
+	if delay, err := time.ParseDuration(os.Getenv("SHUTDOWN_DELAY")); err == nil {
+		config.ShutdownDelay = delay
+	}
+	if timeout, err := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT")); err == nil {
+		config.ShutdownTimeout = timeout
+	}
+
+	return config
+}
+
+type Server struct {
+	config  Config
+	http    *http.Server
+	checker *health.Checker
+	workers []func(ctx context.Context)
+}
+
+// New returns a server for handler. checker, if not nil, is drained on
+// shutdown.
+func New(config Config, handler http.Handler, checker *health.Checker) *Server {
+	return &Server{
+		config:  config,
+		http:    &http.Server{Addr: config.Addr, Handler: handler},
+		checker: checker,
+	}
+}
+
+// Go registers a background worker. Workers are started with the server and
+// must return once their context is cancelled.
+func (s *Server) Go(worker func(ctx context.Context)) {
+	s.workers = append(s.workers, worker)
+}
+
+// Run listens on the configured address and serves until SIGINT or SIGTERM.
+func (s *Server) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	listener, err := net.Listen("tcp", s.config.Addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ctx, listener)
+}
+
+// Serve serves on listener until ctx is done and then shuts down.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+
+	var workers sync.WaitGroup
+	for _, worker := range s.workers {
+		workers.Add(1)
+		go func(worker func(ctx context.Context)) {
+			defer workers.Done()
+			worker(workersCtx)
+		}(worker)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.http.Serve(listener)
+	}()
+
+	slog.Info("listening", "addr", listener.Addr().String())
+
+	select {
+	case err := <-served:
+		stopWorkers()
+		workers.Wait()
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down", "delay", s.config.ShutdownDelay.String(), "timeout", s.config.ShutdownTimeout.String())
+
+	if s.checker != nil {
+		s.checker.Drain()
+	}
+	time.Sleep(s.config.ShutdownDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+
+	err := s.http.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Error("failed to drain in-flight requests", "error", err)
+	}
+
+	stopWorkers()
+
+	stopped := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-shutdownCtx.Done():
+		err = errors.Join(err, errors.New("background workers did not stop in time"))
+	}
+
+	if served := <-served; !errors.Is(served, http.ErrServerClosed) {
+		err = errors.Join(err, served)
+	}
+
+	return err
+}
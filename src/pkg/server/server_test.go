@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"library-system/src/pkg/health"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	checker := health.New(time.Second)
+
+	started := make(chan struct{})
+	router := gin.New()
+	router.GET("/manage/ready", checker.Ready)
+	router.POST("/api/v1/reservations/:uid/return", func(c *gin.Context) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		c.String(http.StatusOK, "returned")
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseURL := "http://" + listener.Addr().String()
+
+	srv := New(Config{ShutdownDelay: 50 * time.Millisecond, ShutdownTimeout: time.Second}, router, checker)
+
+	workerStopped := make(chan struct{})
+	srv.Go(func(ctx context.Context) {
+		<-ctx.Done()
+		close(workerStopped)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ctx, listener)
+	}()
+
+	returned := make(chan string, 1)
+	go func() {
+		res, err := http.Post(baseURL+"/api/v1/reservations/1/return", "application/json", nil)
+		if err != nil {
+			returned <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		returned <- string(body)
+	}()
+
+	<-started
+	cancel()
+
+	// while the shutdown delay lasts the service is up, but not ready
+	time.Sleep(10 * time.Millisecond)
+	res, err := http.Get(baseURL + "/manage/ready")
+	if err != nil {
+		t.Fatalf("service must keep serving during the shutdown delay: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected not ready while shutting down, got %d", res.StatusCode)
+	}
+
+	if body := <-returned; body != "returned" {
+		t.Errorf("in-flight request must complete, got %q", body)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("expected a clean shutdown, got %s", err)
+	}
+
+	select {
+	case <-workerStopped:
+	default:
+		t.Errorf("background worker was not stopped")
+	}
+}
+
+func TestServeReportsStuckWorkers(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := New(Config{ShutdownTimeout: 20 * time.Millisecond}, http.NotFoundHandler(), nil)
+	srv.Go(func(ctx context.Context) {
+		time.Sleep(time.Second)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := srv.Serve(ctx, listener); err == nil {
+		t.Errorf("expected an error for a worker ignoring cancellation")
+	}
+}
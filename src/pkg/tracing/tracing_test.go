@@ -0,0 +1,94 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceIsPropagatedToDownstream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var traceparent string
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer downstream.Close()
+
+	client := &http.Client{Transport: Transport(http.DefaultTransport)}
+
+	router := gin.New()
+	router.Use(Middleware("gateway-service"))
+	router.POST("/api/v1/reservations/:uid/return", func(c *gin.Context) {
+		req, _ := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, downstream.URL, nil)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Errorf("downstream call failed: %s", err)
+			return
+		}
+		res.Body.Close()
+	})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/v1/reservations/1/return", nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected server and client spans, got %d", len(spans))
+	}
+
+	clientSpan, server := spans[0], spans[1]
+	if server.SpanKind() != trace.SpanKindServer || server.Name() != "/api/v1/reservations/:uid/return" {
+		t.Errorf("unexpected server span %s (%s)", server.Name(), server.SpanKind())
+	}
+	if clientSpan.SpanKind() != trace.SpanKindClient || clientSpan.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("client span must be a child of the server span")
+	}
+	if !strings.Contains(traceparent, server.SpanContext().TraceID().String()) {
+		t.Errorf("expected traceparent with trace %s, got %q", server.SpanContext().TraceID(), traceparent)
+	}
+}
+
+func TestNewExporter(t *testing.T) {
+	ctx := context.Background()
+
+	if exporter, _, err := newExporter(ctx, ExporterNone); exporter != nil || err != nil {
+		t.Errorf("expected no exporter, got %v (%v)", exporter, err)
+	}
+	if _, _, err := newExporter(ctx, "zipkin"); err == nil {
+		t.Errorf("expected an error for an unknown exporter")
+	}
+
+	path := filepath.Join(t.TempDir(), "traces.json")
+	t.Setenv("OTEL_TRACES_FILE", path)
+
+	exporter, closer, err := newExporter(ctx, ExporterFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	_, span := provider.Tracer("test").Start(ctx, "GET /api/v1/libraries")
+	span.End()
+	provider.Shutdown(ctx)
+	closer.Close()
+
+	written, err := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(written), "GET /api/v1/libraries") {
+		t.Errorf("expected the span in %s, got %q (%v)", path, written, err)
+	}
+}
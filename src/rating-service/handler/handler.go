@@ -1,20 +1,17 @@
 package handler
 
 import (
-	"context"
 	"encoding/json"
-	"fmt"
+	"log/slog"
 	"net/http"
 
+	"library-system/src/pkg/apierror"
+	"library-system/src/pkg/etag"
 	"library-system/src/rating-service/storage"
 
 	"github.com/gin-gonic/gin"
 )
 
-type ErrorResponse struct {
-	Message string `json:"message"`
-}
-
 type MessageResponse struct {
 	Message string `json:"message"`
 }
@@ -27,6 +24,17 @@ type RatingResponse struct {
 	Stars int `json:"stars"`
 }
 
+type ChangeRatingRequest struct {
+	ReservationUid string `json:"reservationUid"`
+	Delta          int    `json:"delta"`
+}
+
+type ChangeResponse struct {
+	ReservationUid string `json:"reservationUid"`
+	Username       string `json:"username"`
+	Delta          int    `json:"delta"`
+}
+
 func NewHandler(storage storage.Storage) *Handler {
 	return &Handler{storage: storage}
 }
@@ -36,22 +44,19 @@ func (h *Handler) GetRating(c *gin.Context) {
 	username := c.GetHeader("X-User-Name")
 
 	if username == "" {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: "username must be given as X-User-Name Header",
-		})
+		apierror.Respond(c, apierror.BadRequest("username must be given as X-User-Name Header"))
 		return
 	}
 
-	rating, err := h.storage.GetRating(context.Background(), username)
+	rating, err := h.storage.GetRating(c.Request.Context(), username)
 
 	if err != nil {
-		fmt.Printf("failed to get rating %s\n", err.Error())
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		slog.ErrorContext(c.Request.Context(), "failed to get rating", "error", err)
+		apierror.Respond(c, err)
 		return
 	}
 
+	etag.Set(c, rating.Version)
 	c.JSON(http.StatusOK, RatingResponse{
 		Stars: rating.Stars,
 	})
@@ -62,37 +67,106 @@ func (h *Handler) UpdateRating(c *gin.Context) {
 	username := c.GetHeader("X-User-Name")
 
 	if username == "" {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: "username must be given as X-User-Name Header",
-		})
+		apierror.Respond(c, apierror.BadRequest("username must be given as X-User-Name Header"))
+		return
+	}
+
+	version, err := etag.IfMatch(c)
+	if err != nil {
+		apierror.Respond(c, err)
 		return
 	}
 
 	var reqRating RatingResponse
 
-	err := json.NewDecoder(c.Request.Body).Decode(&reqRating)
+	err = json.NewDecoder(c.Request.Body).Decode(&reqRating)
 	if err != nil {
-		fmt.Printf("failed to decode body %s\n", err.Error())
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		slog.ErrorContext(c.Request.Context(), "failed to decode body", "error", err)
+		apierror.Respond(c, apierror.BadRequest("invalid request body: %s", err.Error()))
 		return
 	}
 
-	err = h.storage.UpdateRating(context.Background(), username, reqRating.Stars)
+	version, err = h.storage.UpdateRating(c.Request.Context(), username, reqRating.Stars, version)
 	if err != nil {
-		fmt.Printf("failed to update raing %s\n", err.Error())
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		slog.ErrorContext(c.Request.Context(), "failed to update raing", "error", err)
+		apierror.Respond(c, err)
 		return
 	}
 
+	if version != 0 {
+		etag.Set(c, version)
+	}
+
 	c.JSON(http.StatusOK, MessageResponse{
 		Message: "rating updated",
 	})
 }
 
+// ChangeRating moves the rating of a reader by a number of stars once per
+// reservation. It answers 201 when the change is applied and 200 when it had
+// been applied before, with the resulting rating in both cases.
+func (h *Handler) ChangeRating(c *gin.Context) {
+
+	username := c.GetHeader("X-User-Name")
+
+	if username == "" {
+		apierror.Respond(c, apierror.BadRequest("username must be given as X-User-Name Header"))
+		return
+	}
+
+	var reqChange ChangeRatingRequest
+
+	err := json.NewDecoder(c.Request.Body).Decode(&reqChange)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to decode body", "error", err)
+		apierror.Respond(c, apierror.BadRequest("invalid request body: %s", err.Error()))
+		return
+	}
+
+	if reqChange.ReservationUid == "" {
+		apierror.Respond(c, apierror.Validation("reservationUid must be given"))
+		return
+	}
+
+	rating, applied, err := h.storage.ApplyChange(c.Request.Context(), storage.Change{
+		ReservationUid: reqChange.ReservationUid,
+		Username:       username,
+		Delta:          reqChange.Delta,
+	})
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to change rating", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	status := http.StatusOK
+	if applied {
+		status = http.StatusCreated
+	}
+
+	etag.Set(c, rating.Version)
+	c.JSON(status, RatingResponse{
+		Stars: rating.Stars,
+	})
+}
+
+// GetChange tells whether the change of a reservation has been applied: it
+// answers the change if so and 404 otherwise.
+func (h *Handler) GetChange(c *gin.Context) {
+
+	change, err := h.storage.GetChange(c.Request.Context(), c.Param("reservationUid"))
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, ChangeResponse{
+		ReservationUid: change.ReservationUid,
+		Username:       change.Username,
+		Delta:          change.Delta,
+	})
+}
+
 func (h *Handler) GetHealth(c *gin.Context) {
 	c.Status(http.StatusOK)
 }
@@ -1,19 +1,167 @@
 package handler
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"library-system/src/rating-service/storage"
+
+	"github.com/gin-gonic/gin"
 )
 
+func newTestRouter() (*gin.Engine, storage.Storage) {
+	gin.SetMode(gin.TestMode)
+
+	memory := storage.NewMemory()
+	memory.AddRating("Test Max", 20)
+
+	handler := NewHandler(memory)
+
+	router := gin.New()
+	handler.Register(router)
+
+	return router, memory
+}
+
 func TestGetRating(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		status   int
+		body     string
+	}{
+		{"existing reader", "Test Max", http.StatusOK, `{"stars":20}`},
+		{"unknown reader", "Unknown", http.StatusNotFound, `{"code":"NOT_FOUND","message":"username not found"}`},
+		{"missing username", "", http.StatusBadRequest, `{"code":"BAD_REQUEST","message":"username must be given as X-User-Name Header"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, _ := newTestRouter()
 
-	if 2+2 != 4 {
-		t.Errorf("Unexpected situation")
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/rating/", nil)
+			req.Header.Set("X-User-Name", tt.username)
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.status || recorder.Body.String() != tt.body {
+				t.Errorf("expected %d %s, got %d %s", tt.status, tt.body, recorder.Code, recorder.Body.String())
+			}
+			if tt.status == http.StatusOK && recorder.Header().Get("ETag") != `"1"` {
+				t.Errorf(`expected ETag "1", got %q`, recorder.Header().Get("ETag"))
+			}
+		})
 	}
 }
 
 func TestUpdateRating(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		ifMatch  string
+		body     string
+		status   int
+		stars    int
+	}{
+		{"valid update", "Test Max", `"1"`, `{"stars":35}`, http.StatusOK, 35},
+		{"any version", "Test Max", `*`, `{"stars":35}`, http.StatusOK, 35},
+		{"another version", "Test Max", `"2"`, `{"stars":35}`, http.StatusPreconditionFailed, 20},
+		{"missing If-Match", "Test Max", ``, `{"stars":35}`, http.StatusPreconditionRequired, 20},
+		{"out of range", "Test Max", `"1"`, `{"stars":101}`, http.StatusUnprocessableEntity, 20},
+		{"malformed body", "Test Max", `"1"`, `{"stars":`, http.StatusBadRequest, 20},
+		{"missing username", "", `"1"`, `{"stars":35}`, http.StatusBadRequest, 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, memory := newTestRouter()
+
+			req := httptest.NewRequest(http.MethodPut, "/api/v1/rating/", strings.NewReader(tt.body))
+			req.Header.Set("X-User-Name", tt.username)
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, req)
+
+			if recorder.Code != tt.status {
+				t.Errorf("expected %d, got %d %s", tt.status, recorder.Code, recorder.Body.String())
+			}
+			if tt.status == http.StatusOK && recorder.Header().Get("ETag") != `"2"` {
+				t.Errorf(`expected ETag "2", got %q`, recorder.Header().Get("ETag"))
+			}
+			if rating, _ := memory.GetRating(req.Context(), "Test Max"); rating.Stars != tt.stars {
+				t.Errorf("expected %d stars, got %d", tt.stars, rating.Stars)
+			}
+		})
+	}
+}
+
+func TestChangeRating(t *testing.T) {
+	const reservationUid = "3c4d5e6f-0000-4000-8000-000000000001"
+
+	router, memory := newTestRouter()
+
+	tests := []struct {
+		name     string
+		username string
+		body     string
+		status   int
+		response string
+		stars    int
+	}{
+		{"new change", "Test Max", `{"reservationUid":"` + reservationUid + `","delta":-10}`, http.StatusCreated, `{"stars":10}`, 10},
+		{"repeated change", "Test Max", `{"reservationUid":"` + reservationUid + `","delta":-10}`, http.StatusOK, `{"stars":10}`, 10},
+		{"other change of the reservation", "Test Max", `{"reservationUid":"` + reservationUid + `","delta":1}`, http.StatusConflict, `"code":"CONFLICT"`, 10},
+		{"missing reservation", "Test Max", `{"delta":1}`, http.StatusUnprocessableEntity, `"code":"VALIDATION_FAILED"`, 10},
+		{"invalid reservation", "Test Max", `{"reservationUid":"abc","delta":1}`, http.StatusUnprocessableEntity, `"code":"VALIDATION_FAILED"`, 10},
+		{"unknown reader", "Unknown", `{"reservationUid":"3c4d5e6f-0000-4000-8000-000000000002","delta":1}`, http.StatusNotFound, `"code":"NOT_FOUND"`, 10},
+		{"missing username", "", `{"reservationUid":"3c4d5e6f-0000-4000-8000-000000000003","delta":1}`, http.StatusBadRequest, `"code":"BAD_REQUEST"`, 10},
+	}
+
+	// the cases run in order against the same storage
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/rating/changes", strings.NewReader(tt.body))
+		req.Header.Set("X-User-Name", tt.username)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+
+		if recorder.Code != tt.status || !strings.Contains(recorder.Body.String(), tt.response) {
+			t.Errorf("%s: expected %d %s, got %d %s", tt.name, tt.status, tt.response, recorder.Code, recorder.Body.String())
+		}
+		if rating, _ := memory.GetRating(req.Context(), "Test Max"); rating.Stars != tt.stars {
+			t.Errorf("%s: expected %d stars, got %d", tt.name, tt.stars, rating.Stars)
+		}
+	}
+}
+
+func TestGetChange(t *testing.T) {
+	const reservationUid = "3c4d5e6f-0000-4000-8000-000000000001"
+
+	router, memory := newTestRouter()
+	memory.ApplyChange(context.Background(), storage.Change{ReservationUid: reservationUid, Username: "Test Max", Delta: -10})
+
+	tests := []struct {
+		name           string
+		reservationUid string
+		status         int
+		body           string
+	}{
+		{"applied change", reservationUid, http.StatusOK, `{"reservationUid":"` + reservationUid + `","username":"Test Max","delta":-10}`},
+		{"no change", "3c4d5e6f-0000-4000-8000-000000000002", http.StatusNotFound, `"code":"NOT_FOUND"`},
+		{"invalid reservation", "abc", http.StatusUnprocessableEntity, `"code":"VALIDATION_FAILED"`},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/rating/changes/"+tt.reservationUid, nil)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
 
-	if 2+2 != 4 {
-		t.Errorf("Unexpected situation")
+		if recorder.Code != tt.status || !strings.Contains(recorder.Body.String(), tt.body) {
+			t.Errorf("%s: expected %d %s, got %d %s", tt.name, tt.status, tt.body, recorder.Code, recorder.Body.String())
+		}
 	}
 }
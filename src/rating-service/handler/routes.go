@@ -0,0 +1,19 @@
+package handler
+
+import (
+	"library-system/src/pkg/audit"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Register adds the routes of rating-service to router. Probes and metrics are
+// registered by the caller.
+func (h *Handler) Register(router gin.IRoutes) {
+	router.GET("/api/v1/rating/", h.GetRating)
+	router.PUT("/api/v1/rating/", h.UpdateRating)
+	router.POST("/api/v1/rating/changes", h.ChangeRating)
+	router.GET("/api/v1/rating/changes/:reservationUid", h.GetChange)
+	router.GET("/api/v1/audit", audit.Handler(h.storage.Audit(), "rating-service"))
+
+	router.GET("/manage/health", h.GetHealth)
+}
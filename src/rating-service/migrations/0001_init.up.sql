@@ -0,0 +1,8 @@
+-- IF NOT EXISTS adopts databases created by the former init script
+CREATE TABLE IF NOT EXISTS rating
+(
+    id       SERIAL PRIMARY KEY,
+    username VARCHAR(80) NOT NULL,
+    stars    INT         NOT NULL
+        CHECK (stars BETWEEN 0 AND 100)
+);
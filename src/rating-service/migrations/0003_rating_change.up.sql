@@ -0,0 +1,9 @@
+-- relative changes of ratings, at most one per reservation, so that a
+-- retried change is applied once
+CREATE TABLE rating_change
+(
+    reservation_uid uuid PRIMARY KEY,
+    username        VARCHAR(80) NOT NULL,
+    delta           INT         NOT NULL,
+    applied_at      TIMESTAMP   NOT NULL DEFAULT now()
+);
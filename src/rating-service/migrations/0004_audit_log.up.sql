@@ -0,0 +1,29 @@
+-- append-only trail of every state change, written in its transaction
+CREATE TABLE audit_log
+(
+    id          BIGSERIAL PRIMARY KEY,
+    actor       VARCHAR(80)  NOT NULL,
+    action      VARCHAR(80)  NOT NULL,
+    entity_type VARCHAR(40)  NOT NULL,
+    entity_uid  VARCHAR(255) NOT NULL,
+    before      jsonb,
+    after       jsonb,
+    request_id  VARCHAR(80)  NOT NULL DEFAULT '',
+    created_at  TIMESTAMP    NOT NULL
+);
+
+CREATE INDEX audit_log_entity_idx ON audit_log (entity_uid, created_at);
+CREATE INDEX audit_log_actor_idx ON audit_log (actor, created_at);
+
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS
+$$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_append_only
+    BEFORE UPDATE OR DELETE
+    ON audit_log
+    FOR EACH ROW
+EXECUTE FUNCTION audit_log_append_only();
@@ -0,0 +1 @@
+ALTER TABLE rating DROP COLUMN version;
@@ -0,0 +1,3 @@
+-- version of the record, sent as its ETag and bumped by every update
+ALTER TABLE rating
+    ADD COLUMN version INT NOT NULL DEFAULT 1 CHECK (version > 0);
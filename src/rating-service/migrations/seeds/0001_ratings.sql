@@ -0,0 +1,3 @@
+INSERT INTO rating (username, stars)
+SELECT 'Test Max', 20
+WHERE NOT EXISTS (SELECT 1 FROM rating WHERE username = 'Test Max');
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"context"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"library-system/src/pkg/apierror"
+	"library-system/src/pkg/audit"
+	"library-system/src/pkg/etag"
+	"library-system/src/pkg/outbox"
+)
+
+// memory is a Storage kept in memory with the semantics of postgres, for
+// tests and local development.
+type memory struct {
+	mu      sync.Mutex
+	ratings map[string]Rating
+	lastId  int
+	changes map[string]Change
+	outbox  outbox.MemoryStore
+	audit   audit.MemoryLog
+}
+
+func NewMemory() *memory {
+	return &memory{
+		ratings: make(map[string]Rating),
+		changes: make(map[string]Change),
+		outbox:  outbox.NewMemoryStore(),
+		audit:   audit.NewMemoryLog(),
+	}
+}
+
+func (m *memory) Outbox() outbox.Store {
+	return m.outbox
+}
+
+func (m *memory) Audit() audit.Log {
+	return m.audit
+}
+
+// AddRating inserts the rating of a new reader.
+func (m *memory) AddRating(username string, stars int) Rating {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastId++
+	rating := Rating{ID: m.lastId, Username: username, Stars: stars, Version: 1}
+	m.ratings[username] = rating
+
+	return rating
+}
+
+func (m *memory) GetRating(ctx context.Context, username string) (Rating, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rating, ok := m.ratings[username]
+	if !ok {
+		return Rating{}, apierror.NotFound("username not found")
+	}
+
+	return rating, nil
+}
+
+func (m *memory) UpdateRating(ctx context.Context, username string, stars int, version int) (int, error) {
+	if stars < 0 || stars > 100 {
+		return 0, apierror.Validation("stars must be between 0 and 100")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rating, ok := m.ratings[username]
+	if !ok {
+		return 0, nil
+	}
+	if !etag.Matches(version, rating.Version) {
+		return 0, apierror.PreconditionFailed("rating of %s has changed since version %d", username, version)
+	}
+
+	event, err := ratingChangedEvent(username, stars, rating.Stars)
+	if err != nil {
+		return 0, err
+	}
+	entry, err := ratingUpdatedEntry(ctx, username, stars, rating.Stars)
+	if err != nil {
+		return 0, err
+	}
+
+	rating.Stars = stars
+	rating.Version++
+	m.ratings[username] = rating
+	m.outbox.Add(event)
+	m.audit.Add(entry)
+
+	return rating.Version, nil
+}
+
+func (m *memory) ApplyChange(ctx context.Context, change Change) (Rating, bool, error) {
+	if _, err := uuid.Parse(change.ReservationUid); err != nil {
+		return Rating{}, false, apierror.Validation("invalid input syntax for type uuid: %q", change.ReservationUid)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rating, ok := m.ratings[change.Username]
+
+	if previous, applied := m.changes[change.ReservationUid]; applied {
+		if previous != change {
+			return Rating{}, false, apierror.Conflict("reservation %s has changed the rating by %d already", change.ReservationUid, previous.Delta)
+		}
+		if !ok {
+			return Rating{}, false, apierror.NotFound("username not found")
+		}
+		return rating, false, nil
+	}
+
+	if !ok {
+		return Rating{}, false, apierror.NotFound("username not found")
+	}
+
+	previousStars := rating.Stars
+	rating.Stars = min(MaxStars, max(MinStars, rating.Stars+change.Delta))
+	rating.Version++
+
+	event, err := ratingChangedEvent(change.Username, rating.Stars, previousStars)
+	if err != nil {
+		return Rating{}, false, err
+	}
+	entry, err := ratingChangedEntry(ctx, change, rating.Stars, previousStars)
+	if err != nil {
+		return Rating{}, false, err
+	}
+
+	m.ratings[change.Username] = rating
+	m.changes[change.ReservationUid] = change
+	m.outbox.Add(event)
+	m.audit.Add(entry)
+
+	return rating, true, nil
+}
+
+func (m *memory) GetChange(ctx context.Context, reservationUid string) (Change, error) {
+	if _, err := uuid.Parse(reservationUid); err != nil {
+		return Change{}, apierror.Validation("invalid input syntax for type uuid: %q", reservationUid)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	change, ok := m.changes[reservationUid]
+	if !ok {
+		return Change{}, apierror.NotFound("no change for reservation %s", reservationUid)
+	}
+
+	return change, nil
+}
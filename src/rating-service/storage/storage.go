@@ -4,7 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"sync"
+	"log/slog"
+
+	"library-system/src/pkg/apierror"
+	"library-system/src/pkg/audit"
+	"library-system/src/pkg/etag"
+	"library-system/src/pkg/outbox"
+	"library-system/src/pkg/tracing"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -14,11 +20,76 @@ type Rating struct {
 	ID       int    `json:"id"`
 	Username string `json:"username"`
 	Stars    int    `json:"stars"`
+	Version  int    `json:"version"`
+}
+
+const (
+	MinStars = 0
+	MaxStars = 100
+)
+
+// Change moves the rating of Username by Delta stars, clamped to MinStars and
+// MaxStars. It results from returning the reservation with ReservationUid,
+// which identifies it so that it is applied once however often it is sent.
+type Change struct {
+	ReservationUid string
+	Username       string
+	Delta          int
+}
+
+// RatingChanged is written to the outbox with a RatingEvent as payload.
+const RatingChanged = "rating.changed"
+
+type RatingEvent struct {
+	Username      string `json:"username"`
+	Stars         int    `json:"stars"`
+	PreviousStars int    `json:"previousStars"`
+}
+
+func ratingChangedEvent(username string, stars int, previousStars int) (outbox.Event, error) {
+	return outbox.New(RatingChanged, username, RatingEvent{Username: username, Stars: stars, PreviousStars: previousStars})
+}
+
+// Actions recorded in the audit log.
+const (
+	AuditRatingUpdated = "rating.updated"
+	AuditRatingChanged = "rating.changed"
+)
+
+type ratingAudit struct {
+	Stars          int    `json:"stars"`
+	Delta          int    `json:"delta,omitempty"`
+	ReservationUid string `json:"reservationUid,omitempty"`
+}
+
+func ratingUpdatedEntry(ctx context.Context, username string, stars int, previousStars int) (audit.Entry, error) {
+	return audit.New(ctx, AuditRatingUpdated, "rating", username, ratingAudit{Stars: previousStars}, ratingAudit{Stars: stars})
+}
+
+func ratingChangedEntry(ctx context.Context, change Change, stars int, previousStars int) (audit.Entry, error) {
+	return audit.New(ctx, AuditRatingChanged, "rating", change.Username,
+		ratingAudit{Stars: previousStars},
+		ratingAudit{Stars: stars, Delta: change.Delta, ReservationUid: change.ReservationUid})
 }
 
 type Storage interface {
 	GetRating(ctx context.Context, username string) (Rating, error)
-	UpdateRating(ctx context.Context, username string, stars int) error
+	// UpdateRating sets the stars of the reader unless the rating has changed
+	// since version, which is etag.Any to set them whatever its version, and
+	// returns its new version. Unknown readers are left alone.
+	UpdateRating(ctx context.Context, username string, stars int, version int) (int, error)
+	// ApplyChange applies change unless a change for its reservation has
+	// been applied before, and returns the resulting rating and whether the
+	// change was applied now.
+	ApplyChange(ctx context.Context, change Change) (Rating, bool, error)
+	// GetChange returns the change applied for the reservation, so that a
+	// caller that lost the response of ApplyChange can tell whether it was
+	// applied.
+	GetChange(ctx context.Context, reservationUid string) (Change, error)
+	// Outbox holds the events of the changes above.
+	Outbox() outbox.Store
+	// Audit holds the audit trail of the changes above.
+	Audit() audit.Log
 }
 
 type postgres struct {
@@ -26,31 +97,40 @@ type postgres struct {
 }
 
 func NewPgStorage(ctx context.Context, connString string) (*postgres, error) {
-	var pgInstance *postgres
-	var pgOnce sync.Once
-	pgOnce.Do(func() {
-		db, err := pgxpool.New(ctx, connString)
-		if err != nil {
-			fmt.Printf("Unable to create connection pool: %v\n", err)
-			return
-		}
-
-		pgInstance = &postgres{db}
-	})
+	db, err := tracing.NewPool(ctx, connString)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create connection pool: %w", err)
+	}
 
-	return pgInstance, nil
+	return &postgres{db}, nil
 }
 
 func (pg *postgres) Ping(ctx context.Context) error {
 	return pg.db.Ping(ctx)
 }
 
+func (pg *postgres) Stat() *pgxpool.Stat {
+	return pg.db.Stat()
+}
+
+func (pg *postgres) Pool() *pgxpool.Pool {
+	return pg.db
+}
+
 func (pg *postgres) Close() {
 	pg.db.Close()
 }
 
+func (pg *postgres) Outbox() outbox.Store {
+	return outbox.NewPgStore(pg.db)
+}
+
+func (pg *postgres) Audit() audit.Log {
+	return audit.NewPgLog(pg.db)
+}
+
 func (pg *postgres) GetRating(ctx context.Context, username string) (Rating, error) {
-	query := fmt.Sprintf(`SELECT id, username, stars FROM rating WHERE username = '%s'`, username)
+	query := fmt.Sprintf(`SELECT id, username, stars, version FROM rating WHERE username = '%s'`, username)
 
 	rows, err := pg.db.Query(ctx, query)
 
@@ -64,24 +144,152 @@ func (pg *postgres) GetRating(ctx context.Context, username string) (Rating, err
 	rating, err = pgx.CollectOneRow(rows, pgx.RowToStructByName[Rating])
 
 	if errors.Is(err, pgx.ErrNoRows) {
-		return rating, errors.New("username not found")
+		return rating, apierror.NotFound("username not found")
 	}
 
 	if err != nil {
-		fmt.Printf("CollectRows error: %v", err)
+		slog.ErrorContext(ctx, "CollectRows error", "error", err)
 		return rating, err
 	}
 
 	return rating, nil
 }
 
-func (pg *postgres) UpdateRating(ctx context.Context, username string, stars int) error {
-	query := fmt.Sprintf(`UPDATE rating SET stars = %d WHERE username = '%s'`, stars, username)
+func (pg *postgres) UpdateRating(ctx context.Context, username string, stars int, version int) (int, error) {
+	query := `SELECT stars, version FROM rating WHERE username = @username FOR UPDATE`
+	args := pgx.NamedArgs{"stars": stars, "username": username}
+
+	var updated int
 
-	_, err := pg.db.Exec(ctx, query)
+	err := pgx.BeginFunc(ctx, pg.db, func(tx pgx.Tx) error {
+		var previousStars, previousVersion int
+
+		err := tx.QueryRow(ctx, query, args).Scan(&previousStars, &previousVersion)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to query: %w", err)
+		}
+		if !etag.Matches(version, previousVersion) {
+			return apierror.PreconditionFailed("rating of %s has changed since version %d", username, version)
+		}
+
+		query = `UPDATE rating SET stars = @stars, version = version + 1 WHERE username = @username RETURNING version`
+		if err = tx.QueryRow(ctx, query, args).Scan(&updated); err != nil {
+			return fmt.Errorf("unable to update row: %w", err)
+		}
+
+		event, err := ratingChangedEvent(username, stars, previousStars)
+		if err != nil {
+			return err
+		}
+		if err = outbox.Write(ctx, tx, event); err != nil {
+			return err
+		}
+
+		entry, err := ratingUpdatedEntry(ctx, username, stars, previousStars)
+		if err != nil {
+			return err
+		}
+
+		return audit.Write(ctx, tx, entry)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return updated, nil
+}
+
+func (pg *postgres) ApplyChange(ctx context.Context, change Change) (Rating, bool, error) {
+	var rating Rating
+	var applied bool
+
+	err := pgx.BeginFunc(ctx, pg.db, func(tx pgx.Tx) error {
+		args := pgx.NamedArgs{
+			"reservation_uid": change.ReservationUid,
+			"username":        change.Username,
+			"delta":           change.Delta,
+			"min":             MinStars,
+			"max":             MaxStars,
+		}
+
+		query := `INSERT INTO rating_change (reservation_uid, username, delta) VALUES (@reservation_uid, @username, @delta)
+			ON CONFLICT (reservation_uid) DO NOTHING`
+
+		tag, err := tx.Exec(ctx, query, args)
+		if err != nil {
+			return fmt.Errorf("unable to insert row: %w", err)
+		}
+
+		if tag.RowsAffected() == 0 {
+			var previous Change
+			query = `SELECT reservation_uid::text, username, delta FROM rating_change WHERE reservation_uid = @reservation_uid`
+			if err = tx.QueryRow(ctx, query, args).Scan(&previous.ReservationUid, &previous.Username, &previous.Delta); err != nil {
+				return fmt.Errorf("unable to query: %w", err)
+			}
+			if previous != change {
+				return apierror.Conflict("reservation %s has changed the rating by %d already", change.ReservationUid, previous.Delta)
+			}
+
+			query = `SELECT id, username, stars, version FROM rating WHERE username = @username`
+			err = tx.QueryRow(ctx, query, args).Scan(&rating.ID, &rating.Username, &rating.Stars, &rating.Version)
+			if errors.Is(err, pgx.ErrNoRows) {
+				return apierror.NotFound("username not found")
+			}
+			return err
+		}
+
+		var previousStars int
+
+		query = `UPDATE rating SET stars = LEAST(@max, GREATEST(@min, previous.stars + @delta)), version = rating.version + 1
+			FROM (SELECT id, stars FROM rating WHERE username = @username FOR UPDATE) previous
+			WHERE rating.id = previous.id RETURNING rating.id, rating.username, rating.stars, rating.version, previous.stars`
+
+		err = tx.QueryRow(ctx, query, args).Scan(&rating.ID, &rating.Username, &rating.Stars, &rating.Version, &previousStars)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return apierror.NotFound("username not found")
+		}
+		if err != nil {
+			return fmt.Errorf("unable to update row: %w", err)
+		}
+
+		event, err := ratingChangedEvent(change.Username, rating.Stars, previousStars)
+		if err != nil {
+			return err
+		}
+		if err = outbox.Write(ctx, tx, event); err != nil {
+			return err
+		}
+
+		entry, err := ratingChangedEntry(ctx, change, rating.Stars, previousStars)
+		if err != nil {
+			return err
+		}
+
+		applied = true
+		return audit.Write(ctx, tx, entry)
+	})
+	if err != nil {
+		return Rating{}, false, err
+	}
+
+	return rating, applied, nil
+}
+
+func (pg *postgres) GetChange(ctx context.Context, reservationUid string) (Change, error) {
+	var change Change
+
+	query := `SELECT reservation_uid::text, username, delta FROM rating_change WHERE reservation_uid = @reservation_uid`
+	err := pg.db.QueryRow(ctx, query, pgx.NamedArgs{"reservation_uid": reservationUid}).
+		Scan(&change.ReservationUid, &change.Username, &change.Delta)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Change{}, apierror.NotFound("no change for reservation %s", reservationUid)
+	}
 	if err != nil {
-		return fmt.Errorf("unable to update row: %w", err)
+		return Change{}, fmt.Errorf("unable to query: %w", err)
 	}
 
-	return nil
+	return change, nil
 }
@@ -0,0 +1,39 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"library-system/src/pkg/pgtest"
+	"library-system/src/rating-service/migrations"
+	"library-system/src/rating-service/storage"
+	"library-system/src/rating-service/storage/storagetest"
+)
+
+func TestMemory(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T, fixture storagetest.Fixture) storage.Storage {
+		memory := storage.NewMemory()
+		for _, rating := range fixture.Ratings {
+			memory.AddRating(rating.Username, rating.Stars)
+		}
+		return memory
+	})
+}
+
+func TestPostgres(t *testing.T) {
+	connString := pgtest.Open(t, "TEST_POSTGRES_RATINGS", migrations.Schema)
+
+	pg, err := storage.NewPgStorage(context.Background(), connString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Close()
+
+	storagetest.Run(t, func(t *testing.T, fixture storagetest.Fixture) storage.Storage {
+		pgtest.Exec(t, pg.Pool(), `TRUNCATE rating, rating_change, outbox, audit_log RESTART IDENTITY`)
+		for _, rating := range fixture.Ratings {
+			pgtest.Exec(t, pg.Pool(), `INSERT INTO rating (username, stars) VALUES ($1, $2)`, rating.Username, rating.Stars)
+		}
+		return pg
+	})
+}
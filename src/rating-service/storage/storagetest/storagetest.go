@@ -0,0 +1,265 @@
+// Package storagetest is the conformance suite that every implementation of
+// the rating-service Storage must pass.
+package storagetest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"library-system/src/pkg/apierror"
+	"library-system/src/pkg/audit"
+	"library-system/src/pkg/etag"
+	"library-system/src/rating-service/storage"
+)
+
+type Fixture struct {
+	Ratings []storage.Rating
+}
+
+// Factory returns a storage holding exactly the fixture.
+type Factory func(t *testing.T, fixture Fixture) storage.Storage
+
+var fixture = Fixture{
+	Ratings: []storage.Rating{
+		{Username: "Test Max", Stars: 20},
+		{Username: "Test Min", Stars: 0},
+	},
+}
+
+func Run(t *testing.T, newStorage Factory) {
+	ctx := context.Background()
+
+	t.Run("GetRating", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		rating, err := s.GetRating(ctx, "Test Max")
+		if err != nil || rating.Username != "Test Max" || rating.Stars != 20 || rating.ID == 0 {
+			t.Errorf("unexpected rating %+v (%v)", rating, err)
+		}
+
+		_, err = s.GetRating(ctx, "Unknown")
+		if apierror.From(err).Code != apierror.CodeNotFound {
+			t.Errorf("expected NOT_FOUND for an unknown reader, got %v", err)
+		}
+	})
+
+	t.Run("UpdateRating", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		if version, err := s.UpdateRating(ctx, "Test Max", 35, 1); err != nil || version != 2 {
+			t.Fatalf("expected version 2, got %d (%v)", version, err)
+		}
+		if rating, _ := s.GetRating(ctx, "Test Max"); rating.Stars != 35 || rating.Version != 2 {
+			t.Errorf("expected 35 stars at version 2, got %+v", rating)
+		}
+		if rating, _ := s.GetRating(ctx, "Test Min"); rating.Stars != 0 || rating.Version != 1 {
+			t.Errorf("other readers must not change, got %+v", rating)
+		}
+
+		// updating an unknown reader is not an error, and creates nobody
+		if _, err := s.UpdateRating(ctx, "Unknown", 10, 1); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		if _, err := s.GetRating(ctx, "Unknown"); err == nil {
+			t.Errorf("update must not create a rating")
+		}
+	})
+
+	t.Run("UpdateRatingVersion", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		if _, err := s.UpdateRating(ctx, "Test Max", 35, 1); err != nil {
+			t.Fatal(err)
+		}
+
+		// a second update based on the same version is refused
+		if _, err := s.UpdateRating(ctx, "Test Max", 40, 1); apierror.From(err).Code != apierror.CodePreconditionFailed {
+			t.Errorf("expected PRECONDITION_FAILED, got %v", err)
+		}
+		if rating, _ := s.GetRating(ctx, "Test Max"); rating.Stars != 35 {
+			t.Errorf("a refused update must change nothing, got %+v", rating)
+		}
+
+		// applied changes move the version as well
+		rating, _, err := s.ApplyChange(ctx, storage.Change{ReservationUid: "3c4d5e6f-0000-4000-8000-000000000001", Username: "Test Max", Delta: 1})
+		if err != nil || rating.Version != 3 {
+			t.Fatalf("expected version 3, got %+v (%v)", rating, err)
+		}
+
+		if version, err := s.UpdateRating(ctx, "Test Max", 40, etag.Any); err != nil || version != 4 {
+			t.Errorf("expected an unconditional update to version 4, got %d (%v)", version, err)
+		}
+	})
+
+	t.Run("UpdateRatingOutOfRange", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		for _, stars := range []int{-1, 101} {
+			if _, err := s.UpdateRating(ctx, "Test Max", stars, etag.Any); apierror.From(err).Code != apierror.CodeValidation {
+				t.Errorf("expected VALIDATION_FAILED for %d stars, got %v", stars, err)
+			}
+		}
+		if rating, _ := s.GetRating(ctx, "Test Max"); rating.Stars != 20 {
+			t.Errorf("rejected update must not change the rating, got %d", rating.Stars)
+		}
+	})
+
+	t.Run("Outbox", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		if _, err := s.UpdateRating(ctx, "Test Max", 35, etag.Any); err != nil {
+			t.Fatal(err)
+		}
+		s.UpdateRating(ctx, "Test Max", 101, etag.Any)
+		s.UpdateRating(ctx, "Unknown", 10, etag.Any)
+
+		events, err := s.Outbox().Pending(ctx, 10)
+		if err != nil || len(events) != 1 {
+			t.Fatalf("expected one event, got %+v (%v)", events, err)
+		}
+
+		var changed storage.RatingEvent
+		if err = events[0].Decode(&changed); err != nil || events[0].Type != storage.RatingChanged ||
+			changed != (storage.RatingEvent{Username: "Test Max", Stars: 35, PreviousStars: 20}) {
+			t.Errorf("unexpected event %+v %+v (%v)", events[0], changed, err)
+		}
+	})
+
+	t.Run("ApplyChange", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		change := storage.Change{ReservationUid: "3c4d5e6f-0000-4000-8000-000000000001", Username: "Test Max", Delta: -10}
+
+		rating, applied, err := s.ApplyChange(ctx, change)
+		if err != nil || !applied || rating.Stars != 10 {
+			t.Fatalf("expected the change to be applied, got %+v %t (%v)", rating, applied, err)
+		}
+
+		// a retried change is not applied again
+		rating, applied, err = s.ApplyChange(ctx, change)
+		if err != nil || applied || rating.Stars != 10 {
+			t.Errorf("expected the change to be applied once, got %+v %t (%v)", rating, applied, err)
+		}
+
+		change.Delta = 1
+		_, _, err = s.ApplyChange(ctx, change)
+		if apierror.From(err).Code != apierror.CodeConflict {
+			t.Errorf("expected CONFLICT for another change of the same reservation, got %v", err)
+		}
+
+		// ratings stay between MinStars and MaxStars
+		rating, _, _ = s.ApplyChange(ctx, storage.Change{ReservationUid: "3c4d5e6f-0000-4000-8000-000000000002", Username: "Test Max", Delta: -100})
+		if rating.Stars != storage.MinStars {
+			t.Errorf("expected %d stars, got %d", storage.MinStars, rating.Stars)
+		}
+		rating, _, _ = s.ApplyChange(ctx, storage.Change{ReservationUid: "3c4d5e6f-0000-4000-8000-000000000003", Username: "Test Min", Delta: 150})
+		if rating.Stars != storage.MaxStars {
+			t.Errorf("expected %d stars, got %d", storage.MaxStars, rating.Stars)
+		}
+
+		_, _, err = s.ApplyChange(ctx, storage.Change{ReservationUid: "3c4d5e6f-0000-4000-8000-000000000004", Username: "Unknown", Delta: 1})
+		if apierror.From(err).Code != apierror.CodeNotFound {
+			t.Errorf("expected NOT_FOUND for an unknown reader, got %v", err)
+		}
+
+		_, _, err = s.ApplyChange(ctx, storage.Change{ReservationUid: "not-a-uid", Username: "Test Max", Delta: 1})
+		if apierror.From(err).Code != apierror.CodeValidation {
+			t.Errorf("expected VALIDATION_FAILED for an invalid reservation uid, got %v", err)
+		}
+
+		events, _ := s.Outbox().Pending(ctx, 10)
+		if len(events) != 3 {
+			t.Errorf("expected an event for each applied change, got %+v", events)
+		}
+	})
+
+	t.Run("GetChange", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		change := storage.Change{ReservationUid: "3c4d5e6f-0000-4000-8000-000000000001", Username: "Test Max", Delta: -10}
+		if _, _, err := s.ApplyChange(ctx, change); err != nil {
+			t.Fatal(err)
+		}
+
+		if applied, err := s.GetChange(ctx, change.ReservationUid); err != nil || applied != change {
+			t.Errorf("expected %+v, got %+v (%v)", change, applied, err)
+		}
+
+		_, err := s.GetChange(ctx, "3c4d5e6f-0000-4000-8000-000000000002")
+		if apierror.From(err).Code != apierror.CodeNotFound {
+			t.Errorf("expected NOT_FOUND for a reservation without a change, got %v", err)
+		}
+
+		// a change refused for an unknown reader is not kept
+		s.ApplyChange(ctx, storage.Change{ReservationUid: "3c4d5e6f-0000-4000-8000-000000000003", Username: "Unknown", Delta: 1})
+		_, err = s.GetChange(ctx, "3c4d5e6f-0000-4000-8000-000000000003")
+		if apierror.From(err).Code != apierror.CodeNotFound {
+			t.Errorf("expected NOT_FOUND for a refused change, got %v", err)
+		}
+	})
+
+	t.Run("ApplyChangeConcurrently", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		var wg sync.WaitGroup
+		for i := 1; i <= 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				change := storage.Change{ReservationUid: fmt.Sprintf("3c4d5e6f-0000-4000-8000-%012d", i), Username: "Test Max", Delta: 1}
+				if _, _, err := s.ApplyChange(ctx, change); err != nil {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if rating, _ := s.GetRating(ctx, "Test Max"); rating.Stars != 30 {
+			t.Errorf("expected every change to be applied, got %d stars", rating.Stars)
+		}
+	})
+
+	t.Run("Audit", func(t *testing.T) {
+		s := newStorage(t, fixture)
+		ctx := audit.WithActor(ctx, "admin")
+
+		if _, err := s.UpdateRating(ctx, "Test Max", 50, etag.Any); err != nil {
+			t.Fatal(err)
+		}
+		change := storage.Change{ReservationUid: "3c4d5e6f-0000-4000-8000-000000000001", Username: "Test Max", Delta: -10}
+		if _, _, err := s.ApplyChange(ctx, change); err != nil {
+			t.Fatal(err)
+		}
+
+		// replays and failed changes are not recorded
+		s.ApplyChange(ctx, change)
+		s.UpdateRating(ctx, "Test Max", 101, etag.Any)
+
+		entries, err := s.Audit().Query(ctx, audit.Filter{EntityUid: "Test Max", Limit: 10})
+		if err != nil || len(entries) != 2 {
+			t.Fatalf("expected 2 entries, got %+v (%v)", entries, err)
+		}
+
+		var before, after struct {
+			Stars          int
+			Delta          int
+			ReservationUid string
+		}
+		json.Unmarshal(entries[0].Before, &before)
+		json.Unmarshal(entries[0].After, &after)
+		if entries[0].Action != storage.AuditRatingChanged || entries[0].Actor != "admin" ||
+			before.Stars != 50 || after.Stars != 40 || after.Delta != -10 || after.ReservationUid != change.ReservationUid {
+			t.Errorf("unexpected entry %+v", entries[0])
+		}
+
+		json.Unmarshal(entries[1].Before, &before)
+		json.Unmarshal(entries[1].After, &after)
+		if entries[1].Action != storage.AuditRatingUpdated || entries[1].EntityType != "rating" || before.Stars != 20 || after.Stars != 50 {
+			t.Errorf("unexpected entry %+v", entries[1])
+		}
+	})
+}
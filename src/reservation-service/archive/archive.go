@@ -0,0 +1,130 @@
+// Package archive keeps the reservation table small. Closed reservations are
+// moved to the archive once they are older than the configured age and are
+// purged from it once their retention has passed.
+package archive
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"library-system/src/reservation-service/storage"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	archivedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reservations_archived_total",
+		Help: "Closed reservations moved to the archive.",
+	})
+	purgedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reservations_purged_total",
+		Help: "Archived reservations deleted once their retention passed.",
+	})
+)
+
+// Policy says how long closed reservations are kept. Both ages count from
+// when the reservation was closed.
+type Policy struct {
+	// After is the age at which closed reservations are archived.
+	After time.Duration
+	// Retention is the age at which archived reservations are purged, 0 to
+	// keep them forever.
+	Retention time.Duration
+}
+
+const day = 24 * time.Hour
+
+// PolicyFromEnv reads the policy from ARCHIVE_AFTER_DAYS, 365 by default, and
+// ARCHIVE_RETENTION_DAYS, 0 by default.
+func PolicyFromEnv() (Policy, error) {
+	afterDays, err := strconv.Atoi(os.Getenv("ARCHIVE_AFTER_DAYS"))
+	if err != nil {
+		afterDays = 365
+	}
+
+	retentionDays, err := strconv.Atoi(os.Getenv("ARCHIVE_RETENTION_DAYS"))
+	if err != nil {
+		retentionDays = 0
+	}
+
+	policy := Policy{After: time.Duration(afterDays) * day, Retention: time.Duration(retentionDays) * day}
+	return policy, policy.Validate()
+}
+
+func (p Policy) Validate() error {
+	if p.After <= 0 {
+		return errors.New("reservations must be closed for a while before they are archived")
+	}
+	if p.Retention < 0 || p.Retention > 0 && p.Retention <= p.After {
+		return errors.New("the retention of archived reservations must be longer than their age when archived")
+	}
+	return nil
+}
+
+type Archiver struct {
+	storage storage.Storage
+	policy  Policy
+	batch   int
+}
+
+func New(storage storage.Storage, policy Policy) *Archiver {
+	return &Archiver{storage: storage, policy: policy, batch: 500}
+}
+
+// Archive moves the reservations due for the archive at now to it, purges
+// the archived reservations past their retention and returns how many
+// reservations it archived and purged. It works in batches, so that a
+// failure keeps the progress made before it.
+func (a *Archiver) Archive(ctx context.Context, now time.Time) (archived int, purged int, err error) {
+	archived, err = a.drain(ctx, now.Add(-a.policy.After), a.storage.ArchiveReservations)
+	archivedTotal.Add(float64(archived))
+	if err != nil || a.policy.Retention == 0 {
+		return archived, 0, err
+	}
+
+	purged, err = a.drain(ctx, now.Add(-a.policy.Retention), a.storage.PurgeArchive)
+	purgedTotal.Add(float64(purged))
+	return archived, purged, err
+}
+
+// drain calls step with batches until it runs out of reservations closed
+// before closedBefore.
+func (a *Archiver) drain(ctx context.Context, closedBefore time.Time, step func(context.Context, time.Time, int) (int, error)) (int, error) {
+	total := 0
+
+	for {
+		n, err := step(ctx, closedBefore, a.batch)
+		total += n
+		if err != nil || n < a.batch {
+			return total, err
+		}
+	}
+}
+
+// Run archives immediately and then on every tick until ctx is cancelled.
+func (a *Archiver) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		archived, purged, err := a.Archive(ctx, time.Now().UTC())
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "failed to archive reservations", "error", err)
+		}
+		if archived > 0 || purged > 0 {
+			slog.InfoContext(ctx, "archived reservations", "archived", archived, "purged", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
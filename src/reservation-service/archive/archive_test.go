@@ -0,0 +1,78 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"library-system/src/reservation-service/storage"
+)
+
+func TestArchive(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 10, 11, 15, 30, 0, 0, time.UTC)
+
+	memory := storage.NewMemory()
+	for i, daysAgo := range []int{200, 100, 45, 20} {
+		closedAt := now.AddDate(0, 0, -daysAgo)
+		memory.AddReservation(storage.Reservation{
+			Reservation_uid: fmt.Sprintf("3c4d5e6f-0000-4000-8000-%012d", i+1),
+			Username:        "Test Max",
+			Status:          "RETURNED",
+			Start_date:      closedAt.AddDate(0, 0, -7),
+			Till_date:       closedAt,
+			Closed_at:       &closedAt,
+		})
+	}
+	memory.AddReservation(storage.Reservation{
+		Reservation_uid: "3c4d5e6f-0000-4000-8000-000000000005",
+		Username:        "Test Max",
+		Status:          "RENTED",
+		Start_date:      now.AddDate(0, 0, -300),
+		Till_date:       now.AddDate(0, 0, -290),
+	})
+
+	archiver := New(memory, Policy{After: 30 * day, Retention: 150 * day})
+	archiver.batch = 2
+
+	archived, purged, err := archiver.Archive(ctx, now)
+	if err != nil || archived != 3 || purged != 1 {
+		t.Fatalf("expected 3 archived and 1 purged, got %d and %d (%v)", archived, purged, err)
+	}
+
+	reservations, total, _ := memory.GetArchivedReservations(ctx, "Test Max", storage.HistoryFilter{Limit: 10})
+	if total != 2 || reservations[0].ID != 2 || reservations[1].ID != 3 {
+		t.Errorf("expected the reservations closed 100 and 45 days ago in the archive, got %+v", reservations)
+	}
+
+	reservations, total, _ = memory.GetReservationHistory(ctx, "Test Max", storage.HistoryFilter{Limit: 10})
+	if total != 2 || reservations[0].ID != 5 || reservations[1].ID != 4 {
+		t.Errorf("expected the rented and the recently closed reservation to stay, got %+v", reservations)
+	}
+
+	// archived reservations are kept forever without retention
+	archiver = New(memory, Policy{After: 10 * day})
+	if archived, purged, err = archiver.Archive(ctx, now.AddDate(1, 0, 0)); err != nil || archived != 1 || purged != 0 {
+		t.Errorf("expected 1 archived and none purged, got %d and %d (%v)", archived, purged, err)
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		policy Policy
+		valid  bool
+	}{
+		{Policy{After: 30 * day}, true},
+		{Policy{After: 30 * day, Retention: 365 * day}, true},
+		{Policy{}, false},
+		{Policy{After: 30 * day, Retention: 30 * day}, false},
+		{Policy{After: 30 * day, Retention: -day}, false},
+	}
+
+	for _, tt := range tests {
+		if err := tt.policy.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%+v: expected valid %v, got %v", tt.policy, tt.valid, err)
+		}
+	}
+}
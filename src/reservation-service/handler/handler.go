@@ -2,19 +2,43 @@ package handler
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"library-system/src/pkg/apierror"
+	"library-system/src/pkg/etag"
 	"library-system/src/reservation-service/storage"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-type ErrorResponse struct {
-	Message string `json:"message"`
-}
+var (
+	reservationsCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reservations_created_total",
+		Help: "Reservations created.",
+	})
+
+	reservationsReturned = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reservations_returned_total",
+		Help: "Books returned, on time or overdue.",
+	})
+
+	reservationsReturnedOverdue = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reservations_returned_overdue_total",
+		Help: "Books returned after the till date.",
+	})
+)
 
 type MessageResponse struct {
 	Message string `json:"message"`
@@ -43,6 +67,35 @@ type ReservationResponse struct {
 	Status          string `json:"status"`
 	Start_date      string `json:"startDate"`
 	Till_date       string `json:"tillDate"`
+	Version         int    `json:"version"`
+}
+
+type ReservationHistoryResponse struct {
+	Page          int                   `json:"page"`
+	PageSize      int                   `json:"pageSize"`
+	TotalElements int                   `json:"totalElements"`
+	Items         []ReservationResponse `json:"items"`
+	NextCursor    string                `json:"nextCursor,omitempty"`
+}
+
+// historyCursor points at the last reservation of a history page. Query
+// identifies the order and filters of the page, see historyQuery.
+type historyCursor struct {
+	Page      int       `json:"p"`
+	StartDate time.Time `json:"d"`
+	Id        int       `json:"i"`
+	Query     string    `json:"q"`
+}
+
+const (
+	defaultHistorySize = 25
+	maxHistorySize     = 100
+)
+
+var reservationStatuses = map[string]bool{
+	"RENTED":   true,
+	"RETURNED": true,
+	"EXPIRED":  true,
 }
 
 func NewHandler(storage storage.Storage) *Handler {
@@ -54,37 +107,210 @@ func (h *Handler) GetReservations(c *gin.Context) {
 	username := c.GetHeader("X-User-Name")
 
 	if username == "" {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: "username must be given as X-User-Name Header",
-		})
+		apierror.Respond(c, apierror.BadRequest("username must be given as X-User-Name Header"))
 		return
 	}
 
-	reservations, err := h.storage.GetReservations(context.Background(), username)
+	reservations, err := h.storage.GetReservations(c.Request.Context(), username)
 
 	if err != nil {
-		fmt.Printf("failed to get reservations %s\n", err.Error())
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		slog.ErrorContext(c.Request.Context(), "failed to get reservations", "error", err)
+		apierror.Respond(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, ReservationsToResponse(reservations))
 }
 
-func (h *Handler) GetReservationByUid(c *gin.Context) {
+func (h *Handler) GetReservationHistory(c *gin.Context) {
+	h.history(c, h.storage.GetReservationHistory)
+}
+
+// GetArchivedReservations pages through the archived reservations of the
+// reader like GetReservationHistory does through the others.
+func (h *Handler) GetArchivedReservations(c *gin.Context) {
+	h.history(c, h.storage.GetArchivedReservations)
+}
+
+// history serves a page of the reservations get returns for the reader and
+// the query parameters.
+func (h *Handler) history(c *gin.Context, get func(ctx context.Context, username string, filter storage.HistoryFilter) ([]storage.Reservation, int, error)) {
+
+	username := c.GetHeader("X-User-Name")
+
+	if username == "" {
+		apierror.Respond(c, apierror.BadRequest("username must be given as X-User-Name Header"))
+		return
+	}
+
+	filter, err := historyFilterFromQuery(c)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
+	cursor := historyCursor{}
+	if c.Query("cursor") != "" {
+		cursor, err = decodeHistoryCursor(c.Query("cursor"))
+		if err != nil {
+			apierror.Respond(c, apierror.BadRequest("invalid cursor"))
+			return
+		}
+		if cursor.Query != historyQuery(filter) {
+			apierror.Respond(c, apierror.BadRequest("cursor was issued for another order or other filters"))
+			return
+		}
+		filter.AfterDate = cursor.StartDate
+		filter.AfterId = cursor.Id
+	}
 
-	reservation, err := h.storage.GetReservationByUid(context.Background(), c.Param("uid"))
+	size := filter.Limit
+	filter.Limit = size + 1
+
+	page := cursor.Page + 1
+	if c.Query("page") != "" {
+		page, err = strconv.Atoi(c.Query("page"))
+		if err != nil || page < 1 {
+			apierror.Respond(c, apierror.Validation("page must be a positive number"))
+			return
+		}
+		if c.Query("cursor") != "" {
+			apierror.Respond(c, apierror.Validation("page can not be combined with cursor"))
+			return
+		}
+		filter.Offset = (page - 1) * size
+	}
+
+	reservations, total, err := get(c.Request.Context(), username, filter)
 
 	if err != nil {
-		fmt.Printf("failed to get reservation %s\n", err.Error())
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
+		slog.ErrorContext(c.Request.Context(), "failed to get reservation history", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	response := ReservationHistoryResponse{
+		Page:          page,
+		PageSize:      size,
+		TotalElements: total,
+	}
+
+	if len(reservations) > size {
+		reservations = reservations[:size]
+		last := reservations[size-1]
+		response.NextCursor = encodeHistoryCursor(historyCursor{
+			Page:      response.Page,
+			StartDate: last.Start_date,
+			Id:        last.ID,
+			Query:     historyQuery(filter),
 		})
+	}
+
+	response.Items = ReservationsToResponse(reservations)
+	if response.Items == nil {
+		response.Items = make([]ReservationResponse, 0)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func historyFilterFromQuery(c *gin.Context) (storage.HistoryFilter, error) {
+	filter := storage.HistoryFilter{
+		LibraryUid: c.Query("libraryUid"),
+		BookUid:    c.Query("bookUid"),
+		Desc:       true,
+		Limit:      defaultHistorySize,
+	}
+
+	if c.Query("status") != "" {
+		for _, status := range strings.Split(c.Query("status"), ",") {
+			if !reservationStatuses[status] {
+				return filter, apierror.Validation("unknown status %s", status)
+			}
+			filter.Statuses = append(filter.Statuses, status)
+		}
+	}
+
+	if c.Query("from") != "" {
+		from, err := time.Parse("2006-01-02", c.Query("from"))
+		if err != nil {
+			return filter, apierror.Validation("from must be a date in YYYY-MM-DD format")
+		}
+		filter.From = from
+	}
+
+	if c.Query("to") != "" {
+		to, err := time.Parse("2006-01-02", c.Query("to"))
+		if err != nil {
+			return filter, apierror.Validation("to must be a date in YYYY-MM-DD format")
+		}
+		filter.To = to.AddDate(0, 0, 1)
+	}
+
+	switch c.Query("order") {
+	case "", "desc":
+	case "asc":
+		filter.Desc = false
+	default:
+		return filter, apierror.Validation("order must be asc or desc")
+	}
+
+	if c.Query("size") != "" {
+		size, err := strconv.Atoi(c.Query("size"))
+		if err != nil || size < 1 || size > maxHistorySize {
+			return filter, apierror.Validation("size must be between 1 and %d", maxHistorySize)
+		}
+		filter.Limit = size
+	}
+
+	return filter, nil
+}
+
+// historyQuery identifies the order and filters of filter. Keyset pages only
+// follow each other for the same query, so a cursor must not be reused with
+// another one.
+func historyQuery(filter storage.HistoryFilter) string {
+	statuses := append([]string{}, filter.Statuses...)
+	sort.Strings(statuses)
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%v|%s|%s|%s|%s|%t", statuses, filter.LibraryUid, filter.BookUid,
+		filter.From.Format(time.RFC3339), filter.To.Format(time.RFC3339), filter.Desc)
+
+	return hex.EncodeToString(hash.Sum(nil)[:8])
+}
+
+func encodeHistoryCursor(cursor historyCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeHistoryCursor(value string) (historyCursor, error) {
+	var cursor historyCursor
+
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, err
+	}
+
+	if err = json.Unmarshal(data, &cursor); err != nil {
+		return cursor, err
+	}
+
+	return cursor, nil
+}
+
+func (h *Handler) GetReservationByUid(c *gin.Context) {
+
+	reservation, err := h.storage.GetReservationByUid(c.Request.Context(), c.Param("uid"))
+
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to get reservation", "error", err)
+		apierror.Respond(c, err)
 		return
 	}
 
+	etag.Set(c, reservation.Version)
 	c.JSON(http.StatusOK, ReservationToResponse(reservation))
 }
 
@@ -93,33 +319,51 @@ func (h *Handler) GetRentedReservationAmount(c *gin.Context) {
 	username := c.GetHeader("X-User-Name")
 
 	if username == "" {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: "username must be given as X-User-Name Header",
-		})
+		apierror.Respond(c, apierror.BadRequest("username must be given as X-User-Name Header"))
 		return
 	}
 
-	reservationAmount, err := h.storage.GetRentedReservationAmount(context.Background(), username)
+	reservationAmount, err := h.storage.GetRentedReservationAmount(c.Request.Context(), username)
 
 	if err != nil {
-		fmt.Printf("failed to get reservation amount %s\n", err.Error())
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		slog.ErrorContext(c.Request.Context(), "failed to get reservation amount", "error", err)
+		apierror.Respond(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, reservationAmount)
 }
 
+func (h *Handler) GetDueReservations(c *gin.Context) {
+
+	until, err := time.Parse("2006-01-02", c.Query("until"))
+	if err != nil {
+		apierror.Respond(c, apierror.Validation("until must be a date in YYYY-MM-DD format"))
+		return
+	}
+
+	reservations, err := h.storage.GetDueReservations(c.Request.Context(), until)
+
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "failed to get due reservations", "error", err)
+		apierror.Respond(c, err)
+		return
+	}
+
+	response := ReservationsToResponse(reservations)
+	if response == nil {
+		response = make([]ReservationResponse, 0)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
 func (h *Handler) CreateReservation(c *gin.Context) {
 
 	username := c.GetHeader("X-User-Name")
 
 	if username == "" {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: "username must be given as X-User-Name Header",
-		})
+		apierror.Respond(c, apierror.BadRequest("username must be given as X-User-Name Header"))
 		return
 	}
 
@@ -127,35 +371,38 @@ func (h *Handler) CreateReservation(c *gin.Context) {
 
 	err := json.NewDecoder(c.Request.Body).Decode(&reqCrRes)
 	if err != nil {
-		fmt.Printf("failed to decode body %s\n", err.Error())
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		slog.ErrorContext(c.Request.Context(), "failed to decode body", "error", err)
+		apierror.Respond(c, apierror.BadRequest("invalid request body: %s", err.Error()))
 		return
 	}
 
-	reservation, err := h.storage.CreateReservation(context.Background(), username, reqCrRes.BookUid, reqCrRes.LibraryUid, reqCrRes.TillDate)
+	reservation, err := h.storage.CreateReservation(c.Request.Context(), username, reqCrRes.BookUid, reqCrRes.LibraryUid, reqCrRes.TillDate)
 
 	if err != nil {
-		fmt.Printf("failed to create reservations %s\n", err.Error())
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		slog.ErrorContext(c.Request.Context(), "failed to create reservations", "error", err)
+		apierror.Respond(c, err)
 		return
 	}
 
+	reservationsCreated.Inc()
+
+	etag.Set(c, reservation.Version)
 	c.JSON(http.StatusOK, ReservationToResponse(reservation))
 }
 
 func (h *Handler) UpdateReservationStatus(c *gin.Context) {
 
-	reservation, err := h.storage.GetReservationByUid(context.Background(), c.Param("uid"))
+	version, err := etag.IfMatch(c)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
+	}
+
+	reservation, err := h.storage.GetReservationByUid(c.Request.Context(), c.Param("uid"))
 
 	if err != nil {
-		fmt.Printf("failed to get libraries %s\n", err.Error())
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		slog.ErrorContext(c.Request.Context(), "failed to get libraries", "error", err)
+		apierror.Respond(c, err)
 		return
 	}
 
@@ -163,18 +410,14 @@ func (h *Handler) UpdateReservationStatus(c *gin.Context) {
 
 	err = json.NewDecoder(c.Request.Body).Decode(&reqUpdRes)
 	if err != nil {
-		fmt.Printf("failed to decode body %s\n", err.Error())
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		slog.ErrorContext(c.Request.Context(), "failed to decode body", "error", err)
+		apierror.Respond(c, apierror.BadRequest("invalid request body: %s", err.Error()))
 		return
 	}
 
 	date, err := time.Parse("2006-01-02", reqUpdRes.Date)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		apierror.Respond(c, apierror.Validation("date must be a date in YYYY-MM-DD format"))
 		return
 	}
 	status := "RETURNED"
@@ -182,17 +425,21 @@ func (h *Handler) UpdateReservationStatus(c *gin.Context) {
 		status = "EXPIRED"
 	}
 
-	err = h.storage.UpdateReservationStatus(context.Background(), c.Param("uid"), status)
+	version, err = h.storage.UpdateReservationStatus(c.Request.Context(), c.Param("uid"), status, version)
 
 	if err != nil {
-		fmt.Printf("failed to update reservation %s\n", err.Error())
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Message: err.Error(),
-		})
+		slog.ErrorContext(c.Request.Context(), "failed to update reservation", "error", err)
+		apierror.Respond(c, err)
 		return
 	}
 
+	etag.Set(c, version)
+
+	reservationsReturned.Inc()
+
 	if status == "EXPIRED" {
+		reservationsReturnedOverdue.Inc()
+
 		c.JSON(http.StatusNoContent, MessageResponse{
 			Message: "status updated",
 		})
@@ -213,6 +460,7 @@ func ReservationToResponse(reservation storage.Reservation) ReservationResponse
 		Status:          reservation.Status,
 		Start_date:      reservation.Start_date.Format("2006-01-02"),
 		Till_date:       reservation.Till_date.Format("2006-01-02"),
+		Version:         reservation.Version,
 	}
 }
 
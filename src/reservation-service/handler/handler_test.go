@@ -1,40 +1,331 @@
 package handler
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"library-system/src/reservation-service/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	libraryUid = "83575e12-7ce0-48ee-9931-51919ff3c9ee"
+	bookUid    = "f7cdc58f-2caf-4b15-9727-f89dcc629b27"
+	rentedUid  = "3c4d5e6f-0000-4000-8000-000000000001"
+	returnUid  = "3c4d5e6f-0000-4000-8000-000000000002"
+	unknownUid = "00000000-0000-4000-8000-000000000000"
+	rentedJSON = `{"reservationUid":"3c4d5e6f-0000-4000-8000-000000000001","username":"Test Max","bookUid":"f7cdc58f-2caf-4b15-9727-f89dcc629b27","libraryUid":"83575e12-7ce0-48ee-9931-51919ff3c9ee","status":"RENTED","startDate":"2021-10-09","tillDate":"2021-10-20","version":1}`
 )
 
+type testCase struct {
+	name     string
+	method   string
+	path     string
+	username string
+	body     string
+	status   int
+	// response is the expected body, or a part of it
+	response string
+}
+
+func newTestRouter() (*gin.Engine, storage.Storage) {
+	gin.SetMode(gin.TestMode)
+
+	returnedAt := time.Date(2021, 10, 5, 0, 0, 0, 0, time.UTC)
+
+	memory := storage.NewMemory()
+	memory.AddReservation(storage.Reservation{
+		Reservation_uid: rentedUid, Username: "Test Max", Book_uid: bookUid, Library_uid: libraryUid, Status: "RENTED",
+		Start_date: time.Date(2021, 10, 9, 0, 0, 0, 0, time.UTC), Till_date: time.Date(2021, 10, 20, 0, 0, 0, 0, time.UTC),
+	})
+	memory.AddReservation(storage.Reservation{
+		Reservation_uid: returnUid, Username: "Test Max", Book_uid: bookUid, Library_uid: libraryUid, Status: "RETURNED",
+		Start_date: time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC), Till_date: time.Date(2021, 10, 5, 0, 0, 0, 0, time.UTC), Closed_at: &returnedAt,
+	})
+
+	handler := NewHandler(memory)
+
+	router := gin.New()
+	handler.Register(router)
+
+	return router, memory
+}
+
+func serve(router *gin.Engine, method, path, username, body string) *httptest.ResponseRecorder {
+	return serveWithHeader(router, method, path, username, nil, body)
+}
+
+func serveWithHeader(router *gin.Engine, method, path, username string, header http.Header, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if username != "" {
+		req.Header.Set("X-User-Name", username)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// ifMatch is the header of updates based on the version of a fresh record.
+var ifMatch = http.Header{"If-Match": {`"1"`}}
+
+func run(t *testing.T, tests []testCase) {
+	t.Helper()
+
+	runWithHeader(t, nil, tests)
+}
+
+func runWithHeader(t *testing.T, header http.Header, tests []testCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router, _ := newTestRouter()
+
+			recorder := serveWithHeader(router, tt.method, tt.path, tt.username, header, tt.body)
+
+			if recorder.Code != tt.status || !strings.Contains(recorder.Body.String(), tt.response) {
+				t.Errorf("expected %d %s, got %d %s", tt.status, tt.response, recorder.Code, recorder.Body.String())
+			}
+		})
+	}
+}
+
 func TestGetReservations(t *testing.T) {
+	run(t, []testCase{
+		{"reader with reservations", http.MethodGet, "/api/v1/reservations", "Test Max", "", http.StatusOK, "[" + rentedJSON + ","},
+		{"reader without reservations", http.MethodGet, "/api/v1/reservations", "Test Min", "", http.StatusOK, "[]"},
+		{"missing username", http.MethodGet, "/api/v1/reservations", "", "", http.StatusBadRequest, `"code":"BAD_REQUEST"`},
+	})
+}
+
+func TestGetReservationHistory(t *testing.T) {
+	run(t, []testCase{
+		{"newest first", http.MethodGet, "/api/v1/reservations/history", "Test Max", "", http.StatusOK,
+			`{"page":1,"pageSize":25,"totalElements":2,"items":[` + rentedJSON + `,`},
+		{"filtered", http.MethodGet, "/api/v1/reservations/history?status=RETURNED", "Test Max", "", http.StatusOK, `"totalElements":1,"items":[{"reservationUid":"` + returnUid},
+		{"first page", http.MethodGet, "/api/v1/reservations/history?size=1", "Test Max", "", http.StatusOK, `"nextCursor":"`},
+		{"invalid filter", http.MethodGet, "/api/v1/reservations/history?status=LOST", "Test Max", "", http.StatusUnprocessableEntity, "unknown status LOST"},
+		{"invalid cursor", http.MethodGet, "/api/v1/reservations/history?cursor=abc", "Test Max", "", http.StatusBadRequest, "invalid cursor"},
+		{"page", http.MethodGet, "/api/v1/reservations/history?page=2&size=1", "Test Max", "", http.StatusOK,
+			`{"page":2,"pageSize":1,"totalElements":2,"items":[{"reservationUid":"` + returnUid},
+		{"page past the end", http.MethodGet, "/api/v1/reservations/history?page=3&size=1", "Test Max", "", http.StatusOK, `"page":3,"pageSize":1,"totalElements":2,"items":[]`},
+		{"invalid page", http.MethodGet, "/api/v1/reservations/history?page=0", "Test Max", "", http.StatusUnprocessableEntity, "page must be a positive number"},
+		{"missing username", http.MethodGet, "/api/v1/reservations/history", "", "", http.StatusBadRequest, `"code":"BAD_REQUEST"`},
+	})
+}
 
-	if 2+2 != 4 {
-		t.Errorf("Unexpected situation")
+func TestGetReservationHistoryPages(t *testing.T) {
+	router, _ := newTestRouter()
+
+	var page ReservationHistoryResponse
+	json.Unmarshal(serve(router, http.MethodGet, "/api/v1/reservations/history?size=1", "Test Max", "").Body.Bytes(), &page)
+	if len(page.Items) != 1 || page.Items[0].Reservation_uid != rentedUid || page.NextCursor == "" {
+		t.Fatalf("unexpected first page %+v", page)
+	}
+
+	cursor := page.NextCursor
+	page = ReservationHistoryResponse{}
+	json.Unmarshal(serve(router, http.MethodGet, "/api/v1/reservations/history?size=1&cursor="+cursor, "Test Max", "").Body.Bytes(), &page)
+	if page.Page != 2 || len(page.Items) != 1 || page.Items[0].Reservation_uid != returnUid || page.NextCursor != "" {
+		t.Errorf("unexpected last page %+v", page)
 	}
 }
 
-func TestGetReservationByUid(t *testing.T) {
+func TestHistoryCursorIsBoundToItsQuery(t *testing.T) {
+	router, _ := newTestRouter()
+
+	var page ReservationHistoryResponse
+	json.Unmarshal(serve(router, http.MethodGet, "/api/v1/reservations/history?size=1&status=RENTED,RETURNED", "Test Max", "").Body.Bytes(), &page)
+	if page.NextCursor == "" {
+		t.Fatalf("expected a next page, got %+v", page)
+	}
+
+	for _, query := range []string{"order=asc&status=RENTED,RETURNED", "status=RETURNED", "status=RENTED,RETURNED&libraryUid=" + libraryUid} {
+		recorder := serve(router, http.MethodGet, "/api/v1/reservations/history?size=1&cursor="+page.NextCursor+"&"+query, "Test Max", "")
+		if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "cursor was issued for another order or other filters") {
+			t.Errorf("%s: expected the cursor to be refused, got %d %s", query, recorder.Code, recorder.Body.String())
+		}
+	}
 
-	if 2+2 != 4 {
-		t.Errorf("Unexpected situation")
+	// the same filters in another order are the same query, and the page size may change
+	recorder := serve(router, http.MethodGet, "/api/v1/reservations/history?size=5&status=RETURNED,RENTED&cursor="+page.NextCursor, "Test Max", "")
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"page":2`) {
+		t.Errorf("expected the next page, got %d %s", recorder.Code, recorder.Body.String())
 	}
 }
 
-func TestGetRentedReservationAmount(t *testing.T) {
+func TestGetArchivedReservations(t *testing.T) {
+	router, memory := newTestRouter()
+
+	if archived, err := memory.ArchiveReservations(context.Background(), time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC), 10); err != nil || archived != 1 {
+		t.Fatalf("expected the returned reservation to be archived, got %d (%v)", archived, err)
+	}
+
+	recorder := serve(router, http.MethodGet, "/api/v1/reservations/archive", "Test Max", "")
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"totalElements":1,"items":[{"reservationUid":"`+returnUid) {
+		t.Errorf("expected the archived reservation, got %d %s", recorder.Code, recorder.Body.String())
+	}
 
-	if 2+2 != 4 {
-		t.Errorf("Unexpected situation")
+	recorder = serve(router, http.MethodGet, "/api/v1/reservations/history", "Test Max", "")
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"totalElements":1,"items":[`+rentedJSON+`]`) {
+		t.Errorf("expected the archived reservation to leave the history, got %d %s", recorder.Code, recorder.Body.String())
 	}
+
+	run(t, []testCase{
+		{"nothing archived", http.MethodGet, "/api/v1/reservations/archive", "Test Max", "", http.StatusOK, `"totalElements":0,"items":[]`},
+		{"invalid filter", http.MethodGet, "/api/v1/reservations/archive?status=LOST", "Test Max", "", http.StatusUnprocessableEntity, "unknown status LOST"},
+		{"missing username", http.MethodGet, "/api/v1/reservations/archive", "", "", http.StatusBadRequest, `"code":"BAD_REQUEST"`},
+	})
+}
+
+func TestGetReservationByUid(t *testing.T) {
+	run(t, []testCase{
+		{"existing reservation", http.MethodGet, "/api/v1/reservations/info/" + rentedUid, "", "", http.StatusOK, rentedJSON},
+		{"unknown reservation", http.MethodGet, "/api/v1/reservations/info/" + unknownUid, "", "", http.StatusNotFound, `"code":"NOT_FOUND"`},
+		{"invalid uid", http.MethodGet, "/api/v1/reservations/info/abc", "", "", http.StatusUnprocessableEntity, `"code":"VALIDATION_FAILED"`},
+	})
+}
+
+func TestGetRentedReservationAmount(t *testing.T) {
+	run(t, []testCase{
+		{"reader with rented books", http.MethodGet, "/api/v1/reservations/amount", "Test Max", "", http.StatusOK, `{"amount":1}`},
+		{"reader without rented books", http.MethodGet, "/api/v1/reservations/amount", "Test Min", "", http.StatusOK, `{"amount":0}`},
+		{"missing username", http.MethodGet, "/api/v1/reservations/amount", "", "", http.StatusBadRequest, `"code":"BAD_REQUEST"`},
+	})
+}
+
+func TestGetDueReservations(t *testing.T) {
+	run(t, []testCase{
+		{"due reservations", http.MethodGet, "/api/v1/reservations/due?until=2021-10-20", "", "", http.StatusOK, "[" + rentedJSON + "]"},
+		{"nothing due", http.MethodGet, "/api/v1/reservations/due?until=2021-10-19", "", "", http.StatusOK, "[]"},
+		{"invalid date", http.MethodGet, "/api/v1/reservations/due?until=tomorrow", "", "", http.StatusUnprocessableEntity, "until must be a date"},
+	})
 }
 
 func TestCreateReservation(t *testing.T) {
+	run(t, []testCase{
+		{"valid reservation", http.MethodPost, "/api/v1/reservations", "Test Min",
+			`{"bookUid":"` + bookUid + `","libraryUid":"` + libraryUid + `","tillDate":"2021-10-20"}`, http.StatusOK, `"username":"Test Min"`},
+		{"invalid till date", http.MethodPost, "/api/v1/reservations", "Test Min",
+			`{"bookUid":"` + bookUid + `","libraryUid":"` + libraryUid + `","tillDate":"someday"}`, http.StatusUnprocessableEntity, `"code":"VALIDATION_FAILED"`},
+		{"malformed body", http.MethodPost, "/api/v1/reservations", "Test Min", `{`, http.StatusBadRequest, `"code":"BAD_REQUEST"`},
+		{"missing username", http.MethodPost, "/api/v1/reservations", "", `{}`, http.StatusBadRequest, `"code":"BAD_REQUEST"`},
+	})
+}
+
+func TestUpdateReservationStatus(t *testing.T) {
+	runWithHeader(t, ifMatch, []testCase{
+		{"returned in time", http.MethodPut, "/api/v1/reservations/" + rentedUid, "", `{"condition":"EXCELLENT","date":"2021-10-20"}`, http.StatusOK, "status updated"},
+		{"returned late", http.MethodPut, "/api/v1/reservations/" + rentedUid, "", `{"condition":"EXCELLENT","date":"2021-10-21"}`, http.StatusNoContent, ""},
+		{"invalid date", http.MethodPut, "/api/v1/reservations/" + rentedUid, "", `{"condition":"EXCELLENT","date":"21.10.2021"}`, http.StatusUnprocessableEntity, "date must be a date"},
+		{"unknown reservation", http.MethodPut, "/api/v1/reservations/" + unknownUid, "", `{"condition":"EXCELLENT","date":"2021-10-20"}`, http.StatusNotFound, `"code":"NOT_FOUND"`},
+	})
+	run(t, []testCase{
+		{"without If-Match", http.MethodPut, "/api/v1/reservations/" + rentedUid, "", `{"condition":"EXCELLENT","date":"2021-10-20"}`, http.StatusPreconditionRequired, `"code":"PRECONDITION_REQUIRED"`},
+	})
+	runWithHeader(t, http.Header{"If-Match": {`"2"`}}, []testCase{
+		{"of another version", http.MethodPut, "/api/v1/reservations/" + rentedUid, "", `{"condition":"EXCELLENT","date":"2021-10-20"}`, http.StatusPreconditionFailed, `"code":"PRECONDITION_FAILED"`},
+	})
+}
+
+func TestUpdateReservationStatusWithETag(t *testing.T) {
+	router, _ := newTestRouter()
+
+	recorder := serve(router, http.MethodGet, "/api/v1/reservations/info/"+rentedUid, "", "")
+	tag := recorder.Header().Get("ETag")
+	if tag != `"1"` {
+		t.Fatalf(`expected ETag "1", got %q`, tag)
+	}
+
+	recorder = serveWithHeader(router, http.MethodPut, "/api/v1/reservations/"+rentedUid, "", http.Header{"If-Match": {tag}}, `{"condition":"EXCELLENT","date":"2021-10-20"}`)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("ETag") != `"2"` {
+		t.Fatalf(`expected 200 with ETag "2", got %d %q %s`, recorder.Code, recorder.Header().Get("ETag"), recorder.Body.String())
+	}
 
-	if 2+2 != 4 {
-		t.Errorf("Unexpected situation")
+	// the reservation was returned by someone else in the meantime
+	recorder = serveWithHeader(router, http.MethodPut, "/api/v1/reservations/"+rentedUid, "", http.Header{"If-Match": {tag}}, `{"condition":"EXCELLENT","date":"2021-10-21"}`)
+	if recorder.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected 412, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	// the current version of a returned reservation can not be returned again
+	for _, tag := range []string{`"2"`, "*"} {
+		recorder = serveWithHeader(router, http.MethodPut, "/api/v1/reservations/"+rentedUid, "", http.Header{"If-Match": {tag}}, `{"condition":"EXCELLENT","date":"2021-10-21"}`)
+		if recorder.Code != http.StatusConflict {
+			t.Errorf("%s: expected 409, got %d %s", tag, recorder.Code, recorder.Body.String())
+		}
 	}
 }
 
-func TestUpdateReservationStatus(t *testing.T) {
+func TestUpdateReservationStatusStoresStatus(t *testing.T) {
+	router, memory := newTestRouter()
+
+	serveWithHeader(router, http.MethodPut, "/api/v1/reservations/"+rentedUid, "", ifMatch, `{"condition":"EXCELLENT","date":"2021-10-21"}`)
+
+	reservation, _ := memory.GetReservationByUid(context.Background(), rentedUid)
+	if reservation.Status != "EXPIRED" {
+		t.Errorf("expected a late return to expire the reservation, got %s", reservation.Status)
+	}
+}
+
+func TestHistoryFilterFromQuery(t *testing.T) {
+
+	tests := []struct {
+		query string
+		valid bool
+	}{
+		{"", true},
+		{"status=RENTED,EXPIRED&from=2021-10-01&to=2021-10-31&order=asc&size=10", true},
+		{"status=LOST", false},
+		{"from=01.10.2021", false},
+		{"order=random", false},
+		{"size=0", false},
+		{"size=101", false},
+	}
+
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/api/v1/reservations/history?"+tt.query, nil)
+
+		filter, err := historyFilterFromQuery(c)
+		if (err == nil) != tt.valid {
+			t.Errorf("query %q: unexpected error %v", tt.query, err)
+		}
+
+		if tt.valid && tt.query != "" {
+			if len(filter.Statuses) != 2 || filter.Desc || filter.Limit != 10 {
+				t.Errorf("query %q: unexpected filter %+v", tt.query, filter)
+			}
+			if !filter.To.Equal(time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC)) {
+				t.Errorf("query %q: to date must include the whole day, got %s", tt.query, filter.To)
+			}
+		}
+	}
+}
+
+func TestHistoryCursor(t *testing.T) {
+
+	cursor := historyCursor{Page: 3, StartDate: time.Date(2021, 10, 9, 0, 0, 0, 0, time.UTC), Id: 42}
+
+	decoded, err := decodeHistoryCursor(encodeHistoryCursor(cursor))
+	if err != nil {
+		t.Fatalf("failed to decode cursor: %v", err)
+	}
+
+	if decoded.Page != cursor.Page || !decoded.StartDate.Equal(cursor.StartDate) || decoded.Id != cursor.Id {
+		t.Errorf("cursor changed after round trip: %+v", decoded)
+	}
 
-	if 2+2 != 4 {
-		t.Errorf("Unexpected situation")
+	if _, err = decodeHistoryCursor("not a cursor"); err == nil {
+		t.Errorf("invalid cursor must not be decoded")
 	}
 }
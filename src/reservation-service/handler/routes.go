@@ -0,0 +1,23 @@
+package handler
+
+import (
+	"library-system/src/pkg/audit"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Register adds the routes of reservation-service to router. Probes and metrics are
+// registered by the caller.
+func (h *Handler) Register(router gin.IRoutes) {
+	router.GET("/api/v1/reservations", h.GetReservations)
+	router.GET("/api/v1/reservations/history", h.GetReservationHistory)
+	router.GET("/api/v1/reservations/archive", h.GetArchivedReservations)
+	router.GET("/api/v1/reservations/info/:uid", h.GetReservationByUid)
+	router.GET("/api/v1/reservations/amount", h.GetRentedReservationAmount)
+	router.GET("/api/v1/reservations/due", h.GetDueReservations)
+	router.POST("/api/v1/reservations", h.CreateReservation)
+	router.PUT("/api/v1/reservations/:uid", h.UpdateReservationStatus)
+	router.GET("/api/v1/audit", audit.Handler(h.storage.Audit(), "reservation-service"))
+
+	router.GET("/manage/health", h.GetHealth)
+}
@@ -3,8 +3,21 @@ package main
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"os"
+	"time"
 
+	"library-system/src/pkg/audit"
+	"library-system/src/pkg/health"
+	"library-system/src/pkg/logging"
+	"library-system/src/pkg/metrics"
+	"library-system/src/pkg/migrate"
+	"library-system/src/pkg/outbox"
+	"library-system/src/pkg/server"
+	"library-system/src/pkg/tracing"
+	"library-system/src/reservation-service/archive"
 	"library-system/src/reservation-service/handler"
+	"library-system/src/reservation-service/migrations"
 	"library-system/src/reservation-service/storage"
 
 	"github.com/gin-contrib/cors"
@@ -12,29 +25,93 @@ import (
 )
 
 func main() {
+	logging.Setup("reservation-service")
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "reservation-service")
+	if err != nil {
+		slog.Error("tracing init failed", "error", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
 	postgresURL := fmt.Sprintf("host=%s port=%d user=%s dbname=%s password=%s",
 		"postgres", 5432, "program", "reservations", "test")
 	psqlDB, err := storage.NewPgStorage(context.Background(), postgresURL)
 	if err != nil {
-		fmt.Printf("Postgresql init: %s", err)
-	} else {
-		fmt.Println("Connected to PostreSQL")
+		slog.Error("postgresql init failed", "error", err)
+		os.Exit(1)
 	}
 	defer psqlDB.Close()
 
+	if err = health.WaitFor(context.Background(), "postgres", psqlDB.Ping); err != nil {
+		slog.Error("postgresql init failed", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("connected to PostgreSQL")
+
+	migrator, err := migrate.New(psqlDB.Pool(), migrations.Schema, nil)
+	if err != nil {
+		slog.Error("migrations init failed", "error", err)
+		os.Exit(1)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err = migrator.Command(context.Background(), os.Args[2:], os.Stdout); err != nil {
+			slog.Error("migrate failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err = migrator.OnStart(context.Background()); err != nil {
+		slog.Error("migrations failed", "error", err)
+		os.Exit(1)
+	}
+
+	metrics.RegisterPool(psqlDB)
+
+	checker := health.New(2 * time.Second)
+	checker.Add("postgres", psqlDB.Ping)
+	checker.Add("migrations", migrator.Check)
+
 	handler := handler.NewHandler(psqlDB)
 
-	router := gin.Default()
+	router := gin.New()
+	router.Use(gin.Recovery(), tracing.Middleware("reservation-service"), logging.Middleware(), audit.Middleware(), metrics.Middleware())
 
 	router.Use(cors.Default())
 
-	router.GET("/api/v1/reservations", handler.GetReservations)
-	router.GET("/api/v1/reservations/info/:uid", handler.GetReservationByUid)
-	router.GET("/api/v1/reservations/amount", handler.GetRentedReservationAmount)
-	router.POST("/api/v1/reservations", handler.CreateReservation)
-	router.PUT("/api/v1/reservations/:uid", handler.UpdateReservationStatus)
+	handler.Register(router)
+
+	router.GET("/manage/live", checker.Live)
+	router.GET("/manage/ready", checker.Ready)
+	router.GET("/manage/metrics", metrics.Handler())
+
+	// publish the events of the outbox to the services listening on the
+	// reservation_events channel
+	outboxInterval, err := time.ParseDuration(os.Getenv("OUTBOX_INTERVAL"))
+	if err != nil {
+		outboxInterval = time.Second
+	}
+	relay := outbox.NewRelay(psqlDB.Outbox(), outbox.NewPgBroker(psqlDB.Pool(), "reservation_events"))
+
+	// move closed reservations to the archive and purge it as the policy says
+	archivePolicy, err := archive.PolicyFromEnv()
+	if err != nil {
+		slog.Error("invalid archive policy", "error", err)
+		os.Exit(1)
+	}
+	archiveInterval, err := time.ParseDuration(os.Getenv("ARCHIVE_INTERVAL"))
+	if err != nil {
+		archiveInterval = time.Hour
+	}
+	archiver := archive.New(psqlDB, archivePolicy)
 
-	router.GET("/manage/health", handler.GetHealth)
+	srv := server.New(server.ConfigFromEnv(":8070"), router, checker)
+	srv.Go(func(ctx context.Context) { relay.Run(ctx, outboxInterval) })
+	srv.Go(func(ctx context.Context) { archiver.Run(ctx, archiveInterval) })
 
-	router.Run(":8070")
+	if err = srv.Run(); err != nil {
+		slog.Error("server stopped with error", "error", err)
+	}
 }
@@ -0,0 +1,15 @@
+-- IF NOT EXISTS adopts databases created by the former init script
+CREATE TABLE IF NOT EXISTS reservation
+(
+    id              SERIAL PRIMARY KEY,
+    reservation_uid uuid UNIQUE NOT NULL,
+    username        VARCHAR(80) NOT NULL,
+    book_uid        uuid        NOT NULL,
+    library_uid     uuid        NOT NULL,
+    status          VARCHAR(20) NOT NULL
+        CHECK (status IN ('RENTED', 'RETURNED', 'EXPIRED')),
+    start_date      TIMESTAMP   NOT NULL,
+    till_date       TIMESTAMP   NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS reservation_history_idx ON reservation (username, start_date, id);
@@ -0,0 +1,2 @@
+DROP TABLE reservation_archive;
+ALTER TABLE reservation DROP COLUMN closed_at;
@@ -0,0 +1,29 @@
+-- when the reservation was returned or expired, NULL while it is rented
+ALTER TABLE reservation ADD COLUMN closed_at TIMESTAMP;
+
+-- reservations closed before there was closed_at are taken to have been
+-- closed on their till date
+UPDATE reservation SET closed_at = till_date WHERE status <> 'RENTED';
+
+CREATE INDEX reservation_closed_idx ON reservation (closed_at) WHERE closed_at IS NOT NULL;
+
+-- closed reservations moved out of reservation by the archiver, with their
+-- ids kept so that history cursors stay valid
+CREATE TABLE reservation_archive
+(
+    id              INT PRIMARY KEY,
+    reservation_uid uuid UNIQUE NOT NULL,
+    username        VARCHAR(80) NOT NULL,
+    book_uid        uuid        NOT NULL,
+    library_uid     uuid        NOT NULL,
+    status          VARCHAR(20) NOT NULL
+        CHECK (status IN ('RETURNED', 'EXPIRED')),
+    start_date      TIMESTAMP   NOT NULL,
+    till_date       TIMESTAMP   NOT NULL,
+    version         INT         NOT NULL CHECK (version > 0),
+    closed_at       TIMESTAMP   NOT NULL,
+    archived_at     TIMESTAMP   NOT NULL
+);
+
+CREATE INDEX reservation_archive_history_idx ON reservation_archive (username, start_date, id);
+CREATE INDEX reservation_archive_closed_idx ON reservation_archive (closed_at);
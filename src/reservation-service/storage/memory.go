@@ -0,0 +1,402 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"library-system/src/pkg/apierror"
+	"library-system/src/pkg/audit"
+	"library-system/src/pkg/etag"
+	"library-system/src/pkg/outbox"
+
+	"github.com/google/uuid"
+)
+
+var statuses = map[string]bool{"RENTED": true, "RETURNED": true, "EXPIRED": true}
+
+// memory is a Storage kept in memory with the semantics of postgres, for
+// tests and local development.
+type memory struct {
+	mu           sync.Mutex
+	reservations []Reservation
+	archive      []Reservation
+	lastID       int
+	outbox       outbox.MemoryStore
+	audit        audit.MemoryLog
+}
+
+func NewMemory() *memory {
+	return &memory{outbox: outbox.NewMemoryStore(), audit: audit.NewMemoryLog()}
+}
+
+func (m *memory) Outbox() outbox.Store {
+	return m.outbox
+}
+
+func (m *memory) Audit() audit.Log {
+	return m.audit
+}
+
+// AddReservation inserts reservation as is, at version 1, and returns it with
+// its id.
+func (m *memory) AddReservation(reservation Reservation) Reservation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastID++
+	reservation.ID = m.lastID
+	reservation.Version = 1
+	reservation.Start_date = reservation.Start_date.UTC()
+	reservation.Till_date = reservation.Till_date.UTC()
+	if reservation.Closed_at != nil {
+		closed := reservation.Closed_at.UTC()
+		reservation.Closed_at = &closed
+	}
+	m.reservations = append(m.reservations, reservation)
+
+	return reservation
+}
+
+// validUids reports a validation error like postgres does for malformed uuids.
+func validUids(uids ...string) error {
+	for _, uid := range uids {
+		if _, err := uuid.Parse(uid); err != nil {
+			return apierror.Validation("invalid input syntax for type uuid: %q", uid)
+		}
+	}
+	return nil
+}
+
+func (m *memory) CreateReservation(ctx context.Context, username string, bookUid string, libraryUid string, tillDate string) (Reservation, error) {
+	if err := validUids(bookUid, libraryUid); err != nil {
+		return Reservation{}, err
+	}
+
+	tillDateTime, err := time.Parse("2006-01-02", tillDate)
+	if err != nil {
+		return Reservation{}, apierror.Validation("invalid input syntax for type timestamp: %q", tillDate)
+	}
+
+	now := time.Now().UTC()
+
+	reservation := Reservation{
+		Reservation_uid: uuid.New().String(),
+		Username:        username,
+		Book_uid:        bookUid,
+		Library_uid:     libraryUid,
+		Status:          "RENTED",
+		Start_date:      now,
+		Till_date:       tillDateTime,
+		Version:         1,
+	}
+
+	event, err := newEvent(reservation)
+	if err != nil {
+		return Reservation{}, err
+	}
+
+	entry, err := createdEntry(ctx, reservation)
+	if err != nil {
+		return Reservation{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored := reservation
+	m.lastID++
+	stored.ID = m.lastID
+	stored.Start_date = now.Truncate(24 * time.Hour)
+	m.reservations = append(m.reservations, stored)
+	m.outbox.Add(event)
+	m.audit.Add(entry)
+
+	// like postgres, the id is not read back and the start date is not
+	// truncated to the day
+	return reservation, nil
+}
+
+func (m *memory) GetReservationByUid(ctx context.Context, reservation_uid string) (Reservation, error) {
+	if err := validUids(reservation_uid); err != nil {
+		return Reservation{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, reservation := range m.reservations {
+		if reservation.Reservation_uid == reservation_uid {
+			return reservation, nil
+		}
+	}
+
+	return Reservation{}, apierror.NotFound("reservation not found")
+}
+
+func (m *memory) GetReservations(ctx context.Context, username string) ([]Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reservations := []Reservation{}
+	for _, reservation := range m.reservations {
+		if reservation.Username == username {
+			reservations = append(reservations, reservation)
+		}
+	}
+
+	return reservations, nil
+}
+
+func (m *memory) GetReservationHistory(ctx context.Context, username string, filter HistoryFilter) ([]Reservation, int, error) {
+	if err := validHistoryFilter(filter); err != nil {
+		return nil, 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	page, total := history(m.reservations, username, filter)
+	return page, total, nil
+}
+
+func (m *memory) GetArchivedReservations(ctx context.Context, username string, filter HistoryFilter) ([]Reservation, int, error) {
+	if err := validHistoryFilter(filter); err != nil {
+		return nil, 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	page, total := history(m.archive, username, filter)
+	return page, total, nil
+}
+
+func validHistoryFilter(filter HistoryFilter) error {
+	if filter.LibraryUid != "" {
+		if err := validUids(filter.LibraryUid); err != nil {
+			return err
+		}
+	}
+	if filter.BookUid != "" {
+		if err := validUids(filter.BookUid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// history returns the page of the reservations of username matching filter
+// and how many of them match it.
+func history(reservations []Reservation, username string, filter HistoryFilter) ([]Reservation, int) {
+	matches := func(reservation Reservation) bool {
+		if reservation.Username != username {
+			return false
+		}
+		if len(filter.Statuses) > 0 {
+			found := false
+			for _, status := range filter.Statuses {
+				found = found || reservation.Status == status
+			}
+			if !found {
+				return false
+			}
+		}
+		if filter.LibraryUid != "" && reservation.Library_uid != filter.LibraryUid {
+			return false
+		}
+		if filter.BookUid != "" && reservation.Book_uid != filter.BookUid {
+			return false
+		}
+		if !filter.From.IsZero() && reservation.Start_date.Before(filter.From) {
+			return false
+		}
+		if !filter.To.IsZero() && !reservation.Start_date.Before(filter.To) {
+			return false
+		}
+		return true
+	}
+
+	// before reports whether a comes before b in ascending order
+	before := func(a, b Reservation) bool {
+		if !a.Start_date.Equal(b.Start_date) {
+			return a.Start_date.Before(b.Start_date)
+		}
+		return a.ID < b.ID
+	}
+
+	after := Reservation{ID: filter.AfterId, Start_date: filter.AfterDate}
+
+	var page []Reservation
+	total := 0
+
+	for _, reservation := range reservations {
+		if !matches(reservation) {
+			continue
+		}
+		total++
+
+		if filter.AfterId != 0 {
+			if filter.Desc && !before(reservation, after) || !filter.Desc && !before(after, reservation) {
+				continue
+			}
+		}
+		page = append(page, reservation)
+	}
+
+	sort.Slice(page, func(i, j int) bool {
+		if filter.Desc {
+			return before(page[j], page[i])
+		}
+		return before(page[i], page[j])
+	})
+
+	if filter.Offset < len(page) {
+		page = page[filter.Offset:]
+	} else {
+		page = nil
+	}
+	if len(page) > filter.Limit {
+		page = page[:filter.Limit]
+	}
+	if page == nil {
+		page = []Reservation{}
+	}
+
+	return page, total
+}
+
+func (m *memory) GetRentedReservationAmount(ctx context.Context, username string) (ReservationAmount, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var amount ReservationAmount
+	for _, reservation := range m.reservations {
+		if reservation.Username == username && reservation.Status == "RENTED" {
+			amount.Amount++
+		}
+	}
+
+	return amount, nil
+}
+
+func (m *memory) GetDueReservations(ctx context.Context, until time.Time) ([]Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reservations := []Reservation{}
+	for _, reservation := range m.reservations {
+		if reservation.Status == "RENTED" && !reservation.Till_date.After(until) {
+			reservations = append(reservations, reservation)
+		}
+	}
+
+	sort.SliceStable(reservations, func(i, j int) bool {
+		return reservations[i].Till_date.Before(reservations[j].Till_date)
+	})
+
+	return reservations, nil
+}
+
+func (m *memory) UpdateReservationStatus(ctx context.Context, reservation_uid string, status string, version int) (int, error) {
+	if err := validUids(reservation_uid); err != nil {
+		return 0, err
+	}
+	if !statuses[status] {
+		return 0, apierror.Validation("invalid status %q", status)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.reservations {
+		if m.reservations[i].Reservation_uid == reservation_uid {
+			if !etag.Matches(version, m.reservations[i].Version) {
+				return 0, apierror.PreconditionFailed("reservation %s has changed since version %d", reservation_uid, version)
+			}
+			if m.reservations[i].Status != "RENTED" {
+				return 0, apierror.Conflict("reservation %s is already closed", reservation_uid)
+			}
+
+			entry, err := statusUpdatedEntry(ctx, m.reservations[i], status)
+			if err != nil {
+				return 0, err
+			}
+
+			m.reservations[i].Status = status
+			m.reservations[i].Closed_at = closedAt(status, time.Now().UTC())
+			m.reservations[i].Version++
+
+			event, err := newEvent(m.reservations[i])
+			if err != nil {
+				return 0, err
+			}
+			m.outbox.Add(event)
+			m.audit.Add(entry)
+
+			return m.reservations[i].Version, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// closedBeforeIndexes returns the indexes of up to limit reservations closed
+// before until, oldest first.
+func closedBeforeIndexes(reservations []Reservation, until time.Time, limit int) []int {
+	var indexes []int
+	for i, reservation := range reservations {
+		if reservation.Closed_at != nil && reservation.Closed_at.Before(until) {
+			indexes = append(indexes, i)
+		}
+	}
+
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return reservations[indexes[i]].Closed_at.Before(*reservations[indexes[j]].Closed_at)
+	})
+
+	if len(indexes) > limit {
+		indexes = indexes[:limit]
+	}
+	return indexes
+}
+
+// without returns reservations without those at indexes.
+func without(reservations []Reservation, indexes []int) []Reservation {
+	removed := make(map[int]bool, len(indexes))
+	for _, i := range indexes {
+		removed[i] = true
+	}
+
+	kept := []Reservation{}
+	for i, reservation := range reservations {
+		if !removed[i] {
+			kept = append(kept, reservation)
+		}
+	}
+	return kept
+}
+
+func (m *memory) ArchiveReservations(ctx context.Context, closedBefore time.Time, limit int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	indexes := closedBeforeIndexes(m.reservations, closedBefore, limit)
+	for _, i := range indexes {
+		m.archive = append(m.archive, m.reservations[i])
+	}
+	m.reservations = without(m.reservations, indexes)
+
+	return len(indexes), nil
+}
+
+func (m *memory) PurgeArchive(ctx context.Context, closedBefore time.Time, limit int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	indexes := closedBeforeIndexes(m.archive, closedBefore, limit)
+	m.archive = without(m.archive, indexes)
+
+	return len(indexes), nil
+}
@@ -2,36 +2,155 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"sync"
+	"log/slog"
+	"strings"
 	"time"
 
+	"library-system/src/pkg/apierror"
+	"library-system/src/pkg/audit"
+	"library-system/src/pkg/etag"
+	"library-system/src/pkg/outbox"
+	"library-system/src/pkg/tracing"
+
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type Reservation struct {
-	ID              int       `json:"id"`
-	Reservation_uid string    `json:"reservation_uid"`
-	Username        string    `json:"username"`
-	Book_uid        string    `json:"book_uid"`
-	Library_uid     string    `json:"library_uid"`
-	Status          string    `json:"status"`
-	Start_date      time.Time `json:"start_date"`
-	Till_date       time.Time `json:"till_date"`
+	ID              int        `json:"id"`
+	Reservation_uid string     `json:"reservation_uid"`
+	Username        string     `json:"username"`
+	Book_uid        string     `json:"book_uid"`
+	Library_uid     string     `json:"library_uid"`
+	Status          string     `json:"status"`
+	Start_date      time.Time  `json:"start_date"`
+	Till_date       time.Time  `json:"till_date"`
+	Version         int        `json:"version"`
+	Closed_at       *time.Time `json:"closed_at"`
+}
+
+// reservationColumns are the columns of reservation, which
+// reservation_archive shares.
+const reservationColumns = `id, reservation_uid, username, book_uid, library_uid, status, start_date, till_date, version, closed_at`
+
+// closedAt returns when a reservation set to status at now is closed, nil
+// while it is rented.
+func closedAt(status string, now time.Time) *time.Time {
+	if status == "RENTED" {
+		return nil
+	}
+	return &now
+}
+
+// Events written to the outbox, with a ReservationEvent as payload.
+const (
+	ReservationCreated  = "reservation.created"
+	ReservationReturned = "reservation.returned"
+	ReservationOverdue  = "reservation.overdue"
+)
+
+type ReservationEvent struct {
+	ReservationUid string `json:"reservationUid"`
+	Username       string `json:"username"`
+	BookUid        string `json:"bookUid"`
+	LibraryUid     string `json:"libraryUid"`
+	Status         string `json:"status"`
+	TillDate       string `json:"tillDate"`
+}
+
+// newEvent describes the change of reservation to its current status.
+func newEvent(reservation Reservation) (outbox.Event, error) {
+	eventType := ReservationCreated
+	switch reservation.Status {
+	case "RETURNED":
+		eventType = ReservationReturned
+	case "EXPIRED":
+		eventType = ReservationOverdue
+	}
+
+	return outbox.New(eventType, reservation.Reservation_uid, reservationEvent(reservation))
+}
+
+func reservationEvent(reservation Reservation) ReservationEvent {
+	return ReservationEvent{
+		ReservationUid: reservation.Reservation_uid,
+		Username:       reservation.Username,
+		BookUid:        reservation.Book_uid,
+		LibraryUid:     reservation.Library_uid,
+		Status:         reservation.Status,
+		TillDate:       reservation.Till_date.Format("2006-01-02"),
+	}
+}
+
+// Actions recorded in the audit log.
+const (
+	AuditReservationCreated       = "reservation.created"
+	AuditReservationStatusUpdated = "reservation.status_updated"
+)
+
+type statusAudit struct {
+	Status string `json:"status"`
+}
+
+func createdEntry(ctx context.Context, reservation Reservation) (audit.Entry, error) {
+	return audit.New(ctx, AuditReservationCreated, "reservation", reservation.Reservation_uid, nil, reservationEvent(reservation))
+}
+
+func statusUpdatedEntry(ctx context.Context, reservation Reservation, status string) (audit.Entry, error) {
+	return audit.New(ctx, AuditReservationStatusUpdated, "reservation", reservation.Reservation_uid,
+		statusAudit{Status: reservation.Status}, statusAudit{Status: status})
 }
 
 type ReservationAmount struct {
 	Amount int `json:"amount"`
 }
 
+// HistoryFilter narrows down a reader's reservation history. Zero values
+// disable the corresponding filter. AfterDate and AfterId hold the position
+// of the last reservation of the previous page, Offset instead skips that
+// many reservations.
+type HistoryFilter struct {
+	Statuses   []string
+	LibraryUid string
+	BookUid    string
+	From       time.Time
+	To         time.Time
+	Desc       bool
+	AfterDate  time.Time
+	AfterId    int
+	Offset     int
+	Limit      int
+}
+
 type Storage interface {
 	GetReservations(ctx context.Context, username string) ([]Reservation, error)
+	GetReservationHistory(ctx context.Context, username string, filter HistoryFilter) ([]Reservation, int, error)
 	GetReservationByUid(ctx context.Context, reservation_uid string) (Reservation, error)
 	GetRentedReservationAmount(ctx context.Context, username string) (ReservationAmount, error)
+	GetDueReservations(ctx context.Context, until time.Time) ([]Reservation, error)
 	CreateReservation(ctx context.Context, username string, bookUid string, libraryUid string, tillDate string) (Reservation, error)
-	UpdateReservationStatus(ctx context.Context, reservation_uid string, status string) error
+	// UpdateReservationStatus closes the rented reservation with status unless
+	// it has changed since version, which is etag.Any to close it whatever its
+	// version, and returns its new version. Closed reservations are a conflict
+	// and unknown reservations are left alone.
+	UpdateReservationStatus(ctx context.Context, reservation_uid string, status string, version int) (int, error)
+	// ArchiveReservations moves up to limit reservations closed before
+	// closedBefore to the archive, oldest first, and returns how many it
+	// moved. Archived reservations are only found by GetArchivedReservations.
+	ArchiveReservations(ctx context.Context, closedBefore time.Time, limit int) (int, error)
+	// GetArchivedReservations pages through the archived reservations of a
+	// reader like GetReservationHistory does through the others.
+	GetArchivedReservations(ctx context.Context, username string, filter HistoryFilter) ([]Reservation, int, error)
+	// PurgeArchive deletes up to limit archived reservations closed before
+	// closedBefore and returns how many it deleted.
+	PurgeArchive(ctx context.Context, closedBefore time.Time, limit int) (int, error)
+	// Outbox holds the events of the changes above.
+	Outbox() outbox.Store
+	// Audit holds the audit trail of the changes above.
+	Audit() audit.Log
 }
 
 type postgres struct {
@@ -39,29 +158,38 @@ type postgres struct {
 }
 
 func NewPgStorage(ctx context.Context, connString string) (*postgres, error) {
-	var pgInstance *postgres
-	var pgOnce sync.Once
-	pgOnce.Do(func() {
-		db, err := pgxpool.New(ctx, connString)
-		if err != nil {
-			fmt.Printf("Unable to create connection pool: %v\n", err)
-			return
-		}
-
-		pgInstance = &postgres{db}
-	})
+	db, err := tracing.NewPool(ctx, connString)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create connection pool: %w", err)
+	}
 
-	return pgInstance, nil
+	return &postgres{db}, nil
 }
 
 func (pg *postgres) Ping(ctx context.Context) error {
 	return pg.db.Ping(ctx)
 }
 
+func (pg *postgres) Stat() *pgxpool.Stat {
+	return pg.db.Stat()
+}
+
+func (pg *postgres) Pool() *pgxpool.Pool {
+	return pg.db
+}
+
 func (pg *postgres) Close() {
 	pg.db.Close()
 }
 
+func (pg *postgres) Outbox() outbox.Store {
+	return outbox.NewPgStore(pg.db)
+}
+
+func (pg *postgres) Audit() audit.Log {
+	return audit.NewPgLog(pg.db)
+}
+
 func (pg *postgres) CreateReservation(ctx context.Context, username string, bookUid string, libraryUid string, tillDate string) (Reservation, error) {
 
 	var reservation Reservation
@@ -83,15 +211,10 @@ func (pg *postgres) CreateReservation(ctx context.Context, username string, book
 		"start_date":      start_date,
 		"till_date":       tillDate,
 	}
-	_, err := pg.db.Exec(ctx, query, args)
-	if err != nil {
-		return reservation, fmt.Errorf("unable to insert row: %w", err)
-	}
 
 	tillDateTime, err := time.Parse("2006-01-02", tillDate)
 	if err != nil {
-		fmt.Println(err)
-		return reservation, fmt.Errorf("unable to convert time: %w", err)
+		return reservation, apierror.Validation("invalid input syntax for type timestamp: %q", tillDate)
 	}
 
 	reservation.Reservation_uid = reservation_uid
@@ -101,6 +224,30 @@ func (pg *postgres) CreateReservation(ctx context.Context, username string, book
 	reservation.Status = "RENTED"
 	reservation.Start_date = time.Now().UTC()
 	reservation.Till_date = tillDateTime
+	reservation.Version = 1
+
+	event, err := newEvent(reservation)
+	if err != nil {
+		return reservation, err
+	}
+
+	entry, err := createdEntry(ctx, reservation)
+	if err != nil {
+		return reservation, err
+	}
+
+	err = pgx.BeginFunc(ctx, pg.db, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, query, args); err != nil {
+			return fmt.Errorf("unable to insert row: %w", err)
+		}
+		if err := outbox.Write(ctx, tx, event); err != nil {
+			return err
+		}
+		return audit.Write(ctx, tx, entry)
+	})
+	if err != nil {
+		return Reservation{}, err
+	}
 
 	return reservation, nil
 }
@@ -120,7 +267,7 @@ func (pg *postgres) GetReservationByUid(ctx context.Context, reservation_uid str
 
 	reservation, err = pgx.CollectOneRow(rows, pgx.RowToStructByName[Reservation])
 	if err != nil {
-		fmt.Printf("CollectRows error: %v", err)
+		slog.ErrorContext(ctx, "CollectRows error", "error", err)
 		return reservation, err
 	}
 
@@ -142,13 +289,97 @@ func (pg *postgres) GetReservations(ctx context.Context, username string) ([]Res
 
 	reservations, err = pgx.CollectRows(rows, pgx.RowToStructByName[Reservation])
 	if err != nil {
-		fmt.Printf("CollectRows error: %v", err)
+		slog.ErrorContext(ctx, "CollectRows error", "error", err)
 		return reservations, err
 	}
 
 	return reservations, nil
 }
 
+// GetReservationHistory returns a page of reservations matching the filter
+// together with the total number of matching reservations.
+func (pg *postgres) GetReservationHistory(ctx context.Context, username string, filter HistoryFilter) ([]Reservation, int, error) {
+	return pg.history(ctx, "reservation", username, filter)
+}
+
+func (pg *postgres) GetArchivedReservations(ctx context.Context, username string, filter HistoryFilter) ([]Reservation, int, error) {
+	return pg.history(ctx, "reservation_archive", username, filter)
+}
+
+// history pages through the reservations of username in table.
+func (pg *postgres) history(ctx context.Context, table string, username string, filter HistoryFilter) ([]Reservation, int, error) {
+
+	conditions := []string{"username = @username"}
+	args := pgx.NamedArgs{"username": username}
+
+	if len(filter.Statuses) > 0 {
+		conditions = append(conditions, "status = ANY(@statuses)")
+		args["statuses"] = filter.Statuses
+	}
+	if filter.LibraryUid != "" {
+		conditions = append(conditions, "library_uid = @library_uid")
+		args["library_uid"] = filter.LibraryUid
+	}
+	if filter.BookUid != "" {
+		conditions = append(conditions, "book_uid = @book_uid")
+		args["book_uid"] = filter.BookUid
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "start_date >= @from")
+		args["from"] = filter.From
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "start_date < @to")
+		args["to"] = filter.To
+	}
+
+	var total int
+
+	query := `SELECT COUNT(*) FROM ` + table + ` WHERE ` + strings.Join(conditions, " AND ")
+
+	err := pg.db.QueryRow(ctx, query, args).Scan(&total)
+	if err != nil {
+		return nil, total, fmt.Errorf("unable to query: %w", err)
+	}
+
+	order := "ASC"
+	if filter.Desc {
+		order = "DESC"
+	}
+
+	if filter.AfterId != 0 {
+		if filter.Desc {
+			conditions = append(conditions, "(start_date, id) < (@after_date, @after_id)")
+		} else {
+			conditions = append(conditions, "(start_date, id) > (@after_date, @after_id)")
+		}
+		args["after_date"] = filter.AfterDate
+		args["after_id"] = filter.AfterId
+	}
+
+	query = fmt.Sprintf(`SELECT %s FROM %s WHERE %s ORDER BY start_date %s, id %s LIMIT @limit OFFSET @offset`,
+		reservationColumns, table, strings.Join(conditions, " AND "), order, order)
+	args["limit"] = filter.Limit
+	args["offset"] = filter.Offset
+
+	rows, err := pg.db.Query(ctx, query, args)
+
+	var reservations []Reservation
+
+	if err != nil {
+		return reservations, total, fmt.Errorf("unable to query: %w", err)
+	}
+	defer rows.Close()
+
+	reservations, err = pgx.CollectRows(rows, pgx.RowToStructByName[Reservation])
+	if err != nil {
+		slog.ErrorContext(ctx, "CollectRows error", "error", err)
+		return reservations, total, err
+	}
+
+	return reservations, total, nil
+}
+
 func (pg *postgres) GetRentedReservationAmount(ctx context.Context, username string) (ReservationAmount, error) {
 
 	query := fmt.Sprintf(`SELECT * FROM reservation WHERE username = '%s' and status = 'RENTED'`, username)
@@ -164,7 +395,7 @@ func (pg *postgres) GetRentedReservationAmount(ctx context.Context, username str
 
 	reservations, err := pgx.CollectRows(rows, pgx.RowToStructByName[Reservation])
 	if err != nil {
-		fmt.Printf("CollectRows error: %v", err)
+		slog.ErrorContext(ctx, "CollectRows error", "error", err)
 		return reservationAmount, err
 	}
 	reservationAmount.Amount = len(reservations)
@@ -172,13 +403,120 @@ func (pg *postgres) GetRentedReservationAmount(ctx context.Context, username str
 	return reservationAmount, nil
 }
 
-func (pg *postgres) UpdateReservationStatus(ctx context.Context, reservation_uid string, status string) error {
-	query := fmt.Sprintf(`UPDATE reservation SET status = '%s' WHERE reservation_uid = '%s'`, status, reservation_uid)
+// GetDueReservations returns every rented reservation of all readers that is
+// due on or before until.
+func (pg *postgres) GetDueReservations(ctx context.Context, until time.Time) ([]Reservation, error) {
+
+	query := `SELECT * FROM reservation WHERE status = 'RENTED' AND till_date <= @until ORDER BY till_date, id`
+
+	rows, err := pg.db.Query(ctx, query, pgx.NamedArgs{"until": until})
+
+	var reservations []Reservation
+
+	if err != nil {
+		return reservations, fmt.Errorf("unable to query: %w", err)
+	}
+	defer rows.Close()
+
+	reservations, err = pgx.CollectRows(rows, pgx.RowToStructByName[Reservation])
+	if err != nil {
+		slog.ErrorContext(ctx, "CollectRows error", "error", err)
+		return reservations, err
+	}
+
+	return reservations, nil
+}
+
+func (pg *postgres) UpdateReservationStatus(ctx context.Context, reservation_uid string, status string, version int) (int, error) {
+	query := `SELECT * FROM reservation WHERE reservation_uid = @reservation_uid FOR UPDATE`
+	args := pgx.NamedArgs{"status": status, "reservation_uid": reservation_uid, "closed_at": closedAt(status, time.Now().UTC())}
+
+	var updated int
+
+	err := pgx.BeginFunc(ctx, pg.db, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, query, args)
+		if err != nil {
+			return fmt.Errorf("unable to query: %w", err)
+		}
+
+		reservations, err := pgx.CollectRows(rows, pgx.RowToStructByName[Reservation])
+		if err != nil {
+			return fmt.Errorf("unable to query: %w", err)
+		}
+
+		for _, reservation := range reservations {
+			if !etag.Matches(version, reservation.Version) {
+				return apierror.PreconditionFailed("reservation %s has changed since version %d", reservation_uid, version)
+			}
+			if reservation.Status != "RENTED" {
+				return apierror.Conflict("reservation %s is already closed", reservation_uid)
+			}
+		}
+
+		query = `UPDATE reservation SET status = @status, closed_at = @closed_at, version = version + 1
+			WHERE reservation_uid = @reservation_uid RETURNING version`
+		err = tx.QueryRow(ctx, query, args).Scan(&updated)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to update row: %w", err)
+		}
+
+		for _, reservation := range reservations {
+			entry, err := statusUpdatedEntry(ctx, reservation, status)
+			if err != nil {
+				return err
+			}
+			if err = audit.Write(ctx, tx, entry); err != nil {
+				return err
+			}
+
+			reservation.Status = status
+			event, err := newEvent(reservation)
+			if err != nil {
+				return err
+			}
+			if err = outbox.Write(ctx, tx, event); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return updated, nil
+}
+
+func (pg *postgres) ArchiveReservations(ctx context.Context, closedBefore time.Time, limit int) (int, error) {
+	query := `WITH archived AS (
+			DELETE FROM reservation WHERE id IN (
+				SELECT id FROM reservation WHERE closed_at < @closed_before
+				ORDER BY closed_at, id LIMIT @limit FOR UPDATE SKIP LOCKED)
+			RETURNING ` + reservationColumns + `)
+		INSERT INTO reservation_archive (` + reservationColumns + `, archived_at)
+		SELECT ` + reservationColumns + `, @archived_at FROM archived`
+	args := pgx.NamedArgs{"closed_before": closedBefore, "limit": limit, "archived_at": time.Now().UTC()}
+
+	tag, err := pg.db.Exec(ctx, query, args)
+	if err != nil {
+		return 0, fmt.Errorf("unable to archive reservations: %w", err)
+	}
+
+	return int(tag.RowsAffected()), nil
+}
+
+func (pg *postgres) PurgeArchive(ctx context.Context, closedBefore time.Time, limit int) (int, error) {
+	query := `DELETE FROM reservation_archive WHERE id IN (
+		SELECT id FROM reservation_archive WHERE closed_at < @closed_before ORDER BY closed_at, id LIMIT @limit)`
 
-	_, err := pg.db.Exec(ctx, query)
+	tag, err := pg.db.Exec(ctx, query, pgx.NamedArgs{"closed_before": closedBefore, "limit": limit})
 	if err != nil {
-		return fmt.Errorf("unable to insert row: %w", err)
+		return 0, fmt.Errorf("unable to purge archive: %w", err)
 	}
 
-	return nil
+	return int(tag.RowsAffected()), nil
 }
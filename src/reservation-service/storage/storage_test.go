@@ -0,0 +1,41 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"library-system/src/pkg/pgtest"
+	"library-system/src/reservation-service/migrations"
+	"library-system/src/reservation-service/storage"
+	"library-system/src/reservation-service/storage/storagetest"
+)
+
+func TestMemory(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T, fixture storagetest.Fixture) storage.Storage {
+		memory := storage.NewMemory()
+		for _, reservation := range fixture.Reservations {
+			memory.AddReservation(reservation)
+		}
+		return memory
+	})
+}
+
+func TestPostgres(t *testing.T) {
+	connString := pgtest.Open(t, "TEST_POSTGRES_RESERVATIONS", migrations.Schema)
+
+	pg, err := storage.NewPgStorage(context.Background(), connString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Close()
+
+	storagetest.Run(t, func(t *testing.T, fixture storagetest.Fixture) storage.Storage {
+		pgtest.Exec(t, pg.Pool(), `TRUNCATE reservation, reservation_archive, outbox, audit_log RESTART IDENTITY`)
+		for _, r := range fixture.Reservations {
+			pgtest.Exec(t, pg.Pool(), `INSERT INTO reservation (reservation_uid, username, book_uid, library_uid, status, start_date, till_date, closed_at)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+				r.Reservation_uid, r.Username, r.Book_uid, r.Library_uid, r.Status, r.Start_date, r.Till_date, r.Closed_at)
+		}
+		return pg
+	})
+}
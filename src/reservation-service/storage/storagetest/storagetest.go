@@ -0,0 +1,473 @@
+// Package storagetest is the conformance suite that every implementation of
+// the reservation-service Storage must pass.
+package storagetest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"library-system/src/pkg/apierror"
+	"library-system/src/pkg/audit"
+	"library-system/src/pkg/etag"
+	"library-system/src/reservation-service/storage"
+)
+
+const (
+	libraryUid = "83575e12-7ce0-48ee-9931-51919ff3c9ee"
+	otherUid   = "1b2c3d4e-0000-4000-8000-000000000002"
+	bookUid    = "f7cdc58f-2caf-4b15-9727-f89dcc629b27"
+	unknownUid = "00000000-0000-4000-8000-000000000000"
+)
+
+type Fixture struct {
+	// Reservations are inserted in order, so their ids are 1, 2, ...
+	Reservations []storage.Reservation
+}
+
+// Factory returns a storage holding exactly the fixture.
+type Factory func(t *testing.T, fixture Fixture) storage.Storage
+
+func date(day int) time.Time {
+	return time.Date(2021, 10, day, 0, 0, 0, 0, time.UTC)
+}
+
+func closed(day int) *time.Time {
+	closedAt := date(day)
+	return &closedAt
+}
+
+func uid(n int) string {
+	return fmt.Sprintf("3c4d5e6f-0000-4000-8000-%012d", n)
+}
+
+var fixture = Fixture{
+	Reservations: []storage.Reservation{
+		{Reservation_uid: uid(1), Username: "Test Max", Book_uid: bookUid, Library_uid: libraryUid, Status: "RETURNED", Start_date: date(1), Till_date: date(5), Closed_at: closed(5)},
+		{Reservation_uid: uid(2), Username: "Test Max", Book_uid: bookUid, Library_uid: otherUid, Status: "EXPIRED", Start_date: date(3), Till_date: date(6), Closed_at: closed(6)},
+		{Reservation_uid: uid(3), Username: "Test Max", Book_uid: bookUid, Library_uid: libraryUid, Status: "RENTED", Start_date: date(3), Till_date: date(12)},
+		{Reservation_uid: uid(4), Username: "Test Max", Book_uid: bookUid, Library_uid: libraryUid, Status: "RENTED", Start_date: date(8), Till_date: date(10)},
+		{Reservation_uid: uid(5), Username: "Test Min", Book_uid: bookUid, Library_uid: libraryUid, Status: "RENTED", Start_date: date(9), Till_date: date(10)},
+	},
+}
+
+func reservationUids(reservations []storage.Reservation) []string {
+	uids := make([]string, len(reservations))
+	for i, reservation := range reservations {
+		uids[i] = reservation.Reservation_uid
+	}
+	return uids
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func expectCode(t *testing.T, err error, code apierror.Code) {
+	t.Helper()
+
+	if err == nil || apierror.From(err).Code != code {
+		t.Errorf("expected %s, got %v", code, err)
+	}
+}
+
+func Run(t *testing.T, newStorage Factory) {
+	ctx := context.Background()
+
+	t.Run("GetReservations", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		reservations, err := s.GetReservations(ctx, "Test Min")
+		if err != nil || len(reservations) != 1 || reservations[0] != (storage.Reservation{
+			ID: 5, Reservation_uid: uid(5), Username: "Test Min", Book_uid: bookUid, Library_uid: libraryUid,
+			Status: "RENTED", Start_date: date(9), Till_date: date(10), Version: 1,
+		}) {
+			t.Errorf("unexpected reservations %+v (%v)", reservations, err)
+		}
+
+		reservations, err = s.GetReservations(ctx, "Unknown")
+		if err != nil || len(reservations) != 0 {
+			t.Errorf("expected no reservations, got %+v (%v)", reservations, err)
+		}
+	})
+
+	t.Run("GetReservationByUid", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		reservation, err := s.GetReservationByUid(ctx, uid(2))
+		if err != nil || reservation.ID != 2 || reservation.Status != "EXPIRED" || !reservation.Till_date.Equal(date(6)) {
+			t.Errorf("unexpected reservation %+v (%v)", reservation, err)
+		}
+
+		_, err = s.GetReservationByUid(ctx, unknownUid)
+		expectCode(t, err, apierror.CodeNotFound)
+
+		_, err = s.GetReservationByUid(ctx, "not-a-uid")
+		expectCode(t, err, apierror.CodeValidation)
+	})
+
+	t.Run("GetReservationHistory", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		tests := []struct {
+			name   string
+			filter storage.HistoryFilter
+			uids   []string
+			total  int
+		}{
+			{"newest first", storage.HistoryFilter{Desc: true, Limit: 10}, []string{uid(4), uid(3), uid(2), uid(1)}, 4},
+			{"oldest first", storage.HistoryFilter{Limit: 10}, []string{uid(1), uid(2), uid(3), uid(4)}, 4},
+			{"first page", storage.HistoryFilter{Desc: true, Limit: 2}, []string{uid(4), uid(3)}, 4},
+			{"next page", storage.HistoryFilter{Desc: true, Limit: 2, AfterDate: date(3), AfterId: 3}, []string{uid(2), uid(1)}, 4},
+			{"next page ascending", storage.HistoryFilter{Limit: 10, AfterDate: date(3), AfterId: 2}, []string{uid(3), uid(4)}, 4},
+			{"offset", storage.HistoryFilter{Desc: true, Limit: 2, Offset: 1}, []string{uid(3), uid(2)}, 4},
+			{"offset past the end", storage.HistoryFilter{Limit: 2, Offset: 4}, []string{}, 4},
+			{"statuses", storage.HistoryFilter{Statuses: []string{"RETURNED", "EXPIRED"}, Limit: 10}, []string{uid(1), uid(2)}, 2},
+			{"library", storage.HistoryFilter{LibraryUid: otherUid, Limit: 10}, []string{uid(2)}, 1},
+			{"book", storage.HistoryFilter{BookUid: unknownUid, Limit: 10}, []string{}, 0},
+			{"date range", storage.HistoryFilter{From: date(2), To: date(4), Limit: 10}, []string{uid(2), uid(3)}, 2},
+		}
+
+		for _, tt := range tests {
+			reservations, total, err := s.GetReservationHistory(ctx, "Test Max", tt.filter)
+			if err != nil || total != tt.total || !equal(reservationUids(reservations), tt.uids) {
+				t.Errorf("%s: expected %v of %d, got %v of %d (%v)", tt.name, tt.uids, tt.total, reservationUids(reservations), total, err)
+			}
+		}
+
+		_, _, err := s.GetReservationHistory(ctx, "Test Max", storage.HistoryFilter{LibraryUid: "not-a-uid", Limit: 10})
+		expectCode(t, err, apierror.CodeValidation)
+	})
+
+	t.Run("GetRentedReservationAmount", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		amount, err := s.GetRentedReservationAmount(ctx, "Test Max")
+		if err != nil || amount.Amount != 2 {
+			t.Errorf("expected 2 rented books, got %+v (%v)", amount, err)
+		}
+
+		amount, err = s.GetRentedReservationAmount(ctx, "Unknown")
+		if err != nil || amount.Amount != 0 {
+			t.Errorf("expected no rented books, got %+v (%v)", amount, err)
+		}
+	})
+
+	t.Run("GetDueReservations", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		reservations, err := s.GetDueReservations(ctx, date(10))
+		if err != nil || !equal(reservationUids(reservations), []string{uid(4), uid(5)}) {
+			t.Errorf("expected the reservations due on the 10th, got %v (%v)", reservationUids(reservations), err)
+		}
+
+		reservations, err = s.GetDueReservations(ctx, date(30))
+		if err != nil || !equal(reservationUids(reservations), []string{uid(4), uid(5), uid(3)}) {
+			t.Errorf("expected all rented reservations by till date, got %v (%v)", reservationUids(reservations), err)
+		}
+	})
+
+	t.Run("CreateReservation", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		reservation, err := s.CreateReservation(ctx, "Test Min", bookUid, otherUid, "2021-10-20")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reservation.Reservation_uid == "" || reservation.Status != "RENTED" || !reservation.Till_date.Equal(date(20)) || reservation.Version != 1 {
+			t.Errorf("unexpected reservation %+v", reservation)
+		}
+
+		stored, err := s.GetReservationByUid(ctx, reservation.Reservation_uid)
+		if err != nil || stored.Username != "Test Min" || stored.Library_uid != otherUid || stored.ID == 0 {
+			t.Errorf("unexpected stored reservation %+v (%v)", stored, err)
+		}
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+		if !stored.Start_date.Equal(today) {
+			t.Errorf("expected the reservation to start today, got %s", stored.Start_date)
+		}
+
+		if amount, _ := s.GetRentedReservationAmount(ctx, "Test Min"); amount.Amount != 2 {
+			t.Errorf("expected 2 rented books, got %d", amount.Amount)
+		}
+
+		_, err = s.CreateReservation(ctx, "Test Min", "not-a-uid", otherUid, "2021-10-20")
+		expectCode(t, err, apierror.CodeValidation)
+
+		_, err = s.CreateReservation(ctx, "Test Min", bookUid, otherUid, "someday")
+		expectCode(t, err, apierror.CodeValidation)
+	})
+
+	t.Run("UpdateReservationStatus", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		if version, err := s.UpdateReservationStatus(ctx, uid(3), "RETURNED", 1); err != nil || version != 2 {
+			t.Fatalf("expected version 2, got %d (%v)", version, err)
+		}
+		if reservation, _ := s.GetReservationByUid(ctx, uid(3)); reservation.Status != "RETURNED" || reservation.Version != 2 || reservation.Closed_at == nil {
+			t.Errorf("expected RETURNED and closed at version 2, got %+v", reservation)
+		}
+		if reservation, _ := s.GetReservationByUid(ctx, uid(4)); reservation.Status != "RENTED" || reservation.Version != 1 {
+			t.Errorf("other reservations must not change, got %+v", reservation)
+		}
+
+		_, err := s.UpdateReservationStatus(ctx, uid(4), "LOST", 1)
+		expectCode(t, err, apierror.CodeValidation)
+
+		if _, err := s.UpdateReservationStatus(ctx, unknownUid, "RETURNED", 1); err != nil {
+			t.Errorf("updating an unknown reservation is not an error, got %v", err)
+		}
+	})
+
+	t.Run("UpdateReservationStatusVersion", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		if _, err := s.UpdateReservationStatus(ctx, uid(3), "RETURNED", 1); err != nil {
+			t.Fatal(err)
+		}
+
+		// a second update based on the same version is refused
+		_, err := s.UpdateReservationStatus(ctx, uid(3), "EXPIRED", 1)
+		expectCode(t, err, apierror.CodePreconditionFailed)
+
+		if reservation, _ := s.GetReservationByUid(ctx, uid(3)); reservation.Status != "RETURNED" || reservation.Version != 2 {
+			t.Errorf("a refused update must change nothing, got %+v", reservation)
+		}
+
+		if version, err := s.UpdateReservationStatus(ctx, uid(4), "EXPIRED", etag.Any); err != nil || version != 2 {
+			t.Errorf("expected an unconditional update to version 2, got %d (%v)", version, err)
+		}
+	})
+
+	t.Run("UpdateReservationStatusClosed", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		if _, err := s.UpdateReservationStatus(ctx, uid(3), "RETURNED", 1); err != nil {
+			t.Fatal(err)
+		}
+
+		// a reservation is closed once, even unconditionally
+		_, err := s.UpdateReservationStatus(ctx, uid(3), "EXPIRED", 2)
+		expectCode(t, err, apierror.CodeConflict)
+
+		_, err = s.UpdateReservationStatus(ctx, uid(1), "RETURNED", etag.Any)
+		expectCode(t, err, apierror.CodeConflict)
+
+		if reservation, _ := s.GetReservationByUid(ctx, uid(3)); reservation.Status != "RETURNED" || reservation.Version != 2 {
+			t.Errorf("a refused update must change nothing, got %+v", reservation)
+		}
+	})
+
+	t.Run("ArchiveReservations", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		if archived, err := s.ArchiveReservations(ctx, date(6), 10); err != nil || archived != 1 {
+			t.Fatalf("expected the reservation closed on the 5th to be archived, got %d (%v)", archived, err)
+		}
+
+		reservations, total, err := s.GetReservationHistory(ctx, "Test Max", storage.HistoryFilter{Limit: 10})
+		if err != nil || total != 3 || !equal(reservationUids(reservations), []string{uid(2), uid(3), uid(4)}) {
+			t.Errorf("expected the archived reservation to leave the history, got %v of %d (%v)", reservationUids(reservations), total, err)
+		}
+		_, err = s.GetReservationByUid(ctx, uid(1))
+		expectCode(t, err, apierror.CodeNotFound)
+
+		reservations, total, err = s.GetArchivedReservations(ctx, "Test Max", storage.HistoryFilter{Limit: 10})
+		if err != nil || total != 1 || len(reservations) != 1 {
+			t.Fatalf("expected one archived reservation, got %+v of %d (%v)", reservations, total, err)
+		}
+		archived := reservations[0]
+		archived.Closed_at = nil
+		if archived != (storage.Reservation{
+			ID: 1, Reservation_uid: uid(1), Username: "Test Max", Book_uid: bookUid, Library_uid: libraryUid,
+			Status: "RETURNED", Start_date: date(1), Till_date: date(5), Version: 1,
+		}) || reservations[0].Closed_at == nil || !reservations[0].Closed_at.Equal(date(5)) {
+			t.Errorf("unexpected archived reservation %+v", reservations[0])
+		}
+
+		// reservations closed now are archived too, oldest first
+		if _, err = s.UpdateReservationStatus(ctx, uid(3), "RETURNED", etag.Any); err != nil {
+			t.Fatal(err)
+		}
+		if archived, err := s.ArchiveReservations(ctx, time.Now().Add(time.Hour), 1); err != nil || archived != 1 {
+			t.Fatalf("expected one reservation to be archived, got %d (%v)", archived, err)
+		}
+		if _, err = s.GetReservationByUid(ctx, uid(3)); err != nil {
+			t.Errorf("expected the reservation closed last to be archived last, got %v", err)
+		}
+		if archived, err := s.ArchiveReservations(ctx, time.Now().Add(time.Hour), 10); err != nil || archived != 1 {
+			t.Fatalf("expected one reservation to be archived, got %d (%v)", archived, err)
+		}
+
+		tests := []struct {
+			name   string
+			filter storage.HistoryFilter
+			uids   []string
+			total  int
+		}{
+			{"newest first", storage.HistoryFilter{Desc: true, Limit: 10}, []string{uid(3), uid(2), uid(1)}, 3},
+			{"next page", storage.HistoryFilter{Limit: 10, AfterDate: date(3), AfterId: 2}, []string{uid(3)}, 3},
+			{"statuses", storage.HistoryFilter{Statuses: []string{"RETURNED"}, Limit: 10}, []string{uid(1), uid(3)}, 2},
+		}
+
+		for _, tt := range tests {
+			reservations, total, err := s.GetArchivedReservations(ctx, "Test Max", tt.filter)
+			if err != nil || total != tt.total || !equal(reservationUids(reservations), tt.uids) {
+				t.Errorf("%s: expected %v of %d, got %v of %d (%v)", tt.name, tt.uids, tt.total, reservationUids(reservations), total, err)
+			}
+		}
+
+		if reservations, total, err = s.GetArchivedReservations(ctx, "Test Min", storage.HistoryFilter{Limit: 10}); err != nil || total != 0 || len(reservations) != 0 {
+			t.Errorf("rented reservations must not be archived, got %v of %d (%v)", reservationUids(reservations), total, err)
+		}
+
+		_, _, err = s.GetArchivedReservations(ctx, "Test Max", storage.HistoryFilter{BookUid: "not-a-uid", Limit: 10})
+		expectCode(t, err, apierror.CodeValidation)
+	})
+
+	t.Run("PurgeArchive", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		if archived, err := s.ArchiveReservations(ctx, date(7), 10); err != nil || archived != 2 {
+			t.Fatalf("expected 2 reservations to be archived, got %d (%v)", archived, err)
+		}
+
+		if purged, err := s.PurgeArchive(ctx, date(6), 10); err != nil || purged != 1 {
+			t.Errorf("expected the reservation closed on the 5th to be purged, got %d (%v)", purged, err)
+		}
+		if reservations, total, _ := s.GetArchivedReservations(ctx, "Test Max", storage.HistoryFilter{Limit: 10}); total != 1 || !equal(reservationUids(reservations), []string{uid(2)}) {
+			t.Errorf("expected the reservation closed on the 6th to be kept, got %v of %d", reservationUids(reservations), total)
+		}
+
+		if purged, err := s.PurgeArchive(ctx, date(30), 10); err != nil || purged != 1 {
+			t.Errorf("expected the last archived reservation to be purged, got %d (%v)", purged, err)
+		}
+		if purged, err := s.PurgeArchive(ctx, date(30), 10); err != nil || purged != 0 {
+			t.Errorf("expected nothing left to purge, got %d (%v)", purged, err)
+		}
+		if amount, _ := s.GetRentedReservationAmount(ctx, "Test Max"); amount.Amount != 2 {
+			t.Errorf("purging must not touch rented reservations, got %d", amount.Amount)
+		}
+	})
+
+	t.Run("Outbox", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		reservation, err := s.CreateReservation(ctx, "Test Min", bookUid, otherUid, "2021-10-20")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = s.UpdateReservationStatus(ctx, reservation.Reservation_uid, "EXPIRED", reservation.Version); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = s.UpdateReservationStatus(ctx, uid(3), "RETURNED", etag.Any); err != nil {
+			t.Fatal(err)
+		}
+
+		// failed changes write no events
+		s.CreateReservation(ctx, "Test Min", "not-a-uid", otherUid, "2021-10-20")
+		s.UpdateReservationStatus(ctx, uid(4), "LOST", etag.Any)
+
+		events, err := s.Outbox().Pending(ctx, 10)
+		if err != nil || len(events) != 3 {
+			t.Fatalf("expected 3 events, got %+v (%v)", events, err)
+		}
+
+		expected := []struct {
+			eventType      string
+			reservationUid string
+			status         string
+		}{
+			{storage.ReservationCreated, reservation.Reservation_uid, "RENTED"},
+			{storage.ReservationOverdue, reservation.Reservation_uid, "EXPIRED"},
+			{storage.ReservationReturned, uid(3), "RETURNED"},
+		}
+		for i, event := range events {
+			var payload storage.ReservationEvent
+			if err = event.Decode(&payload); err != nil {
+				t.Fatal(err)
+			}
+			if event.Type != expected[i].eventType || event.EntityUid != expected[i].reservationUid || payload.Status != expected[i].status {
+				t.Errorf("event %d: expected %+v, got %+v %+v", i, expected[i], event, payload)
+			}
+		}
+
+		var created storage.ReservationEvent
+		events[0].Decode(&created)
+		if created != (storage.ReservationEvent{ReservationUid: reservation.Reservation_uid, Username: "Test Min", BookUid: bookUid, LibraryUid: otherUid, Status: "RENTED", TillDate: "2021-10-20"}) {
+			t.Errorf("unexpected payload %+v", created)
+		}
+
+		if err = s.Outbox().MarkPublished(ctx, []int64{events[0].ID, events[1].ID}); err != nil {
+			t.Fatal(err)
+		}
+		if events, _ = s.Outbox().Pending(ctx, 10); len(events) != 1 || events[0].EntityUid != uid(3) {
+			t.Errorf("expected only the last event to be pending, got %+v", events)
+		}
+
+		if pruned, err := s.Outbox().Prune(ctx, time.Hour); err != nil || pruned != 0 {
+			t.Errorf("expected recently published events to be kept, got %d (%v)", pruned, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if pruned, err := s.Outbox().Prune(ctx, 0); err != nil || pruned != 2 {
+			t.Errorf("expected the published events to be pruned, got %d (%v)", pruned, err)
+		}
+		if events, _ = s.Outbox().Pending(ctx, 10); len(events) != 1 {
+			t.Errorf("pending events must not be pruned, got %+v", events)
+		}
+	})
+
+	t.Run("Audit", func(t *testing.T) {
+		s := newStorage(t, fixture)
+
+		reservation, err := s.CreateReservation(audit.WithActor(ctx, "Test Min"), "Test Min", bookUid, otherUid, "2021-10-20")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = s.UpdateReservationStatus(audit.WithActor(ctx, "admin"), uid(3), "RETURNED", etag.Any); err != nil {
+			t.Fatal(err)
+		}
+
+		// failed changes are not recorded
+		s.UpdateReservationStatus(ctx, uid(4), "LOST", etag.Any)
+
+		entries, err := s.Audit().Query(ctx, audit.Filter{Limit: 10})
+		if err != nil || len(entries) != 2 {
+			t.Fatalf("expected 2 entries, got %+v (%v)", entries, err)
+		}
+
+		returned, created := entries[0], entries[1]
+
+		var before, after struct{ Status string }
+		json.Unmarshal(returned.Before, &before)
+		json.Unmarshal(returned.After, &after)
+		if returned.Action != storage.AuditReservationStatusUpdated || returned.EntityUid != uid(3) || returned.Actor != "admin" ||
+			before.Status != "RENTED" || after.Status != "RETURNED" {
+			t.Errorf("unexpected entry %+v", returned)
+		}
+
+		var payload storage.ReservationEvent
+		json.Unmarshal(created.After, &payload)
+		if created.Action != storage.AuditReservationCreated || created.EntityType != "reservation" || created.Actor != "Test Min" ||
+			len(created.Before) != 0 || payload.ReservationUid != reservation.Reservation_uid || payload.TillDate != "2021-10-20" {
+			t.Errorf("unexpected entry %+v", created)
+		}
+
+		if entries, _ = s.Audit().Query(ctx, audit.Filter{Actor: "admin", Limit: 10}); len(entries) != 1 || entries[0].EntityUid != uid(3) {
+			t.Errorf("expected the entry of admin, got %+v", entries)
+		}
+		if entries, _ = s.Audit().Query(ctx, audit.Filter{To: time.Now().Add(-time.Hour), Limit: 10}); len(entries) != 0 {
+			t.Errorf("expected no entries an hour ago, got %+v", entries)
+		}
+	})
+}
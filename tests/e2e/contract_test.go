@@ -0,0 +1,120 @@
+package e2e
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	gateway "library-system/src/gateway-service/handler"
+	"library-system/src/pkg/etag"
+)
+
+const unknownReservationUid = "9e3b5a2c-0000-4000-8000-000000000000"
+
+// TestContract requests every operation of the specification with both
+// successful and failing requests. Do checks each response against the
+// specification.
+func TestContract(t *testing.T) {
+	h := Start(t)
+
+	take := `{"bookUid":"` + BookUid + `","libraryUid":"` + LibraryUid + `","tillDate":"2025-10-11"}`
+
+	var taken gateway.TakeBookResponse
+
+	// the reader sends an ETag, so that the return is refused for their role
+	readerReturning := reader.Clone()
+	readerReturning.Set("If-Match", `"1"`)
+
+	anyVersion := admin.Clone()
+	anyVersion.Set("If-Match", "*")
+
+	steps := []struct {
+		name   string
+		method string
+		path   string
+		header http.Header
+		body   string
+		status int
+		out    any
+	}{
+		{"libraries", http.MethodGet, "/api/v1/libraries?page=1&size=10&city=" + url.QueryEscape(City), nil, "", http.StatusOK, nil},
+		{"libraries without city", http.MethodGet, "/api/v1/libraries?page=1&size=10", nil, "", http.StatusBadRequest, nil},
+		{"books", http.MethodGet, "/api/v1/libraries/" + LibraryUid + "/books?page=1&size=25&showAll=true", nil, "", http.StatusOK, nil},
+		{"books with too large page", http.MethodGet, "/api/v1/libraries/" + LibraryUid + "/books?size=1000", nil, "", http.StatusBadRequest, nil},
+
+		{"take a book", http.MethodPost, "/api/v1/reservations", reader, take, http.StatusOK, &taken},
+		{"take without till date", http.MethodPost, "/api/v1/reservations", reader,
+			`{"bookUid":"` + BookUid + `","libraryUid":"` + LibraryUid + `"}`, http.StatusBadRequest, nil},
+		{"take with invalid book", http.MethodPost, "/api/v1/reservations", reader,
+			`{"bookUid":"abc","libraryUid":"` + LibraryUid + `","tillDate":"2025-10-11"}`, http.StatusBadRequest, nil},
+
+		{"reservations", http.MethodGet, "/api/v1/reservations", admin, "", http.StatusOK, nil},
+		{"reservations of a reader", http.MethodGet, "/api/v1/reservations", reader, "", http.StatusUnauthorized, nil},
+
+		{"rating", http.MethodGet, "/api/v1/rating", admin, "", http.StatusOK, nil},
+		{"rating of a reader", http.MethodGet, "/api/v1/rating", reader, "", http.StatusUnauthorized, nil},
+		{"rating without user", http.MethodGet, "/api/v1/rating", nil, "", http.StatusBadRequest, nil},
+
+		{"unknown reservation", http.MethodGet, "/api/v1/reservations/info/" + unknownReservationUid, admin, "", http.StatusNotFound, nil},
+		{"reservation for a reader", http.MethodGet, "/api/v1/reservations/info/" + unknownReservationUid, reader, "", http.StatusUnauthorized, nil},
+		{"reservation with invalid uid", http.MethodGet, "/api/v1/reservations/info/abc", admin, "", http.StatusBadRequest, nil},
+
+		{"return by a reader", http.MethodPost, "/api/v1/reservations/" + unknownReservationUid + "/return", readerReturning,
+			`{"condition":"EXCELLENT","date":"2021-10-11"}`, http.StatusUnauthorized, nil},
+		{"return without If-Match", http.MethodPost, "/api/v1/reservations/" + unknownReservationUid + "/return", admin,
+			`{"condition":"EXCELLENT","date":"2021-10-11"}`, http.StatusPreconditionRequired, nil},
+		{"return with any version", http.MethodPost, "/api/v1/reservations/" + unknownReservationUid + "/return", anyVersion,
+			`{"condition":"EXCELLENT","date":"2021-10-11"}`, http.StatusPreconditionRequired, nil},
+		{"return an unknown reservation", http.MethodPost, "/api/v1/reservations/" + unknownReservationUid + "/return", returning,
+			`{"condition":"EXCELLENT","date":"2021-10-11"}`, http.StatusNotFound, nil},
+		{"return in an unknown condition", http.MethodPost, "/api/v1/reservations/" + unknownReservationUid + "/return", returning,
+			`{"condition":"TORN","date":"2021-10-11"}`, http.StatusBadRequest, nil},
+	}
+
+	for _, step := range steps {
+		if status := h.Do(t, step.method, step.path, step.header, step.body, step.out); status != step.status {
+			t.Errorf("%s: expected %d, got %d", step.name, step.status, status)
+		}
+	}
+
+	if status := h.Do(t, http.MethodGet, "/api/v1/reservations/info/"+taken.Reservation_uid, admin, "", nil); status != http.StatusOK {
+		t.Errorf("reservation: expected %d, got %d", http.StatusOK, status)
+	}
+
+	status, header := h.DoWithHeader(t, http.MethodPost, "/api/v1/reservations/"+taken.Reservation_uid+"/return", returning,
+		`{"condition":"EXCELLENT","date":"2021-10-11"}`, nil)
+	if status != http.StatusNoContent {
+		t.Errorf("return: expected %d, got %d", http.StatusNoContent, status)
+	}
+
+	// the returned reservation is closed at its new version as well
+	returned := admin.Clone()
+	returned.Set("If-Match", header.Get("ETag"))
+
+	status = h.Do(t, http.MethodPost, "/api/v1/reservations/"+taken.Reservation_uid+"/return", returned,
+		`{"condition":"EXCELLENT","date":"2021-10-11"}`, nil)
+	if status != http.StatusConflict {
+		t.Errorf("second return: expected %d, got %d", http.StatusConflict, status)
+	}
+
+	// a novice may only hold one book
+	if _, err := h.Ratings.UpdateRating(context.Background(), Username, 0, etag.Any); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Do(t, http.MethodPost, "/api/v1/reservations", reader, take, nil)
+	if status = h.Do(t, http.MethodPost, "/api/v1/reservations", reader, take, nil); status != http.StatusConflict {
+		t.Errorf("take over the limit: expected %d, got %d", http.StatusConflict, status)
+	}
+
+	covered := map[string]bool{}
+	for _, operation := range h.Covered() {
+		covered[operation] = true
+	}
+	for _, operation := range h.Spec.Operations() {
+		if !covered[operation] {
+			t.Errorf("%s is not covered", operation)
+		}
+	}
+}
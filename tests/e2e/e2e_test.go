@@ -0,0 +1,402 @@
+package e2e
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	gateway "library-system/src/gateway-service/handler"
+	"library-system/src/pkg/audit"
+)
+
+var (
+	reader = http.Header{"X-User-Name": {Username}}
+	admin  = http.Header{"X-User-Name": {Username}, "X-Authorization": {"admin"}}
+
+	// returning returns a book taken just before, at the first version of
+	// its reservation
+	returning = http.Header{"X-User-Name": {Username}, "X-Authorization": {"admin"}, "If-Match": {`"1"`}}
+)
+
+func TestListLibrariesAndBooks(t *testing.T) {
+	h := Start(t)
+
+	var libraries gateway.LibrariesLimited
+	status := h.Do(t, http.MethodGet, "/api/v1/libraries?page=1&size=10&city="+url.QueryEscape(City), nil, "", &libraries)
+	if status != http.StatusOK || len(libraries.Items) != 1 || libraries.PageSize > 10 {
+		t.Fatalf("unexpected libraries %d %+v", status, libraries)
+	}
+	if expected := (gateway.LibraryResponse{Library_uid: LibraryUid, Name: LibraryName, City: City, Address: Address}); libraries.Items[0] != expected {
+		t.Errorf("expected %+v, got %+v", expected, libraries.Items[0])
+	}
+
+	var books gateway.BookLimited
+	status = h.Do(t, http.MethodGet, "/api/v1/libraries/"+LibraryUid+"/books?page=1&size=25&showAll=false", nil, "", &books)
+	if status != http.StatusOK || len(books.Items) != 1 {
+		t.Fatalf("unexpected books %d %+v", status, books)
+	}
+	expected := gateway.BookResponse{Book_uid: BookUid, Name: BookName, Author: Author, Genre: Genre, Condition: "EXCELLENT", Available_count: 1}
+	if books.Items[0] != expected {
+		t.Errorf("expected %+v, got %+v", expected, books.Items[0])
+	}
+}
+
+func TestBorrowAndReturn(t *testing.T) {
+	h := Start(t)
+
+	var rating gateway.RatingResponse
+	if status := h.Do(t, http.MethodGet, "/api/v1/rating", admin, "", &rating); status != http.StatusOK || rating.Stars != Stars {
+		t.Fatalf("expected %d stars, got %d %+v", Stars, status, rating)
+	}
+
+	var taken gateway.TakeBookResponse
+	status, header := h.DoWithHeader(t, http.MethodPost, "/api/v1/reservations", reader,
+		`{"bookUid":"`+BookUid+`","libraryUid":"`+LibraryUid+`","tillDate":"2025-10-11"}`, &taken)
+	if status != http.StatusOK || taken.Status != "RENTED" || taken.Till_date != "2025-10-11" || taken.Rating.Stars != Stars {
+		t.Fatalf("unexpected reservation %d %+v", status, taken)
+	}
+	if header.Get("ETag") != `"1"` {
+		t.Errorf(`expected ETag "1", got %q`, header.Get("ETag"))
+	}
+	if taken.Book.Book_uid != BookUid || taken.Book.Name != BookName || taken.Library.Library_uid != LibraryUid || taken.Library.Address != Address {
+		t.Errorf("unexpected book or library %+v", taken)
+	}
+
+	var reservations gateway.ReservationsLimited
+	if status = h.Do(t, http.MethodGet, "/api/v1/reservations", admin, "", &reservations); status != http.StatusOK || reservations.TotalElements != 1 || len(reservations.Items) != 1 {
+		t.Fatalf("expected the reservation, got %d %+v", status, reservations)
+	}
+	rented := reservations.Items
+	if rented[0].Reservation_uid != taken.Reservation_uid || rented[0].Status != "RENTED" || rented[0].Version != 1 ||
+		rented[0].Book.Name != BookName || rented[0].Library.City != City {
+		t.Errorf("unexpected reservation %+v", rented[0])
+	}
+
+	var reservation gateway.ReservationToUserResponse
+	status, header = h.DoWithHeader(t, http.MethodGet, "/api/v1/reservations/info/"+taken.Reservation_uid, admin, "", &reservation)
+	if status != http.StatusOK || reservation != rented[0] || header.Get("ETag") != `"1"` {
+		t.Errorf("expected the reservation with its ETag, got %d %+v %q", status, reservation, header.Get("ETag"))
+	}
+
+	if book, _ := h.Libraries.GetBookByUid(context.Background(), BookUid); book.Available_count != 0 {
+		t.Errorf("the taken copy must not be available, got %d", book.Available_count)
+	}
+
+	// the librarian returns the version of the reservation they were given
+	returning := admin.Clone()
+	returning.Set("If-Match", header.Get("ETag"))
+
+	status = h.Do(t, http.MethodPost, "/api/v1/reservations/"+taken.Reservation_uid+"/return", returning,
+		`{"condition":"EXCELLENT","date":"2021-10-11"}`, nil)
+	if status != http.StatusNoContent {
+		t.Fatalf("expected the book to be returned, got %d", status)
+	}
+
+	if status = h.Do(t, http.MethodGet, "/api/v1/rating", admin, "", &rating); status != http.StatusOK || rating.Stars != Stars+1 {
+		t.Errorf("expected %d stars after a good return, got %d %+v", Stars+1, status, rating)
+	}
+
+	if returned, _ := h.Reservations.GetReservationByUid(context.Background(), taken.Reservation_uid); returned.Status != "RETURNED" {
+		t.Errorf("expected RETURNED, got %s", returned.Status)
+	}
+	if book, _ := h.Libraries.GetBookByUid(context.Background(), BookUid); book.Available_count != 1 {
+		t.Errorf("the returned copy must be available, got %d", book.Available_count)
+	}
+
+	assessments := h.Assessments()
+	if len(assessments) != 1 || assessments[0].ReservationUid != taken.Reservation_uid || assessments[0].ConditionBefore != "EXCELLENT" {
+		t.Errorf("unexpected fine assessments %+v", assessments)
+	}
+}
+
+func TestLateDamagedReturnLowersRating(t *testing.T) {
+	h := Start(t)
+
+	var taken gateway.TakeBookResponse
+	status := h.Do(t, http.MethodPost, "/api/v1/reservations", reader,
+		`{"bookUid":"`+BookUid+`","libraryUid":"`+LibraryUid+`","tillDate":"2021-10-01"}`, &taken)
+	if status != http.StatusOK {
+		t.Fatalf("unexpected reservation %d %+v", status, taken)
+	}
+
+	status = h.Do(t, http.MethodPost, "/api/v1/reservations/"+taken.Reservation_uid+"/return", returning,
+		`{"condition":"BAD","date":"2021-10-11"}`, nil)
+	if status != http.StatusNoContent {
+		t.Fatalf("expected the book to be returned, got %d", status)
+	}
+
+	var rating gateway.RatingResponse
+	if h.Do(t, http.MethodGet, "/api/v1/rating", admin, "", &rating); rating.Stars != Stars-20 {
+		t.Errorf("expected 10 stars off for lateness and for damage, got %d", rating.Stars)
+	}
+
+	reservation, _ := h.Reservations.GetReservationByUid(context.Background(), taken.Reservation_uid)
+	if reservation.Status != "EXPIRED" {
+		t.Errorf("expected EXPIRED, got %s", reservation.Status)
+	}
+	if book, _ := h.Libraries.GetBookInfoByUid(context.Background(), BookUid); book.Condition != "BAD" {
+		t.Errorf("expected the book to be BAD, got %s", book.Condition)
+	}
+
+	assessments := h.Assessments()
+	if len(assessments) != 1 || assessments[0].TillDate != "2021-10-01" || assessments[0].ConditionAfter != "BAD" {
+		t.Errorf("unexpected fine assessments %+v", assessments)
+	}
+}
+
+func TestAuditTrail(t *testing.T) {
+	h := Start(t)
+
+	// the reader can not pose as the librarian
+	posing := reader.Clone()
+	posing.Set(audit.ActorHeader, "admin")
+
+	var taken gateway.TakeBookResponse
+	status := h.Do(t, http.MethodPost, "/api/v1/reservations", posing,
+		`{"bookUid":"`+BookUid+`","libraryUid":"`+LibraryUid+`","tillDate":"2021-10-01"}`, &taken)
+	if status != http.StatusOK {
+		t.Fatalf("unexpected reservation %d %+v", status, taken)
+	}
+
+	status = h.Do(t, http.MethodPost, "/api/v1/reservations/"+taken.Reservation_uid+"/return", returning,
+		`{"condition":"BAD","date":"2021-10-11"}`, nil)
+	if status != http.StatusNoContent {
+		t.Fatalf("expected the book to be returned, got %d", status)
+	}
+
+	var entries []audit.Entry
+	if status = h.Do(t, http.MethodGet, "/api/v1/audit", admin, "", &entries); status != http.StatusOK {
+		t.Fatalf("expected the audit trail, got %d", status)
+	}
+
+	recorded := map[string]bool{}
+	for i, entry := range entries {
+		recorded[entry.Service+" "+entry.Action+" by "+entry.Actor] = true
+		if i > 0 && entry.CreatedAt.After(entries[i-1].CreatedAt) {
+			t.Errorf("entries must be newest first, got %+v after %+v", entry, entries[i-1])
+		}
+	}
+
+	for _, change := range []string{
+		"reservation-service reservation.created by " + Username,
+		"library-service book.count_updated by " + Username,
+		"reservation-service reservation.status_updated by admin",
+		"library-service book.condition_updated by admin",
+		"library-service book.count_updated by admin",
+		"rating-service rating.changed by admin",
+		"fine-service fine.assessed by admin",
+	} {
+		if !recorded[change] {
+			t.Errorf("expected %s to be recorded, got %+v", change, entries)
+		}
+	}
+	if len(entries) != 7 {
+		t.Errorf("expected 7 entries, got %+v", entries)
+	}
+
+	if status = h.Do(t, http.MethodGet, "/api/v1/audit?actor=admin&entityUid="+BookUid+"&limit=1", admin, "", &entries); status != http.StatusOK ||
+		len(entries) != 1 || entries[0].Actor != "admin" || entries[0].EntityUid != BookUid {
+		t.Errorf("expected the last change of the book by admin, got %d %+v", status, entries)
+	}
+
+	if status = h.Do(t, http.MethodGet, "/api/v1/audit?limit=0", admin, "", nil); status != http.StatusUnprocessableEntity {
+		t.Errorf("expected an invalid limit to be rejected, got %d", status)
+	}
+	if status = h.Do(t, http.MethodGet, "/api/v1/audit", reader, "", nil); status != http.StatusUnauthorized {
+		t.Errorf("expected the audit trail to need admin, got %d", status)
+	}
+}
+
+func TestDamagedCopyIsRepaired(t *testing.T) {
+	h := Start(t)
+
+	var taken gateway.TakeBookResponse
+	status := h.Do(t, http.MethodPost, "/api/v1/reservations", reader,
+		`{"bookUid":"`+BookUid+`","libraryUid":"`+LibraryUid+`","tillDate":"2021-10-20"}`, &taken)
+	if status != http.StatusOK {
+		t.Fatalf("unexpected reservation %d %+v", status, taken)
+	}
+
+	status = h.Do(t, http.MethodPost, "/api/v1/reservations/"+taken.Reservation_uid+"/return", returning,
+		`{"condition":"BAD","date":"2021-10-11","notes":"torn cover","photos":["s3://photos/1.jpg"]}`, nil)
+	if status != http.StatusNoContent {
+		t.Fatalf("expected the book to be returned, got %d", status)
+	}
+
+	var history []struct {
+		Condition      string
+		Assessor       string
+		Date           string
+		ReservationUid string
+		Notes          string
+		Photos         []string
+	}
+	status = h.Do(t, http.MethodGet, "/api/v1/books/"+BookUid+"/condition/history", admin, "", &history)
+	if status != http.StatusOK || len(history) != 1 {
+		t.Fatalf("expected the assessment of the return, got %d %+v", status, history)
+	}
+	if assessment := history[0]; assessment.Condition != "BAD" || assessment.Assessor != "admin" || assessment.Date != "2021-10-11" ||
+		assessment.ReservationUid != taken.Reservation_uid || assessment.Notes != "torn cover" || len(assessment.Photos) != 1 {
+		t.Errorf("unexpected assessment %+v", assessment)
+	}
+
+	var report struct {
+		ReportUid  string
+		Status     string
+		ReportedBy string
+	}
+	status = h.Do(t, http.MethodPost, "/api/v1/books/"+BookUid+"/damage-reports", admin, `{"libraryUid":"`+LibraryUid+`","notes":"needs rebinding"}`, &report)
+	if status != http.StatusCreated || report.Status != "IN_REPAIR" || report.ReportedBy != "admin" {
+		t.Fatalf("unexpected damage report %d %+v", status, report)
+	}
+
+	var books gateway.BookLimited
+	if h.Do(t, http.MethodGet, "/api/v1/libraries/"+LibraryUid+"/books?page=1&size=10&showAll=false", nil, "", &books); len(books.Items) != 0 {
+		t.Errorf("expected the copy in repair to be unavailable, got %+v", books.Items)
+	}
+
+	status = h.Do(t, http.MethodPost, "/api/v1/damage-reports/"+report.ReportUid+"/resolve", admin, `{"status":"ON_SHELF","condition":"GOOD"}`, &report)
+	if status != http.StatusOK || report.Status != "ON_SHELF" {
+		t.Fatalf("unexpected resolved report %d %+v", status, report)
+	}
+
+	h.Do(t, http.MethodGet, "/api/v1/libraries/"+LibraryUid+"/books?page=1&size=10&showAll=false", nil, "", &books)
+	if len(books.Items) != 1 || books.Items[0].Available_count != 1 || books.Items[0].Condition != "GOOD" {
+		t.Errorf("expected the repaired copy back on the shelf, got %+v", books.Items)
+	}
+
+	if status = h.Do(t, http.MethodGet, "/api/v1/damage-reports", reader, "", nil); status != http.StatusUnauthorized {
+		t.Errorf("expected damage reports to need admin, got %d", status)
+	}
+}
+
+func TestConcurrentEditsAreRejected(t *testing.T) {
+	h := Start(t)
+
+	withIfMatch := func(tag string) http.Header {
+		header := admin.Clone()
+		header.Set("If-Match", tag)
+		return header
+	}
+
+	status, header := h.DoWithHeader(t, http.MethodGet, "/api/v1/books/"+BookUid, admin, "", nil)
+	tag := header.Get("ETag")
+	if status != http.StatusOK || tag == "" {
+		t.Fatalf("expected the book with its ETag, got %d %q", status, tag)
+	}
+
+	update := `{"name":"Краткий курс C++","author":"Бьерн Страуструп","genre":"Учебник","materialType":"BOOK"}`
+	if status = h.Do(t, http.MethodPut, "/api/v1/books/"+BookUid, admin, update, nil); status != http.StatusPreconditionRequired {
+		t.Errorf("update without If-Match: expected %d, got %d", http.StatusPreconditionRequired, status)
+	}
+
+	status, header = h.DoWithHeader(t, http.MethodPut, "/api/v1/books/"+BookUid, withIfMatch(tag), update, nil)
+	if status != http.StatusOK || header.Get("ETag") == tag {
+		t.Fatalf("expected the update to give a new ETag, got %d %q", status, header.Get("ETag"))
+	}
+
+	// a second librarian edits the book they read before the update
+	if status = h.Do(t, http.MethodPut, "/api/v1/books/"+BookUid, withIfMatch(tag), update, nil); status != http.StatusPreconditionFailed {
+		t.Errorf("stale update: expected %d, got %d", http.StatusPreconditionFailed, status)
+	}
+
+	var taken gateway.TakeBookResponse
+	h.Do(t, http.MethodPost, "/api/v1/reservations", reader,
+		`{"bookUid":"`+BookUid+`","libraryUid":"`+LibraryUid+`","tillDate":"2021-10-20"}`, &taken)
+
+	returnBody := `{"condition":"EXCELLENT","date":"2021-10-11"}`
+	if status = h.Do(t, http.MethodPost, "/api/v1/reservations/"+taken.Reservation_uid+"/return", withIfMatch(`"1"`), returnBody, nil); status != http.StatusNoContent {
+		t.Fatalf("return: expected %d, got %d", http.StatusNoContent, status)
+	}
+	if status = h.Do(t, http.MethodPost, "/api/v1/reservations/"+taken.Reservation_uid+"/return", withIfMatch(`"1"`), returnBody, nil); status != http.StatusPreconditionFailed {
+		t.Errorf("second return: expected %d, got %d", http.StatusPreconditionFailed, status)
+	}
+	if status = h.Do(t, http.MethodPost, "/api/v1/reservations/"+taken.Reservation_uid+"/return", withIfMatch("*"), returnBody, nil); status != http.StatusPreconditionRequired {
+		t.Errorf("unconditional second return: expected %d, got %d", http.StatusPreconditionRequired, status)
+	}
+	if status = h.Do(t, http.MethodPost, "/api/v1/reservations/"+taken.Reservation_uid+"/return", admin, returnBody, nil); status != http.StatusPreconditionRequired {
+		t.Errorf("return without If-Match: expected %d, got %d", http.StatusPreconditionRequired, status)
+	}
+}
+
+func TestClosedReservationsAreArchived(t *testing.T) {
+	h := Start(t)
+
+	var taken gateway.TakeBookResponse
+	h.Do(t, http.MethodPost, "/api/v1/reservations", reader,
+		`{"bookUid":"`+BookUid+`","libraryUid":"`+LibraryUid+`","tillDate":"2021-10-20"}`, &taken)
+	if status := h.Do(t, http.MethodPost, "/api/v1/reservations/"+taken.Reservation_uid+"/return", returning,
+		`{"condition":"EXCELLENT","date":"2021-10-11"}`, nil); status != http.StatusNoContent {
+		t.Fatalf("expected the book to be returned, got %d", status)
+	}
+
+	if archived, err := h.Reservations.ArchiveReservations(context.Background(), time.Now().Add(time.Hour), 10); err != nil || archived != 1 {
+		t.Fatalf("expected the returned reservation to be archived, got %d (%v)", archived, err)
+	}
+
+	var history gateway.ReservationsLimited
+	if status := h.Do(t, http.MethodGet, "/api/v1/reservations/history", admin, "", &history); status != http.StatusOK || history.TotalElements != 0 {
+		t.Errorf("expected the archived reservation to leave the history, got %d %+v", status, history)
+	}
+
+	var archive gateway.ReservationsLimited
+	status := h.Do(t, http.MethodGet, "/api/v1/reservations/archive?status=RETURNED", admin, "", &archive)
+	if status != http.StatusOK || archive.TotalElements != 1 || len(archive.Items) != 1 {
+		t.Fatalf("expected the archived reservation, got %d %+v", status, archive)
+	}
+	if item := archive.Items[0]; item.Reservation_uid != taken.Reservation_uid || item.Status != "RETURNED" || item.Book.Name != BookName || item.Library.City != City {
+		t.Errorf("unexpected archived reservation %+v", item)
+	}
+}
+
+func TestReservationsArePagedByCursor(t *testing.T) {
+	h := Start(t)
+
+	var uids []string
+	for i := 0; i < 2; i++ {
+		var taken gateway.TakeBookResponse
+		h.Do(t, http.MethodPost, "/api/v1/reservations", reader,
+			`{"bookUid":"`+BookUid+`","libraryUid":"`+LibraryUid+`","tillDate":"2021-10-20"}`, &taken)
+		if status := h.Do(t, http.MethodPost, "/api/v1/reservations/"+taken.Reservation_uid+"/return", returning,
+			`{"condition":"EXCELLENT","date":"2021-10-11"}`, nil); status != http.StatusNoContent {
+			t.Fatalf("expected the book to be returned, got %d", status)
+		}
+		uids = append(uids, taken.Reservation_uid)
+	}
+
+	var first gateway.ReservationsLimited
+	status := h.Do(t, http.MethodGet, "/api/v1/reservations?size=1", admin, "", &first)
+	if status != http.StatusOK || len(first.Items) != 1 || first.Items[0].Reservation_uid != uids[0] || first.NextCursor == "" {
+		t.Fatalf("expected the oldest reservation and a cursor, got %d %+v", status, first)
+	}
+
+	var second gateway.ReservationsLimited
+	status = h.Do(t, http.MethodGet, "/api/v1/reservations?size=1&cursor="+url.QueryEscape(first.NextCursor), admin, "", &second)
+	if status != http.StatusOK || len(second.Items) != 1 || second.Items[0].Reservation_uid != uids[1] || second.NextCursor != "" {
+		t.Errorf("expected the newer reservation on the last page, got %d %+v", status, second)
+	}
+
+	var newest gateway.ReservationsLimited
+	status = h.Do(t, http.MethodGet, "/api/v1/reservations?size=1&order=desc", admin, "", &newest)
+	if status != http.StatusOK || len(newest.Items) != 1 || newest.Items[0].Reservation_uid != uids[1] {
+		t.Errorf("expected the newest reservation first, got %d %+v", status, newest)
+	}
+
+	// a cursor belongs to the order it was issued for
+	status = h.Do(t, http.MethodGet, "/api/v1/reservations?size=1&order=desc&cursor="+url.QueryEscape(first.NextCursor), admin, "", nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("expected a cursor of another order to be rejected, got %d", status)
+	}
+}
+
+func TestPrivateRoutesNeedAdmin(t *testing.T) {
+	h := Start(t)
+
+	for _, path := range []string{"/api/v1/rating", "/api/v1/reservations", "/api/v1/reservations/history", "/api/v1/reservations/archive", "/manage/breakers", "/manage/rating/pending"} {
+		if status := h.Do(t, http.MethodGet, path, reader, "", nil); status != http.StatusUnauthorized {
+			t.Errorf("%s: expected %d, got %d", path, http.StatusUnauthorized, status)
+		}
+	}
+}
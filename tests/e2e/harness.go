@@ -0,0 +1,271 @@
+// Package e2e runs the gateway together with library-service,
+// reservation-service and rating-service in one process, so that the
+// scenarios of the Postman collection can run under go test without
+// containers. Every service listens on an ephemeral loopback port and is
+// backed by its in-memory storage. fine-service and notification-service are
+// replaced by stubs that accept every request.
+//
+// The gateway rejects requests that do not conform to tests/library_system.yml
+// like it does in production, and every response to an operation of the
+// specification is validated against it.
+package e2e
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"library-system/src/gateway-service/cache"
+	"library-system/src/gateway-service/downstream"
+	gateway "library-system/src/gateway-service/handler"
+	"library-system/src/gateway-service/idempotency"
+	"library-system/src/gateway-service/limits"
+	"library-system/src/gateway-service/openapi"
+	"library-system/src/gateway-service/rating"
+	library "library-system/src/library-service/handler"
+	librarystorage "library-system/src/library-service/storage"
+	"library-system/src/pkg/audit"
+	ratings "library-system/src/rating-service/handler"
+	ratingstorage "library-system/src/rating-service/storage"
+	reservations "library-system/src/reservation-service/handler"
+	reservationstorage "library-system/src/reservation-service/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The data the services start with, the same as the dev seeds.
+const (
+	Username    = "Test Max"
+	Stars       = 20
+	LibraryUid  = "83575e12-7ce0-48ee-9931-51919ff3c9ee"
+	LibraryName = "Библиотека имени 7 Непьющих"
+	City        = "Москва"
+	Address     = "2-я Бауманская ул., д.5, стр.1"
+	BookUid     = "f7cdc58f-2caf-4b15-9727-f89dcc629b27"
+	BookName    = "Краткий курс C++ в 7 томах"
+	Author      = "Бьерн Страуструп"
+	Genre       = "Научная фантастика"
+)
+
+// SpecPath is the API specification of the gateway, relative to this package.
+const SpecPath = "../library_system.yml"
+
+type Harness struct {
+	// Gateway is the base URL of the gateway.
+	Gateway string
+
+	Libraries    librarystorage.Storage
+	Reservations reservationstorage.Storage
+	Ratings      ratingstorage.Storage
+
+	// Spec is the specification the gateway is checked against.
+	Spec *openapi.Spec
+
+	client *http.Client
+
+	mu          sync.Mutex
+	assessments []gateway.AssessFinesRequest
+	covered     map[string]bool
+}
+
+// Start starts all services and stops them when the test ends.
+func Start(t *testing.T) *Harness {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+
+	spec, err := openapi.Load(SpecPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &Harness{Spec: spec, client: &http.Client{Timeout: 10 * time.Second}, covered: map[string]bool{}}
+
+	libraryMemory := librarystorage.NewMemory()
+	libraryMemory.AddLibrary(librarystorage.Library{Library_uid: LibraryUid, Name: LibraryName, City: City, Address: Address})
+	libraryMemory.AddBook(LibraryUid, librarystorage.BookInfo{Book_uid: BookUid, Name: BookName, Author: Author, Genre: Genre}, 1)
+	h.Libraries = libraryMemory
+
+	reservationMemory := reservationstorage.NewMemory()
+	h.Reservations = reservationMemory
+
+	ratingMemory := ratingstorage.NewMemory()
+	ratingMemory.AddRating(Username, Stars)
+	h.Ratings = ratingMemory
+
+	services := gateway.Services{
+		Library:      serve(t, library.NewHandler(libraryMemory)),
+		Reservation:  serve(t, reservations.NewHandler(reservationMemory)),
+		Rating:       serve(t, ratings.NewHandler(ratingMemory)),
+		Fine:         serve(t, registerFunc(h.fineStub)),
+		Notification: serve(t, registerFunc(notificationStub)),
+	}
+
+	clients := downstream.NewClients(downstream.DefaultConfig())
+	for name, serviceURL := range services.ByName() {
+		if err := clients.Register(name, serviceURL, downstream.DefaultConfig()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ratingService := rating.NewService(clients, services.Rating, rating.DefaultPolicy(), cache.New(cache.NewMemory(100), time.Hour), rating.NewMemoryQueue())
+
+	handler := gateway.NewHandler(services, limits.NewService(limits.DefaultConfig()), cache.New(cache.NewMemory(1000), time.Minute), clients, ratingService, "")
+
+	router := handler.Router(spec, idempotency.NewMemoryStore(), time.Hour)
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	h.Gateway = server.URL
+
+	return h
+}
+
+type registerer interface {
+	Register(router gin.IRoutes)
+}
+
+// registerFunc turns a function adding routes into a registerer.
+type registerFunc func(router gin.IRoutes)
+
+func (fn registerFunc) Register(router gin.IRoutes) {
+	fn(router)
+}
+
+// serve starts a server for the routes of service and returns its URL.
+func serve(t *testing.T, service registerer) string {
+	router := gin.New()
+	router.Use(gin.Recovery(), audit.Middleware())
+	service.Register(router)
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	return server.URL
+}
+
+// fineStub never blocks a reader and records the assessments it gets. Its
+// audit trail holds an entry for every assessment.
+func (h *Harness) fineStub(router gin.IRoutes) {
+	trail := audit.NewMemoryLog()
+	router.GET("/api/v1/audit", audit.Handler(trail, "fine-service"))
+
+	router.GET("/api/v1/fines/balance", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gateway.FineBalanceResponse{Username: c.GetHeader("X-User-Name"), Threshold: 100})
+	})
+
+	router.POST("/api/v1/fines/assess", func(c *gin.Context) {
+		var assessment gateway.AssessFinesRequest
+		if err := c.BindJSON(&assessment); err != nil {
+			return
+		}
+
+		h.mu.Lock()
+		h.assessments = append(h.assessments, assessment)
+		h.mu.Unlock()
+
+		entry, err := audit.New(c.Request.Context(), "fine.assessed", "reservation", assessment.ReservationUid, nil, assessment)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		trail.Add(entry)
+
+		c.JSON(http.StatusOK, []gateway.FineResponse{})
+	})
+}
+
+func notificationStub(router gin.IRoutes) {
+	router.POST("/api/v1/notifications/events/book-available", func(c *gin.Context) {
+		c.Status(http.StatusAccepted)
+	})
+}
+
+// Assessments returns the fine assessments the gateway has requested.
+func (h *Harness) Assessments() []gateway.AssessFinesRequest {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]gateway.AssessFinesRequest{}, h.assessments...)
+}
+
+// Covered returns the operations of the specification, as "METHOD path", that
+// have been requested so far.
+func (h *Harness) Covered() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var operations []string
+	for operation := range h.covered {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+
+	return operations
+}
+
+// Do sends a request to the gateway, decodes the JSON response into out
+// unless it is nil, and returns the status code. A response to an operation
+// of the specification that does not conform to it fails the test.
+func (h *Harness) Do(t *testing.T, method string, path string, header http.Header, body string, out any) int {
+	t.Helper()
+
+	status, _ := h.DoWithHeader(t, method, path, header, body, out)
+	return status
+}
+
+// DoWithHeader is Do that also returns the headers of the response.
+func (h *Harness) DoWithHeader(t *testing.T, method string, path string, header http.Header, body string, out any) (int, http.Header) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, h.Gateway+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %s", method, path, err)
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if operation, ok := h.Spec.Operation(req); ok {
+		h.mu.Lock()
+		h.covered[operation] = true
+		h.mu.Unlock()
+
+		// the body has been sent, validate with a request that can be read
+		// again
+		check, _ := http.NewRequest(method, req.URL.String(), strings.NewReader(body))
+		check.Header = req.Header
+		if err = h.Spec.ValidateResponse(req.Context(), check, res.StatusCode, res.Header, data); err != nil {
+			t.Errorf("%s %s: response %d %s does not conform to the specification: %s", method, path, res.StatusCode, bytes.TrimSpace(data), err)
+		}
+	}
+
+	if out != nil && len(data) > 0 {
+		if err = json.Unmarshal(data, out); err != nil {
+			t.Fatalf("%s %s: unable to decode %q: %s", method, path, data, err)
+		}
+	}
+
+	return res.StatusCode, res.Header
+}